@@ -1,5 +1,13 @@
 package mailprovider
 
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
 // ErrAuth returns an authentication error.
 func ErrAuth(err error) *AuthErr {
 	return &AuthErr{
@@ -22,10 +30,107 @@ func (e *AuthErr) Unwrap() error {
 	return e.Err
 }
 
+// ErrorCategory is a category of the delivery error, used to decide whether the delivery should be retried
+// or the recipient suppressed.
+type ErrorCategory int
+
+const (
+	// CategoryUnknown is the category of the errors that could not be classified.
+	CategoryUnknown ErrorCategory = iota
+	// CategoryMailboxUnknown is the category of the errors caused by the non-existing or disabled mailbox.
+	CategoryMailboxUnknown
+	// CategoryPolicy is the category of the errors caused by the policy or spam block.
+	CategoryPolicy
+	// CategoryQuotaExceeded is the category of the errors caused by the full mailbox or storage.
+	CategoryQuotaExceeded
+	// CategoryRateLimited is the category of the errors caused by sending too much or too fast.
+	CategoryRateLimited
+	// CategoryMessageTooLarge is the category of the errors caused by the message size limit.
+	CategoryMessageTooLarge
+)
+
+// String returns the string representation of the category.
+func (c ErrorCategory) String() string {
+	switch c {
+	case CategoryUnknown:
+		return "unknown"
+	case CategoryMailboxUnknown:
+		return "mailbox_unknown"
+	case CategoryPolicy:
+		return "policy"
+	case CategoryQuotaExceeded:
+		return "quota_exceeded"
+	case CategoryRateLimited:
+		return "rate_limited"
+	case CategoryMessageTooLarge:
+		return "message_too_large"
+	default:
+		return fmt.Sprintf("ErrorCategory(%d)", int(c))
+	}
+}
+
+// EnhancedStatusCode is the RFC 3463 enhanced mail system status code, i.e. 5.1.1.
+type EnhancedStatusCode struct {
+	Class   int
+	Subject int
+	Detail  int
+}
+
+// IsZero checks if the status code is not set.
+func (c EnhancedStatusCode) IsZero() bool {
+	return c == EnhancedStatusCode{}
+}
+
+// String returns the status code in the class.subject.detail format.
+func (c EnhancedStatusCode) String() string {
+	if c.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf("%d.%d.%d", c.Class, c.Subject, c.Detail)
+}
+
+// ParseEnhancedStatusCode parses the enhanced status code at the beginning of the reply text.
+// It returns the status code and the rest of the text.
+func ParseEnhancedStatusCode(text string) (EnhancedStatusCode, string, bool) {
+	field, rest, _ := strings.Cut(text, " ")
+	parts := strings.Split(field, ".")
+	if len(parts) != 3 {
+		return EnhancedStatusCode{}, text, false
+	}
+
+	var nums [3]int
+	for i, p := range parts {
+		// The subject and detail have at most three digits, the class is a single digit.
+		if p == "" || len(p) > 3 || (i == 0 && len(p) != 1) {
+			return EnhancedStatusCode{}, text, false
+		}
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return EnhancedStatusCode{}, text, false
+		}
+		nums[i] = n
+	}
+
+	code := EnhancedStatusCode{Class: nums[0], Subject: nums[1], Detail: nums[2]}
+	if code.Class != 2 && code.Class != 4 && code.Class != 5 {
+		return EnhancedStatusCode{}, text, false
+	}
+	return code, strings.TrimSpace(rest), true
+}
+
 // Error is an error.
 type Error struct {
 	Temporary bool
 	Err       error
+	// Code is the reply code returned by the server, the HTTP status of the provider API,
+	// or the exit status of the mail submission program, if any.
+	Code int
+	// EnhancedCode is the enhanced status code returned by the server, if any.
+	EnhancedCode EnhancedStatusCode
+	// Category is the category of the error.
+	Category ErrorCategory
+	// Message is the reply text returned by the server, without the enhanced status code.
+	Message string
 }
 
 // Error returns the error.
@@ -53,3 +158,158 @@ func ErrPermanent(err error) *Error {
 		Err:       err,
 	}
 }
+
+// AsError returns the Error found in the error chain, so that the classification made by the callee is kept.
+// The unclassified error is wrapped into the Error with the temporary flag.
+func AsError(err error, temporary bool) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return &Error{
+		Temporary: temporary,
+		Err:       err,
+	}
+}
+
+// ErrReply returns an error classified from the server reply code and text.
+// The enhanced status code, if present in the text, takes precedence over the reply code.
+func ErrReply(code int, text string, err error) *Error {
+	e := &Error{
+		Temporary: code/100 == 4,
+		Err:       err,
+		Code:      code,
+		Message:   text,
+	}
+
+	if esc, rest, ok := ParseEnhancedStatusCode(text); ok {
+		e.EnhancedCode = esc
+		e.Message = rest
+		e.Temporary = esc.Class == 4
+	}
+
+	e.Category = classify(code, e.EnhancedCode)
+	if e.Category == CategoryRateLimited {
+		e.Temporary = true
+	}
+	return e
+}
+
+// classify returns the category of the reply code and the enhanced status code.
+func classify(code int, esc EnhancedStatusCode) ErrorCategory {
+	if !esc.IsZero() {
+		switch {
+		case esc.Subject == 1 && (esc.Detail == 1 || esc.Detail == 2 || esc.Detail == 3 || esc.Detail == 6 || esc.Detail == 10):
+			// Bad destination mailbox, system or address syntax, mailbox moved or null MX.
+			return CategoryMailboxUnknown
+		case esc.Subject == 2 && esc.Detail == 1 && esc.Class == 5:
+			// Mailbox disabled.
+			return CategoryMailboxUnknown
+		case esc.Subject == 2 && esc.Detail == 1 && esc.Class == 4:
+			// The recipient receives mail at too high rate.
+			return CategoryRateLimited
+		case esc.Subject == 2 && esc.Detail == 2:
+			// Mailbox full.
+			return CategoryQuotaExceeded
+		case esc.Subject == 2 && esc.Detail == 3, esc.Subject == 3 && esc.Detail == 4:
+			// Message length exceeds the administrative limit or is too big for the system.
+			return CategoryMessageTooLarge
+		case esc.Subject == 3 && esc.Detail == 1:
+			// Mail system full.
+			return CategoryQuotaExceeded
+		case esc.Subject == 4 && esc.Detail == 5, esc.Subject == 5 && esc.Detail == 3, esc.Subject == 7 && esc.Detail == 28:
+			// Mail system congestion, too many recipients or the sender sends too much.
+			return CategoryRateLimited
+		case esc.Subject == 7:
+			// Security or policy status.
+			return CategoryPolicy
+		}
+	}
+
+	switch code {
+	case 421:
+		return CategoryRateLimited
+	case 452:
+		return CategoryQuotaExceeded
+	case 552:
+		return CategoryMessageTooLarge
+	case 554:
+		return CategoryPolicy
+	}
+	return CategoryUnknown
+}
+
+// ErrHTTPStatus returns an error classified from the HTTP response status of the provider API.
+// The authentication failures are returned as AuthErr, the rate limiting, timeouts and server errors
+// are temporary, and any other client error is permanent.
+func ErrHTTPStatus(statusCode int, err error) error {
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return ErrAuth(err)
+	case statusCode == http.StatusTooManyRequests:
+		return &Error{Temporary: true, Err: err, Code: statusCode, Category: CategoryRateLimited}
+	case statusCode == http.StatusRequestEntityTooLarge:
+		return &Error{Err: err, Code: statusCode, Category: CategoryMessageTooLarge}
+	case statusCode == http.StatusRequestTimeout || statusCode >= 500:
+		return &Error{Temporary: true, Err: err, Code: statusCode}
+	default:
+		return &Error{Err: err, Code: statusCode}
+	}
+}
+
+// The exit statuses of the mail submission programs, as defined by the sysexits.h.
+const (
+	ExitUsage       = 64
+	ExitDataErr     = 65
+	ExitNoInput     = 66
+	ExitNoUser      = 67
+	ExitNoHost      = 68
+	ExitUnavailable = 69
+	ExitSoftware    = 70
+	ExitOSErr       = 71
+	ExitOSFile      = 72
+	ExitCantCreat   = 73
+	ExitIOErr       = 74
+	ExitTempFail    = 75
+	ExitProtocol    = 76
+	ExitNoPerm      = 77
+	ExitConfig      = 78
+)
+
+// sysexitCodes are the enhanced status codes of the sysexits.h exit statuses, the same as reported by the Postfix.
+var sysexitCodes = map[int]EnhancedStatusCode{
+	ExitUsage:       {Class: 5, Subject: 3, Detail: 0},
+	ExitDataErr:     {Class: 5, Subject: 6, Detail: 0},
+	ExitNoInput:     {Class: 5, Subject: 3, Detail: 0},
+	ExitNoUser:      {Class: 5, Subject: 1, Detail: 1},
+	ExitNoHost:      {Class: 5, Subject: 1, Detail: 2},
+	ExitUnavailable: {Class: 5, Subject: 3, Detail: 0},
+	ExitSoftware:    {Class: 5, Subject: 3, Detail: 0},
+	ExitOSErr:       {Class: 4, Subject: 3, Detail: 0},
+	ExitOSFile:      {Class: 4, Subject: 3, Detail: 0},
+	ExitCantCreat:   {Class: 4, Subject: 2, Detail: 0},
+	ExitIOErr:       {Class: 4, Subject: 3, Detail: 0},
+	ExitTempFail:    {Class: 4, Subject: 3, Detail: 0},
+	ExitProtocol:    {Class: 4, Subject: 5, Detail: 0},
+	ExitNoPerm:      {Class: 5, Subject: 7, Detail: 0},
+	ExitConfig:      {Class: 4, Subject: 3, Detail: 5},
+}
+
+// ErrExitStatus returns an error classified from the exit status of the mail submission program, i.e. the sendmail.
+// The statuses follow the sysexits.h semantics, any status not defined there is considered temporary.
+func ErrExitStatus(status int, text string, err error) *Error {
+	esc, ok := sysexitCodes[status]
+	if !ok {
+		esc = EnhancedStatusCode{Class: 4, Subject: 3, Detail: 0}
+	}
+
+	e := &Error{
+		Temporary:    esc.Class == 4,
+		Err:          err,
+		Code:         status,
+		EnhancedCode: esc,
+		Message:      text,
+	}
+	e.Category = classify(0, esc)
+	return e
+}
@@ -0,0 +1,194 @@
+package filemailprovider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
+	mailprovider2 "github.com/blockysource/mailing/logic/mailprovider"
+	mailproviderwriter "github.com/blockysource/mailing/logic/mailprovider/writer"
+)
+
+// Compile-time check to verify implements interface.
+var _ mailprovider2.Provider = (*FileProvider)(nil)
+
+// FileProvider is a provider that captures the rendered messages in a local directory, instead of sending them.
+// The messages are written either as the .eml files or into a Maildir, and their envelopes are written
+// to the sidecar JSON files.
+type FileProvider struct {
+	l sync.RWMutex
+
+	p           mailprovider2.MailingProviderDefinition
+	fromAddress *mail.Address
+	cfg         mailingpb.FileConfig
+	log         *logrus.Entry
+	isVerified  bool
+}
+
+// New creates a new file provider.
+func New(p mailprovider2.MailingProviderDefinition, log *logrus.Entry) (*FileProvider, error) {
+	cfg := p.Config.GetFileConfig()
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	return &FileProvider{
+		p:   p,
+		cfg: *cfg,
+		log: log.WithFields(logrus.Fields{
+			"provider_id": p.UID,
+			"provider":    mailingpb.FILE,
+		}),
+	}, nil
+}
+
+// Close closes the provider.
+func (f *FileProvider) Close() {}
+
+// GetID returns the ID of the provider.
+func (f *FileProvider) GetID() string {
+	return f.p.UID
+}
+
+// GetDefinition returns the provider definition.
+func (f *FileProvider) GetDefinition() mailprovider2.MailingProviderDefinition {
+	return f.p
+}
+
+// Type returns the type of the provider.
+func (f *FileProvider) Type() mailingpb.MailingProviderType {
+	return mailingpb.FILE
+}
+
+// IsVerified returns whether the provider is verified.
+func (f *FileProvider) IsVerified() bool {
+	f.l.RLock()
+	defer f.l.RUnlock()
+
+	return f.isVerified
+}
+
+// UpdateConfig updates the config of the provider.
+func (f *FileProvider) UpdateConfig(config *mailingpb.MailingProviderConfig) error {
+	cfg := config.GetFileConfig()
+	if cfg == nil {
+		return fmt.Errorf("invalid config type: %T", config)
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	f.l.Lock()
+	f.cfg = *cfg
+	f.l.Unlock()
+	return nil
+}
+
+// GetConfig returns the config of the provider.
+func (f *FileProvider) GetConfig() mailingpb.MailingProviderConfig {
+	f.l.RLock()
+	defer f.l.RUnlock()
+
+	cfg := f.cfg
+	return mailingpb.MailingProviderConfig{
+		Config: &mailingpb.MailingProviderConfig_FileConfig{
+			FileConfig: &cfg,
+		},
+	}
+}
+
+// GetDefaultFromAddress returns the default from address.
+func (f *FileProvider) GetDefaultFromAddress() *mail.Address {
+	f.l.RLock()
+	defer f.l.RUnlock()
+
+	return f.fromAddress
+}
+
+// Send lets the provider send the input message.
+// The message is never delivered, all the recipients are reported as accepted once the message is written.
+// The name of the written message file is returned as the message identifier.
+func (f *FileProvider) Send(ctx context.Context, msg *mailprovider2.Message) (*mailprovider2.SendResult, error) {
+	rcpts := msg.Recipients()
+	if len(rcpts) == 0 {
+		return nil, mailprovider2.ErrPermanent(errors.New("message has no recipients"))
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, mailprovider2.ErrTemporary(err)
+	}
+
+	var domain string
+	if msg.From != nil {
+		domain = mailproviderwriter.DomainOf(msg.From.Address)
+	}
+	mw := mailproviderwriter.Writer{Domain: domain, EightBit: true}
+
+	env := envelope{
+		MessageID:  msg.ID,
+		Recipients: make([]string, 0, len(rcpts)),
+		CreatedAt:  time.Now().UTC(),
+	}
+	if msg.From != nil {
+		env.From = msg.From.Address
+	}
+	for _, rcpt := range rcpts {
+		env.Recipients = append(env.Recipients, rcpt.Address)
+	}
+
+	name, err := f.store().write(&env, func(w *os.File) error {
+		return mw.Render(ctx, msg, w)
+	})
+	if err != nil {
+		f.log.WithFields(logrus.Fields{
+			"msg_id":        msg.ID,
+			logrus.ErrorKey: err,
+		}).Debug("failed to write message")
+		// The directory might become writable again, i.e. after the disk space is freed,
+		// while the render errors keep their classification.
+		return nil, mailprovider2.AsError(err, true)
+	}
+
+	res := &mailprovider2.SendResult{MessageID: name}
+	for _, rcpt := range rcpts {
+		res.Recipients = append(res.Recipients, mailprovider2.RecipientResult{
+			Address: rcpt.Address,
+			Status:  mailprovider2.RecipientAccepted,
+		})
+	}
+
+	f.log.WithFields(logrus.Fields{
+		"msg_id":            msg.ID,
+		"file":              name,
+		"recipients_number": len(res.Recipients),
+	}).Debug("email message captured successfully")
+	return res, nil
+}
+
+// Verify verifies that the configured directory exists, or could be created, and is writable.
+func (f *FileProvider) Verify(ctx context.Context) error {
+	if err := f.store().check(); err != nil {
+		f.log.WithError(err).Debug("failed to verify capture directory")
+		return err
+	}
+
+	f.l.Lock()
+	f.isVerified = true
+	f.l.Unlock()
+	return nil
+}
+
+// store returns the store of the configured directory and format.
+func (f *FileProvider) store() store {
+	f.l.RLock()
+	defer f.l.RUnlock()
+
+	return store{dir: f.cfg.Directory, maildir: f.cfg.Format == mailingpb.FILE_FORMAT_MAILDIR}
+}
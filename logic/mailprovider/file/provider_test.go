@@ -0,0 +1,256 @@
+package filemailprovider_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
+	mailprovider2 "github.com/blockysource/mailing/logic/mailprovider"
+	filemailprovider "github.com/blockysource/mailing/logic/mailprovider/file"
+)
+
+func newTestProvider(t *testing.T, dir string, format mailingpb.FileFormat) *filemailprovider.FileProvider {
+	t.Helper()
+
+	cfg := &mailingpb.FileConfig{Directory: dir, Format: format}
+
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	p, err := filemailprovider.New(mailprovider2.MailingProviderDefinition{
+		UID:    "file",
+		Config: &mailingpb.MailingProviderConfig{Config: &mailingpb.MailingProviderConfig_FileConfig{FileConfig: cfg}},
+	}, logrus.NewEntry(log))
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+	t.Cleanup(p.Close)
+	return p
+}
+
+func testMessage() *mailprovider2.Message {
+	return &mailprovider2.Message{
+		ID:          "msg-1",
+		From:        &mail.Address{Address: "sender@example.org"},
+		To:          []*mail.Address{{Address: "to@example.com"}},
+		Cc:          []*mail.Address{{Address: "cc@example.com"}},
+		Bcc:         []*mail.Address{{Address: "bcc@example.com"}},
+		Subject:     "Hello",
+		Body:        "Hello",
+		ContentType: "text/plain; charset=utf-8",
+	}
+}
+
+// listFiles returns the relative paths of the files in the directory tree.
+func listFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		files = append(files, rel)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to list files: %v", err)
+	}
+	return files
+}
+
+func TestFileProvider_Send(t *testing.T) {
+	tests := []struct {
+		name         string
+		format       mailingpb.FileFormat
+		messagePath  func(id string) string
+		envelopePath func(id string) string
+	}{
+		{
+			name:         "eml",
+			format:       mailingpb.FILE_FORMAT_EML,
+			messagePath:  func(id string) string { return id },
+			envelopePath: func(id string) string { return strings.TrimSuffix(id, ".eml") + ".json" },
+		},
+		{
+			// The message is moved to the new directory, the envelope is kept out of the Maildir subdirectories.
+			name:         "maildir",
+			format:       mailingpb.FILE_FORMAT_MAILDIR,
+			messagePath:  func(id string) string { return filepath.Join("new", id) },
+			envelopePath: func(id string) string { return filepath.Join("envelope", id+".json") },
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			p := newTestProvider(t, dir, tc.format)
+
+			start := time.Now().UTC()
+			res, err := p.Send(context.Background(), testMessage())
+			if err != nil {
+				t.Fatalf("send failed: %v", err)
+			}
+			if len(res.Recipients) != 3 || len(res.Accepted()) != 3 {
+				t.Errorf("unexpected recipient results: %+v", res.Recipients)
+			}
+			if tc.format == mailingpb.FILE_FORMAT_EML && !strings.HasSuffix(res.MessageID, ".eml") {
+				t.Errorf("got message id %q, want the eml file name", res.MessageID)
+			}
+
+			// Only the message and its envelope are left, no temporary files.
+			got := listFiles(t, dir)
+			want := []string{tc.envelopePath(res.MessageID), tc.messagePath(res.MessageID)}
+			sort.Strings(want)
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got files %v, want %v", got, want)
+			}
+
+			data, err := os.ReadFile(filepath.Join(dir, tc.messagePath(res.MessageID)))
+			if err != nil {
+				t.Fatalf("failed to read message: %v", err)
+			}
+			m, err := mail.ReadMessage(strings.NewReader(string(data)))
+			if err != nil {
+				t.Fatalf("failed to parse message: %v", err)
+			}
+			if m.Header.Get("Subject") != "Hello" || m.Header.Get("Bcc") != "" {
+				t.Errorf("unexpected message header: %v", m.Header)
+			}
+
+			data, err = os.ReadFile(filepath.Join(dir, tc.envelopePath(res.MessageID)))
+			if err != nil {
+				t.Fatalf("failed to read envelope: %v", err)
+			}
+			var env struct {
+				MessageID  string    `json:"message_id"`
+				From       string    `json:"from"`
+				Recipients []string  `json:"recipients"`
+				CreatedAt  time.Time `json:"created_at"`
+			}
+			if err = json.Unmarshal(data, &env); err != nil {
+				t.Fatalf("failed to decode envelope: %v", err)
+			}
+			if env.MessageID != "msg-1" || env.From != "sender@example.org" {
+				t.Errorf("unexpected envelope: %+v", env)
+			}
+			if want := []string{"to@example.com", "cc@example.com", "bcc@example.com"}; !reflect.DeepEqual(env.Recipients, want) {
+				t.Errorf("got envelope recipients %v, want %v", env.Recipients, want)
+			}
+			if env.CreatedAt.Before(start.Truncate(time.Second)) || env.CreatedAt.After(time.Now()) {
+				t.Errorf("unexpected envelope creation time: %v", env.CreatedAt)
+			}
+		})
+	}
+}
+
+func TestFileProvider_Send_Errors(t *testing.T) {
+	dir := t.TempDir()
+	p := newTestProvider(t, dir, mailingpb.FILE_FORMAT_EML)
+
+	// The render failure keeps its classification and leaves no files behind.
+	msg := testMessage()
+	msg.Attachments = []mailprovider2.Attachment{{
+		Filename:    "report.pdf",
+		ContentType: "application/pdf",
+		Open: func(context.Context) (io.ReadCloser, error) {
+			return nil, errors.New("store unavailable")
+		},
+	}}
+	_, err := p.Send(context.Background(), msg)
+	var e *mailprovider2.Error
+	if !errors.As(err, &e) || !e.Temporary || !strings.Contains(e.Error(), "store unavailable") {
+		t.Fatalf("got %v, want temporary attachment error", err)
+	}
+	if files := listFiles(t, dir); len(files) != 0 {
+		t.Fatalf("got files %v, want none", files)
+	}
+
+	// The message without the recipients is rejected permanently.
+	msg = testMessage()
+	msg.To, msg.Cc, msg.Bcc = nil, nil, nil
+	_, err = p.Send(context.Background(), msg)
+	if !errors.As(err, &e) || e.Temporary {
+		t.Fatalf("got %v, want permanent error", err)
+	}
+
+	// The directory that could not be created might be fixed later.
+	blocked := filepath.Join(dir, "blocked")
+	if err = os.WriteFile(blocked, nil, 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	p = newTestProvider(t, filepath.Join(blocked, "messages"), mailingpb.FILE_FORMAT_EML)
+	_, err = p.Send(context.Background(), testMessage())
+	if !errors.As(err, &e) || !e.Temporary {
+		t.Fatalf("got %v, want temporary error", err)
+	}
+}
+
+func TestFileProvider_Verify(t *testing.T) {
+	t.Run("creates directories", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "messages")
+		p := newTestProvider(t, dir, mailingpb.FILE_FORMAT_MAILDIR)
+
+		if err := p.Verify(context.Background()); err != nil {
+			t.Fatalf("verify failed: %v", err)
+		}
+		if !p.IsVerified() {
+			t.Fatal("provider is not verified")
+		}
+		for _, sub := range []string{"tmp", "new", "cur", "envelope"} {
+			if fi, err := os.Stat(filepath.Join(dir, sub)); err != nil || !fi.IsDir() {
+				t.Errorf("maildir subdirectory %s is not created: %v", sub, err)
+			}
+		}
+		// The verification file is removed.
+		if files := listFiles(t, dir); len(files) != 0 {
+			t.Fatalf("got files %v, want none", files)
+		}
+	})
+
+	t.Run("not configured", func(t *testing.T) {
+		p := newTestProvider(t, "", mailingpb.FILE_FORMAT_EML)
+		if err := p.Verify(context.Background()); err == nil || p.IsVerified() {
+			t.Fatalf("got error %v, want not configured directory error", err)
+		}
+	})
+
+	t.Run("not a directory", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "messages")
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+		p := newTestProvider(t, path, mailingpb.FILE_FORMAT_EML)
+		if err := p.Verify(context.Background()); err == nil || p.IsVerified() {
+			t.Fatalf("got error %v, want directory error", err)
+		}
+	})
+
+	t.Run("not writable", func(t *testing.T) {
+		if os.Geteuid() == 0 {
+			t.Skip("the permissions do not apply to root")
+		}
+		dir := t.TempDir()
+		if err := os.Chmod(dir, 0o555); err != nil {
+			t.Fatalf("failed to change mode: %v", err)
+		}
+		t.Cleanup(func() { os.Chmod(dir, 0o755) })
+
+		p := newTestProvider(t, dir, mailingpb.FILE_FORMAT_EML)
+		if err := p.Verify(context.Background()); err == nil || p.IsVerified() {
+			t.Fatalf("got error %v, want not writable error", err)
+		}
+	})
+}
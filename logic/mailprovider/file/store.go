@@ -0,0 +1,163 @@
+package filemailprovider
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// emlExt is the extension of the message files written in the eml format.
+	emlExt = ".eml"
+	// envelopeExt is the extension of the sidecar envelope files.
+	envelopeExt = ".json"
+)
+
+// The subdirectories of the Maildir, the messages are written to the tmp and moved to the new once complete.
+// The envelopes are kept out of the Maildir subdirectories, so that the mail clients do not treat them as messages.
+const (
+	maildirTmp      = "tmp"
+	maildirNew      = "new"
+	maildirCur      = "cur"
+	maildirEnvelope = "envelope"
+)
+
+// envelope is the sidecar record of the captured message envelope.
+type envelope struct {
+	// MessageID is the identifier of the message.
+	MessageID string `json:"message_id,omitempty"`
+	// From is the envelope sender address.
+	From string `json:"from,omitempty"`
+	// Recipients are the envelope recipient addresses, including the blind carbon copy ones.
+	Recipients []string `json:"recipients"`
+	// CreatedAt is the time the message was captured.
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// store writes the messages to the directory, either as the eml files or into the Maildir.
+type store struct {
+	dir     string
+	maildir bool
+}
+
+// check verifies that the directory could be created and written to.
+func (s store) check() error {
+	if err := s.mkdirs(); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(s.tmpDir(), ".verify-*")
+	if err != nil {
+		return fmt.Errorf("capture directory is not writable: %w", err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// write writes the message rendered by the input function along with its envelope and returns the message file name.
+// The files are written to the temporary names first, so that their readers never see partially written files.
+func (s store) write(env *envelope, render func(w *os.File) error) (string, error) {
+	if err := s.mkdirs(); err != nil {
+		return "", err
+	}
+
+	name := uniqueName(env.CreatedAt)
+	msgPath := filepath.Join(s.dir, name+emlExt)
+	envPath := filepath.Join(s.dir, name+envelopeExt)
+	if s.maildir {
+		msgPath = filepath.Join(s.dir, maildirNew, name)
+		envPath = filepath.Join(s.dir, maildirEnvelope, name+envelopeExt)
+	}
+
+	data, err := json.MarshalIndent(env, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	// The envelope is written first, so that it is present once the message appears.
+	if err = s.writeFile(envPath, func(f *os.File) error {
+		_, err := f.Write(data)
+		return err
+	}); err != nil {
+		return "", err
+	}
+
+	if err = s.writeFile(msgPath, render); err != nil {
+		_ = os.Remove(envPath)
+		return "", err
+	}
+	return filepath.Base(msgPath), nil
+}
+
+// writeFile writes the file with the input function to the temporary file and renames it to the path.
+func (s store) writeFile(path string, write func(f *os.File) error) error {
+	f, err := os.CreateTemp(s.tmpDir(), ".capture-*")
+	if err != nil {
+		return err
+	}
+
+	// The temporary files are created readable only by the owner, the captured messages are meant to be inspected.
+	err = f.Chmod(0o644)
+	if err == nil {
+		err = write(f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// mkdirs creates the directory along with the Maildir subdirectories.
+func (s store) mkdirs() error {
+	if s.dir == "" {
+		return errors.New("capture directory is not configured")
+	}
+
+	dirs := []string{s.dir}
+	if s.maildir {
+		for _, sub := range []string{maildirTmp, maildirNew, maildirCur, maildirEnvelope} {
+			dirs = append(dirs, filepath.Join(s.dir, sub))
+		}
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("failed to create capture directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// tmpDir returns the directory of the temporary files, it needs to be on the same file system as the target ones.
+func (s store) tmpDir() string {
+	if s.maildir {
+		return filepath.Join(s.dir, maildirTmp)
+	}
+	return s.dir
+}
+
+// deliveries is the number of the messages written by the process, it makes the names unique within the process.
+var deliveries atomic.Uint64
+
+// uniqueName returns the unique file name in the Maildir format, i.e. 1700000000.M123456P42Q1.host.
+func uniqueName(t time.Time) string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+	// The slash and colon are not allowed in the Maildir names.
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", t.Unix(), t.Nanosecond()/1000, os.Getpid(), deliveries.Add(1), host)
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/blockysource/blocky/pkg/go/providers"
 	"github.com/blockysource/blocky/services/mailing/internal/persistence"
 	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
+	"github.com/blockysource/mailing/logic/mailprovider"
 	mailproviderevents "github.com/blockysource/mailing/logic/mailprovider/events"
 	mailprovidermanager "github.com/blockysource/mailing/logic/mailprovider/manager"
 )
@@ -87,7 +88,7 @@ func (h *Handler) UpdateMailingProvider(ctx context.Context, in *mailingpb.Updat
 		WithField("uid", in.UID).
 		Debug("mailing provider updated")
 
-	return &mailingpb.UpdateMailingProviderResponse{MailingProvider: out.MailingProvider.ToProto()}, nil
+	return &mailingpb.UpdateMailingProviderResponse{MailingProvider: h.redact(out.MailingProvider).ToProto()}, nil
 }
 
 // CreateMailingProvider creates a new mailing provider.
@@ -131,7 +132,7 @@ func (h *Handler) CreateMailingProvider(ctx context.Context, in *mailingpb.Creat
 			Name:        out.Name,
 			Type:        out.Type,
 			InUse:       false,
-			Config:      in.Config,
+			Config:      *h.m.Registry().Redact(base.Type, &in.Config),
 			CreatedAt:   out.CreatedAt,
 			VerifiedAt:  nil,
 			FromAddress: out.FromAddress,
@@ -177,7 +178,7 @@ func (h *Handler) ListMailingProviders(ctx context.Context, in *mailingpb.ListMa
 
 	var providers []mailingpb.MailingProvider
 	for _, p := range ls {
-		providers = append(providers, p.ToProto())
+		providers = append(providers, h.redact(p).ToProto())
 	}
 
 	return &mailingpb.ListMailingProvidersResponse{
@@ -204,7 +205,7 @@ func (h *Handler) GetCurrentMailingProvider(ctx context.Context, in *mailingpb.G
 			Name:        pd.Name,
 			Type:        pd.Type,
 			InUse:       true,
-			Config:      *pd.Config.Clone(),
+			Config:      *h.m.Registry().Redact(pd.Type, pd.Config),
 			CreatedAt:   pd.CreatedAt,
 			VerifiedAt:  verifiedAt,
 			FromAddress: pd.FromAddress,
@@ -212,3 +213,10 @@ func (h *Handler) GetCurrentMailingProvider(ctx context.Context, in *mailingpb.G
 	}, nil
 
 }
+
+// redact returns the provider definition with the secret fields of its config cleared,
+// so that the secrets are never sent back in the responses.
+func (h *Handler) redact(d mailprovider.MailingProviderDefinition) mailprovider.MailingProviderDefinition {
+	d.Config = h.m.Registry().Redact(d.Type, d.Config)
+	return d
+}
@@ -0,0 +1,328 @@
+package mailgunmailprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
+	mailprovider2 "github.com/blockysource/mailing/logic/mailprovider"
+	mailproviderwriter "github.com/blockysource/mailing/logic/mailprovider/writer"
+)
+
+const (
+	// USBaseURL is the base URL of the Mailgun API for the domains in the US region.
+	USBaseURL = "https://api.mailgun.net"
+	// EUBaseURL is the base URL of the Mailgun API for the domains in the EU region.
+	EUBaseURL = "https://api.eu.mailgun.net"
+)
+
+// domainStateActive is the state of the domain that is verified and allowed to send the messages.
+const domainStateActive = "active"
+
+// Compile-time check to verify implements interface.
+var _ mailprovider2.Provider = (*MailgunProvider)(nil)
+
+// MailgunProvider is a provider that sends the raw emails with the Mailgun messages API.
+type MailgunProvider struct {
+	l sync.RWMutex
+
+	p           mailprovider2.MailingProviderDefinition
+	fromAddress *mail.Address
+	cfg         mailingpb.MailgunConfig
+	log         *logrus.Entry
+	isVerified  bool
+	client      *http.Client
+}
+
+// New creates a new Mailgun provider.
+func New(p mailprovider2.MailingProviderDefinition, log *logrus.Entry) (*MailgunProvider, error) {
+	cfg := p.Config.GetMailgunConfig()
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	return &MailgunProvider{
+		p:      p,
+		cfg:    *cfg,
+		client: &http.Client{Timeout: 30 * time.Second},
+		log: log.WithFields(logrus.Fields{
+			"provider_id": p.UID,
+			"provider":    mailingpb.MAILGUN,
+		}),
+	}, nil
+}
+
+// Close closes the provider.
+func (m *MailgunProvider) Close() {
+	m.client.CloseIdleConnections()
+}
+
+// GetID returns the ID of the provider.
+func (m *MailgunProvider) GetID() string {
+	return m.p.UID
+}
+
+// GetDefinition returns the provider definition.
+func (m *MailgunProvider) GetDefinition() mailprovider2.MailingProviderDefinition {
+	return m.p
+}
+
+// Type returns the type of the provider.
+func (m *MailgunProvider) Type() mailingpb.MailingProviderType {
+	return mailingpb.MAILGUN
+}
+
+// IsVerified returns whether the provider is verified.
+func (m *MailgunProvider) IsVerified() bool {
+	m.l.RLock()
+	defer m.l.RUnlock()
+
+	return m.isVerified
+}
+
+// UpdateConfig updates the config of the provider.
+func (m *MailgunProvider) UpdateConfig(config *mailingpb.MailingProviderConfig) error {
+	cfg := config.GetMailgunConfig()
+	if cfg == nil {
+		return fmt.Errorf("invalid config type: %T", config)
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	m.l.Lock()
+	m.cfg = *cfg
+	m.l.Unlock()
+	return nil
+}
+
+// GetConfig returns the config of the provider.
+func (m *MailgunProvider) GetConfig() mailingpb.MailingProviderConfig {
+	m.l.RLock()
+	defer m.l.RUnlock()
+
+	cfg := m.cfg
+	return mailingpb.MailingProviderConfig{
+		Config: &mailingpb.MailingProviderConfig_MailgunConfig{
+			MailgunConfig: &cfg,
+		},
+	}
+}
+
+// GetDefaultFromAddress returns the default from address.
+func (m *MailgunProvider) GetDefaultFromAddress() *mail.Address {
+	m.l.RLock()
+	defer m.l.RUnlock()
+
+	return m.fromAddress
+}
+
+// Send lets the provider send the input message.
+// The message is rendered by the shared writer and uploaded as a MIME message, so that it is delivered as it is.
+// The API accepts or rejects the message as a whole, so that all the recipients share the same result.
+func (m *MailgunProvider) Send(ctx context.Context, msg *mailprovider2.Message) (*mailprovider2.SendResult, error) {
+	m.l.RLock()
+	domain := m.cfg.Domain
+	m.l.RUnlock()
+
+	body, contentType, err := newMIMEForm(ctx, msg, domain)
+	if err != nil {
+		m.log.WithFields(logrus.Fields{
+			"msg_id":        msg.ID,
+			logrus.ErrorKey: err,
+		}).Debug("failed to prepare message")
+		return nil, mailprovider2.AsError(err, false)
+	}
+
+	resp, err := m.do(ctx, http.MethodPost, "/v3/"+url.PathEscape(domain)+"/messages.mime", body, contentType)
+	if err != nil {
+		m.log.WithFields(logrus.Fields{
+			"msg_id":        msg.ID,
+			logrus.ErrorKey: err,
+		}).Debug("failed to send message")
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = responseErr(resp)
+		m.log.WithFields(logrus.Fields{
+			"msg_id":        msg.ID,
+			"status":        resp.StatusCode,
+			logrus.ErrorKey: err,
+		}).Debug("mailgun rejected the message")
+		return nil, err
+	}
+
+	var out struct {
+		ID string `json:"id"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&out); err != nil {
+		// The message was accepted, only the identifier is missing.
+		m.log.WithError(err).Debug("failed to decode mailgun response")
+	}
+
+	// The events report the identifier without the angle brackets.
+	res := &mailprovider2.SendResult{MessageID: strings.Trim(out.ID, "<>")}
+	for _, rcpt := range msg.Recipients() {
+		res.Recipients = append(res.Recipients, mailprovider2.RecipientResult{
+			Address: rcpt.Address,
+			Status:  mailprovider2.RecipientAccepted,
+		})
+	}
+
+	m.log.WithFields(logrus.Fields{
+		"msg_id":            msg.ID,
+		"mailgun_msg_id":    res.MessageID,
+		"recipients_number": len(res.Recipients),
+	}).Debug("email message sent successfully")
+	return res, nil
+}
+
+// Verify verifies that the API key is valid and the sending domain is active.
+func (m *MailgunProvider) Verify(ctx context.Context) error {
+	m.l.RLock()
+	domain := m.cfg.Domain
+	m.l.RUnlock()
+
+	resp, err := m.do(ctx, http.MethodGet, "/v3/domains/"+url.PathEscape(domain), nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = responseErr(resp)
+		m.log.WithError(err).Debug("failed to verify mailgun domain")
+		return err
+	}
+
+	var out struct {
+		Domain struct {
+			State string `json:"state"`
+		} `json:"domain"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&out); err != nil {
+		return fmt.Errorf("failed to decode mailgun domain: %w", err)
+	}
+	if out.Domain.State != domainStateActive {
+		return fmt.Errorf("mailgun domain %s is not active, state: %s", domain, out.Domain.State)
+	}
+
+	m.l.Lock()
+	m.isVerified = true
+	m.l.Unlock()
+	return nil
+}
+
+// newMIMEForm renders the message and returns the multipart form of the MIME message upload along with its content type.
+func newMIMEForm(ctx context.Context, msg *mailprovider2.Message, domain string) (*bytes.Buffer, string, error) {
+	rcpts := msg.Recipients()
+	if len(rcpts) == 0 {
+		return nil, "", errors.New("message has no recipients")
+	}
+
+	var body bytes.Buffer
+	fw := multipart.NewWriter(&body)
+
+	// The recipients of the upload are the envelope recipients, including the blind carbon copy ones.
+	for _, rcpt := range rcpts {
+		if err := fw.WriteField("to", rcpt.Address); err != nil {
+			return nil, "", err
+		}
+	}
+
+	// The variable is passed back in the webhooks, so that the events could be correlated with the message.
+	if msg.ID != "" {
+		if err := fw.WriteField("v:msg_id", msg.ID); err != nil {
+			return nil, "", err
+		}
+	}
+
+	part, err := fw.CreateFormFile("message", "message.mime")
+	if err != nil {
+		return nil, "", err
+	}
+
+	mw := mailproviderwriter.Writer{Domain: domain}
+	if err = mw.Render(ctx, msg, part); err != nil {
+		return nil, "", err
+	}
+
+	if err = fw.Close(); err != nil {
+		return nil, "", err
+	}
+	return &body, fw.FormDataContentType(), nil
+}
+
+// do sends the authorized request to the Mailgun API.
+func (m *MailgunProvider) do(ctx context.Context, method, path string, body io.Reader, contentType string) (*http.Response, error) {
+	m.l.RLock()
+	baseURL := m.cfg.BaseURL
+	region := m.cfg.Region
+	apiKey := m.cfg.APIKey.UnsafeString()
+	m.l.RUnlock()
+
+	// The domains are bound to the region they were created in.
+	if baseURL == "" {
+		baseURL = USBaseURL
+		if region == mailingpb.MAILGUN_REGION_EU {
+			baseURL = EUBaseURL
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(baseURL, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth("api", apiKey)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		// The request might not have reached the API, so that it could be retried.
+		return nil, mailprovider2.ErrTemporary(fmt.Errorf("mailgun request failed: %w", err))
+	}
+	return resp, nil
+}
+
+// maxResponseSize is the maximum size of the API response body that is read.
+const maxResponseSize = 1 << 20
+
+// responseErr returns the error of the failed API response.
+func responseErr(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+
+	var apiErr struct {
+		Message string `json:"message"`
+	}
+	msg := strings.TrimSpace(string(body))
+	if err := json.Unmarshal(body, &apiErr); err == nil && apiErr.Message != "" {
+		msg = apiErr.Message
+	}
+	if msg == "" {
+		msg = resp.Status
+	}
+
+	err := mailprovider2.ErrHTTPStatus(resp.StatusCode, errors.New("mailgun: "+msg))
+	var e *mailprovider2.Error
+	if errors.As(err, &e) {
+		e.Message = msg
+	}
+	return err
+}
@@ -0,0 +1,295 @@
+package mailgunmailprovider_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
+	mailprovider2 "github.com/blockysource/mailing/logic/mailprovider"
+	mailgunmailprovider "github.com/blockysource/mailing/logic/mailprovider/mailgun"
+)
+
+// redirectTransport sends all the requests to the test server, recording the hosts they were meant for.
+type redirectTransport struct {
+	target *url.URL
+	base   http.RoundTripper
+
+	mu    sync.Mutex
+	hosts []string
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.hosts = append(t.hosts, req.URL.Scheme+"://"+req.URL.Host)
+	t.mu.Unlock()
+
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.target.Scheme
+	req.URL.Host = t.target.Host
+	return t.base.RoundTrip(req)
+}
+
+// newTestProvider creates the provider which requests are served by the handler.
+// The requests are redirected by the default transport, so that the configured base URL, or the region one, is kept.
+// The tests using it must not run in parallel.
+func newTestProvider(t *testing.T, cfg *mailingpb.MailgunConfig, h http.HandlerFunc) (*mailgunmailprovider.MailgunProvider, *redirectTransport) {
+	t.Helper()
+
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	target, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("failed to parse server url: %v", err)
+	}
+
+	rt := &redirectTransport{target: target, base: http.DefaultTransport}
+	http.DefaultTransport = rt
+	t.Cleanup(func() { http.DefaultTransport = rt.base })
+
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	p, err := mailgunmailprovider.New(mailprovider2.MailingProviderDefinition{
+		UID:    "mailgun",
+		Config: &mailingpb.MailingProviderConfig{Config: &mailingpb.MailingProviderConfig_MailgunConfig{MailgunConfig: cfg}},
+	}, logrus.NewEntry(log))
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+	t.Cleanup(p.Close)
+	return p, rt
+}
+
+func testConfig() *mailingpb.MailgunConfig {
+	return &mailingpb.MailgunConfig{APIKey: "key-123", Domain: "mg.example.org"}
+}
+
+func testMessage() *mailprovider2.Message {
+	return &mailprovider2.Message{
+		ID:          "msg-1",
+		From:        &mail.Address{Name: "Sender", Address: "sender@mg.example.org"},
+		To:          []*mail.Address{{Address: "to@example.com"}},
+		Cc:          []*mail.Address{{Address: "cc@example.com"}},
+		Bcc:         []*mail.Address{{Address: "bcc@example.com"}},
+		Subject:     "Hello",
+		Body:        "<p>Hello</p>",
+		ContentType: "text/html; charset=utf-8",
+	}
+}
+
+func TestMailgunProvider_Send(t *testing.T) {
+	var (
+		form    url.Values
+		message string
+	)
+	p, _ := newTestProvider(t, testConfig(), func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v3/mg.example.org/messages.mime" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		if user, pass, ok := r.BasicAuth(); !ok || user != "api" || pass != "key-123" {
+			t.Errorf("unexpected basic auth: %s %s", user, pass)
+		}
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Errorf("failed to parse form: %v", err)
+			return
+		}
+		form = r.MultipartForm.Value
+
+		f, _, err := r.FormFile("message")
+		if err != nil {
+			t.Errorf("missing message file: %v", err)
+			return
+		}
+		defer f.Close()
+		data, _ := io.ReadAll(f)
+		message = string(data)
+
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"<20231017.1@mg.example.org>","message":"Queued. Thank you."}`)
+	})
+
+	res, err := p.Send(context.Background(), testMessage())
+	if err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+
+	// The blind carbon copy recipients are only a part of the envelope.
+	if want := []string{"to@example.com", "cc@example.com", "bcc@example.com"}; !reflect.DeepEqual(form["to"], want) {
+		t.Errorf("got to fields %v, want %v", form["to"], want)
+	}
+	if got := form["v:msg_id"]; len(got) != 1 || got[0] != "msg-1" {
+		t.Errorf("got v:msg_id %v, want msg-1", got)
+	}
+	if !strings.Contains(message, "Subject: Hello\r\n") || strings.Contains(message, "bcc@example.com") {
+		t.Errorf("unexpected message:\n%s", message)
+	}
+
+	if res.MessageID != "20231017.1@mg.example.org" {
+		t.Errorf("got message id %q, want it without the angle brackets", res.MessageID)
+	}
+	if len(res.Recipients) != 3 || len(res.Accepted()) != 3 {
+		t.Errorf("unexpected recipient results: %+v", res.Recipients)
+	}
+}
+
+func TestMailgunProvider_BaseURL(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  func(cfg *mailingpb.MailgunConfig)
+		want string
+	}{
+		{name: "us region", want: mailgunmailprovider.USBaseURL},
+		{name: "eu region", cfg: func(cfg *mailingpb.MailgunConfig) { cfg.Region = mailingpb.MAILGUN_REGION_EU }, want: mailgunmailprovider.EUBaseURL},
+		{
+			name: "base url",
+			cfg: func(cfg *mailingpb.MailgunConfig) {
+				cfg.Region = mailingpb.MAILGUN_REGION_EU
+				cfg.BaseURL = "https://mailgun.internal/"
+			},
+			want: "https://mailgun.internal",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig()
+			if tc.cfg != nil {
+				tc.cfg(cfg)
+			}
+			p, rt := newTestProvider(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, `{"id":"<1@mg.example.org>"}`)
+			})
+
+			if _, err := p.Send(context.Background(), testMessage()); err != nil {
+				t.Fatalf("send failed: %v", err)
+			}
+			if len(rt.hosts) != 1 || rt.hosts[0] != tc.want {
+				t.Fatalf("got requests to %v, want %s", rt.hosts, tc.want)
+			}
+		})
+	}
+}
+
+func TestMailgunProvider_Send_Errors(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		auth      bool
+		temporary bool
+		category  mailprovider2.ErrorCategory
+	}{
+		{name: "unauthorized", status: http.StatusUnauthorized, body: "Forbidden", auth: true},
+		{name: "rate limited", status: http.StatusTooManyRequests, body: `{"message":"Too many requests"}`, temporary: true, category: mailprovider2.CategoryRateLimited},
+		{name: "server error", status: http.StatusInternalServerError, body: `{"message":"Internal error"}`, temporary: true},
+		{name: "unavailable", status: http.StatusServiceUnavailable, temporary: true},
+		{name: "bad request", status: http.StatusBadRequest, body: `{"message":"'from' parameter is not a valid address"}`},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p, _ := newTestProvider(t, testConfig(), func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				io.WriteString(w, tc.body)
+			})
+
+			_, err := p.Send(context.Background(), testMessage())
+			if err == nil {
+				t.Fatal("send succeeded, want error")
+			}
+
+			var authErr *mailprovider2.AuthErr
+			if tc.auth {
+				if !errors.As(err, &authErr) {
+					t.Fatalf("got %T %v, want auth error", err, err)
+				}
+				return
+			}
+
+			var e *mailprovider2.Error
+			if !errors.As(err, &e) {
+				t.Fatalf("got %T %v, want mailprovider error", err, err)
+			}
+			if e.Temporary != tc.temporary || e.Category != tc.category || e.Code != tc.status {
+				t.Errorf("got temporary %t category %s code %d, want %t %s %d", e.Temporary, e.Category, e.Code, tc.temporary, tc.category, tc.status)
+			}
+		})
+	}
+}
+
+func TestMailgunProvider_Send_AttachmentError(t *testing.T) {
+	var requests int
+	p, _ := newTestProvider(t, testConfig(), func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	})
+
+	msg := testMessage()
+	msg.Attachments = []mailprovider2.Attachment{{
+		Filename:    "report.pdf",
+		ContentType: "application/pdf",
+		Open: func(context.Context) (io.ReadCloser, error) {
+			return nil, errors.New("store unavailable")
+		},
+	}}
+
+	_, err := p.Send(context.Background(), msg)
+	var e *mailprovider2.Error
+	if !errors.As(err, &e) || !e.Temporary {
+		t.Fatalf("got %v, want temporary error", err)
+	}
+	if requests != 0 {
+		t.Fatalf("got %d requests, want none", requests)
+	}
+}
+
+func TestMailgunProvider_Verify(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		verified bool
+		auth     bool
+	}{
+		{name: "active", status: http.StatusOK, body: `{"domain":{"name":"mg.example.org","state":"active"}}`, verified: true},
+		{name: "unverified", status: http.StatusOK, body: `{"domain":{"name":"mg.example.org","state":"unverified"}}`},
+		{name: "disabled", status: http.StatusOK, body: `{"domain":{"name":"mg.example.org","state":"disabled"}}`},
+		{name: "not found", status: http.StatusNotFound, body: `{"message":"Domain not found"}`},
+		{name: "unauthorized", status: http.StatusUnauthorized, body: "Forbidden", auth: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p, _ := newTestProvider(t, testConfig(), func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodGet || r.URL.Path != "/v3/domains/mg.example.org" {
+					t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+				}
+				w.WriteHeader(tc.status)
+				io.WriteString(w, tc.body)
+			})
+
+			err := p.Verify(context.Background())
+			if tc.verified != (err == nil) {
+				t.Fatalf("got error %v, want verified %t", err, tc.verified)
+			}
+			if p.IsVerified() != tc.verified {
+				t.Fatalf("got verified %t, want %t", p.IsVerified(), tc.verified)
+			}
+
+			var authErr *mailprovider2.AuthErr
+			if tc.auth && !errors.As(err, &authErr) {
+				t.Fatalf("got %T %v, want auth error", err, err)
+			}
+		})
+	}
+}
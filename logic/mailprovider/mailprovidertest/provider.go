@@ -0,0 +1,371 @@
+// Package mailprovidertest provides an in-memory mailprovider.Provider implementation for the tests.
+// The provider records the sent messages, lets the tests script the send failures, and is verified by default,
+// so that it could be set as the current provider with the Manager.ReplaceCurrentProvider.
+package mailprovidertest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
+	"github.com/blockysource/mailing/logic/mailprovider"
+)
+
+// Compile-time check to verify implements interface.
+var _ mailprovider.Provider = (*Provider)(nil)
+
+// SentMessage is the message accepted by the provider for at least one of its recipients.
+type SentMessage struct {
+	// Message is the sent message.
+	Message *mailprovider.Message
+	// Result is the result returned from the Send.
+	Result *mailprovider.SendResult
+	// SentAt is the time the message was sent.
+	SentAt time.Time
+}
+
+// Accepted returns the addresses of the recipients, that accepted the message.
+func (s *SentMessage) Accepted() []string {
+	var out []string
+	for _, rr := range s.Result.Accepted() {
+		out = append(out, rr.Address)
+	}
+	return out
+}
+
+// Provider is an in-memory provider, that records the messages instead of sending them.
+// It is safe for the concurrent use.
+type Provider struct {
+	l sync.Mutex
+
+	def          mailprovider.MailingProviderDefinition
+	fromAddress  *mail.Address
+	cfg          mailingpb.MailingProviderConfig
+	isVerified   bool
+	verifyErr    error
+	callFailures []error
+	rcptFailures map[string]error
+	sent         []*SentMessage
+	sendCalls    int
+	closed       bool
+
+	// sentCh is closed and replaced whenever a message is sent, so that the waiters are notified.
+	sentCh chan struct{}
+}
+
+// New creates a new verified in-memory provider.
+func New() *Provider {
+	return &Provider{
+		def: mailprovider.MailingProviderDefinition{
+			UID:  "mailprovidertest",
+			Name: "mailprovidertest",
+		},
+		isVerified:   true,
+		rcptFailures: make(map[string]error),
+		sentCh:       make(chan struct{}),
+	}
+}
+
+// SetDefinition sets the provider definition returned by the GetDefinition and GetID.
+func (p *Provider) SetDefinition(def mailprovider.MailingProviderDefinition) {
+	p.l.Lock()
+	p.def = def
+	p.l.Unlock()
+}
+
+// SetDefaultFromAddress sets the address returned by the GetDefaultFromAddress.
+func (p *Provider) SetDefaultFromAddress(addr *mail.Address) {
+	p.l.Lock()
+	p.fromAddress = addr
+	p.l.Unlock()
+}
+
+// SetVerifyError sets the error returned by the Verify, the provider is not verified until it is cleared with nil.
+func (p *Provider) SetVerifyError(err error) {
+	p.l.Lock()
+	p.verifyErr = err
+	p.isVerified = err == nil
+	p.l.Unlock()
+}
+
+// FailNextCall makes the next call of the Send fail with the input error, without sending the message.
+// The failures of the subsequent calls are queued, i.e. calling it twice fails the two next calls.
+func (p *Provider) FailNextCall(err error) {
+	p.l.Lock()
+	p.callFailures = append(p.callFailures, err)
+	p.l.Unlock()
+}
+
+// FailRecipient makes the recipient reject all the messages until the failure is cleared with nil.
+// The recipient is rejected temporarily if the error is a temporary *mailprovider.Error, and permanently otherwise.
+func (p *Provider) FailRecipient(address string, err error) {
+	key := normalize(address)
+
+	p.l.Lock()
+	if err == nil {
+		delete(p.rcptFailures, key)
+	} else {
+		p.rcptFailures[key] = err
+	}
+	p.l.Unlock()
+}
+
+// Reset removes all the recorded messages and scripted failures.
+func (p *Provider) Reset() {
+	p.l.Lock()
+	p.callFailures = nil
+	p.rcptFailures = make(map[string]error)
+	p.sent = nil
+	p.sendCalls = 0
+	p.l.Unlock()
+}
+
+// Close closes the provider.
+func (p *Provider) Close() {
+	p.l.Lock()
+	p.closed = true
+	p.l.Unlock()
+}
+
+// Closed returns whether the provider was closed, i.e. by the Manager.UnsetCurrentProvider.
+func (p *Provider) Closed() bool {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	return p.closed
+}
+
+// GetID returns the ID of the provider.
+func (p *Provider) GetID() string {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	return p.def.UID
+}
+
+// GetDefinition returns the provider definition.
+func (p *Provider) GetDefinition() mailprovider.MailingProviderDefinition {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	return p.def
+}
+
+// Type returns the type of the provider.
+func (p *Provider) Type() mailingpb.MailingProviderType {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	return p.def.Type
+}
+
+// IsVerified returns whether the provider is verified.
+func (p *Provider) IsVerified() bool {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	return p.isVerified
+}
+
+// UpdateConfig updates the config of the provider.
+func (p *Provider) UpdateConfig(config *mailingpb.MailingProviderConfig) error {
+	if config == nil {
+		return errors.New("config is nil")
+	}
+
+	p.l.Lock()
+	p.cfg = *config
+	p.l.Unlock()
+	return nil
+}
+
+// GetConfig returns the config of the provider.
+func (p *Provider) GetConfig() mailingpb.MailingProviderConfig {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	return p.cfg
+}
+
+// GetDefaultFromAddress returns the default from address.
+func (p *Provider) GetDefaultFromAddress() *mail.Address {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	return p.fromAddress
+}
+
+// Send records the message for the recipients that have no scripted failure.
+// The message is recorded only if it was accepted by at least one recipient.
+func (p *Provider) Send(ctx context.Context, msg *mailprovider.Message) (*mailprovider.SendResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, mailprovider.ErrTemporary(err)
+	}
+
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	p.sendCalls++
+	if len(p.callFailures) > 0 {
+		err := p.callFailures[0]
+		p.callFailures = p.callFailures[1:]
+		return nil, err
+	}
+
+	rcpts := msg.Recipients()
+	if len(rcpts) == 0 {
+		return nil, mailprovider.ErrPermanent(errors.New("message has no recipients"))
+	}
+
+	res := &mailprovider.SendResult{MessageID: fmt.Sprintf("mailprovidertest-%d", p.sendCalls)}
+	for _, rcpt := range rcpts {
+		res.Recipients = append(res.Recipients, recipientResult(rcpt.Address, p.rcptFailures[normalize(rcpt.Address)]))
+	}
+
+	if err := res.Err(); err != nil {
+		return res, err
+	}
+
+	p.sent = append(p.sent, &SentMessage{Message: msg, Result: res, SentAt: time.Now()})
+	close(p.sentCh)
+	p.sentCh = make(chan struct{})
+	return res, nil
+}
+
+// Verify verifies the provider configuration, it fails with the error set by the SetVerifyError.
+func (p *Provider) Verify(ctx context.Context) error {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	if p.verifyErr != nil {
+		return p.verifyErr
+	}
+	p.isVerified = true
+	return nil
+}
+
+// SendCalls returns the number of the Send calls, including the failed ones.
+func (p *Provider) SendCalls() int {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	return p.sendCalls
+}
+
+// Sent returns the sent messages in the order they were sent.
+func (p *Provider) Sent() []*SentMessage {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	return append([]*SentMessage(nil), p.sent...)
+}
+
+// Messages returns the sent messages in the order they were sent.
+func (p *Provider) Messages() []*mailprovider.Message {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	out := make([]*mailprovider.Message, 0, len(p.sent))
+	for _, s := range p.sent {
+		out = append(out, s.Message)
+	}
+	return out
+}
+
+// LastMessage returns the last sent message, or nil if none was sent.
+func (p *Provider) LastMessage() *mailprovider.Message {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	if len(p.sent) == 0 {
+		return nil
+	}
+	return p.sent[len(p.sent)-1].Message
+}
+
+// MessagesTo returns the messages accepted by the recipient, in the order they were sent.
+func (p *Provider) MessagesTo(address string) []*mailprovider.Message {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	var out []*mailprovider.Message
+	for _, s := range p.sent {
+		if acceptedBy(s, address) {
+			out = append(out, s.Message)
+		}
+	}
+	return out
+}
+
+// WaitForMessage waits until a message is accepted by the recipient and returns it.
+// If the recipient already accepted a message, the first one is returned immediately.
+func (p *Provider) WaitForMessage(to string, timeout time.Duration) (*mailprovider.Message, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	seen := 0
+	for {
+		p.l.Lock()
+		for ; seen < len(p.sent); seen++ {
+			if acceptedBy(p.sent[seen], to) {
+				msg := p.sent[seen].Message
+				p.l.Unlock()
+				return msg, nil
+			}
+		}
+		sentCh := p.sentCh
+		p.l.Unlock()
+
+		select {
+		case <-sentCh:
+		case <-timer.C:
+			return nil, fmt.Errorf("no message sent to %s within %s", to, timeout)
+		}
+	}
+}
+
+// recipientResult returns the result of the recipient with the scripted failure, if any.
+func recipientResult(address string, err error) mailprovider.RecipientResult {
+	rr := mailprovider.RecipientResult{Address: address, Status: mailprovider.RecipientAccepted}
+	if err == nil {
+		return rr
+	}
+
+	rr.Status = mailprovider.RecipientPermanentRejected
+	rr.Message = err.Error()
+
+	var e *mailprovider.Error
+	if errors.As(err, &e) {
+		if e.Temporary {
+			rr.Status = mailprovider.RecipientTemporaryRejected
+		}
+		rr.Code = e.Code
+		rr.EnhancedCode = e.EnhancedCode
+		rr.Category = e.Category
+		if e.Message != "" {
+			rr.Message = e.Message
+		}
+	}
+	return rr
+}
+
+// acceptedBy checks if the message was accepted by the recipient.
+func acceptedBy(s *SentMessage, address string) bool {
+	key := normalize(address)
+	for _, rr := range s.Result.Recipients {
+		if rr.Status == mailprovider.RecipientAccepted && normalize(rr.Address) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// normalize returns the address in the form used to match the recipients.
+func normalize(address string) string {
+	return strings.ToLower(strings.TrimSpace(address))
+}
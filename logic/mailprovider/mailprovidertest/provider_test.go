@@ -0,0 +1,201 @@
+package mailprovidertest_test
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/blockysource/mailing/logic/mailprovider"
+	"github.com/blockysource/mailing/logic/mailprovider/mailprovidertest"
+	mailprovidermanager "github.com/blockysource/mailing/logic/mailprovider/manager"
+)
+
+func testMessage(id string, to ...string) *mailprovider.Message {
+	msg := &mailprovider.Message{
+		ID:          id,
+		From:        &mail.Address{Address: "sender@example.org"},
+		Subject:     "Hello",
+		Body:        "Hello there",
+		ContentType: "text/plain; charset=utf-8",
+	}
+	for _, addr := range to {
+		msg.To = append(msg.To, &mail.Address{Address: addr})
+	}
+	return msg
+}
+
+func TestProvider_WaitForMessage(t *testing.T) {
+	p := mailprovidertest.New()
+
+	errCh := make(chan error, 1)
+	go func() {
+		// The message to the other recipient does not satisfy the waiter.
+		if _, err := p.Send(context.Background(), testMessage("other", "bob@example.com")); err != nil {
+			errCh <- err
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+		_, err := p.Send(context.Background(), testMessage("wanted", "Alice@example.com"))
+		errCh <- err
+	}()
+
+	msg, err := p.WaitForMessage("alice@example.com", 5*time.Second)
+	if err != nil {
+		t.Fatalf("wait failed: %v", err)
+	}
+	if msg.ID != "wanted" {
+		t.Fatalf("got message %s, want wanted", msg.ID)
+	}
+	if err = <-errCh; err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+
+	// The message already sent is returned right away.
+	msg, err = p.WaitForMessage("bob@example.com", time.Nanosecond)
+	if err != nil || msg.ID != "other" {
+		t.Fatalf("got message %v and error %v, want other", msg, err)
+	}
+}
+
+func TestProvider_WaitForMessage_Timeout(t *testing.T) {
+	p := mailprovidertest.New()
+	p.FailRecipient("alice@example.com", errors.New("mailbox unavailable"))
+
+	// The message rejected by the recipient does not satisfy the waiter.
+	if _, err := p.Send(context.Background(), testMessage("rejected", "alice@example.com", "bob@example.com")); err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+
+	start := time.Now()
+	msg, err := p.WaitForMessage("alice@example.com", 50*time.Millisecond)
+	if err == nil {
+		t.Fatalf("got message %s, want timeout", msg.ID)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("wait returned after %s, before the timeout", elapsed)
+	}
+}
+
+func TestProvider_FailNextCall(t *testing.T) {
+	p := mailprovidertest.New()
+
+	errFirst := mailprovider.ErrTemporary(errors.New("first"))
+	errSecond := mailprovider.ErrPermanent(errors.New("second"))
+	p.FailNextCall(errFirst)
+	p.FailNextCall(errSecond)
+
+	for i, want := range []error{errFirst, errSecond, nil} {
+		_, err := p.Send(context.Background(), testMessage("msg", "alice@example.com"))
+		if err != want {
+			t.Fatalf("call %d: got error %v, want %v", i+1, err, want)
+		}
+	}
+
+	if got := p.SendCalls(); got != 3 {
+		t.Fatalf("got %d send calls, want 3", got)
+	}
+	if got := len(p.Sent()); got != 1 {
+		t.Fatalf("got %d sent messages, want 1", got)
+	}
+}
+
+func TestProvider_FailRecipient(t *testing.T) {
+	p := mailprovidertest.New()
+	p.FailRecipient("temporary@example.com", &mailprovider.Error{
+		Temporary: true,
+		Code:      452,
+		Message:   "Mailbox full",
+		Err:       errors.New("mailbox full"),
+	})
+	p.FailRecipient("permanent@example.com", errors.New("no such user"))
+
+	res, err := p.Send(context.Background(), testMessage("msg", "temporary@example.com", "permanent@example.com", "ok@example.com"))
+	if err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+
+	want := map[string]mailprovider.RecipientStatus{
+		"temporary@example.com": mailprovider.RecipientTemporaryRejected,
+		"permanent@example.com": mailprovider.RecipientPermanentRejected,
+		"ok@example.com":        mailprovider.RecipientAccepted,
+	}
+	for _, rr := range res.Recipients {
+		if rr.Status != want[rr.Address] {
+			t.Errorf("recipient %s: got status %s, want %s", rr.Address, rr.Status, want[rr.Address])
+		}
+		if rr.Address == "temporary@example.com" && (rr.Code != 452 || rr.Message != "Mailbox full") {
+			t.Errorf("recipient %s: got code %d message %q", rr.Address, rr.Code, rr.Message)
+		}
+	}
+
+	sent := p.Sent()
+	if len(sent) != 1 || !reflect.DeepEqual(sent[0].Accepted(), []string{"ok@example.com"}) {
+		t.Fatalf("unexpected sent messages: %+v", sent)
+	}
+	if got := p.MessagesTo("permanent@example.com"); len(got) != 0 {
+		t.Fatalf("got %d messages to the rejected recipient, want none", len(got))
+	}
+
+	// The message rejected by all its recipients fails, temporarily if any of the rejections is temporary.
+	_, err = p.Send(context.Background(), testMessage("rejected", "temporary@example.com", "permanent@example.com"))
+	var e *mailprovider.Error
+	if !errors.As(err, &e) || !e.Temporary {
+		t.Fatalf("got error %v, want temporary error", err)
+	}
+
+	// The cleared failure lets the recipient accept the messages again.
+	p.FailRecipient("permanent@example.com", nil)
+	if _, err = p.Send(context.Background(), testMessage("cleared", "permanent@example.com")); err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	if got := p.MessagesTo("permanent@example.com"); len(got) != 1 || got[0].ID != "cleared" {
+		t.Fatalf("unexpected messages to the cleared recipient: %v", got)
+	}
+}
+
+func TestProvider_ReplaceCurrentProvider(t *testing.T) {
+	var m mailprovidermanager.Manager
+	p := mailprovidertest.New()
+
+	// The provider is verified by default.
+	if err := m.ReplaceCurrentProvider(p); err != nil {
+		t.Fatalf("replace failed: %v", err)
+	}
+	if cp, ok := m.GetCurrentProvider(); !ok || cp != p {
+		t.Fatalf("got current provider %v, want the test provider", cp)
+	}
+
+	// The provider that fails the verification cannot become the current one.
+	unverified := mailprovidertest.New()
+	unverified.SetVerifyError(errors.New("invalid credentials"))
+	if err := unverified.Verify(context.Background()); err == nil {
+		t.Fatal("verify succeeded, want error")
+	}
+	if err := m.ReplaceCurrentProvider(unverified); err == nil {
+		t.Fatal("replaced with the unverified provider, want error")
+	}
+
+	unverified.SetVerifyError(nil)
+	if err := unverified.Verify(context.Background()); err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+	if err := m.ReplaceCurrentProvider(unverified); err != nil {
+		t.Fatalf("replace failed: %v", err)
+	}
+
+	cp, _ := m.GetCurrentProvider()
+	if _, err := cp.Send(context.Background(), testMessage("msg", "alice@example.com")); err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	if got := unverified.LastMessage(); got == nil || got.ID != "msg" {
+		t.Fatalf("got last message %v, want msg", got)
+	}
+
+	m.UnsetCurrentProvider()
+	if !unverified.Closed() {
+		t.Fatal("provider was not closed when unset")
+	}
+}
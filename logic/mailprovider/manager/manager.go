@@ -3,19 +3,14 @@ package mailprovidermanager
 import (
 	"context"
 	"errors"
-	"fmt"
-	"net/mail"
 	"sync"
 
-	"github.com/google/uuid"
-	"github.com/pallinder/go-randomdata"
-	"golang.org/x/exp/slog"
+	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
 	mailingadminv1 "github.com/blockysource/go-genproto/blockyapis/mailing/admin/v1alpha"
 	"github.com/blockysource/mailing/logic/mailprovider"
-	smtpmailprovider "github.com/blockysource/mailing/logic/mailprovider/smtp"
 )
 
 // Manager is responsible for managing currently used provider.
@@ -24,55 +19,40 @@ type Manager struct {
 	// current is a currently used mailprovider.Provider
 	current mailprovider.Provider `wire:"-"`
 
-	log *slog.Logger
-	sc  *smtpmailprovider.SMTPProvidersConfig
+	log *logrus.Entry
+	r   *mailprovider.Registry
 }
 
 // NewProviderBase creates a new provider from the given configuration.
 func (m *Manager) NewProviderBase(in *mailingadminv1.CreateMailingProviderRequest) (mailprovider.Base, error) {
-	switch in.Type {
-	case mailingadminv1.MailingProviderType_SMTP:
-		// Verify that the input config is valid - the validate function checks if the input is nil.
-		if err := in.Config.GetSmtpConfig().Validate(); err != nil {
-			return mailprovider.Base{}, err
-		}
-	default:
+	f, ok := m.r.Lookup(in.Type)
+	if !ok {
 		return mailprovider.Base{}, status.Error(codes.Unimplemented, "not implemented yet")
 	}
 
-	b := mailprovider.Base{
-		ID:   in.UID,
-		Type: in.Type,
-		Name: in.Name,
+	// Verify that the input config is valid - the validate function checks if the input is nil.
+	if err := f.Validate(&in.Config); err != nil {
+		return mailprovider.Base{}, err
 	}
 
-	// Check if the unique identifier was provided and generate a random one if it is empty.
-	if b.ID == "" {
-		b.ID = uuid.New().String()
+	if f.NewBase != nil {
+		return f.NewBase(in)
 	}
-
-	// Check if the name is empty and generate a random one if it is.
-	if b.Name == "" {
-		b.Name = fmt.Sprintf("%s %s", in.Type.String(), randomdata.SillyName())
-	}
-
-	addr, err := mail.ParseAddress(in.FromAddress)
-	if err != nil {
-		return mailprovider.Base{}, status.Error(codes.InvalidArgument, "invalid from address")
-	}
-	b.FromAddress = addr
-
-	return b, nil
+	return mailprovider.NewBase(in)
 }
 
 // LoadProvider loads a provider from the given configuration.
 func (m *Manager) LoadProvider(ctx context.Context, def mailprovider.MailingProviderDefinition) (mailprovider.Provider, error) {
-	switch def.Type {
-	case mailingadminv1.SMTP:
-		return smtpmailprovider.New(m.sc, def, m.log)
-	default:
+	f, ok := m.r.Lookup(def.Type)
+	if !ok {
 		return nil, status.Error(codes.Unimplemented, "not implemented yet")
 	}
+	return f.New(ctx, def, m.log)
+}
+
+// Registry returns the registry of the provider factories, the custom provider types could be registered to it.
+func (m *Manager) Registry() *mailprovider.Registry {
+	return m.r
 }
 
 // ReplaceCurrentProvider replaces the current provider with the given one.
@@ -0,0 +1,34 @@
+package mailprovidermanager
+
+import (
+	"github.com/blockysource/mailing/logic/mailprovider"
+	filemailprovider "github.com/blockysource/mailing/logic/mailprovider/file"
+	mailgunmailprovider "github.com/blockysource/mailing/logic/mailprovider/mailgun"
+	postmarkmailprovider "github.com/blockysource/mailing/logic/mailprovider/postmark"
+	sendgridmailprovider "github.com/blockysource/mailing/logic/mailprovider/sendgrid"
+	sendmailmailprovider "github.com/blockysource/mailing/logic/mailprovider/sendmail"
+	sesmailprovider "github.com/blockysource/mailing/logic/mailprovider/ses"
+	smtpmailprovider "github.com/blockysource/mailing/logic/mailprovider/smtp"
+)
+
+// NewRegistry creates the registry with the factories of the built-in provider types.
+func NewRegistry(sc *smtpmailprovider.SMTPProvidersConfig) (*mailprovider.Registry, error) {
+	r := mailprovider.NewRegistry()
+	if err := smtpmailprovider.Register(r, sc); err != nil {
+		return nil, err
+	}
+
+	for _, register := range []func(*mailprovider.Registry) error{
+		sendgridmailprovider.Register,
+		sesmailprovider.Register,
+		mailgunmailprovider.Register,
+		postmarkmailprovider.Register,
+		sendmailmailprovider.Register,
+		filemailprovider.Register,
+	} {
+		if err := register(r); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
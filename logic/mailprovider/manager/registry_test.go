@@ -0,0 +1,111 @@
+package mailprovidermanager
+
+import (
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	mailingadminv1 "github.com/blockysource/go-genproto/blockyapis/mailing/admin/v1alpha"
+)
+
+// builtInTypes are the provider types registered by the NewRegistry.
+var builtInTypes = []mailingadminv1.MailingProviderType{
+	mailingadminv1.MailingProviderType_SMTP,
+	mailingadminv1.MailingProviderType_MX,
+	mailingadminv1.MailingProviderType_LMTP,
+	mailingadminv1.MailingProviderType_SENDGRID,
+	mailingadminv1.MailingProviderType_SES,
+	mailingadminv1.MailingProviderType_MAILGUN,
+	mailingadminv1.MailingProviderType_POSTMARK,
+	mailingadminv1.MailingProviderType_SENDMAIL,
+	mailingadminv1.MailingProviderType_FILE,
+}
+
+// setField sets the field at the path to a non-zero value, the messages on the way are created
+// and the repeated message fields get a single element.
+func setField(t *testing.T, m protoreflect.Message, path []string) {
+	t.Helper()
+
+	fd := m.Descriptor().Fields().ByName(protoreflect.Name(path[0]))
+	if fd == nil {
+		t.Fatalf("unknown field %s of %s", path[0], m.Descriptor().FullName())
+	}
+	if len(path) > 1 {
+		if fd.IsList() {
+			l := m.Mutable(fd).List()
+			e := l.NewElement()
+			l.Append(e)
+			setField(t, e.Message(), path[1:])
+			return
+		}
+		setField(t, m.Mutable(fd).Message(), path[1:])
+		return
+	}
+
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		m.Set(fd, protoreflect.ValueOfString("secret"))
+	case protoreflect.BytesKind:
+		m.Set(fd, protoreflect.ValueOfBytes([]byte("secret")))
+	case protoreflect.MessageKind:
+		m.Mutable(fd)
+	default:
+		t.Fatalf("unsupported secret field kind %s of %s", fd.Kind(), fd.FullName())
+	}
+}
+
+// fieldSet reports whether the field at the path is set, in any of the repeated message field elements.
+func fieldSet(m protoreflect.Message, path []string) bool {
+	fd := m.Descriptor().Fields().ByName(protoreflect.Name(path[0]))
+	if fd == nil || !m.Has(fd) {
+		return false
+	}
+	if len(path) == 1 {
+		return true
+	}
+
+	if fd.IsList() {
+		l := m.Get(fd).List()
+		for i := 0; i < l.Len(); i++ {
+			if fieldSet(l.Get(i).Message(), path[1:]) {
+				return true
+			}
+		}
+		return false
+	}
+	return fieldSet(m.Get(fd).Message(), path[1:])
+}
+
+func TestNewRegistry_SecretFields(t *testing.T) {
+	// The registration checks that the secret field paths of each factory resolve to the config fields.
+	r, err := NewRegistry(nil)
+	if err != nil {
+		t.Fatalf("failed to create registry: %v", err)
+	}
+
+	for _, pt := range builtInTypes {
+		t.Run(pt.String(), func(t *testing.T) {
+			f, ok := r.Lookup(pt)
+			if !ok {
+				t.Fatalf("provider type %s is not registered", pt)
+			}
+
+			for _, path := range f.SecretFields {
+				cfg := &mailingadminv1.MailingProviderConfig{}
+				setField(t, cfg.ProtoReflect(), strings.Split(path, "."))
+				orig := proto.Clone(cfg)
+
+				redacted := r.Redact(pt, cfg)
+				if fieldSet(redacted.ProtoReflect(), strings.Split(path, ".")) {
+					t.Errorf("secret field %s is not cleared", path)
+				}
+				// The input config is left intact.
+				if !proto.Equal(cfg, orig) {
+					t.Errorf("redact of %s modified the input config", path)
+				}
+			}
+		})
+	}
+}
@@ -25,6 +25,7 @@ func New(d *mailing.Dependencies) (*Manager, error) {
 		}),
 		providers.FieldsLogrusEntry,
 		smtpprovider.NewSMTPProvidersConfig,
+		NewRegistry,
 		wire.Struct(new(Manager), "*"),
 	)
 	return nil, nil
@@ -37,9 +37,13 @@ func New(d *mailing.Dependencies) (*Manager, error) {
 	if err != nil {
 		return nil, err
 	}
+	registry, err := NewRegistry(smtpProvidersConfig)
+	if err != nil {
+		return nil, err
+	}
 	manager := &Manager{
 		log: entry,
-		sc:  smtpProvidersConfig,
+		r:   registry,
 	}
 	return manager, nil
 }
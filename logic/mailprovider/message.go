@@ -0,0 +1,95 @@
+package mailprovider
+
+import (
+	"context"
+	"io"
+	"net/mail"
+)
+
+// Message is an email message sent by the mailing providers.
+type Message struct {
+	// ID is the unique identifier of the message.
+	ID string
+	// From is the sender address of the message.
+	From *mail.Address
+	// ReplyTo are the addresses the replies to the message should be sent to.
+	ReplyTo []*mail.Address
+	// To are the primary recipients of the message.
+	To []*mail.Address
+	// Cc are the carbon copy recipients of the message.
+	Cc []*mail.Address
+	// Bcc are the blind carbon copy recipients of the message.
+	// They are only used for the envelope and never written to the message headers.
+	Bcc []*mail.Address
+	// Subject is the subject of the message.
+	Subject string
+	// Body is the content of the message.
+	Body string
+	// TextBody is an optional plain text alternative of the Body.
+	// If it is set, the message is sent as multipart/alternative with the Body as the preferred part.
+	TextBody string
+	// ContentType is the content type of the message body.
+	ContentType string
+	// Attachments are the files attached to the message.
+	Attachments []Attachment
+	// Inline are the assets embedded in the Body, referenced by their ContentID.
+	Inline []Attachment
+	// DSN are the optional delivery status notification options of the message.
+	DSN *DSN
+}
+
+// DSNNotify is a set of the conditions on which the delivery status notification is requested (RFC 3461).
+type DSNNotify int
+
+const (
+	// DSNNotifySuccess requests the notification on the successful delivery.
+	DSNNotifySuccess DSNNotify = 1 << iota
+	// DSNNotifyFailure requests the notification on the delivery failure.
+	DSNNotifyFailure
+	// DSNNotifyDelay requests the notification on the delayed delivery.
+	DSNNotifyDelay
+)
+
+// DSNReturn is the part of the message returned with the delivery status notification.
+type DSNReturn int
+
+const (
+	// DSNReturnDefault leaves the returned part to the server.
+	DSNReturnDefault DSNReturn = iota
+	// DSNReturnHeaders returns only the message headers.
+	DSNReturnHeaders
+	// DSNReturnFull returns the full message.
+	DSNReturnFull
+)
+
+// DSN are the delivery status notification options of the message.
+type DSN struct {
+	// Notify are the conditions on which the notification is sent, if empty the server default is used.
+	Notify DSNNotify
+	// Return is the part of the message returned with the failure notification.
+	Return DSNReturn
+	// EnvelopeID is the identifier returned with the notification, so that it could be correlated with the message.
+	EnvelopeID string
+}
+
+// Attachment is a file attached to the message.
+type Attachment struct {
+	// Filename is the name of the attached file.
+	Filename string
+	// ContentType is the content type of the attached file.
+	ContentType string
+	// ContentID is the Content-ID of the inline attachment, without the angle brackets.
+	ContentID string
+	// Open opens the attachment content with the context of the send, so that it could be streamed
+	// without loading it into memory.
+	Open func(ctx context.Context) (io.ReadCloser, error)
+}
+
+// Recipients returns all the envelope recipients of the message.
+func (m *Message) Recipients() []*mail.Address {
+	rcpts := make([]*mail.Address, 0, len(m.To)+len(m.Cc)+len(m.Bcc))
+	rcpts = append(rcpts, m.To...)
+	rcpts = append(rcpts, m.Cc...)
+	rcpts = append(rcpts, m.Bcc...)
+	return rcpts
+}
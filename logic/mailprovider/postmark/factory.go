@@ -0,0 +1,28 @@
+package postmarkmailprovider
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
+	mailprovider2 "github.com/blockysource/mailing/logic/mailprovider"
+)
+
+// Register registers the factory of the Postmark providers.
+func Register(r *mailprovider2.Registry) error {
+	return r.Register(mailprovider2.Factory{
+		Type: mailingpb.POSTMARK,
+		Validate: func(cfg *mailingpb.MailingProviderConfig) error {
+			return cfg.GetPostmarkConfig().Validate()
+		},
+		New: func(_ context.Context, def mailprovider2.MailingProviderDefinition, log *logrus.Entry) (mailprovider2.Provider, error) {
+			p, err := New(def, log)
+			if err != nil {
+				return nil, err
+			}
+			return p, nil
+		},
+		SecretFields: []string{"postmark_config.server_token"},
+	})
+}
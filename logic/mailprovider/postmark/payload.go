@@ -0,0 +1,131 @@
+package postmarkmailprovider
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"strings"
+
+	mailprovider2 "github.com/blockysource/mailing/logic/mailprovider"
+)
+
+// email is the payload of the single email send request.
+type email struct {
+	From          string            `json:"From"`
+	To            string            `json:"To"`
+	Cc            string            `json:"Cc,omitempty"`
+	Bcc           string            `json:"Bcc,omitempty"`
+	ReplyTo       string            `json:"ReplyTo,omitempty"`
+	Subject       string            `json:"Subject"`
+	HtmlBody      string            `json:"HtmlBody,omitempty"`
+	TextBody      string            `json:"TextBody,omitempty"`
+	Attachments   []attachment      `json:"Attachments,omitempty"`
+	Metadata      map[string]string `json:"Metadata,omitempty"`
+	MessageStream string            `json:"MessageStream,omitempty"`
+}
+
+type attachment struct {
+	Name        string `json:"Name"`
+	Content     string `json:"Content"`
+	ContentType string `json:"ContentType"`
+	ContentID   string `json:"ContentID,omitempty"`
+}
+
+// newEmail maps the message to the email send payload.
+// The invalid message fails permanently, while the failure to read the attachment content is temporary,
+// as the attachment store might recover.
+func newEmail(ctx context.Context, msg *mailprovider2.Message, stream string) (*email, error) {
+	if msg.From == nil {
+		return nil, mailprovider2.ErrPermanent(errors.New("message has no from address"))
+	}
+	if len(msg.To) == 0 {
+		return nil, mailprovider2.ErrPermanent(errors.New("message has no primary recipients"))
+	}
+
+	e := email{
+		From:          msg.From.String(),
+		To:            joinAddresses(msg.To),
+		Cc:            joinAddresses(msg.Cc),
+		Bcc:           joinAddresses(msg.Bcc),
+		ReplyTo:       joinAddresses(msg.ReplyTo),
+		Subject:       msg.Subject,
+		TextBody:      msg.TextBody,
+		MessageStream: stream,
+	}
+
+	// The metadata is passed back in the webhooks, so that the events could be correlated with the message.
+	if msg.ID != "" {
+		e.Metadata = map[string]string{"msg_id": msg.ID}
+	}
+
+	if mediaType(msg.ContentType) == "text/plain" {
+		if e.TextBody == "" {
+			e.TextBody = msg.Body
+		}
+	} else {
+		e.HtmlBody = msg.Body
+	}
+
+	for _, a := range msg.Attachments {
+		att, err := newAttachment(ctx, a, "")
+		if err != nil {
+			return nil, err
+		}
+		e.Attachments = append(e.Attachments, att)
+	}
+	for _, a := range msg.Inline {
+		att, err := newAttachment(ctx, a, "cid:"+a.ContentID)
+		if err != nil {
+			return nil, err
+		}
+		e.Attachments = append(e.Attachments, att)
+	}
+	return &e, nil
+}
+
+// joinAddresses returns the comma separated list of the addresses.
+func joinAddresses(addrs []*mail.Address) string {
+	out := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		out = append(out, addr.String())
+	}
+	return strings.Join(out, ", ")
+}
+
+// newAttachment reads the attachment content and encodes it with the base64.
+func newAttachment(ctx context.Context, a mailprovider2.Attachment, contentID string) (attachment, error) {
+	rc, err := a.Open(ctx)
+	if err != nil {
+		return attachment{}, mailprovider2.ErrTemporary(fmt.Errorf("failed to open attachment %s: %w", a.Filename, err))
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return attachment{}, mailprovider2.ErrTemporary(fmt.Errorf("failed to read attachment %s: %w", a.Filename, err))
+	}
+
+	contentType := a.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return attachment{
+		Name:        a.Filename,
+		Content:     base64.StdEncoding.EncodeToString(data),
+		ContentType: contentType,
+		ContentID:   contentID,
+	}, nil
+}
+
+// mediaType returns the media type of the content type without its parameters, defaulting to text/html.
+func mediaType(contentType string) string {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "text/html"
+	}
+	return mt
+}
@@ -0,0 +1,318 @@
+package postmarkmailprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
+	mailprovider2 "github.com/blockysource/mailing/logic/mailprovider"
+)
+
+// DefaultBaseURL is the base URL of the Postmark API.
+const DefaultBaseURL = "https://api.postmarkapp.com"
+
+// DefaultMessageStream is the transactional message stream every Postmark server is created with.
+const DefaultMessageStream = "outbound"
+
+// inboundStreamType is the type of the message stream that receives the messages, it cannot be used for sending.
+const inboundStreamType = "Inbound"
+
+// The API error codes, that are mapped to the error categories. The full list is available at:
+// https://postmarkapp.com/developer/api/overview#error-codes
+const (
+	errCodeSenderSignatureNotFound     = 400
+	errCodeSenderSignatureNotConfirmed = 401
+	errCodeNotAllowedToSend            = 405
+	errCodeInactiveRecipient           = 406
+	errCodeAccountPending              = 412
+)
+
+// Compile-time check to verify implements interface.
+var _ mailprovider2.Provider = (*PostmarkProvider)(nil)
+
+// PostmarkProvider is a provider that sends emails with the Postmark email API.
+type PostmarkProvider struct {
+	l sync.RWMutex
+
+	p           mailprovider2.MailingProviderDefinition
+	fromAddress *mail.Address
+	cfg         mailingpb.PostmarkConfig
+	log         *logrus.Entry
+	isVerified  bool
+	client      *http.Client
+}
+
+// New creates a new Postmark provider.
+func New(p mailprovider2.MailingProviderDefinition, log *logrus.Entry) (*PostmarkProvider, error) {
+	cfg := p.Config.GetPostmarkConfig()
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	return &PostmarkProvider{
+		p:      p,
+		cfg:    *cfg,
+		client: &http.Client{Timeout: 30 * time.Second},
+		log: log.WithFields(logrus.Fields{
+			"provider_id": p.UID,
+			"provider":    mailingpb.POSTMARK,
+		}),
+	}, nil
+}
+
+// Close closes the provider.
+func (s *PostmarkProvider) Close() {
+	s.client.CloseIdleConnections()
+}
+
+// GetID returns the ID of the provider.
+func (s *PostmarkProvider) GetID() string {
+	return s.p.UID
+}
+
+// GetDefinition returns the provider definition.
+func (s *PostmarkProvider) GetDefinition() mailprovider2.MailingProviderDefinition {
+	return s.p
+}
+
+// Type returns the type of the provider.
+func (s *PostmarkProvider) Type() mailingpb.MailingProviderType {
+	return mailingpb.POSTMARK
+}
+
+// IsVerified returns whether the provider is verified.
+func (s *PostmarkProvider) IsVerified() bool {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	return s.isVerified
+}
+
+// UpdateConfig updates the config of the provider.
+func (s *PostmarkProvider) UpdateConfig(config *mailingpb.MailingProviderConfig) error {
+	cfg := config.GetPostmarkConfig()
+	if cfg == nil {
+		return fmt.Errorf("invalid config type: %T", config)
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	s.l.Lock()
+	s.cfg = *cfg
+	s.l.Unlock()
+	return nil
+}
+
+// GetConfig returns the config of the provider.
+func (s *PostmarkProvider) GetConfig() mailingpb.MailingProviderConfig {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	cfg := s.cfg
+	return mailingpb.MailingProviderConfig{
+		Config: &mailingpb.MailingProviderConfig_PostmarkConfig{
+			PostmarkConfig: &cfg,
+		},
+	}
+}
+
+// GetDefaultFromAddress returns the default from address.
+func (s *PostmarkProvider) GetDefaultFromAddress() *mail.Address {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	return s.fromAddress
+}
+
+// Send lets the provider send the input message.
+// The API accepts or rejects the message as a whole, so that all the recipients share the same result.
+func (s *PostmarkProvider) Send(ctx context.Context, msg *mailprovider2.Message) (*mailprovider2.SendResult, error) {
+	payload, err := newEmail(ctx, msg, s.messageStream())
+	if err != nil {
+		s.log.WithFields(logrus.Fields{
+			"msg_id":        msg.ID,
+			logrus.ErrorKey: err,
+		}).Debug("failed to prepare message")
+		return nil, err
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, mailprovider2.ErrPermanent(fmt.Errorf("failed to encode message: %w", err))
+	}
+
+	resp, err := s.do(ctx, http.MethodPost, "/email", body)
+	if err != nil {
+		s.log.WithFields(logrus.Fields{
+			"msg_id":        msg.ID,
+			logrus.ErrorKey: err,
+		}).Debug("failed to send message")
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = responseErr(resp)
+		s.log.WithFields(logrus.Fields{
+			"msg_id":        msg.ID,
+			"status":        resp.StatusCode,
+			logrus.ErrorKey: err,
+		}).Debug("postmark rejected the message")
+		return nil, err
+	}
+
+	var out struct {
+		MessageID string `json:"MessageID"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&out); err != nil {
+		// The message was accepted, only the identifier is missing.
+		s.log.WithError(err).Debug("failed to decode postmark response")
+	}
+
+	res := &mailprovider2.SendResult{MessageID: out.MessageID}
+	for _, rcpt := range msg.Recipients() {
+		res.Recipients = append(res.Recipients, mailprovider2.RecipientResult{
+			Address: rcpt.Address,
+			Status:  mailprovider2.RecipientAccepted,
+		})
+	}
+
+	s.log.WithFields(logrus.Fields{
+		"msg_id":            msg.ID,
+		"postmark_msg_id":   res.MessageID,
+		"recipients_number": len(res.Recipients),
+	}).Debug("email message sent successfully")
+	return res, nil
+}
+
+// Verify verifies that the server token is valid and the configured message stream could be used for sending.
+func (s *PostmarkProvider) Verify(ctx context.Context) error {
+	stream := s.messageStream()
+
+	resp, err := s.do(ctx, http.MethodGet, "/message-streams/"+url.PathEscape(stream), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = responseErr(resp)
+		s.log.WithError(err).Debug("failed to verify postmark message stream")
+		return err
+	}
+
+	var out struct {
+		MessageStreamType string  `json:"MessageStreamType"`
+		ArchivedAt        *string `json:"ArchivedAt"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&out); err != nil {
+		return fmt.Errorf("failed to decode postmark message stream: %w", err)
+	}
+	if out.MessageStreamType == inboundStreamType {
+		return fmt.Errorf("postmark message stream %s is an inbound stream", stream)
+	}
+	if out.ArchivedAt != nil {
+		return fmt.Errorf("postmark message stream %s is archived", stream)
+	}
+
+	s.l.Lock()
+	s.isVerified = true
+	s.l.Unlock()
+	return nil
+}
+
+// messageStream returns the configured message stream, or the default one.
+func (s *PostmarkProvider) messageStream() string {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	if s.cfg.MessageStream == "" {
+		return DefaultMessageStream
+	}
+	return s.cfg.MessageStream
+}
+
+// do sends the authorized request to the Postmark API.
+func (s *PostmarkProvider) do(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	s.l.RLock()
+	baseURL := s.cfg.BaseURL
+	token := s.cfg.ServerToken.UnsafeString()
+	s.l.RUnlock()
+
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(baseURL, "/")+path, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Postmark-Server-Token", token)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		// The request might not have reached the API, so that it could be retried.
+		return nil, mailprovider2.ErrTemporary(fmt.Errorf("postmark request failed: %w", err))
+	}
+	return resp, nil
+}
+
+// maxResponseSize is the maximum size of the API response body that is read.
+const maxResponseSize = 1 << 20
+
+// responseErr returns the error of the failed API response.
+// The API returns the 422 status for all the rejected requests, the reason is given by the error code.
+func responseErr(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+
+	var apiErr struct {
+		ErrorCode int    `json:"ErrorCode"`
+		Message   string `json:"Message"`
+	}
+	msg := strings.TrimSpace(string(body))
+	if err := json.Unmarshal(body, &apiErr); err == nil && apiErr.Message != "" {
+		msg = fmt.Sprintf("%d %s", apiErr.ErrorCode, apiErr.Message)
+	}
+	if msg == "" {
+		msg = resp.Status
+	}
+
+	cause := errors.New("postmark: " + msg)
+	if resp.StatusCode == http.StatusUnprocessableEntity {
+		switch apiErr.ErrorCode {
+		case errCodeNotAllowedToSend:
+			// The account has run out of credits, the messages could be sent once these are added.
+			return &mailprovider2.Error{Temporary: true, Err: cause, Code: resp.StatusCode, Category: mailprovider2.CategoryQuotaExceeded, Message: msg}
+		case errCodeSenderSignatureNotFound, errCodeSenderSignatureNotConfirmed, errCodeInactiveRecipient, errCodeAccountPending:
+			return &mailprovider2.Error{Err: cause, Code: resp.StatusCode, Category: mailprovider2.CategoryPolicy, Message: msg}
+		}
+	}
+
+	err := mailprovider2.ErrHTTPStatus(resp.StatusCode, cause)
+	var e *mailprovider2.Error
+	if errors.As(err, &e) {
+		e.Message = msg
+	}
+	return err
+}
@@ -0,0 +1,266 @@
+package postmarkmailprovider_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
+	mailprovider2 "github.com/blockysource/mailing/logic/mailprovider"
+	postmarkmailprovider "github.com/blockysource/mailing/logic/mailprovider/postmark"
+)
+
+// newTestProvider creates the provider which requests are served by the handler.
+func newTestProvider(t *testing.T, stream string, h http.HandlerFunc) *postmarkmailprovider.PostmarkProvider {
+	t.Helper()
+
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	cfg := &mailingpb.PostmarkConfig{
+		ServerToken:   "server-token",
+		MessageStream: stream,
+		BaseURL:       srv.URL,
+	}
+
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	p, err := postmarkmailprovider.New(mailprovider2.MailingProviderDefinition{
+		UID:    "postmark",
+		Config: &mailingpb.MailingProviderConfig{Config: &mailingpb.MailingProviderConfig_PostmarkConfig{PostmarkConfig: cfg}},
+	}, logrus.NewEntry(log))
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+	t.Cleanup(p.Close)
+	return p
+}
+
+func testMessage() *mailprovider2.Message {
+	return &mailprovider2.Message{
+		ID:          "msg-1",
+		From:        &mail.Address{Address: "sender@example.org"},
+		To:          []*mail.Address{{Address: "to@example.com"}},
+		Bcc:         []*mail.Address{{Address: "bcc@example.com"}},
+		Subject:     "Hello",
+		Body:        "<p>Hello</p>",
+		ContentType: "text/html; charset=utf-8",
+	}
+}
+
+func TestPostmarkProvider_Send(t *testing.T) {
+	tests := []struct {
+		name       string
+		stream     string
+		wantStream string
+	}{
+		{name: "default stream", wantStream: postmarkmailprovider.DefaultMessageStream},
+		{name: "configured stream", stream: "broadcast", wantStream: "broadcast"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var payload map[string]any
+			p := newTestProvider(t, tc.stream, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost || r.URL.Path != "/email" {
+					t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+				}
+				if got := r.Header.Get("X-Postmark-Server-Token"); got != "server-token" {
+					t.Errorf("got server token %q, want server-token", got)
+				}
+				if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+					t.Errorf("failed to decode payload: %v", err)
+				}
+				io.WriteString(w, `{"To":"to@example.com","MessageID":"b7bc2f4a-e38e-4336-af7d-e6c392c2f817","ErrorCode":0,"Message":"OK"}`)
+			})
+
+			res, err := p.Send(context.Background(), testMessage())
+			if err != nil {
+				t.Fatalf("send failed: %v", err)
+			}
+
+			if payload["MessageStream"] != tc.wantStream {
+				t.Errorf("got message stream %v, want %s", payload["MessageStream"], tc.wantStream)
+			}
+			if payload["Bcc"] != "<bcc@example.com>" || payload["HtmlBody"] != "<p>Hello</p>" {
+				t.Errorf("unexpected payload: %v", payload)
+			}
+			if md, _ := payload["Metadata"].(map[string]any); md["msg_id"] != "msg-1" {
+				t.Errorf("got metadata %v, want msg_id", payload["Metadata"])
+			}
+
+			if res.MessageID != "b7bc2f4a-e38e-4336-af7d-e6c392c2f817" {
+				t.Errorf("got message id %q", res.MessageID)
+			}
+			if len(res.Accepted()) != 2 {
+				t.Errorf("unexpected recipient results: %+v", res.Recipients)
+			}
+		})
+	}
+}
+
+func TestPostmarkProvider_Send_Errors(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		auth      bool
+		temporary bool
+		category  mailprovider2.ErrorCategory
+	}{
+		{name: "unauthorized", status: http.StatusUnauthorized, body: `{"ErrorCode":10,"Message":"No Account or Server API tokens were supplied in the HTTP headers."}`, auth: true},
+		{name: "rate limited", status: http.StatusTooManyRequests, temporary: true, category: mailprovider2.CategoryRateLimited},
+		{name: "server error", status: http.StatusInternalServerError, temporary: true},
+		{name: "unavailable", status: http.StatusServiceUnavailable, temporary: true},
+		{
+			name:     "sender signature not found",
+			status:   http.StatusUnprocessableEntity,
+			body:     `{"ErrorCode":400,"Message":"The 'From' address you supplied is not a Sender Signature on your account."}`,
+			category: mailprovider2.CategoryPolicy,
+		},
+		{
+			name:     "sender signature not confirmed",
+			status:   http.StatusUnprocessableEntity,
+			body:     `{"ErrorCode":401,"Message":"Sender signature not confirmed."}`,
+			category: mailprovider2.CategoryPolicy,
+		},
+		{
+			name:      "not allowed to send",
+			status:    http.StatusUnprocessableEntity,
+			body:      `{"ErrorCode":405,"Message":"You have run out of credits."}`,
+			temporary: true,
+			category:  mailprovider2.CategoryQuotaExceeded,
+		},
+		{
+			name:     "inactive recipient",
+			status:   http.StatusUnprocessableEntity,
+			body:     `{"ErrorCode":406,"Message":"You tried to send to a recipient that has been marked as inactive."}`,
+			category: mailprovider2.CategoryPolicy,
+		},
+		{
+			name:     "account pending",
+			status:   http.StatusUnprocessableEntity,
+			body:     `{"ErrorCode":412,"Message":"Your account is pending approval."}`,
+			category: mailprovider2.CategoryPolicy,
+		},
+		{
+			name:   "invalid request",
+			status: http.StatusUnprocessableEntity,
+			body:   `{"ErrorCode":300,"Message":"Invalid email request."}`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestProvider(t, "", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				io.WriteString(w, tc.body)
+			})
+
+			_, err := p.Send(context.Background(), testMessage())
+			if err == nil {
+				t.Fatal("send succeeded, want error")
+			}
+
+			var authErr *mailprovider2.AuthErr
+			if tc.auth {
+				if !errors.As(err, &authErr) {
+					t.Fatalf("got %T %v, want auth error", err, err)
+				}
+				return
+			}
+
+			var e *mailprovider2.Error
+			if !errors.As(err, &e) {
+				t.Fatalf("got %T %v, want mailprovider error", err, err)
+			}
+			if e.Temporary != tc.temporary || e.Category != tc.category || e.Code != tc.status {
+				t.Errorf("got temporary %t category %s code %d, want %t %s %d", e.Temporary, e.Category, e.Code, tc.temporary, tc.category, tc.status)
+			}
+		})
+	}
+}
+
+func TestPostmarkProvider_Send_AttachmentError(t *testing.T) {
+	var requests int
+	p := newTestProvider(t, "", func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	})
+
+	msg := testMessage()
+	msg.Attachments = []mailprovider2.Attachment{{
+		Filename:    "report.pdf",
+		ContentType: "application/pdf",
+		Open: func(context.Context) (io.ReadCloser, error) {
+			return nil, errors.New("store unavailable")
+		},
+	}}
+
+	_, err := p.Send(context.Background(), msg)
+	var e *mailprovider2.Error
+	if !errors.As(err, &e) || !e.Temporary {
+		t.Fatalf("got %v, want temporary error", err)
+	}
+	if requests != 0 {
+		t.Fatalf("got %d requests, want none", requests)
+	}
+
+	// The invalid message is rejected permanently.
+	msg.To = nil
+	_, err = p.Send(context.Background(), msg)
+	if !errors.As(err, &e) || e.Temporary {
+		t.Fatalf("got %v, want permanent error", err)
+	}
+}
+
+func TestPostmarkProvider_Verify(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		verified bool
+		auth     bool
+	}{
+		{name: "transactional", status: http.StatusOK, body: `{"ID":"outbound","MessageStreamType":"Transactional","ArchivedAt":null}`, verified: true},
+		{name: "broadcasts", status: http.StatusOK, body: `{"ID":"outbound","MessageStreamType":"Broadcasts","ArchivedAt":null}`, verified: true},
+		{name: "inbound", status: http.StatusOK, body: `{"ID":"outbound","MessageStreamType":"Inbound","ArchivedAt":null}`},
+		{name: "archived", status: http.StatusOK, body: `{"ID":"outbound","MessageStreamType":"Transactional","ArchivedAt":"2023-10-17T10:00:00Z"}`},
+		{name: "not found", status: http.StatusUnprocessableEntity, body: `{"ErrorCode":1226,"Message":"The message stream for the provided 'ID' was not found."}`},
+		{name: "unauthorized", status: http.StatusUnauthorized, body: `{"ErrorCode":10,"Message":"Bad or missing Server API token."}`, auth: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestProvider(t, "", func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodGet || r.URL.Path != "/message-streams/outbound" {
+					t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+				}
+				if got := r.Header.Get("X-Postmark-Server-Token"); got != "server-token" {
+					t.Errorf("got server token %q, want server-token", got)
+				}
+				w.WriteHeader(tc.status)
+				io.WriteString(w, tc.body)
+			})
+
+			err := p.Verify(context.Background())
+			if tc.verified != (err == nil) {
+				t.Fatalf("got error %v, want verified %t", err, tc.verified)
+			}
+			if p.IsVerified() != tc.verified {
+				t.Fatalf("got verified %t, want %t", p.IsVerified(), tc.verified)
+			}
+
+			var authErr *mailprovider2.AuthErr
+			if tc.auth && !errors.As(err, &authErr) {
+				t.Fatalf("got %T %v, want auth error", err, err)
+			}
+		})
+	}
+}
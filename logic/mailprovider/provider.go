@@ -0,0 +1,34 @@
+package mailprovider
+
+import (
+	"context"
+	"net/mail"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
+)
+
+// Provider is the interface implemented by the mailing providers.
+type Provider interface {
+	// Close closes the provider.
+	Close()
+	// GetID returns the ID of the provider.
+	GetID() string
+	// GetDefinition returns the provider definition.
+	GetDefinition() MailingProviderDefinition
+	// Type returns the type of the provider.
+	Type() mailingpb.MailingProviderType
+	// IsVerified returns whether the provider is verified.
+	IsVerified() bool
+	// UpdateConfig updates the config of the provider.
+	UpdateConfig(config *mailingpb.MailingProviderConfig) error
+	// GetConfig returns the config of the provider.
+	GetConfig() mailingpb.MailingProviderConfig
+	// GetDefaultFromAddress returns the default from address.
+	GetDefaultFromAddress() *mail.Address
+	// Send lets the provider send the input message.
+	// The result lists the delivery outcome of each recipient, the message is delivered to the accepted ones
+	// even if some of the recipients were rejected.
+	Send(ctx context.Context, msg *Message) (*SendResult, error)
+	// Verify verifies the provider configuration.
+	Verify(ctx context.Context) error
+}
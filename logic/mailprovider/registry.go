@@ -0,0 +1,170 @@
+package mailprovider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/pallinder/go-randomdata"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	mailingadminv1 "github.com/blockysource/go-genproto/blockyapis/mailing/admin/v1alpha"
+)
+
+// Factory creates the providers of a single type.
+type Factory struct {
+	// Type is the type of the providers created by the factory.
+	Type mailingadminv1.MailingProviderType
+	// Validate validates the provider config, it needs to fail if the config of the provider type is not set.
+	Validate func(cfg *mailingadminv1.MailingProviderConfig) error
+	// NewBase builds the provider base from the create request with the validated config.
+	// If it is not set, the NewBase function is used.
+	NewBase func(in *mailingadminv1.CreateMailingProviderRequest) (Base, error)
+	// New creates the provider from its definition.
+	New func(ctx context.Context, def MailingProviderDefinition, log *logrus.Entry) (Provider, error)
+	// SecretFields are the paths of the config fields holding the secrets, made of the proto field names
+	// separated with dots and starting at the provider config, i.e. "smtp_config.password".
+	// The repeated message fields apply the rest of the path to each of their elements.
+	SecretFields []string
+}
+
+// Registry holds the provider factories by their type, it is safe for the concurrent use.
+type Registry struct {
+	l         sync.RWMutex
+	factories map[mailingadminv1.MailingProviderType]Factory
+}
+
+// NewRegistry creates a new empty registry.
+func NewRegistry() *Registry {
+	return &Registry{factories: make(map[mailingadminv1.MailingProviderType]Factory)}
+}
+
+// Register registers the factory of the provider type, each type could be registered only once.
+func (r *Registry) Register(f Factory) error {
+	if f.Validate == nil || f.New == nil {
+		return fmt.Errorf("provider factory of type %s has no validate or new function", f.Type)
+	}
+	cd := (&mailingadminv1.MailingProviderConfig{}).ProtoReflect().Descriptor()
+	for _, path := range f.SecretFields {
+		if err := checkFieldPath(cd, path); err != nil {
+			return fmt.Errorf("provider factory of type %s: %w", f.Type, err)
+		}
+	}
+
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	if _, ok := r.factories[f.Type]; ok {
+		return fmt.Errorf("provider factory of type %s is already registered", f.Type)
+	}
+	f.SecretFields = append([]string(nil), f.SecretFields...)
+	r.factories[f.Type] = f
+	return nil
+}
+
+// Lookup returns the factory of the provider type.
+func (r *Registry) Lookup(t mailingadminv1.MailingProviderType) (Factory, bool) {
+	r.l.RLock()
+	defer r.l.RUnlock()
+
+	f, ok := r.factories[t]
+	return f, ok
+}
+
+// Redact returns the copy of the config with the secret fields of the provider type cleared.
+// The config of the provider type that is not registered is cleared entirely, as its secrets are unknown.
+func (r *Registry) Redact(t mailingadminv1.MailingProviderType, cfg *mailingadminv1.MailingProviderConfig) *mailingadminv1.MailingProviderConfig {
+	if cfg == nil {
+		return nil
+	}
+
+	f, ok := r.Lookup(t)
+	if !ok {
+		return &mailingadminv1.MailingProviderConfig{}
+	}
+
+	out := proto.Clone(cfg).(*mailingadminv1.MailingProviderConfig)
+	for _, path := range f.SecretFields {
+		clearField(out.ProtoReflect(), strings.Split(path, "."))
+	}
+	return out
+}
+
+// NewBase builds the provider base from the create request, generating its identifier and name if they are not set.
+func NewBase(in *mailingadminv1.CreateMailingProviderRequest) (Base, error) {
+	b := Base{
+		ID:   in.UID,
+		Type: in.Type,
+		Name: in.Name,
+	}
+
+	// Check if the unique identifier was provided and generate a random one if it is empty.
+	if b.ID == "" {
+		b.ID = uuid.New().String()
+	}
+
+	// Check if the name is empty and generate a random one if it is.
+	if b.Name == "" {
+		b.Name = fmt.Sprintf("%s %s", in.Type.String(), randomdata.SillyName())
+	}
+
+	addr, err := mail.ParseAddress(in.FromAddress)
+	if err != nil {
+		return Base{}, status.Error(codes.InvalidArgument, "invalid from address")
+	}
+	b.FromAddress = addr
+
+	return b, nil
+}
+
+// checkFieldPath checks if the path refers to an existing field of the message.
+func checkFieldPath(md protoreflect.MessageDescriptor, path string) error {
+	if path == "" {
+		return errors.New("empty secret field path")
+	}
+
+	names := strings.Split(path, ".")
+	for i, name := range names {
+		fd := md.Fields().ByName(protoreflect.Name(name))
+		if fd == nil {
+			return fmt.Errorf("unknown secret field %s", path)
+		}
+		if i == len(names)-1 {
+			return nil
+		}
+		if fd.Message() == nil || fd.IsMap() {
+			return fmt.Errorf("secret field path %s goes through the non-message field %s", path, name)
+		}
+		md = fd.Message()
+	}
+	return nil
+}
+
+// clearField clears the field at the path, the unset fields on the way are skipped.
+func clearField(m protoreflect.Message, path []string) {
+	fd := m.Descriptor().Fields().ByName(protoreflect.Name(path[0]))
+	if fd == nil || !m.Has(fd) {
+		return
+	}
+	if len(path) == 1 {
+		m.Clear(fd)
+		return
+	}
+
+	if fd.IsList() {
+		l := m.Mutable(fd).List()
+		for i := 0; i < l.Len(); i++ {
+			clearField(l.Get(i).Message(), path[1:])
+		}
+		return
+	}
+	clearField(m.Mutable(fd).Message(), path[1:])
+}
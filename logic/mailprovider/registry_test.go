@@ -0,0 +1,94 @@
+package mailprovider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
+	mailingadminv1 "github.com/blockysource/go-genproto/blockyapis/mailing/admin/v1alpha"
+)
+
+func TestCheckFieldPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		wantErr bool
+	}{
+		{path: "sendgrid_config.api_key"},
+		{path: "smtp_config.oauth2.client_secret"},
+		{path: "smtp_config.dkim_keys.private_key"},
+		{path: "", wantErr: true},
+		{path: "unknown_config", wantErr: true},
+		{path: "sendgrid_config.unknown", wantErr: true},
+	}
+
+	md := (&mailingadminv1.MailingProviderConfig{}).ProtoReflect().Descriptor()
+	for _, tc := range tests {
+		t.Run(tc.path, func(t *testing.T) {
+			if err := checkFieldPath(md, tc.path); (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func testFactory(secretFields ...string) Factory {
+	return Factory{
+		Type:     mailingadminv1.MailingProviderType_SENDGRID,
+		Validate: func(*mailingadminv1.MailingProviderConfig) error { return nil },
+		New: func(context.Context, MailingProviderDefinition, *logrus.Entry) (Provider, error) {
+			return nil, nil
+		},
+		SecretFields: secretFields,
+	}
+}
+
+func TestRegistry_Register(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Register(testFactory("sendgrid_config.api_key")); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	if _, ok := r.Lookup(mailingadminv1.MailingProviderType_SENDGRID); !ok {
+		t.Fatal("registered factory not found")
+	}
+	if _, ok := r.Lookup(mailingadminv1.MailingProviderType_SES); ok {
+		t.Fatal("found factory that is not registered")
+	}
+
+	// The type is registered only once.
+	if err := r.Register(testFactory()); err == nil {
+		t.Fatal("registered the same type twice")
+	}
+
+	// The factory without the functions or with the unknown secret field is rejected.
+	invalid := testFactory()
+	invalid.Type = mailingadminv1.MailingProviderType_SES
+	invalid.New = nil
+	if err := r.Register(invalid); err == nil {
+		t.Fatal("registered factory without the new function")
+	}
+	invalid = testFactory("ses_config.unknown")
+	invalid.Type = mailingadminv1.MailingProviderType_SES
+	if err := r.Register(invalid); err == nil {
+		t.Fatal("registered factory with unknown secret field")
+	}
+	if _, ok := r.Lookup(mailingadminv1.MailingProviderType_SES); ok {
+		t.Fatal("found factory that failed to register")
+	}
+}
+
+func TestRegistry_Redact_Unregistered(t *testing.T) {
+	r := NewRegistry()
+	if got := r.Redact(mailingadminv1.MailingProviderType_SES, nil); got != nil {
+		t.Fatalf("got %v, want nil", got)
+	}
+
+	// The secrets of the unknown type are unknown, so that nothing of its config is kept.
+	cfg := &mailingpb.MailingProviderConfig{Config: &mailingpb.MailingProviderConfig_SesConfig{
+		SesConfig: &mailingpb.SESConfig{Region: "eu-west-1"},
+	}}
+	if got := r.Redact(mailingadminv1.MailingProviderType_SES, cfg); got.GetSesConfig() != nil {
+		t.Fatalf("got %v, want empty config", got)
+	}
+}
@@ -0,0 +1,120 @@
+package mailprovider
+
+import (
+	"errors"
+	"fmt"
+)
+
+// RecipientStatus is the delivery status of the message recipient.
+type RecipientStatus int
+
+const (
+	// RecipientAccepted is the status of the recipient accepted by the provider.
+	RecipientAccepted RecipientStatus = iota
+	// RecipientTemporaryRejected is the status of the recipient temporarily rejected by the provider,
+	// the delivery to the recipient can be retried later.
+	RecipientTemporaryRejected
+	// RecipientPermanentRejected is the status of the recipient permanently rejected by the provider,
+	// the delivery to the recipient should not be retried.
+	RecipientPermanentRejected
+)
+
+// String returns the string representation of the status.
+func (s RecipientStatus) String() string {
+	switch s {
+	case RecipientAccepted:
+		return "accepted"
+	case RecipientTemporaryRejected:
+		return "temporary_rejected"
+	case RecipientPermanentRejected:
+		return "permanent_rejected"
+	default:
+		return fmt.Sprintf("RecipientStatus(%d)", int(s))
+	}
+}
+
+// RecipientResult is the delivery result of the message recipient.
+type RecipientResult struct {
+	// Address is the recipient email address.
+	Address string
+	// Status is the delivery status of the recipient.
+	Status RecipientStatus
+	// Code is the reply code returned by the server for the recipient, if any.
+	Code int
+	// EnhancedCode is the enhanced status code returned by the server for the recipient, if any.
+	EnhancedCode EnhancedStatusCode
+	// Category is the category of the recipient rejection.
+	Category ErrorCategory
+	// Message is the reply text returned by the server for the recipient, if any.
+	Message string
+}
+
+// DomainResult is the delivery result of the recipients of a single domain,
+// reported by the providers that deliver directly to the recipient domains.
+type DomainResult struct {
+	// Domain is the recipient domain.
+	Domain string
+	// Host is the mail exchanger the transaction was made with, empty if none could be reached.
+	Host string
+	// Err is the error of the delivery to the domain, nil if the transaction was completed.
+	Err error
+}
+
+// SendResult is the result of sending the message.
+type SendResult struct {
+	// MessageID is the identifier assigned to the message by the provider, if any.
+	// It is used to correlate the message with the events reported later by the provider.
+	MessageID string
+	// Recipients are the delivery results of each envelope recipient of the message.
+	Recipients []RecipientResult
+	// Domains are the delivery results of each recipient domain, if the provider delivers to the domains directly.
+	Domains []DomainResult
+}
+
+// Accepted returns the results of the accepted recipients.
+func (r *SendResult) Accepted() []RecipientResult {
+	return r.filter(func(rr RecipientResult) bool { return rr.Status == RecipientAccepted })
+}
+
+// Rejected returns the results of the rejected recipients.
+func (r *SendResult) Rejected() []RecipientResult {
+	return r.filter(func(rr RecipientResult) bool { return rr.Status != RecipientAccepted })
+}
+
+// Err returns the error if none of the recipients were accepted.
+// The error is temporary if any of the recipients was temporary rejected.
+func (r *SendResult) Err() error {
+	if len(r.Recipients) == 0 {
+		return ErrPermanent(errors.New("message has no recipients"))
+	}
+
+	first := r.Recipients[0]
+	temporary := false
+	for _, rr := range r.Recipients {
+		switch rr.Status {
+		case RecipientAccepted:
+			return nil
+		case RecipientTemporaryRejected:
+			temporary = true
+		}
+	}
+
+	return &Error{
+		Temporary:    temporary,
+		Err:          fmt.Errorf("all recipients rejected: %d %s", first.Code, first.Message),
+		Code:         first.Code,
+		EnhancedCode: first.EnhancedCode,
+		Category:     first.Category,
+		Message:      first.Message,
+	}
+}
+
+func (r *SendResult) filter(fn func(rr RecipientResult) bool) []RecipientResult {
+	var out []RecipientResult
+	for _, rr := range r.Recipients {
+		if fn(rr) {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
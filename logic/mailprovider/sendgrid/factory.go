@@ -0,0 +1,28 @@
+package sendgridmailprovider
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
+	mailprovider2 "github.com/blockysource/mailing/logic/mailprovider"
+)
+
+// Register registers the factory of the SendGrid providers.
+func Register(r *mailprovider2.Registry) error {
+	return r.Register(mailprovider2.Factory{
+		Type: mailingpb.SENDGRID,
+		Validate: func(cfg *mailingpb.MailingProviderConfig) error {
+			return cfg.GetSendgridConfig().Validate()
+		},
+		New: func(_ context.Context, def mailprovider2.MailingProviderDefinition, log *logrus.Entry) (mailprovider2.Provider, error) {
+			p, err := New(def, log)
+			if err != nil {
+				return nil, err
+			}
+			return p, nil
+		},
+		SecretFields: []string{"sendgrid_config.api_key"},
+	})
+}
@@ -0,0 +1,149 @@
+package sendgridmailprovider
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+
+	mailprovider2 "github.com/blockysource/mailing/logic/mailprovider"
+)
+
+// mailSend is the payload of the v3 mail send request.
+type mailSend struct {
+	Personalizations []personalization `json:"personalizations"`
+	From             emailAddress      `json:"from"`
+	ReplyToList      []emailAddress    `json:"reply_to_list,omitempty"`
+	Subject          string            `json:"subject"`
+	Content          []content         `json:"content"`
+	Attachments      []attachment      `json:"attachments,omitempty"`
+	CustomArgs       map[string]string `json:"custom_args,omitempty"`
+}
+
+type personalization struct {
+	To  []emailAddress `json:"to"`
+	Cc  []emailAddress `json:"cc,omitempty"`
+	Bcc []emailAddress `json:"bcc,omitempty"`
+}
+
+type emailAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type content struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type attachment struct {
+	Content     string `json:"content"`
+	Type        string `json:"type,omitempty"`
+	Filename    string `json:"filename"`
+	Disposition string `json:"disposition,omitempty"`
+	ContentID   string `json:"content_id,omitempty"`
+}
+
+// newMailSend maps the message to the mail send payload.
+// The invalid message fails permanently, while the failure to read the attachment content is temporary,
+// as the attachment store might recover.
+func newMailSend(ctx context.Context, msg *mailprovider2.Message) (*mailSend, error) {
+	if msg.From == nil {
+		return nil, mailprovider2.ErrPermanent(errors.New("message has no sender"))
+	}
+	if len(msg.To) == 0 {
+		return nil, mailprovider2.ErrPermanent(errors.New("message has no primary recipients"))
+	}
+
+	ms := mailSend{
+		Personalizations: []personalization{{
+			To:  emailAddresses(msg.To),
+			Cc:  emailAddresses(msg.Cc),
+			Bcc: emailAddresses(msg.Bcc),
+		}},
+		From:        emailAddress{Email: msg.From.Address, Name: msg.From.Name},
+		ReplyToList: emailAddresses(msg.ReplyTo),
+		Subject:     msg.Subject,
+	}
+
+	// The identifier is passed back in the event webhooks, so that the events could be correlated with the message.
+	if msg.ID != "" {
+		ms.CustomArgs = map[string]string{"msg_id": msg.ID}
+	}
+
+	// The plain text content needs to be the first one, and there could be only one of each type.
+	if mt := mediaType(msg.ContentType); mt == "text/plain" {
+		text := msg.TextBody
+		if text == "" {
+			text = msg.Body
+		}
+		ms.Content = append(ms.Content, content{Type: mt, Value: text})
+	} else {
+		if msg.TextBody != "" {
+			ms.Content = append(ms.Content, content{Type: "text/plain", Value: msg.TextBody})
+		}
+		ms.Content = append(ms.Content, content{Type: mt, Value: msg.Body})
+	}
+
+	for _, a := range msg.Attachments {
+		att, err := newAttachment(ctx, a, "attachment")
+		if err != nil {
+			return nil, err
+		}
+		ms.Attachments = append(ms.Attachments, att)
+	}
+	for _, a := range msg.Inline {
+		att, err := newAttachment(ctx, a, "inline")
+		if err != nil {
+			return nil, err
+		}
+		ms.Attachments = append(ms.Attachments, att)
+	}
+	return &ms, nil
+}
+
+func emailAddresses(addrs []*mail.Address) []emailAddress {
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	out := make([]emailAddress, 0, len(addrs))
+	for _, addr := range addrs {
+		out = append(out, emailAddress{Email: addr.Address, Name: addr.Name})
+	}
+	return out
+}
+
+// newAttachment reads the attachment content and encodes it with the base64.
+func newAttachment(ctx context.Context, a mailprovider2.Attachment, disposition string) (attachment, error) {
+	rc, err := a.Open(ctx)
+	if err != nil {
+		return attachment{}, mailprovider2.ErrTemporary(fmt.Errorf("failed to open attachment %s: %w", a.Filename, err))
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return attachment{}, mailprovider2.ErrTemporary(fmt.Errorf("failed to read attachment %s: %w", a.Filename, err))
+	}
+
+	return attachment{
+		Content:     base64.StdEncoding.EncodeToString(data),
+		Type:        a.ContentType,
+		Filename:    a.Filename,
+		Disposition: disposition,
+		ContentID:   a.ContentID,
+	}, nil
+}
+
+// mediaType returns the media type of the content type without its parameters, defaulting to text/html.
+func mediaType(contentType string) string {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "text/html"
+	}
+	return mt
+}
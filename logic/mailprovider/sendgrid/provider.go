@@ -0,0 +1,284 @@
+package sendgridmailprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
+	mailprovider2 "github.com/blockysource/mailing/logic/mailprovider"
+)
+
+// DefaultBaseURL is the base URL of the SendGrid API.
+const DefaultBaseURL = "https://api.sendgrid.com"
+
+// mailSendScope is the API key scope required to send the messages.
+const mailSendScope = "mail.send"
+
+// Compile-time check to verify implements interface.
+var _ mailprovider2.Provider = (*SendGridProvider)(nil)
+
+// SendGridProvider is a provider that sends emails with the SendGrid v3 mail send API.
+type SendGridProvider struct {
+	l sync.RWMutex
+
+	p           mailprovider2.MailingProviderDefinition
+	fromAddress *mail.Address
+	cfg         mailingpb.SendGridConfig
+	log         *logrus.Entry
+	isVerified  bool
+	client      *http.Client
+}
+
+// New creates a new SendGrid provider.
+func New(p mailprovider2.MailingProviderDefinition, log *logrus.Entry) (*SendGridProvider, error) {
+	cfg := p.Config.GetSendgridConfig()
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	return &SendGridProvider{
+		p:      p,
+		cfg:    *cfg,
+		client: &http.Client{Timeout: 30 * time.Second},
+		log: log.WithFields(logrus.Fields{
+			"provider_id": p.UID,
+			"provider":    mailingpb.SENDGRID,
+		}),
+	}, nil
+}
+
+// Close closes the provider.
+func (s *SendGridProvider) Close() {
+	s.client.CloseIdleConnections()
+}
+
+// GetID returns the ID of the provider.
+func (s *SendGridProvider) GetID() string {
+	return s.p.UID
+}
+
+// GetDefinition returns the provider definition.
+func (s *SendGridProvider) GetDefinition() mailprovider2.MailingProviderDefinition {
+	return s.p
+}
+
+// Type returns the type of the provider.
+func (s *SendGridProvider) Type() mailingpb.MailingProviderType {
+	return mailingpb.SENDGRID
+}
+
+// IsVerified returns whether the provider is verified.
+func (s *SendGridProvider) IsVerified() bool {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	return s.isVerified
+}
+
+// UpdateConfig updates the config of the provider.
+func (s *SendGridProvider) UpdateConfig(config *mailingpb.MailingProviderConfig) error {
+	cfg := config.GetSendgridConfig()
+	if cfg == nil {
+		return fmt.Errorf("invalid config type: %T", config)
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	s.l.Lock()
+	s.cfg = *cfg
+	s.l.Unlock()
+	return nil
+}
+
+// GetConfig returns the config of the provider.
+func (s *SendGridProvider) GetConfig() mailingpb.MailingProviderConfig {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	cfg := s.cfg
+	return mailingpb.MailingProviderConfig{
+		Config: &mailingpb.MailingProviderConfig_SendgridConfig{
+			SendgridConfig: &cfg,
+		},
+	}
+}
+
+// GetDefaultFromAddress returns the default from address.
+func (s *SendGridProvider) GetDefaultFromAddress() *mail.Address {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	return s.fromAddress
+}
+
+// Send lets the provider send the input message.
+// The API accepts or rejects the message as a whole, so that all the recipients share the same result.
+func (s *SendGridProvider) Send(ctx context.Context, msg *mailprovider2.Message) (*mailprovider2.SendResult, error) {
+	payload, err := newMailSend(ctx, msg)
+	if err != nil {
+		s.log.WithFields(logrus.Fields{
+			"msg_id":        msg.ID,
+			logrus.ErrorKey: err,
+		}).Debug("failed to prepare message")
+		return nil, err
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, mailprovider2.ErrPermanent(fmt.Errorf("failed to encode message: %w", err))
+	}
+
+	resp, err := s.do(ctx, http.MethodPost, "/v3/mail/send", body)
+	if err != nil {
+		s.log.WithFields(logrus.Fields{
+			"msg_id":        msg.ID,
+			logrus.ErrorKey: err,
+		}).Debug("failed to send message")
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		err = responseErr(resp)
+		s.log.WithFields(logrus.Fields{
+			"msg_id":        msg.ID,
+			"status":        resp.StatusCode,
+			logrus.ErrorKey: err,
+		}).Debug("sendgrid rejected the message")
+		return nil, err
+	}
+
+	res := &mailprovider2.SendResult{MessageID: resp.Header.Get("X-Message-Id")}
+	for _, rcpt := range msg.Recipients() {
+		res.Recipients = append(res.Recipients, mailprovider2.RecipientResult{
+			Address: rcpt.Address,
+			Status:  mailprovider2.RecipientAccepted,
+		})
+	}
+
+	s.log.WithFields(logrus.Fields{
+		"msg_id":            msg.ID,
+		"sendgrid_msg_id":   res.MessageID,
+		"recipients_number": len(res.Recipients),
+	}).Debug("email message sent successfully")
+	return res, nil
+}
+
+// Verify verifies that the API key is valid and allowed to send the messages.
+func (s *SendGridProvider) Verify(ctx context.Context) error {
+	resp, err := s.do(ctx, http.MethodGet, "/v3/scopes", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = responseErr(resp)
+		s.log.WithError(err).Debug("failed to verify sendgrid api key")
+		return err
+	}
+
+	var scopes struct {
+		Scopes []string `json:"scopes"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&scopes); err != nil {
+		return fmt.Errorf("failed to decode sendgrid scopes: %w", err)
+	}
+
+	found := false
+	for _, scope := range scopes.Scopes {
+		if scope == mailSendScope {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return mailprovider2.ErrAuth(fmt.Errorf("sendgrid api key has no %s scope", mailSendScope))
+	}
+
+	s.l.Lock()
+	s.isVerified = true
+	s.l.Unlock()
+	return nil
+}
+
+// do sends the authorized request to the SendGrid API.
+func (s *SendGridProvider) do(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	s.l.RLock()
+	baseURL := s.cfg.BaseURL
+	apiKey := s.cfg.APIKey.UnsafeString()
+	s.l.RUnlock()
+
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(baseURL, "/")+path, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		// The request might not have reached the API, so that it could be retried.
+		return nil, mailprovider2.ErrTemporary(fmt.Errorf("sendgrid request failed: %w", err))
+	}
+	return resp, nil
+}
+
+// maxResponseSize is the maximum size of the API response body that is read.
+const maxResponseSize = 1 << 20
+
+// responseErr returns the error of the failed API response.
+func responseErr(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+
+	var apiErr struct {
+		Errors []struct {
+			Message string `json:"message"`
+			Field   string `json:"field"`
+		} `json:"errors"`
+	}
+	msg := strings.TrimSpace(string(body))
+	if err := json.Unmarshal(body, &apiErr); err == nil && len(apiErr.Errors) > 0 {
+		msgs := make([]string, 0, len(apiErr.Errors))
+		for _, e := range apiErr.Errors {
+			if e.Field != "" {
+				msgs = append(msgs, e.Field+": "+e.Message)
+				continue
+			}
+			msgs = append(msgs, e.Message)
+		}
+		msg = strings.Join(msgs, "; ")
+	}
+	if msg == "" {
+		msg = resp.Status
+	}
+
+	err := mailprovider2.ErrHTTPStatus(resp.StatusCode, errors.New("sendgrid: "+msg))
+	var e *mailprovider2.Error
+	if errors.As(err, &e) {
+		e.Message = msg
+	}
+	return err
+}
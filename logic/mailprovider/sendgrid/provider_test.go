@@ -0,0 +1,371 @@
+package sendgridmailprovider_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
+	mailprovider2 "github.com/blockysource/mailing/logic/mailprovider"
+	sendgridmailprovider "github.com/blockysource/mailing/logic/mailprovider/sendgrid"
+)
+
+// newTestProvider creates the provider which requests are served by the handler.
+func newTestProvider(t *testing.T, h http.HandlerFunc) *sendgridmailprovider.SendGridProvider {
+	t.Helper()
+
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	cfg := &mailingpb.SendGridConfig{
+		APIKey:  mailingpb.Secret("SG.key"),
+		BaseURL: srv.URL,
+	}
+
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	p, err := sendgridmailprovider.New(mailprovider2.MailingProviderDefinition{
+		UID:    "sendgrid",
+		Config: &mailingpb.MailingProviderConfig{Config: &mailingpb.MailingProviderConfig_SendgridConfig{SendgridConfig: cfg}},
+	}, logrus.NewEntry(log))
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+	t.Cleanup(p.Close)
+	return p
+}
+
+func testMessage() *mailprovider2.Message {
+	return &mailprovider2.Message{
+		ID:          "msg-1",
+		From:        &mail.Address{Name: "Sender", Address: "sender@example.org"},
+		To:          []*mail.Address{{Name: "To", Address: "to@example.com"}},
+		Cc:          []*mail.Address{{Address: "cc@example.com"}},
+		Bcc:         []*mail.Address{{Address: "bcc@example.com"}},
+		ReplyTo:     []*mail.Address{{Address: "reply@example.org"}},
+		Subject:     "Hello",
+		Body:        "<p>Hello</p>",
+		ContentType: "text/html; charset=utf-8",
+	}
+}
+
+// mailSend is the decoded mail send request payload.
+type mailSend struct {
+	Personalizations []struct {
+		To  []map[string]string `json:"to"`
+		Cc  []map[string]string `json:"cc"`
+		Bcc []map[string]string `json:"bcc"`
+	} `json:"personalizations"`
+	From        map[string]string   `json:"from"`
+	ReplyToList []map[string]string `json:"reply_to_list"`
+	Subject     string              `json:"subject"`
+	Content     []struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	} `json:"content"`
+	Attachments []map[string]string `json:"attachments"`
+	CustomArgs  map[string]string   `json:"custom_args"`
+}
+
+// sendPayload sends the message and returns the decoded request payload.
+func sendPayload(t *testing.T, msg *mailprovider2.Message) (mailSend, *mailprovider2.SendResult) {
+	t.Helper()
+
+	var payload mailSend
+	p := newTestProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v3/mail/send" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer SG.key" {
+			t.Errorf("got authorization %q, want the bearer api key", got)
+		}
+		if got := r.Header.Get("Content-Type"); got != "application/json" {
+			t.Errorf("got content type %q, want application/json", got)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("failed to decode payload: %v", err)
+		}
+		w.Header().Set("X-Message-Id", "sg-message-id")
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	res, err := p.Send(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	return payload, res
+}
+
+func TestSendGridProvider_Send(t *testing.T) {
+	msg := testMessage()
+	msg.Attachments = []mailprovider2.Attachment{{
+		Filename:    "report.pdf",
+		ContentType: "application/pdf",
+		Open: func(context.Context) (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader("report")), nil
+		},
+	}}
+	msg.Inline = []mailprovider2.Attachment{{
+		Filename:    "logo.png",
+		ContentType: "image/png",
+		ContentID:   "logo@example.org",
+		Open: func(context.Context) (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader("logo")), nil
+		},
+	}}
+
+	payload, res := sendPayload(t, msg)
+
+	if len(payload.Personalizations) != 1 {
+		t.Fatalf("got %d personalizations, want 1", len(payload.Personalizations))
+	}
+	pers := payload.Personalizations[0]
+	if !reflect.DeepEqual(pers.To, []map[string]string{{"email": "to@example.com", "name": "To"}}) ||
+		!reflect.DeepEqual(pers.Cc, []map[string]string{{"email": "cc@example.com"}}) ||
+		!reflect.DeepEqual(pers.Bcc, []map[string]string{{"email": "bcc@example.com"}}) {
+		t.Errorf("unexpected personalization: %+v", pers)
+	}
+	if !reflect.DeepEqual(payload.From, map[string]string{"email": "sender@example.org", "name": "Sender"}) {
+		t.Errorf("unexpected from: %v", payload.From)
+	}
+	if !reflect.DeepEqual(payload.ReplyToList, []map[string]string{{"email": "reply@example.org"}}) {
+		t.Errorf("unexpected reply to list: %v", payload.ReplyToList)
+	}
+	if payload.Subject != "Hello" || payload.CustomArgs["msg_id"] != "msg-1" {
+		t.Errorf("unexpected subject %q or custom args %v", payload.Subject, payload.CustomArgs)
+	}
+	if len(payload.Content) != 1 || payload.Content[0].Type != "text/html" || payload.Content[0].Value != "<p>Hello</p>" {
+		t.Errorf("unexpected content: %+v", payload.Content)
+	}
+
+	wantAttachments := []map[string]string{
+		{
+			"content":     base64.StdEncoding.EncodeToString([]byte("report")),
+			"type":        "application/pdf",
+			"filename":    "report.pdf",
+			"disposition": "attachment",
+		},
+		{
+			"content":     base64.StdEncoding.EncodeToString([]byte("logo")),
+			"type":        "image/png",
+			"filename":    "logo.png",
+			"disposition": "inline",
+			"content_id":  "logo@example.org",
+		},
+	}
+	if !reflect.DeepEqual(payload.Attachments, wantAttachments) {
+		t.Errorf("got attachments %v, want %v", payload.Attachments, wantAttachments)
+	}
+
+	if res.MessageID != "sg-message-id" {
+		t.Errorf("got message id %q, want sg-message-id", res.MessageID)
+	}
+	if len(res.Recipients) != 3 || len(res.Accepted()) != 3 {
+		t.Errorf("unexpected recipient results: %+v", res.Recipients)
+	}
+}
+
+func TestSendGridProvider_Send_Content(t *testing.T) {
+	type content struct {
+		Type, Value string
+	}
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		textBody    string
+		want        []content
+	}{
+		{
+			name:        "html",
+			contentType: "text/html; charset=utf-8",
+			body:        "<p>Hello</p>",
+			want:        []content{{Type: "text/html", Value: "<p>Hello</p>"}},
+		},
+		{
+			name:        "html with text",
+			contentType: "text/html; charset=utf-8",
+			body:        "<p>Hello</p>",
+			textBody:    "Hello",
+			want:        []content{{Type: "text/plain", Value: "Hello"}, {Type: "text/html", Value: "<p>Hello</p>"}},
+		},
+		{
+			name:        "plain",
+			contentType: "text/plain; charset=utf-8",
+			body:        "Hello",
+			want:        []content{{Type: "text/plain", Value: "Hello"}},
+		},
+		{
+			// The API rejects the repeated content types.
+			name:        "plain with text",
+			contentType: "text/plain; charset=utf-8",
+			body:        "Hello body",
+			textBody:    "Hello text",
+			want:        []content{{Type: "text/plain", Value: "Hello text"}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := testMessage()
+			msg.ContentType = tc.contentType
+			msg.Body = tc.body
+			msg.TextBody = tc.textBody
+
+			payload, _ := sendPayload(t, msg)
+
+			got := make([]content, 0, len(payload.Content))
+			for _, c := range payload.Content {
+				got = append(got, content{Type: c.Type, Value: c.Value})
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got content %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSendGridProvider_Send_Errors(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		auth      bool
+		temporary bool
+		category  mailprovider2.ErrorCategory
+		message   string
+	}{
+		{name: "unauthorized", status: http.StatusUnauthorized, body: `{"errors":[{"message":"The provided authorization grant is invalid, expired, or revoked"}]}`, auth: true},
+		{name: "forbidden", status: http.StatusForbidden, body: `{"errors":[{"message":"access forbidden"}]}`, auth: true},
+		{
+			name:    "bad request",
+			status:  http.StatusBadRequest,
+			body:    `{"errors":[{"message":"Invalid type. Expected: object, given: string.","field":"personalizations.0.to"},{"message":"The subject is required."}]}`,
+			message: "personalizations.0.to: Invalid type. Expected: object, given: string.; The subject is required.",
+		},
+		{name: "too large", status: http.StatusRequestEntityTooLarge, body: "Payload Too Large", category: mailprovider2.CategoryMessageTooLarge, message: "Payload Too Large"},
+		{name: "rate limited", status: http.StatusTooManyRequests, temporary: true, category: mailprovider2.CategoryRateLimited, message: "429 Too Many Requests"},
+		{name: "server error", status: http.StatusInternalServerError, body: `{"errors":[{"message":"internal error"}]}`, temporary: true, message: "internal error"},
+		{name: "unavailable", status: http.StatusServiceUnavailable, temporary: true, message: "503 Service Unavailable"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestProvider(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				io.WriteString(w, tc.body)
+			})
+
+			_, err := p.Send(context.Background(), testMessage())
+			if err == nil {
+				t.Fatal("send succeeded, want error")
+			}
+
+			var authErr *mailprovider2.AuthErr
+			if tc.auth {
+				if !errors.As(err, &authErr) {
+					t.Fatalf("got %T %v, want auth error", err, err)
+				}
+				return
+			}
+
+			var e *mailprovider2.Error
+			if !errors.As(err, &e) {
+				t.Fatalf("got %T %v, want mailprovider error", err, err)
+			}
+			if e.Temporary != tc.temporary || e.Category != tc.category || e.Code != tc.status {
+				t.Errorf("got temporary %t category %s code %d, want %t %s %d", e.Temporary, e.Category, e.Code, tc.temporary, tc.category, tc.status)
+			}
+			if e.Message != tc.message {
+				t.Errorf("got message %q, want %q", e.Message, tc.message)
+			}
+		})
+	}
+}
+
+func TestSendGridProvider_Send_InvalidMessage(t *testing.T) {
+	var requests int
+	p := newTestProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	})
+
+	// The attachment store failure is temporary.
+	msg := testMessage()
+	msg.Attachments = []mailprovider2.Attachment{{
+		Filename:    "report.pdf",
+		ContentType: "application/pdf",
+		Open: func(context.Context) (io.ReadCloser, error) {
+			return nil, errors.New("store unavailable")
+		},
+	}}
+	_, err := p.Send(context.Background(), msg)
+	var e *mailprovider2.Error
+	if !errors.As(err, &e) || !e.Temporary {
+		t.Fatalf("got %v, want temporary error", err)
+	}
+
+	// The message without the primary recipients is rejected permanently.
+	msg = testMessage()
+	msg.To = nil
+	_, err = p.Send(context.Background(), msg)
+	if !errors.As(err, &e) || e.Temporary {
+		t.Fatalf("got %v, want permanent error", err)
+	}
+
+	if requests != 0 {
+		t.Fatalf("got %d requests, want none", requests)
+	}
+}
+
+func TestSendGridProvider_Verify(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		verified bool
+		auth     bool
+	}{
+		{name: "mail send scope", status: http.StatusOK, body: `{"scopes":["alerts.read","mail.send"]}`, verified: true},
+		{name: "no mail send scope", status: http.StatusOK, body: `{"scopes":["alerts.read"]}`, auth: true},
+		{name: "unauthorized", status: http.StatusUnauthorized, body: `{"errors":[{"message":"authorization required"}]}`, auth: true},
+		{name: "server error", status: http.StatusInternalServerError},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestProvider(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodGet || r.URL.Path != "/v3/scopes" {
+					t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+				}
+				if got := r.Header.Get("Authorization"); got != "Bearer SG.key" {
+					t.Errorf("got authorization %q, want the bearer api key", got)
+				}
+				w.WriteHeader(tc.status)
+				io.WriteString(w, tc.body)
+			})
+
+			err := p.Verify(context.Background())
+			if tc.verified != (err == nil) {
+				t.Fatalf("got error %v, want verified %t", err, tc.verified)
+			}
+			if p.IsVerified() != tc.verified {
+				t.Fatalf("got verified %t, want %t", p.IsVerified(), tc.verified)
+			}
+
+			var authErr *mailprovider2.AuthErr
+			if tc.auth && !errors.As(err, &authErr) {
+				t.Fatalf("got %T %v, want auth error", err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,303 @@
+package sendmailmailprovider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
+	mailprovider2 "github.com/blockysource/mailing/logic/mailprovider"
+	mailproviderwriter "github.com/blockysource/mailing/logic/mailprovider/writer"
+)
+
+// DefaultPath is the default path of the sendmail compatible binary, installed by the Postfix, Exim and Sendmail.
+const DefaultPath = "/usr/sbin/sendmail"
+
+// DefaultArgs are the default arguments of the sendmail binary.
+// The recipients are extracted from the message headers and a line with a single dot does not end the message.
+var DefaultArgs = []string{"-t", "-i"}
+
+// extractRecipientsFlag is the flag that makes the sendmail extract the recipients from the message headers.
+const extractRecipientsFlag = "-t"
+
+// maxStderrSize is the maximum size of the sendmail diagnostic output that is kept for the error.
+const maxStderrSize = 4 << 10
+
+// Compile-time check to verify implements interface.
+var _ mailprovider2.Provider = (*SendmailProvider)(nil)
+
+// SendmailProvider is a provider that pipes the rendered messages into a local sendmail compatible binary.
+type SendmailProvider struct {
+	l sync.RWMutex
+
+	p           mailprovider2.MailingProviderDefinition
+	fromAddress *mail.Address
+	cfg         mailingpb.SendmailConfig
+	log         *logrus.Entry
+	isVerified  bool
+}
+
+// New creates a new sendmail provider.
+func New(p mailprovider2.MailingProviderDefinition, log *logrus.Entry) (*SendmailProvider, error) {
+	cfg := p.Config.GetSendmailConfig()
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	return &SendmailProvider{
+		p:   p,
+		cfg: *cfg,
+		log: log.WithFields(logrus.Fields{
+			"provider_id": p.UID,
+			"provider":    mailingpb.SENDMAIL,
+		}),
+	}, nil
+}
+
+// Close closes the provider.
+func (s *SendmailProvider) Close() {}
+
+// GetID returns the ID of the provider.
+func (s *SendmailProvider) GetID() string {
+	return s.p.UID
+}
+
+// GetDefinition returns the provider definition.
+func (s *SendmailProvider) GetDefinition() mailprovider2.MailingProviderDefinition {
+	return s.p
+}
+
+// Type returns the type of the provider.
+func (s *SendmailProvider) Type() mailingpb.MailingProviderType {
+	return mailingpb.SENDMAIL
+}
+
+// IsVerified returns whether the provider is verified.
+func (s *SendmailProvider) IsVerified() bool {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	return s.isVerified
+}
+
+// UpdateConfig updates the config of the provider.
+func (s *SendmailProvider) UpdateConfig(config *mailingpb.MailingProviderConfig) error {
+	cfg := config.GetSendmailConfig()
+	if cfg == nil {
+		return fmt.Errorf("invalid config type: %T", config)
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	s.l.Lock()
+	s.cfg = *cfg
+	s.l.Unlock()
+	return nil
+}
+
+// GetConfig returns the config of the provider.
+func (s *SendmailProvider) GetConfig() mailingpb.MailingProviderConfig {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	cfg := s.cfg
+	cfg.Args = append([]string(nil), s.cfg.Args...)
+	return mailingpb.MailingProviderConfig{
+		Config: &mailingpb.MailingProviderConfig_SendmailConfig{
+			SendmailConfig: &cfg,
+		},
+	}
+}
+
+// GetDefaultFromAddress returns the default from address.
+func (s *SendmailProvider) GetDefaultFromAddress() *mail.Address {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	return s.fromAddress
+}
+
+// Send lets the provider send the input message.
+// The binary either accepts the message for all the recipients or fails, so that all the recipients share the same result.
+func (s *SendmailProvider) Send(ctx context.Context, msg *mailprovider2.Message) (*mailprovider2.SendResult, error) {
+	rcpts := msg.Recipients()
+	if len(rcpts) == 0 {
+		return nil, mailprovider2.ErrPermanent(errors.New("message has no recipients"))
+	}
+
+	path, args, err := s.lookPath()
+	if err != nil {
+		// The binary might be installed later.
+		return nil, mailprovider2.ErrTemporary(fmt.Errorf("sendmail binary not found: %w", err))
+	}
+
+	// If the recipients are extracted from the headers, the blind carbon copy recipients need to be in the headers too,
+	// the binary removes the Bcc header before the message is delivered.
+	// Otherwise, the envelope recipients are passed as the arguments.
+	extract := hasArg(args, extractRecipientsFlag)
+	if !extract {
+		args = append(args, "--")
+		for _, rcpt := range rcpts {
+			args = append(args, rcpt.Address)
+		}
+	}
+
+	var domain string
+	if msg.From != nil {
+		domain = mailproviderwriter.DomainOf(msg.From.Address)
+	}
+	mw := mailproviderwriter.Writer{Domain: domain, Bcc: extract}
+
+	var sp mailproviderwriter.Spool
+	defer sp.Close()
+
+	if err := mw.Render(ctx, msg, &sp); err != nil {
+		s.log.WithFields(logrus.Fields{
+			"msg_id":        msg.ID,
+			logrus.ErrorKey: err,
+		}).Debug("failed to render message")
+		return nil, mailprovider2.AsError(err, false)
+	}
+
+	r, err := sp.Reader()
+	if err != nil {
+		return nil, mailprovider2.ErrTemporary(err)
+	}
+
+	stderr := &limitedBuffer{max: maxStderrSize}
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdin = r
+	cmd.Stderr = stderr
+
+	if err = cmd.Run(); err != nil {
+		err = runErr(ctx, path, err, stderr.String())
+		s.log.WithFields(logrus.Fields{
+			"msg_id":        msg.ID,
+			"path":          path,
+			logrus.ErrorKey: err,
+		}).Debug("failed to send message")
+		return nil, err
+	}
+
+	res := &mailprovider2.SendResult{}
+	for _, rcpt := range rcpts {
+		res.Recipients = append(res.Recipients, mailprovider2.RecipientResult{
+			Address: rcpt.Address,
+			Status:  mailprovider2.RecipientAccepted,
+		})
+	}
+
+	s.log.WithFields(logrus.Fields{
+		"msg_id":            msg.ID,
+		"recipients_number": len(res.Recipients),
+	}).Debug("email message sent successfully")
+	return res, nil
+}
+
+// Verify verifies that the configured binary exists and is executable.
+func (s *SendmailProvider) Verify(ctx context.Context) error {
+	if _, _, err := s.lookPath(); err != nil {
+		return fmt.Errorf("sendmail binary not found: %w", err)
+	}
+
+	s.l.Lock()
+	s.isVerified = true
+	s.l.Unlock()
+	return nil
+}
+
+// command returns the path of the binary and its arguments, or the defaults.
+func (s *SendmailProvider) command() (string, []string) {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	path := s.cfg.Path
+	if path == "" {
+		path = DefaultPath
+	}
+
+	args := s.cfg.Args
+	if len(args) == 0 {
+		args = DefaultArgs
+	}
+	return path, append([]string(nil), args...)
+}
+
+// lookPath returns the path of the executable binary and its arguments.
+// The binary name without a slash is searched in the directories of the PATH.
+func (s *SendmailProvider) lookPath() (string, []string, error) {
+	path, args := s.command()
+
+	lp, err := exec.LookPath(path)
+	if err != nil {
+		return "", nil, err
+	}
+	return lp, args, nil
+}
+
+// runErr returns the error of the failed binary run.
+func runErr(ctx context.Context, path string, err error, stderr string) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return mailprovider2.ErrTemporary(fmt.Errorf("sendmail interrupted: %w", ctxErr))
+	}
+
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		// The binary could not be started, it might be installed or fixed later.
+		return mailprovider2.ErrTemporary(fmt.Errorf("failed to run sendmail %s: %w", path, err))
+	}
+
+	status := ee.ExitCode()
+	if status < 0 {
+		// The binary was terminated by a signal.
+		return mailprovider2.ErrTemporary(fmt.Errorf("sendmail %s: %w", path, err))
+	}
+
+	text := strings.TrimSpace(stderr)
+	if text == "" {
+		text = err.Error()
+	}
+	return mailprovider2.ErrExitStatus(status, text, fmt.Errorf("sendmail exited with status %d: %s", status, text))
+}
+
+// hasArg checks if the options preceding the recipient arguments contain the flag.
+func hasArg(args []string, flag string) bool {
+	for _, arg := range args {
+		if arg == "--" {
+			return false
+		}
+		if arg == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// limitedBuffer keeps up to max bytes written to it and discards the rest.
+type limitedBuffer struct {
+	buf []byte
+	max int
+}
+
+// Write writes the input to the buffer, it never fails so that the command is not interrupted.
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if n := b.max - len(b.buf); n > 0 {
+		if len(p) < n {
+			n = len(p)
+		}
+		b.buf = append(b.buf, p[:n]...)
+	}
+	return len(p), nil
+}
+
+// String returns the buffered output.
+func (b *limitedBuffer) String() string {
+	return string(b.buf)
+}
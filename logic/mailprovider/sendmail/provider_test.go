@@ -0,0 +1,260 @@
+package sendmailmailprovider_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
+	mailprovider2 "github.com/blockysource/mailing/logic/mailprovider"
+	sendmailmailprovider "github.com/blockysource/mailing/logic/mailprovider/sendmail"
+)
+
+// fakeSendmail writes the script to the directory, which records its arguments and input in the directory files,
+// writes the stderr text and exits with the status.
+func fakeSendmail(t *testing.T, dir string, status int, stderr string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, "sendmail")
+	script := fmt.Sprintf(`#!/bin/sh
+printf '%%s\n' "$@" > %[1]q
+cat > %[2]q
+printf '%%b' %[3]q >&2
+exit %[4]d
+`, filepath.Join(dir, "args"), filepath.Join(dir, "stdin"), stderr, status)
+	if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatalf("failed to write sendmail script: %v", err)
+	}
+	return path
+}
+
+func newTestProvider(t *testing.T, path string, args ...string) *sendmailmailprovider.SendmailProvider {
+	t.Helper()
+
+	cfg := &mailingpb.SendmailConfig{Path: path, Args: args}
+
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	p, err := sendmailmailprovider.New(mailprovider2.MailingProviderDefinition{
+		UID:    "sendmail",
+		Config: &mailingpb.MailingProviderConfig{Config: &mailingpb.MailingProviderConfig_SendmailConfig{SendmailConfig: cfg}},
+	}, logrus.NewEntry(log))
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+	t.Cleanup(p.Close)
+	return p
+}
+
+func testMessage() *mailprovider2.Message {
+	return &mailprovider2.Message{
+		ID:          "msg-1",
+		From:        &mail.Address{Address: "sender@example.org"},
+		To:          []*mail.Address{{Address: "to@example.com"}},
+		Cc:          []*mail.Address{{Address: "cc@example.com"}},
+		Bcc:         []*mail.Address{{Address: "bcc@example.com"}},
+		Subject:     "Hello",
+		Body:        "Hello",
+		ContentType: "text/plain; charset=utf-8",
+	}
+}
+
+func TestSendmailProvider_Send(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		wantArgs []string
+		wantBcc  bool
+	}{
+		{
+			// The binary extracts the recipients from the headers, including the Bcc it removes.
+			name:     "default",
+			wantArgs: []string{"-t", "-i"},
+			wantBcc:  true,
+		},
+		{
+			name:     "envelope recipients",
+			args:     []string{"-i", "-f", "bounce@example.org"},
+			wantArgs: []string{"-i", "-f", "bounce@example.org", "--", "to@example.com", "cc@example.com", "bcc@example.com"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			p := newTestProvider(t, fakeSendmail(t, dir, 0, ""), tc.args...)
+
+			res, err := p.Send(context.Background(), testMessage())
+			if err != nil {
+				t.Fatalf("send failed: %v", err)
+			}
+			if len(res.Recipients) != 3 || len(res.Accepted()) != 3 {
+				t.Errorf("unexpected recipient results: %+v", res.Recipients)
+			}
+
+			args, err := os.ReadFile(filepath.Join(dir, "args"))
+			if err != nil {
+				t.Fatalf("failed to read args: %v", err)
+			}
+			if got := strings.Fields(string(args)); !reflect.DeepEqual(got, tc.wantArgs) {
+				t.Errorf("got args %v, want %v", got, tc.wantArgs)
+			}
+
+			data, err := os.ReadFile(filepath.Join(dir, "stdin"))
+			if err != nil {
+				t.Fatalf("failed to read message: %v", err)
+			}
+			m, err := mail.ReadMessage(strings.NewReader(string(data)))
+			if err != nil {
+				t.Fatalf("failed to parse message: %v", err)
+			}
+			if m.Header.Get("Subject") != "Hello" {
+				t.Errorf("unexpected message header: %v", m.Header)
+			}
+			if got := m.Header.Get("Bcc") != ""; got != tc.wantBcc {
+				t.Errorf("got Bcc header %t, want %t", got, tc.wantBcc)
+			}
+		})
+	}
+}
+
+func TestSendmailProvider_Send_ExitStatus(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		stderr    string
+		temporary bool
+		category  mailprovider2.ErrorCategory
+		esc       mailprovider2.EnhancedStatusCode
+		message   string
+	}{
+		{
+			name:     "no user",
+			status:   mailprovider2.ExitNoUser,
+			stderr:   "to@example.com... User unknown\n",
+			category: mailprovider2.CategoryMailboxUnknown,
+			esc:      mailprovider2.EnhancedStatusCode{Class: 5, Subject: 1, Detail: 1},
+			message:  "to@example.com... User unknown",
+		},
+		{
+			name:     "no permission",
+			status:   mailprovider2.ExitNoPerm,
+			stderr:   "permission denied",
+			category: mailprovider2.CategoryPolicy,
+			esc:      mailprovider2.EnhancedStatusCode{Class: 5, Subject: 7, Detail: 0},
+			message:  "permission denied",
+		},
+		{
+			name:      "temporary failure",
+			status:    mailprovider2.ExitTempFail,
+			stderr:    "queue file write error",
+			temporary: true,
+			esc:       mailprovider2.EnhancedStatusCode{Class: 4, Subject: 3, Detail: 0},
+			message:   "queue file write error",
+		},
+		{
+			// The status not defined in the sysexits.h is temporary, the exit error is the message without the output.
+			name:      "unknown status",
+			status:    1,
+			temporary: true,
+			esc:       mailprovider2.EnhancedStatusCode{Class: 4, Subject: 3, Detail: 0},
+			message:   "exit status 1",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestProvider(t, fakeSendmail(t, t.TempDir(), tc.status, tc.stderr))
+
+			_, err := p.Send(context.Background(), testMessage())
+			var e *mailprovider2.Error
+			if !errors.As(err, &e) {
+				t.Fatalf("got %T %v, want mailprovider error", err, err)
+			}
+			if e.Temporary != tc.temporary || e.Category != tc.category || e.Code != tc.status || e.EnhancedCode != tc.esc {
+				t.Errorf("got temporary %t category %s code %d esc %v, want %t %s %d %v",
+					e.Temporary, e.Category, e.Code, e.EnhancedCode, tc.temporary, tc.category, tc.status, tc.esc)
+			}
+			if e.Message != tc.message {
+				t.Errorf("got message %q, want %q", e.Message, tc.message)
+			}
+		})
+	}
+}
+
+func TestSendmailProvider_Send_Interrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sendmail")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\nexec sleep 10\n"), 0o755); err != nil {
+		t.Fatalf("failed to write sendmail script: %v", err)
+	}
+	p := newTestProvider(t, path)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err := p.Send(ctx, testMessage())
+	var e *mailprovider2.Error
+	if !errors.As(err, &e) || !e.Temporary || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want temporary deadline error", err)
+	}
+}
+
+func TestSendmailProvider_Verify(t *testing.T) {
+	dir := t.TempDir()
+	fakeSendmail(t, dir, 0, "")
+
+	notExecutable := filepath.Join(dir, "not-executable")
+	if err := os.WriteFile(notExecutable, []byte("#!/bin/sh\n"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	// The binary name is searched in the PATH.
+	t.Setenv("PATH", dir)
+
+	tests := []struct {
+		name     string
+		path     string
+		verified bool
+	}{
+		{name: "absolute path", path: filepath.Join(dir, "sendmail"), verified: true},
+		{name: "name in path", path: "sendmail", verified: true},
+		{name: "not found", path: filepath.Join(dir, "missing")},
+		{name: "name not in path", path: "missing"},
+		{name: "not executable", path: notExecutable},
+		{name: "directory", path: dir},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestProvider(t, tc.path)
+
+			err := p.Verify(context.Background())
+			if tc.verified != (err == nil) {
+				t.Fatalf("got error %v, want verified %t", err, tc.verified)
+			}
+			if p.IsVerified() != tc.verified {
+				t.Fatalf("got verified %t, want %t", p.IsVerified(), tc.verified)
+			}
+			if tc.verified {
+				return
+			}
+
+			// The message is not sent with the binary that fails the verification, but it could be installed later.
+			_, err = p.Send(context.Background(), testMessage())
+			var e *mailprovider2.Error
+			if !errors.As(err, &e) || !e.Temporary {
+				t.Fatalf("got %v, want temporary error", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package sesmailprovider
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
+	mailprovider2 "github.com/blockysource/mailing/logic/mailprovider"
+)
+
+// Register registers the factory of the Amazon SES providers.
+func Register(r *mailprovider2.Registry) error {
+	return r.Register(mailprovider2.Factory{
+		Type: mailingpb.SES,
+		Validate: func(cfg *mailingpb.MailingProviderConfig) error {
+			return cfg.GetSesConfig().Validate()
+		},
+		New: func(_ context.Context, def mailprovider2.MailingProviderDefinition, log *logrus.Entry) (mailprovider2.Provider, error) {
+			p, err := New(def, log)
+			if err != nil {
+				return nil, err
+			}
+			return p, nil
+		},
+		SecretFields: []string{
+			"ses_config.access_key_id",
+			"ses_config.secret_access_key",
+			"ses_config.session_token",
+		},
+	})
+}
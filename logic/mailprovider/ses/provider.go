@@ -0,0 +1,436 @@
+package sesmailprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
+	mailprovider2 "github.com/blockysource/mailing/logic/mailprovider"
+	mailproviderwriter "github.com/blockysource/mailing/logic/mailprovider/writer"
+)
+
+// Compile-time check to verify implements interface.
+var _ mailprovider2.Provider = (*SESProvider)(nil)
+
+// SESProvider is a provider that sends the raw emails with the Amazon SES v2 API.
+type SESProvider struct {
+	l sync.RWMutex
+
+	p           mailprovider2.MailingProviderDefinition
+	fromAddress *mail.Address
+	cfg         mailingpb.SESConfig
+	log         *logrus.Entry
+	isVerified  bool
+	client      *http.Client
+}
+
+// New creates a new SES provider.
+func New(p mailprovider2.MailingProviderDefinition, log *logrus.Entry) (*SESProvider, error) {
+	cfg := p.Config.GetSesConfig()
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	s := &SESProvider{
+		p:      p,
+		cfg:    *cfg,
+		client: &http.Client{Timeout: 30 * time.Second},
+		log: log.WithFields(logrus.Fields{
+			"provider_id": p.UID,
+			"provider":    mailingpb.SES,
+		}),
+	}
+
+	// The from address is the identity, which verification status is checked by the Verify.
+	if p.FromAddress != "" {
+		addr, err := mail.ParseAddress(p.FromAddress)
+		if err != nil {
+			return nil, fmt.Errorf("invalid from address: %w", err)
+		}
+		s.fromAddress = addr
+	}
+	return s, nil
+}
+
+// Close closes the provider.
+func (s *SESProvider) Close() {
+	s.client.CloseIdleConnections()
+}
+
+// GetID returns the ID of the provider.
+func (s *SESProvider) GetID() string {
+	return s.p.UID
+}
+
+// GetDefinition returns the provider definition.
+func (s *SESProvider) GetDefinition() mailprovider2.MailingProviderDefinition {
+	return s.p
+}
+
+// Type returns the type of the provider.
+func (s *SESProvider) Type() mailingpb.MailingProviderType {
+	return mailingpb.SES
+}
+
+// IsVerified returns whether the provider is verified.
+func (s *SESProvider) IsVerified() bool {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	return s.isVerified
+}
+
+// UpdateConfig updates the config of the provider.
+func (s *SESProvider) UpdateConfig(config *mailingpb.MailingProviderConfig) error {
+	cfg := config.GetSesConfig()
+	if cfg == nil {
+		return fmt.Errorf("invalid config type: %T", config)
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	s.l.Lock()
+	s.cfg = *cfg
+	s.l.Unlock()
+	return nil
+}
+
+// GetConfig returns the config of the provider.
+func (s *SESProvider) GetConfig() mailingpb.MailingProviderConfig {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	cfg := s.cfg
+	return mailingpb.MailingProviderConfig{
+		Config: &mailingpb.MailingProviderConfig_SesConfig{
+			SesConfig: &cfg,
+		},
+	}
+}
+
+// GetDefaultFromAddress returns the default from address.
+func (s *SESProvider) GetDefaultFromAddress() *mail.Address {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	return s.fromAddress
+}
+
+// sendEmailRequest is the payload of the SES v2 SendEmail request with the raw content.
+type sendEmailRequest struct {
+	FromEmailAddress     string       `json:"FromEmailAddress,omitempty"`
+	Destination          *destination `json:"Destination,omitempty"`
+	Content              emailContent `json:"Content"`
+	ConfigurationSetName string       `json:"ConfigurationSetName,omitempty"`
+	EmailTags            []messageTag `json:"EmailTags,omitempty"`
+}
+
+type destination struct {
+	ToAddresses  []string `json:"ToAddresses,omitempty"`
+	CcAddresses  []string `json:"CcAddresses,omitempty"`
+	BccAddresses []string `json:"BccAddresses,omitempty"`
+}
+
+type emailContent struct {
+	Raw rawMessage `json:"Raw"`
+}
+
+// rawMessage is the raw MIME message, the json encoding of the byte slice is the base64 required by the API.
+type rawMessage struct {
+	Data []byte `json:"Data"`
+}
+
+type messageTag struct {
+	Name  string `json:"Name"`
+	Value string `json:"Value"`
+}
+
+// Send lets the provider send the input message.
+// The API accepts or rejects the message as a whole, so that all the recipients share the same result.
+func (s *SESProvider) Send(ctx context.Context, msg *mailprovider2.Message) (*mailprovider2.SendResult, error) {
+	if msg.From == nil {
+		return nil, mailprovider2.ErrPermanent(errors.New("message has no from address"))
+	}
+
+	// SES replaces the Message-ID with its own one, the generated one only needs to be well-formed.
+	mw := mailproviderwriter.Writer{Domain: mailproviderwriter.DomainOf(msg.From.Address)}
+
+	var raw bytes.Buffer
+	if err := mw.Render(ctx, msg, &raw); err != nil {
+		s.log.WithFields(logrus.Fields{
+			"msg_id":        msg.ID,
+			logrus.ErrorKey: err,
+		}).Debug("failed to render message")
+		return nil, mailprovider2.AsError(err, false)
+	}
+
+	s.l.RLock()
+	configurationSet := s.cfg.ConfigurationSet
+	s.l.RUnlock()
+
+	// The destination is the envelope of the raw message, the blind carbon copy recipients are not in its headers.
+	in := sendEmailRequest{
+		FromEmailAddress: msg.From.Address,
+		Destination: &destination{
+			ToAddresses:  addresses(msg.To),
+			CcAddresses:  addresses(msg.Cc),
+			BccAddresses: addresses(msg.Bcc),
+		},
+		Content:              emailContent{Raw: rawMessage{Data: raw.Bytes()}},
+		ConfigurationSetName: configurationSet,
+	}
+	// The tag is published with the sending events, so that they could be correlated with the message.
+	if msg.ID != "" && configurationSet != "" {
+		in.EmailTags = []messageTag{{Name: "msg_id", Value: tagValue(msg.ID)}}
+	}
+
+	body, err := json.Marshal(in)
+	if err != nil {
+		return nil, mailprovider2.ErrPermanent(fmt.Errorf("failed to encode message: %w", err))
+	}
+
+	resp, err := s.do(ctx, http.MethodPost, "/v2/email/outbound-emails", body)
+	if err != nil {
+		s.log.WithFields(logrus.Fields{
+			"msg_id":        msg.ID,
+			logrus.ErrorKey: err,
+		}).Debug("failed to send message")
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = responseErr(resp)
+		s.log.WithFields(logrus.Fields{
+			"msg_id":        msg.ID,
+			"status":        resp.StatusCode,
+			logrus.ErrorKey: err,
+		}).Debug("ses rejected the message")
+		return nil, err
+	}
+
+	var out struct {
+		MessageId string `json:"MessageId"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&out); err != nil {
+		// The message was accepted, only the identifier is missing.
+		s.log.WithError(err).Debug("failed to decode ses response")
+	}
+
+	res := &mailprovider2.SendResult{MessageID: out.MessageId}
+	for _, rcpt := range msg.Recipients() {
+		res.Recipients = append(res.Recipients, mailprovider2.RecipientResult{
+			Address: rcpt.Address,
+			Status:  mailprovider2.RecipientAccepted,
+		})
+	}
+
+	s.log.WithFields(logrus.Fields{
+		"msg_id":            msg.ID,
+		"ses_msg_id":        res.MessageID,
+		"recipients_number": len(res.Recipients),
+	}).Debug("email message sent successfully")
+	return res, nil
+}
+
+// Verify verifies that the credentials are valid and the from address identity is verified for sending.
+// The identity is either the email address itself or its domain.
+func (s *SESProvider) Verify(ctx context.Context) error {
+	from := s.GetDefaultFromAddress()
+	if from == nil {
+		return errors.New("ses provider requires a from address")
+	}
+
+	identities := []string{from.Address}
+	if domain := mailproviderwriter.DomainOf(from.Address); domain != "" {
+		identities = append(identities, domain)
+	}
+
+	var lastErr error
+	for _, identity := range identities {
+		verified, status, err := s.identityStatus(ctx, identity)
+		if err != nil {
+			var e *mailprovider2.Error
+			if errors.As(err, &e) && e.Code == http.StatusNotFound {
+				// The identity does not exist, try with the next one.
+				lastErr = err
+				continue
+			}
+			s.log.WithError(err).Debug("failed to verify ses identity")
+			return err
+		}
+
+		if !verified {
+			return fmt.Errorf("ses identity %s is not verified for sending, verification status: %s", identity, status)
+		}
+
+		s.l.Lock()
+		s.isVerified = true
+		s.l.Unlock()
+		return nil
+	}
+	s.log.WithError(lastErr).Debug("ses identity not found")
+	return fmt.Errorf("no ses identity found for the from address %s: %w", from.Address, lastErr)
+}
+
+// identityStatus returns whether the identity is verified for sending along with its verification status.
+func (s *SESProvider) identityStatus(ctx context.Context, identity string) (bool, string, error) {
+	resp, err := s.do(ctx, http.MethodGet, "/v2/email/identities/"+uriEncode(identity), nil)
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, "", responseErr(resp)
+	}
+
+	var out struct {
+		VerifiedForSendingStatus bool   `json:"VerifiedForSendingStatus"`
+		VerificationStatus       string `json:"VerificationStatus"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&out); err != nil {
+		return false, "", fmt.Errorf("failed to decode ses identity: %w", err)
+	}
+	return out.VerifiedForSendingStatus, out.VerificationStatus, nil
+}
+
+// do sends the signed request to the SES API.
+func (s *SESProvider) do(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	s.l.RLock()
+	region := s.cfg.Region
+	endpoint := s.cfg.Endpoint
+	creds := credentials{
+		accessKeyID:     s.cfg.AccessKeyID.UnsafeString(),
+		secretAccessKey: s.cfg.SecretAccessKey.UnsafeString(),
+		sessionToken:    s.cfg.SessionToken.UnsafeString(),
+	}
+	s.l.RUnlock()
+
+	// The endpoint override allows to use the compatible services or the local stubs.
+	if endpoint == "" {
+		endpoint = "https://email." + region + ".amazonaws.com"
+	}
+
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(endpoint, "/")+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	signRequest(req, body, creds, region, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		// The request might not have reached the API, so that it could be retried.
+		return nil, mailprovider2.ErrTemporary(fmt.Errorf("ses request failed: %w", err))
+	}
+	return resp, nil
+}
+
+// maxResponseSize is the maximum size of the API response body that is read.
+const maxResponseSize = 1 << 20
+
+// responseErr returns the error of the failed API response.
+// The error type is passed in the X-Amzn-ErrorType header, or in the __type field of the body.
+func responseErr(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+
+	var apiErr struct {
+		Type         string `json:"__type"`
+		Message      string `json:"message"`
+		MessageUpper string `json:"Message"`
+	}
+	_ = json.Unmarshal(body, &apiErr)
+
+	errType := resp.Header.Get("X-Amzn-ErrorType")
+	if errType == "" {
+		errType = apiErr.Type
+	}
+	errType = errorTypeName(errType)
+
+	msg := apiErr.Message
+	if msg == "" {
+		msg = apiErr.MessageUpper
+	}
+	if msg == "" {
+		msg = strings.TrimSpace(string(body))
+	}
+	if msg == "" {
+		msg = resp.Status
+	}
+	if errType != "" {
+		msg = errType + ": " + msg
+	}
+
+	cause := errors.New("ses: " + msg)
+	switch errType {
+	case "TooManyRequestsException", "ThrottlingException", "Throttling":
+		return &mailprovider2.Error{Temporary: true, Err: cause, Code: resp.StatusCode, Category: mailprovider2.CategoryRateLimited, Message: msg}
+	case "LimitExceededException":
+		// The sending quota is reset after the quota period, so that the message could be sent later.
+		return &mailprovider2.Error{Temporary: true, Err: cause, Code: resp.StatusCode, Category: mailprovider2.CategoryQuotaExceeded, Message: msg}
+	case "MessageRejected", "MailFromDomainNotVerifiedException", "AccountSuspendedException", "SendingPausedException":
+		return &mailprovider2.Error{Err: cause, Code: resp.StatusCode, Category: mailprovider2.CategoryPolicy, Message: msg}
+	}
+
+	err := mailprovider2.ErrHTTPStatus(resp.StatusCode, cause)
+	var e *mailprovider2.Error
+	if errors.As(err, &e) {
+		e.Message = msg
+	}
+	return err
+}
+
+// errorTypeName strips the namespace and the documentation link of the error type,
+// i.e. "com.amazonaws.ses#MessageRejected:http://internal.amazon.com/" becomes "MessageRejected".
+func errorTypeName(t string) string {
+	if i := strings.IndexByte(t, ':'); i >= 0 {
+		t = t[:i]
+	}
+	if i := strings.LastIndexByte(t, '#'); i >= 0 {
+		t = t[i+1:]
+	}
+	return strings.TrimSpace(t)
+}
+
+func addresses(addrs []*mail.Address) []string {
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	out := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		out = append(out, addr.Address)
+	}
+	return out
+}
+
+// tagValue replaces the characters that are not allowed in the message tag values.
+func tagValue(v string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		default:
+			return '_'
+		}
+	}, v)
+}
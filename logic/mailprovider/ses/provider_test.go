@@ -0,0 +1,302 @@
+package sesmailprovider_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
+	mailprovider2 "github.com/blockysource/mailing/logic/mailprovider"
+	sesmailprovider "github.com/blockysource/mailing/logic/mailprovider/ses"
+)
+
+// newTestProvider creates the provider which requests are served by the handler through the endpoint override.
+func newTestProvider(t *testing.T, configurationSet string, h http.HandlerFunc) *sesmailprovider.SESProvider {
+	t.Helper()
+
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	cfg := &mailingpb.SESConfig{
+		Region:           "eu-west-1",
+		AccessKeyID:      mailingpb.Secret("AKIDEXAMPLE"),
+		SecretAccessKey:  mailingpb.Secret("wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"),
+		Endpoint:         srv.URL + "/",
+		ConfigurationSet: configurationSet,
+	}
+
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	p, err := sesmailprovider.New(mailprovider2.MailingProviderDefinition{
+		UID:         "ses",
+		FromAddress: "Sender <sender@example.org>",
+		Config:      &mailingpb.MailingProviderConfig{Config: &mailingpb.MailingProviderConfig_SesConfig{SesConfig: cfg}},
+	}, logrus.NewEntry(log))
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+	t.Cleanup(p.Close)
+	return p
+}
+
+func testMessage() *mailprovider2.Message {
+	return &mailprovider2.Message{
+		ID:          "msg-1",
+		From:        &mail.Address{Address: "sender@example.org"},
+		To:          []*mail.Address{{Address: "to@example.com"}},
+		Cc:          []*mail.Address{{Address: "cc@example.com"}},
+		Bcc:         []*mail.Address{{Address: "bcc@example.com"}},
+		Subject:     "Hello",
+		Body:        "<p>Hello</p>",
+		ContentType: "text/html; charset=utf-8",
+	}
+}
+
+// checkSigned verifies that the request is signed with the configured credentials.
+func checkSigned(t *testing.T, r *http.Request) {
+	t.Helper()
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || !strings.Contains(auth, "/eu-west-1/ses/aws4_request") {
+		t.Errorf("unexpected authorization: %q", auth)
+	}
+	if r.Header.Get("X-Amz-Date") == "" || r.Header.Get("X-Amz-Content-Sha256") == "" {
+		t.Errorf("missing signature headers: %v", r.Header)
+	}
+}
+
+func TestSESProvider_Send(t *testing.T) {
+	tests := []struct {
+		name             string
+		configurationSet string
+		wantTags         []map[string]string
+	}{
+		{name: "no configuration set"},
+		{
+			name:             "configuration set",
+			configurationSet: "events",
+			wantTags:         []map[string]string{{"Name": "msg_id", "Value": "msg-1"}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var payload struct {
+				FromEmailAddress     string
+				Destination          map[string][]string
+				Content              struct{ Raw struct{ Data []byte } }
+				ConfigurationSetName string
+				EmailTags            []map[string]string
+			}
+			p := newTestProvider(t, tc.configurationSet, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost || r.URL.Path != "/v2/email/outbound-emails" {
+					t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+				}
+				checkSigned(t, r)
+				if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+					t.Errorf("failed to decode payload: %v", err)
+				}
+				io.WriteString(w, `{"MessageId":"ses-message-id"}`)
+			})
+
+			res, err := p.Send(context.Background(), testMessage())
+			if err != nil {
+				t.Fatalf("send failed: %v", err)
+			}
+			if res.MessageID != "ses-message-id" {
+				t.Errorf("got message id %q, want ses-message-id", res.MessageID)
+			}
+			if len(res.Recipients) != 3 || len(res.Accepted()) != 3 {
+				t.Errorf("unexpected recipient results: %+v", res.Recipients)
+			}
+
+			if payload.FromEmailAddress != "sender@example.org" {
+				t.Errorf("got from %q", payload.FromEmailAddress)
+			}
+			wantDestination := map[string][]string{
+				"ToAddresses":  {"to@example.com"},
+				"CcAddresses":  {"cc@example.com"},
+				"BccAddresses": {"bcc@example.com"},
+			}
+			if !reflect.DeepEqual(payload.Destination, wantDestination) {
+				t.Errorf("got destination %v, want %v", payload.Destination, wantDestination)
+			}
+			if payload.ConfigurationSetName != tc.configurationSet || !reflect.DeepEqual(payload.EmailTags, tc.wantTags) {
+				t.Errorf("got configuration set %q and tags %v", payload.ConfigurationSetName, payload.EmailTags)
+			}
+
+			// The blind carbon copy recipients are only a part of the destination.
+			raw, err := mail.ReadMessage(strings.NewReader(string(payload.Content.Raw.Data)))
+			if err != nil {
+				t.Fatalf("failed to parse raw message: %v", err)
+			}
+			if raw.Header.Get("Subject") != "Hello" || raw.Header.Get("To") == "" || raw.Header.Get("Bcc") != "" {
+				t.Errorf("unexpected raw message header: %v", raw.Header)
+			}
+		})
+	}
+}
+
+func TestSESProvider_Send_Errors(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		errType   string
+		body      string
+		auth      bool
+		temporary bool
+		category  mailprovider2.ErrorCategory
+		message   string
+	}{
+		{
+			name:      "throttling",
+			status:    http.StatusTooManyRequests,
+			errType:   "TooManyRequestsException:http://internal.amazon.com/coral/com.amazonaws.ses/",
+			body:      `{"message":"Too many requests."}`,
+			temporary: true,
+			category:  mailprovider2.CategoryRateLimited,
+			message:   "TooManyRequestsException: Too many requests.",
+		},
+		{
+			name:      "sending quota",
+			status:    http.StatusTooManyRequests,
+			body:      `{"__type":"com.amazonaws.ses#LimitExceededException","message":"Daily message quota exceeded."}`,
+			temporary: true,
+			category:  mailprovider2.CategoryQuotaExceeded,
+			message:   "LimitExceededException: Daily message quota exceeded.",
+		},
+		{
+			name:     "message rejected",
+			status:   http.StatusBadRequest,
+			body:     `{"__type":"com.amazonaws.ses#MessageRejected","Message":"Email address is not verified."}`,
+			category: mailprovider2.CategoryPolicy,
+			message:  "MessageRejected: Email address is not verified.",
+		},
+		{
+			name:    "bad request",
+			status:  http.StatusBadRequest,
+			errType: "BadRequestException",
+			body:    `{"message":"Missing required field."}`,
+			message: "BadRequestException: Missing required field.",
+		},
+		{
+			name:    "invalid signature",
+			status:  http.StatusForbidden,
+			errType: "SignatureDoesNotMatch",
+			body:    `{"message":"The request signature we calculated does not match the signature you provided."}`,
+			auth:    true,
+		},
+		{name: "server error", status: http.StatusInternalServerError, temporary: true, message: "500 Internal Server Error"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestProvider(t, "", func(w http.ResponseWriter, r *http.Request) {
+				if tc.errType != "" {
+					w.Header().Set("X-Amzn-ErrorType", tc.errType)
+				}
+				w.WriteHeader(tc.status)
+				io.WriteString(w, tc.body)
+			})
+
+			_, err := p.Send(context.Background(), testMessage())
+			if err == nil {
+				t.Fatal("send succeeded, want error")
+			}
+
+			var authErr *mailprovider2.AuthErr
+			if tc.auth {
+				if !errors.As(err, &authErr) {
+					t.Fatalf("got %T %v, want auth error", err, err)
+				}
+				return
+			}
+
+			var e *mailprovider2.Error
+			if !errors.As(err, &e) {
+				t.Fatalf("got %T %v, want mailprovider error", err, err)
+			}
+			if e.Temporary != tc.temporary || e.Category != tc.category || e.Code != tc.status {
+				t.Errorf("got temporary %t category %s code %d, want %t %s %d", e.Temporary, e.Category, e.Code, tc.temporary, tc.category, tc.status)
+			}
+			if e.Message != tc.message {
+				t.Errorf("got message %q, want %q", e.Message, tc.message)
+			}
+		})
+	}
+}
+
+func TestSESProvider_Verify(t *testing.T) {
+	notFound := `{"message":"Identity does not exist."}`
+	tests := []struct {
+		name       string
+		identities map[string]string
+		status     int
+		verified   bool
+		auth       bool
+	}{
+		{
+			name:       "address identity",
+			identities: map[string]string{"sender@example.org": `{"VerifiedForSendingStatus":true,"VerificationStatus":"SUCCESS"}`},
+			verified:   true,
+		},
+		{
+			name:       "domain identity",
+			identities: map[string]string{"example.org": `{"VerifiedForSendingStatus":true,"VerificationStatus":"SUCCESS"}`},
+			verified:   true,
+		},
+		{
+			name:       "pending identity",
+			identities: map[string]string{"sender@example.org": `{"VerifiedForSendingStatus":false,"VerificationStatus":"PENDING"}`},
+		},
+		{name: "no identity"},
+		{name: "unauthorized", status: http.StatusForbidden, auth: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestProvider(t, "", func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodGet || !strings.HasPrefix(r.URL.Path, "/v2/email/identities/") {
+					t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+				}
+				checkSigned(t, r)
+				if tc.status != 0 {
+					w.Header().Set("X-Amzn-ErrorType", "AccessDeniedException")
+					w.WriteHeader(tc.status)
+					return
+				}
+
+				body, ok := tc.identities[strings.TrimPrefix(r.URL.Path, "/v2/email/identities/")]
+				if !ok {
+					w.Header().Set("X-Amzn-ErrorType", "NotFoundException")
+					w.WriteHeader(http.StatusNotFound)
+					io.WriteString(w, notFound)
+					return
+				}
+				io.WriteString(w, body)
+			})
+
+			err := p.Verify(context.Background())
+			if tc.verified != (err == nil) {
+				t.Fatalf("got error %v, want verified %t", err, tc.verified)
+			}
+			if p.IsVerified() != tc.verified {
+				t.Fatalf("got verified %t, want %t", p.IsVerified(), tc.verified)
+			}
+
+			var authErr *mailprovider2.AuthErr
+			if tc.auth && !errors.As(err, &authErr) {
+				t.Fatalf("got %T %v, want auth error", err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package sesmailprovider
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignRequest(t *testing.T) {
+	creds := credentials{
+		accessKeyID:     "AKIDEXAMPLE",
+		secretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	now := time.Date(2023, 10, 17, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		method       string
+		url          string
+		body         string
+		contentType  string
+		sessionToken string
+		region       string
+		wantHash     string
+		wantAuth     string
+	}{
+		{
+			name:        "send",
+			method:      http.MethodPost,
+			url:         "https://email.us-east-1.amazonaws.com/v2/email/outbound-emails",
+			body:        `{"FromEmailAddress":"sender@example.org"}`,
+			contentType: "application/json",
+			region:      "us-east-1",
+			wantHash:    "1ec9190b89e8e3cfa8e3d07d301dc27e10d6f32fb85cd671613f0447d6751cb9",
+			wantAuth: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20231017/us-east-1/ses/aws4_request, " +
+				"SignedHeaders=content-type;host;x-amz-content-sha256;x-amz-date, " +
+				"Signature=6c29df96710a29d26fe1ad9345a0685f56a39d7f358ef7f0d1965bb797d8f12d",
+		},
+		{
+			// The escaped path segment is encoded once again, the session token is signed.
+			name:         "escaped path with session token",
+			method:       http.MethodGet,
+			url:          "https://email.eu-west-1.amazonaws.com/v2/email/identities/sender%40example.org",
+			sessionToken: "session-token",
+			region:       "eu-west-1",
+			wantHash:     "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			wantAuth: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20231017/eu-west-1/ses/aws4_request, " +
+				"SignedHeaders=host;x-amz-content-sha256;x-amz-date;x-amz-security-token, " +
+				"Signature=f62e8451a46d7a09bf2e2b2b2138f71c0249526b896abdc8dc45787d31ff0325",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, tc.url, strings.NewReader(tc.body))
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			if tc.contentType != "" {
+				req.Header.Set("Content-Type", tc.contentType)
+			}
+
+			c := creds
+			c.sessionToken = tc.sessionToken
+			signRequest(req, []byte(tc.body), c, tc.region, now.In(time.FixedZone("CEST", 2*60*60)))
+
+			if got := req.Header.Get("X-Amz-Date"); got != "20231017T120000Z" {
+				t.Errorf("got date %q, want the UTC time", got)
+			}
+			if got := req.Header.Get("X-Amz-Content-Sha256"); got != tc.wantHash {
+				t.Errorf("got payload hash %q, want %q", got, tc.wantHash)
+			}
+			if got := req.Header.Get("X-Amz-Security-Token"); got != tc.sessionToken {
+				t.Errorf("got session token %q, want %q", got, tc.sessionToken)
+			}
+			if got := req.Header.Get("Authorization"); got != tc.wantAuth {
+				t.Errorf("got authorization\n%s\nwant\n%s", got, tc.wantAuth)
+			}
+		})
+	}
+}
@@ -0,0 +1,296 @@
+package smtpmailprovider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
+	mailprovider2 "github.com/blockysource/mailing/logic/mailprovider"
+)
+
+// authenticate authenticates the smtp client session with the configured mechanism.
+// If no mechanism is configured, it is negotiated from the mechanisms advertised by the server.
+func (s *SMTPProvider) authenticate(ctx context.Context, c *smtp.Client) error {
+	s.l.RLock()
+	mech := s.cfg.AuthMechanism
+	ts := s.ts
+	s.l.RUnlock()
+
+	// The relay restricted by the IP address doesn't need the authentication.
+	if mech == mailingpb.SMTP_AUTH_NONE {
+		return nil
+	}
+
+	ok, params := c.Extension("AUTH")
+	if !ok {
+		s.log.WithField("host", s.host()).Debug("smtp server does not support authentication")
+		return mailprovider2.ErrAuth(errors.New("smtp server does not support authentication"))
+	}
+	advertised := strings.Fields(strings.ToUpper(params))
+
+	if mech == mailingpb.SMTP_AUTH_AUTO {
+		_, isTLS := c.TLSConnectionState()
+		mech = negotiateAuthMechanism(advertised, isTLS, ts != nil)
+		if mech == mailingpb.SMTP_AUTH_AUTO {
+			return mailprovider2.ErrAuth(fmt.Errorf("no supported authentication mechanism in: %s", params))
+		}
+	} else if !containsMechanism(advertised, authMechanismName(mech)) {
+		return mailprovider2.ErrAuth(fmt.Errorf("smtp server does not support %s authentication", authMechanismName(mech)))
+	}
+
+	a, err := s.auth(ctx, mech, ts)
+	if err != nil {
+		s.log.WithError(err).Debug("failed to prepare smtp authentication")
+		return mailprovider2.ErrAuth(err)
+	}
+
+	if err = c.Auth(a); err != nil {
+		s.log.WithError(err).Debug("failed to authenticate smtp client")
+		if mech == mailingpb.SMTP_AUTH_XOAUTH2 {
+			// The token might have been revoked, force the refresh on the next attempt.
+			ts.invalidate()
+		}
+		return mailprovider2.ErrAuth(fmt.Errorf("failed to authenticate smtp client: %w", err))
+	}
+	return nil
+}
+
+func (s *SMTPProvider) auth(ctx context.Context, mech mailingpb.SMTPAuthMechanism, ts *oauth2TokenSource) (smtp.Auth, error) {
+	s.l.RLock()
+	username := s.cfg.Username.UnsafeString()
+	password := s.cfg.Password.UnsafeString()
+	host := s.cfg.Host.UnsafeString()
+	s.l.RUnlock()
+
+	switch mech {
+	case mailingpb.SMTP_AUTH_PLAIN:
+		return smtp.PlainAuth("", username, password, host), nil
+	case mailingpb.SMTP_AUTH_LOGIN:
+		return &loginAuth{username: username, password: password, host: host}, nil
+	case mailingpb.SMTP_AUTH_CRAM_MD5:
+		return smtp.CRAMMD5Auth(username, password), nil
+	case mailingpb.SMTP_AUTH_XOAUTH2:
+		if ts == nil {
+			return nil, errors.New("xoauth2 authentication requires oauth2 configuration")
+		}
+		token, err := ts.Token(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get oauth2 token: %w", err)
+		}
+		return &xoauth2Auth{username: username, token: token}, nil
+	default:
+		return nil, fmt.Errorf("unsupported authentication mechanism: %s", mech)
+	}
+}
+
+// negotiateAuthMechanism selects the authentication mechanism from the ones advertised by the server.
+// The XOAUTH2 is preferred if the token source is configured, and the CRAM-MD5 is preferred over plain
+// text mechanisms on the connections that are not encrypted.
+func negotiateAuthMechanism(advertised []string, isTLS, hasTokenSource bool) mailingpb.SMTPAuthMechanism {
+	preferred := []mailingpb.SMTPAuthMechanism{mailingpb.SMTP_AUTH_PLAIN, mailingpb.SMTP_AUTH_LOGIN, mailingpb.SMTP_AUTH_CRAM_MD5}
+	if !isTLS {
+		preferred = []mailingpb.SMTPAuthMechanism{mailingpb.SMTP_AUTH_CRAM_MD5, mailingpb.SMTP_AUTH_PLAIN, mailingpb.SMTP_AUTH_LOGIN}
+	}
+	if hasTokenSource {
+		preferred = append([]mailingpb.SMTPAuthMechanism{mailingpb.SMTP_AUTH_XOAUTH2}, preferred...)
+	}
+
+	for _, mech := range preferred {
+		if containsMechanism(advertised, authMechanismName(mech)) {
+			return mech
+		}
+	}
+	return mailingpb.SMTP_AUTH_AUTO
+}
+
+func containsMechanism(advertised []string, name string) bool {
+	for _, a := range advertised {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+func authMechanismName(mech mailingpb.SMTPAuthMechanism) string {
+	switch mech {
+	case mailingpb.SMTP_AUTH_PLAIN:
+		return "PLAIN"
+	case mailingpb.SMTP_AUTH_LOGIN:
+		return "LOGIN"
+	case mailingpb.SMTP_AUTH_CRAM_MD5:
+		return "CRAM-MD5"
+	case mailingpb.SMTP_AUTH_XOAUTH2:
+		return "XOAUTH2"
+	default:
+		return ""
+	}
+}
+
+// loginAuth implements the LOGIN authentication mechanism.
+type loginAuth struct {
+	username, password, host string
+}
+
+// Start begins the LOGIN authentication.
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// Same as the PLAIN mechanism, the LOGIN sends the credentials in cleartext.
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+// Next responds to the username and password challenges.
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected server challenge: %s", fromServer)
+	}
+}
+
+// xoauth2Auth implements the XOAUTH2 authentication mechanism.
+type xoauth2Auth struct {
+	username, token string
+}
+
+// Start begins the XOAUTH2 authentication with the initial response.
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// The bearer token grants access to the whole mailbox, it is never sent in cleartext.
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+// Next responds to the server error challenge with an empty response, so that the server could finish the exchange.
+func (a *xoauth2Auth) Next(_ []byte, more bool) ([]byte, error) {
+	if more {
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+func isLocalhost(name string) bool {
+	if name == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(name)
+	return ip != nil && ip.IsLoopback()
+}
+
+// tokenExpiryDelta is the time before the token expiry at which the token is refreshed.
+const tokenExpiryDelta = 30 * time.Second
+
+// oauth2TokenSource is a source of the oauth2 access tokens, refreshed with the refresh token grant.
+type oauth2TokenSource struct {
+	l            sync.Mutex
+	cfg          mailingpb.SMTPOAuth2Config
+	client       *http.Client
+	refreshToken string
+	token        string
+	expiry       time.Time
+}
+
+func newOAuth2TokenSource(cfg *mailingpb.SMTPOAuth2Config) *oauth2TokenSource {
+	if cfg == nil {
+		return nil
+	}
+	return &oauth2TokenSource{
+		cfg:          *cfg,
+		client:       &http.Client{Timeout: 30 * time.Second},
+		refreshToken: cfg.RefreshToken.UnsafeString(),
+	}
+}
+
+// Token returns a valid access token, refreshing it if it is missing or about to expire.
+func (t *oauth2TokenSource) Token(ctx context.Context) (string, error) {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	if t.token != "" && (t.expiry.IsZero() || time.Now().Add(tokenExpiryDelta).Before(t.expiry)) {
+		return t.token, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {t.refreshToken},
+		"client_id":     {t.cfg.ClientID},
+	}
+	if secret := t.cfg.ClientSecret.UnsafeString(); secret != "" {
+		form.Set("client_secret", secret)
+	}
+	if len(t.cfg.Scopes) > 0 {
+		form.Set("scope", strings.Join(t.cfg.Scopes, " "))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.cfg.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to refresh oauth2 token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("failed to read oauth2 token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to refresh oauth2 token: %s: %s", resp.Status, body)
+	}
+
+	var tr struct {
+		AccessToken  string `json:"access_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err = json.Unmarshal(body, &tr); err != nil {
+		return "", fmt.Errorf("failed to decode oauth2 token response: %w", err)
+	}
+	if tr.AccessToken == "" {
+		return "", errors.New("oauth2 token response has no access token")
+	}
+
+	t.token = tr.AccessToken
+	t.expiry = time.Time{}
+	if tr.ExpiresIn > 0 {
+		t.expiry = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	}
+	// Some authorization servers rotate the refresh tokens.
+	if tr.RefreshToken != "" {
+		t.refreshToken = tr.RefreshToken
+	}
+	return t.token, nil
+}
+
+// invalidate drops the cached access token.
+func (t *oauth2TokenSource) invalidate() {
+	t.l.Lock()
+	t.token = ""
+	t.l.Unlock()
+}
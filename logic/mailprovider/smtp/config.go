@@ -1,18 +1,100 @@
 package smtpmailprovider
 
 import (
+	"context"
 	"net"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/blockysource/blocky/pkg/go/geoip"
 	"github.com/blockysource/blocky/services/mailing/public/mailing"
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
 )
 
 // SMTPProvidersConfig is a configuration used for SMTP providers.
 // It provides common configuration for the SMTP providers, like the domain name used for the HELO command.
 type SMTPProvidersConfig struct {
 	Domain string
+
+	// MaxConnections is the maximum number of open smtp sessions per provider.
+	MaxConnections int
+	// MaxIdleTime is the maximum time an authenticated session is kept idle in the pool.
+	MaxIdleTime time.Duration
+	// MaxMessagesPerConn is the maximum number of messages sent over a single session.
+	MaxMessagesPerConn int
+	// Resolver is the DNS resolver used to lookup the mail exchangers and the DKIM records.
+	// If it is nil, the net.DefaultResolver is used.
+	Resolver Resolver
+}
+
+// Resolver is the DNS resolver used by the SMTP providers, implemented by the *net.Resolver.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// resolver returns the configured resolver, or the default one.
+func (c *SMTPProvidersConfig) resolver() Resolver {
+	if c.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return c.Resolver
+}
+
+const (
+	// DefaultMaxConnections is the default maximum number of open smtp sessions per provider.
+	DefaultMaxConnections = 4
+	// DefaultMaxIdleTime is the default maximum idle time of a pooled smtp session.
+	DefaultMaxIdleTime = 30 * time.Second
+	// DefaultMaxMessagesPerConn is the default maximum number of messages sent over a single smtp session.
+	DefaultMaxMessagesPerConn = 100
+)
+
+const (
+	// DefaultConnectTimeout is the default timeout of dialing the smtp server.
+	DefaultConnectTimeout = 10 * time.Second
+	// DefaultGreetingTimeout is the default timeout of waiting for the smtp server greeting.
+	DefaultGreetingTimeout = 30 * time.Second
+	// DefaultCommandTimeout is the default timeout of a single smtp command.
+	DefaultCommandTimeout = time.Minute
+	// DefaultDataTimeout is the default timeout of sending the message data, including the server reply.
+	DefaultDataTimeout = 5 * time.Minute
+)
+
+// smtpTimeouts are the timeouts of the smtp session phases.
+type smtpTimeouts struct {
+	connect  time.Duration
+	greeting time.Duration
+	command  time.Duration
+	data     time.Duration
+}
+
+// newSMTPTimeouts returns the configured timeouts, using the defaults for the ones that are not set.
+func newSMTPTimeouts(cfg *mailingpb.SMTPTimeouts) smtpTimeouts {
+	t := smtpTimeouts{
+		connect:  DefaultConnectTimeout,
+		greeting: DefaultGreetingTimeout,
+		command:  DefaultCommandTimeout,
+		data:     DefaultDataTimeout,
+	}
+	if cfg == nil {
+		return t
+	}
+	if cfg.ConnectTimeout > 0 {
+		t.connect = cfg.ConnectTimeout
+	}
+	if cfg.GreetingTimeout > 0 {
+		t.greeting = cfg.GreetingTimeout
+	}
+	if cfg.CommandTimeout > 0 {
+		t.command = cfg.CommandTimeout
+	}
+	if cfg.DataTimeout > 0 {
+		t.data = cfg.DataTimeout
+	}
+	return t
 }
 
 // NewSMTPProvidersConfig creates a new SMTP providers configuration.
@@ -63,5 +145,10 @@ func NewSMTPProvidersConfig(cfg *mailing.Config, log *logrus.Entry) (*SMTPProvid
 		}
 	}
 
-	return &SMTPProvidersConfig{Domain: domain}, nil
+	return &SMTPProvidersConfig{
+		Domain:             domain,
+		MaxConnections:     DefaultMaxConnections,
+		MaxIdleTime:        DefaultMaxIdleTime,
+		MaxMessagesPerConn: DefaultMaxMessagesPerConn,
+	}, nil
 }
@@ -0,0 +1,75 @@
+package smtpmailprovider
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
+	mailprovider2 "github.com/blockysource/mailing/logic/mailprovider"
+)
+
+// Register registers the factories of the SMTP, MX and LMTP providers, that share the input config.
+func Register(r *mailprovider2.Registry, mc *SMTPProvidersConfig) error {
+	factories := []mailprovider2.Factory{
+		{
+			Type: mailingpb.SMTP,
+			Validate: func(cfg *mailingpb.MailingProviderConfig) error {
+				return cfg.GetSmtpConfig().Validate()
+			},
+			New: func(_ context.Context, def mailprovider2.MailingProviderDefinition, log *logrus.Entry) (mailprovider2.Provider, error) {
+				p, err := New(mc, def, log)
+				if err != nil {
+					return nil, err
+				}
+				return p, nil
+			},
+			SecretFields: []string{
+				"smtp_config.host",
+				"smtp_config.username",
+				"smtp_config.password",
+				"smtp_config.oauth2.client_secret",
+				"smtp_config.oauth2.refresh_token",
+				"smtp_config.dkim_keys.private_key",
+				"smtp_config.tls.client_key",
+			},
+		},
+		{
+			Type: mailingpb.MX,
+			Validate: func(cfg *mailingpb.MailingProviderConfig) error {
+				return cfg.GetMxConfig().Validate()
+			},
+			New: func(_ context.Context, def mailprovider2.MailingProviderDefinition, log *logrus.Entry) (mailprovider2.Provider, error) {
+				p, err := NewMX(mc, def, log)
+				if err != nil {
+					return nil, err
+				}
+				return p, nil
+			},
+			SecretFields: []string{
+				"mx_config.dkim_keys.private_key",
+				"mx_config.tls.client_key",
+			},
+		},
+		{
+			Type: mailingpb.LMTP,
+			Validate: func(cfg *mailingpb.MailingProviderConfig) error {
+				return cfg.GetLmtpConfig().Validate()
+			},
+			New: func(_ context.Context, def mailprovider2.MailingProviderDefinition, log *logrus.Entry) (mailprovider2.Provider, error) {
+				p, err := NewLMTP(mc, def, log)
+				if err != nil {
+					return nil, err
+				}
+				return p, nil
+			},
+		},
+	}
+
+	for _, f := range factories {
+		if err := r.Register(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,401 @@
+package smtpmailprovider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
+	mailprovider2 "github.com/blockysource/mailing/logic/mailprovider"
+	mailproviderwriter "github.com/blockysource/mailing/logic/mailprovider/writer"
+)
+
+// Compile-time check to verify implements interface.
+var _ mailprovider2.Provider = (*LMTPProvider)(nil)
+
+// LMTPProvider is a provider that delivers emails over the LMTP (RFC 2033) to the local mail store, i.e. the Dovecot.
+// Contrary to the SMTP, the server replies to the end of the message data once for each accepted recipient,
+// so that the delivery status of each recipient is reported individually.
+type LMTPProvider struct {
+	l sync.RWMutex
+
+	pc          *SMTPProvidersConfig
+	p           mailprovider2.MailingProviderDefinition
+	fromAddress *mail.Address
+	cfg         mailingpb.LMTPConfig
+	log         *logrus.Entry
+	isVerified  bool
+}
+
+// NewLMTP creates a new LMTP provider.
+func NewLMTP(mc *SMTPProvidersConfig, p mailprovider2.MailingProviderDefinition, log *logrus.Entry) (*LMTPProvider, error) {
+	cfg := p.Config.GetLmtpConfig()
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	return &LMTPProvider{
+		pc:  mc,
+		p:   p,
+		cfg: *cfg,
+		log: log.WithFields(logrus.Fields{
+			"provider_id": p.UID,
+			"provider":    mailingpb.LMTP,
+		}),
+	}, nil
+}
+
+// Close closes the provider. The provider keeps no sessions open between the messages.
+func (l *LMTPProvider) Close() {}
+
+// GetID returns the ID of the provider.
+func (l *LMTPProvider) GetID() string {
+	return l.p.UID
+}
+
+// GetDefinition returns the provider definition.
+func (l *LMTPProvider) GetDefinition() mailprovider2.MailingProviderDefinition {
+	return l.p
+}
+
+// Type returns the type of the provider.
+func (l *LMTPProvider) Type() mailingpb.MailingProviderType {
+	return mailingpb.LMTP
+}
+
+// IsVerified returns whether the provider is verified.
+func (l *LMTPProvider) IsVerified() bool {
+	l.l.RLock()
+	defer l.l.RUnlock()
+
+	return l.isVerified
+}
+
+// UpdateConfig updates the config of the provider.
+func (l *LMTPProvider) UpdateConfig(config *mailingpb.MailingProviderConfig) error {
+	cfg := config.GetLmtpConfig()
+	if cfg == nil {
+		return fmt.Errorf("invalid config type: %T", config)
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	l.l.Lock()
+	l.cfg = *cfg
+	l.l.Unlock()
+	return nil
+}
+
+// GetConfig returns the config of the provider.
+func (l *LMTPProvider) GetConfig() mailingpb.MailingProviderConfig {
+	l.l.RLock()
+	defer l.l.RUnlock()
+
+	cfg := l.cfg
+	return mailingpb.MailingProviderConfig{
+		Config: &mailingpb.MailingProviderConfig_LmtpConfig{
+			LmtpConfig: &cfg,
+		},
+	}
+}
+
+// GetDefaultFromAddress returns the default from address.
+func (l *LMTPProvider) GetDefaultFromAddress() *mail.Address {
+	l.l.RLock()
+	defer l.l.RUnlock()
+
+	return l.fromAddress
+}
+
+// Verify verifies that the LMTP server is reachable and accepts the session.
+func (l *LMTPProvider) Verify(ctx context.Context) error {
+	s, err := l.connect(ctx)
+	if err != nil {
+		l.log.WithError(err).Debug("failed to connect to lmtp server")
+		return err
+	}
+
+	stop := s.pc.watch(ctx)
+	s.quit()
+	stop()
+
+	l.l.Lock()
+	l.isVerified = true
+	l.l.Unlock()
+	return nil
+}
+
+// Send lets the provider send the input message.
+func (l *LMTPProvider) Send(ctx context.Context, msg *mailprovider2.Message) (*mailprovider2.SendResult, error) {
+	s, err := l.connect(ctx)
+	if err != nil {
+		l.log.WithFields(logrus.Fields{
+			"msg_id":        msg.ID,
+			logrus.ErrorKey: err,
+		}).Debug("failed to connect to lmtp server")
+		return nil, err
+	}
+
+	stop := s.pc.watch(ctx)
+	defer stop()
+
+	log := l.log.WithField("msg_id", msg.ID)
+	mw := mailproviderwriter.Writer{Domain: l.pc.Domain}
+	res, healthy, err := s.sendTransaction(ctx, mw, msg, log)
+	if healthy {
+		s.quit()
+	} else {
+		s.pc.conn.Close()
+	}
+
+	if ctxErr := ctx.Err(); ctxErr != nil && err != nil {
+		// The session was aborted by the context, the delivery outcome is unknown.
+		return res, mailprovider2.ErrTemporary(fmt.Errorf("failed to send message: %w", ctxErr))
+	}
+	if err != nil {
+		return res, err
+	}
+
+	log.WithFields(logrus.Fields{
+		"recipients_number": len(res.Recipients),
+		"rejected":          len(res.Rejected()),
+	}).Debug("email message delivered")
+	return res, nil
+}
+
+// lmtpSession is an established LMTP session, after the LHLO.
+type lmtpSession struct {
+	pc  *pooledConn
+	ext serverExtensions
+}
+
+// connect dials the LMTP server, reads its greeting and introduces the client with the LHLO.
+func (l *LMTPProvider) connect(ctx context.Context) (*lmtpSession, error) {
+	l.l.RLock()
+	network, address := lmtpAddr(l.cfg.Network, l.cfg.Address)
+	timeouts := newSMTPTimeouts(l.cfg.Timeouts)
+	l.l.RUnlock()
+
+	d := net.Dialer{Timeout: timeouts.connect}
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, handleErr(fmt.Errorf("failed to dial lmtp server: %w", err))
+	}
+
+	// The client is used only for its text connection, as its methods would send the EHLO instead of the LHLO.
+	t := textproto.NewConn(conn)
+	pc := &pooledConn{c: &smtp.Client{Text: t}, conn: conn, timeouts: timeouts}
+
+	stop := pc.watch(ctx)
+	defer stop()
+
+	pc.setDeadline(timeouts.greeting)
+	if _, _, err = t.ReadResponse(220); err != nil {
+		conn.Close()
+		return nil, handleErr(fmt.Errorf("failed to read lmtp server greeting: %w", err))
+	}
+
+	pc.setDeadline(timeouts.command)
+	id, err := t.Cmd("LHLO %s", l.pc.Domain)
+	if err != nil {
+		conn.Close()
+		return nil, handleErr(err)
+	}
+	t.StartResponse(id)
+	_, reply, err := t.ReadResponse(250)
+	t.EndResponse(id)
+	if err != nil {
+		conn.Close()
+		return nil, handleErr(fmt.Errorf("failed to say hello to lmtp server: %w", err))
+	}
+
+	return &lmtpSession{pc: pc, ext: lhloExtensions(reply)}, nil
+}
+
+// lmtpAddr returns the network and the address of the LMTP server, the absolute paths are the unix sockets.
+func lmtpAddr(network, address string) (string, string) {
+	if network != "" {
+		return network, address
+	}
+	if strings.HasPrefix(address, "/") {
+		return "unix", address
+	}
+	return "tcp", address
+}
+
+// lhloExtensions returns the extensions advertised in the LHLO reply, the first line of which is the greeting.
+func lhloExtensions(reply string) serverExtensions {
+	exts := make(map[string]string)
+	lines := strings.Split(reply, "\n")
+	for _, line := range lines[1:] {
+		k, v, _ := strings.Cut(line, " ")
+		exts[strings.ToUpper(k)] = v
+	}
+	return parseExtensions(func(ext string) (bool, string) {
+		v, ok := exts[ext]
+		return ok, v
+	})
+}
+
+// sendTransaction sends the message to all its recipients.
+// The returned healthy flag reports whether the session could still be ended gracefully.
+func (s *lmtpSession) sendTransaction(ctx context.Context, mw mailproviderwriter.Writer, msg *mailprovider2.Message, log *logrus.Entry) (*mailprovider2.SendResult, bool, error) {
+	ext := s.ext
+	rcpts := msg.Recipients()
+
+	if needsSMTPUTF8(msg) && !ext.smtpUTF8 {
+		return nil, true, mailprovider2.ErrPermanent(errors.New("lmtp server does not support SMTPUTF8 required by the message addresses"))
+	}
+
+	var sp mailproviderwriter.Spool
+	defer sp.Close()
+
+	mw.EightBit = ext.eightBitMIME
+	if err := mw.Render(ctx, msg, &sp); err != nil {
+		log.WithError(err).Debug("failed to write message")
+		return nil, true, mailprovider2.AsError(err, true)
+	}
+
+	if ext.size > 0 && sp.Size() > ext.size {
+		return nil, true, &mailprovider2.Error{
+			Err:      fmt.Errorf("message size %d exceeds the lmtp server limit of %d bytes", sp.Size(), ext.size),
+			Category: mailprovider2.CategoryMessageTooLarge,
+		}
+	}
+
+	cmds := make([]string, 0, len(rcpts)+1)
+	cmds = append(cmds, mailCommand(msg, ext, sp.Size()))
+	for _, to := range rcpts {
+		cmds = append(cmds, rcptCommand(msg, to, ext))
+	}
+
+	replies, err := cmdReply(s.pc, ext.pipelining, cmds)
+	if err != nil {
+		log.WithError(err).Debug("failed to start mail transaction")
+		return nil, false, handleErr(err)
+	}
+	if err = replies[0]; err != nil {
+		log.WithError(err).Debug("failed to set sender")
+		return nil, true, handleErr(err)
+	}
+
+	res := &mailprovider2.SendResult{}
+	var accepted []int
+	for i, to := range rcpts {
+		if err = replies[i+1]; err != nil {
+			log.WithFields(logrus.Fields{
+				"to":            to.String(),
+				logrus.ErrorKey: err,
+			}).Debug("failed to set recipient")
+			res.Recipients = append(res.Recipients, rejectedRecipient(to.Address, err))
+			continue
+		}
+		accepted = append(accepted, len(res.Recipients))
+		res.Recipients = append(res.Recipients, mailprovider2.RecipientResult{
+			Address: to.Address,
+			Status:  mailprovider2.RecipientAccepted,
+		})
+	}
+	if err = res.Err(); err != nil {
+		// The transaction needs to be reset, unless the session is ended right away.
+		return res, true, err
+	}
+
+	// The data is followed by the reply of each accepted recipient, in the order of the RCPT commands.
+	dataReplies, err := s.writeData(&sp, len(accepted))
+	for i, idx := range accepted {
+		switch {
+		case i < len(dataReplies) && dataReplies[i] == nil:
+		case i < len(dataReplies):
+			log.WithFields(logrus.Fields{
+				"to":            res.Recipients[idx].Address,
+				logrus.ErrorKey: dataReplies[i],
+			}).Debug("message rejected for recipient")
+			res.Recipients[idx] = rejectedDelivery(res.Recipients[idx].Address, dataReplies[i])
+		default:
+			// The session failed before the reply, the delivery outcome is unknown.
+			res.Recipients[idx] = rejectedRecipient(res.Recipients[idx].Address, err)
+		}
+	}
+	if err != nil {
+		log.WithError(err).Debug("failed to send message data")
+		return res, isReplyErr(err), handleErr(err)
+	}
+
+	if err = res.Err(); err != nil {
+		return res, true, err
+	}
+	return res, true, nil
+}
+
+// writeData sends the message content and reads the replies of the accepted recipients.
+// The returned error is set if the data could not be sent, or the session failed before all the replies were read.
+func (s *lmtpSession) writeData(sp *mailproviderwriter.Spool, n int) ([]error, error) {
+	r, err := sp.Reader()
+	if err != nil {
+		return nil, err
+	}
+
+	t := s.pc.c.Text
+	s.pc.setDeadline(s.pc.timeouts.data)
+
+	var id uint
+	if s.ext.chunking {
+		id = t.Next()
+		t.StartRequest(id)
+		err = writeChunk(t.W, sp.Size(), r)
+		t.EndRequest(id)
+	} else {
+		if id, err = t.Cmd("DATA"); err != nil {
+			return nil, err
+		}
+		if err = readReply(t, id, 354); err != nil {
+			return nil, err
+		}
+
+		id = t.Next()
+		t.StartRequest(id)
+		w := t.DotWriter()
+		if _, err = io.Copy(w, r); err == nil {
+			err = w.Close()
+		}
+		t.EndRequest(id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	t.StartResponse(id)
+	defer t.EndResponse(id)
+
+	replies := make([]error, 0, n)
+	for i := 0; i < n; i++ {
+		_, _, err = t.ReadResponse(250)
+		if err != nil && !isReplyErr(err) {
+			return replies, err
+		}
+		replies = append(replies, err)
+	}
+	return replies, nil
+}
+
+// quit gracefully ends the session and closes its connection.
+// The client QUIT method is not used, as it would send the EHLO first.
+func (s *lmtpSession) quit() {
+	t := s.pc.c.Text
+	s.pc.setDeadline(s.pc.timeouts.command)
+	if id, err := t.Cmd("QUIT"); err == nil {
+		_ = readReply(t, id, 221)
+	}
+	t.Close()
+}
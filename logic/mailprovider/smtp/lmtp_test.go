@@ -0,0 +1,137 @@
+package smtpmailprovider_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
+	mailprovider2 "github.com/blockysource/mailing/logic/mailprovider"
+	smtpmailprovider "github.com/blockysource/mailing/logic/mailprovider/smtp"
+)
+
+// lmtpServer is the minimal LMTP server, which accepts the session and records the received commands.
+type lmtpServer struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	commands []string
+}
+
+func newLMTPServer(t *testing.T) *lmtpServer {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s := &lmtpServer{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *lmtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	io.WriteString(conn, "220 lmtp.example.org LMTP ready\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.Fields(line + " ")[0])
+
+		s.mu.Lock()
+		s.commands = append(s.commands, cmd)
+		s.mu.Unlock()
+
+		switch cmd {
+		case "LHLO":
+			io.WriteString(conn, "250-lmtp.example.org\r\n250 8BITMIME\r\n")
+		case "QUIT":
+			io.WriteString(conn, "221 Bye\r\n")
+			return
+		default:
+			io.WriteString(conn, "250 OK\r\n")
+		}
+	}
+}
+
+func (s *lmtpServer) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+func newLMTPProvider(t *testing.T, srv *lmtpServer) *smtpmailprovider.LMTPProvider {
+	t.Helper()
+
+	cfg := &mailingpb.LMTPConfig{
+		Network: "tcp",
+		Address: srv.ln.Addr().String(),
+		Timeouts: &mailingpb.SMTPTimeouts{
+			ConnectTimeout:  time.Second,
+			GreetingTimeout: time.Second,
+			CommandTimeout:  time.Second,
+			DataTimeout:     time.Second,
+		},
+	}
+	def := mailprovider2.MailingProviderDefinition{
+		UID:    "lmtp",
+		Config: &mailingpb.MailingProviderConfig{Config: &mailingpb.MailingProviderConfig_LmtpConfig{LmtpConfig: cfg}},
+	}
+
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	p, err := smtpmailprovider.NewLMTP(&smtpmailprovider.SMTPProvidersConfig{Domain: "mta.example.org"}, def, logrus.NewEntry(log))
+	if err != nil {
+		t.Fatalf("failed to create lmtp provider: %v", err)
+	}
+	t.Cleanup(p.Close)
+	return p
+}
+
+func TestLMTPProvider_Send_AttachmentError(t *testing.T) {
+	srv := newLMTPServer(t)
+	p := newLMTPProvider(t, srv)
+
+	msg := smtpMessage("alice@example.com")
+	msg.Attachments = []mailprovider2.Attachment{{
+		Filename:    "report.pdf",
+		ContentType: "application/pdf",
+		Open: func(context.Context) (io.ReadCloser, error) {
+			return nil, errors.New("store unavailable")
+		},
+	}}
+
+	// The attachment store failure keeps its temporary classification, so that the message is retried.
+	_, err := p.Send(context.Background(), msg)
+	var e *mailprovider2.Error
+	if !errors.As(err, &e) || !e.Temporary {
+		t.Fatalf("got %v, want temporary error", err)
+	}
+	for _, cmd := range srv.Commands() {
+		if cmd == "MAIL" {
+			t.Fatalf("got commands %v, want no transaction started", srv.Commands())
+		}
+	}
+}
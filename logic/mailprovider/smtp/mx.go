@@ -0,0 +1,498 @@
+package smtpmailprovider
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
+	mailprovider2 "github.com/blockysource/mailing/logic/mailprovider"
+	mailproviderwriter "github.com/blockysource/mailing/logic/mailprovider/writer"
+)
+
+// DefaultMXPort is the default port of the mail exchangers.
+const DefaultMXPort = 25
+
+// Compile-time check to verify implements interface.
+var _ mailprovider2.Provider = (*MXProvider)(nil)
+
+// MXProvider is a provider that delivers emails directly to the mail exchangers of the recipient domains.
+type MXProvider struct {
+	l sync.RWMutex
+
+	pc          *SMTPProvidersConfig
+	p           mailprovider2.MailingProviderDefinition
+	fromAddress *mail.Address
+	cfg         mailingpb.MXConfig
+	log         *logrus.Entry
+	isVerified  bool
+	dkim        *mailproviderwriter.DKIMSigner
+	tc          *tls.Config
+}
+
+// NewMX creates a new direct to MX provider.
+func NewMX(mc *SMTPProvidersConfig, p mailprovider2.MailingProviderDefinition, log *logrus.Entry) (*MXProvider, error) {
+	cfg := p.Config.GetMxConfig()
+	dkim, tc, err := parseMXConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	return &MXProvider{
+		pc:   mc,
+		p:    p,
+		cfg:  *cfg,
+		dkim: dkim,
+		tc:   tc,
+		log: log.WithFields(logrus.Fields{
+			"provider_id": p.UID,
+			"provider":    mailingpb.MX,
+		}),
+	}, nil
+}
+
+func parseMXConfig(cfg *mailingpb.MXConfig) (*mailproviderwriter.DKIMSigner, *tls.Config, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	// The mail exchangers listen for the plain connections, upgraded with the STARTTLS.
+	if cfg.TLSMode == mailingpb.SMTP_TLS_IMPLICIT {
+		return nil, nil, errors.New("implicit tls is not supported for mx delivery")
+	}
+
+	dkim, err := mailproviderwriter.NewDKIMSigner(cfg.DKIMKeys)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The server name is set for each mail exchanger.
+	tc, err := newTLSConfig("", cfg.TLS)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dkim, tc, nil
+}
+
+// Close closes the provider. The provider keeps no sessions open between the messages.
+func (m *MXProvider) Close() {}
+
+// GetID returns the ID of the provider.
+func (m *MXProvider) GetID() string {
+	return m.p.UID
+}
+
+// GetDefinition returns the provider definition.
+func (m *MXProvider) GetDefinition() mailprovider2.MailingProviderDefinition {
+	return m.p
+}
+
+// Type returns the type of the provider.
+func (m *MXProvider) Type() mailingpb.MailingProviderType {
+	return mailingpb.MX
+}
+
+// IsVerified returns whether the provider is verified.
+func (m *MXProvider) IsVerified() bool {
+	m.l.RLock()
+	defer m.l.RUnlock()
+
+	return m.isVerified
+}
+
+// UpdateConfig updates the config of the provider.
+func (m *MXProvider) UpdateConfig(config *mailingpb.MailingProviderConfig) error {
+	cfg := config.GetMxConfig()
+	if cfg == nil {
+		return fmt.Errorf("invalid config type: %T", config)
+	}
+
+	dkim, tc, err := parseMXConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	m.l.Lock()
+	m.cfg = *cfg
+	m.dkim = dkim
+	m.tc = tc
+	m.l.Unlock()
+	return nil
+}
+
+// GetConfig returns the config of the provider.
+func (m *MXProvider) GetConfig() mailingpb.MailingProviderConfig {
+	m.l.RLock()
+	defer m.l.RUnlock()
+
+	cfg := m.cfg
+	return mailingpb.MailingProviderConfig{
+		Config: &mailingpb.MailingProviderConfig_MxConfig{
+			MxConfig: &cfg,
+		},
+	}
+}
+
+// GetDefaultFromAddress returns the default from address.
+func (m *MXProvider) GetDefaultFromAddress() *mail.Address {
+	m.l.RLock()
+	defer m.l.RUnlock()
+
+	return m.fromAddress
+}
+
+// Verify verifies the provider configuration.
+func (m *MXProvider) Verify(ctx context.Context) error {
+	// The mail exchangers check the HELO domain of the sending host, it needs to be a fully qualified domain name.
+	if d := m.pc.Domain; !mailproviderwriter.IsDotAtom(d) || !strings.Contains(d, ".") || net.ParseIP(d) != nil {
+		return fmt.Errorf("mx delivery requires the domain name of the sending host, got: %q", m.pc.Domain)
+	}
+
+	// Check if the DKIM keys are published by the signing domains.
+	if dkim := m.settings().dkim; dkim != nil {
+		if err := dkim.Verify(ctx, m.pc.resolver()); err != nil {
+			m.log.WithError(err).Debug("failed to verify dkim keys")
+			return err
+		}
+	}
+
+	m.l.Lock()
+	m.isVerified = true
+	m.l.Unlock()
+	return nil
+}
+
+// Send delivers the message to the mail exchangers of each recipient domain.
+// The result of each domain is reported separately, and the error is returned only if none of the recipients
+// was accepted.
+func (m *MXProvider) Send(ctx context.Context, msg *mailprovider2.Message) (*mailprovider2.SendResult, error) {
+	st := m.settings()
+
+	res := &mailprovider2.SendResult{}
+	for _, g := range groupByDomain(msg.Recipients()) {
+		dr, rcpts := m.deliverDomain(ctx, msg, st, g)
+		res.Domains = append(res.Domains, dr)
+		res.Recipients = append(res.Recipients, rcpts...)
+	}
+
+	if err := res.Err(); err != nil {
+		return res, err
+	}
+
+	m.log.WithFields(logrus.Fields{
+		"msg_id":   msg.ID,
+		"domains":  len(res.Domains),
+		"rejected": len(res.Rejected()),
+	}).Debug("email message sent successfully")
+	return res, nil
+}
+
+// mxSettings is the snapshot of the provider configuration used by a single send.
+type mxSettings struct {
+	port     string
+	tlsMode  mailingpb.SMTPTLSMode
+	tc       *tls.Config
+	dkim     *mailproviderwriter.DKIMSigner
+	timeouts smtpTimeouts
+}
+
+func (m *MXProvider) settings() mxSettings {
+	m.l.RLock()
+	defer m.l.RUnlock()
+
+	port := m.cfg.Port
+	if port == 0 {
+		port = DefaultMXPort
+	}
+	return mxSettings{
+		port:     strconv.FormatUint(uint64(port), 10),
+		tlsMode:  m.cfg.TLSMode,
+		tc:       m.tc,
+		dkim:     m.dkim,
+		timeouts: newSMTPTimeouts(m.cfg.Timeouts),
+	}
+}
+
+// domainRecipients are the message recipients of a single domain.
+type domainRecipients struct {
+	domain string
+	rcpts  []*mail.Address
+}
+
+// groupByDomain groups the recipients by their domain, in the order of the first occurrence.
+func groupByDomain(rcpts []*mail.Address) []domainRecipients {
+	var groups []domainRecipients
+	idx := map[string]int{}
+	for _, rcpt := range rcpts {
+		domain := strings.ToLower(mailproviderwriter.DomainOf(rcpt.Address))
+
+		i, ok := idx[domain]
+		if !ok {
+			i = len(groups)
+			idx[domain] = i
+			groups = append(groups, domainRecipients{domain: domain})
+		}
+		groups[i].rcpts = append(groups[i].rcpts, rcpt)
+	}
+	return groups
+}
+
+// deliverDomain delivers the message to the recipients of the domain, trying its mail exchangers in the priority order.
+// The next mail exchanger is tried if the session with the previous one could not be established,
+// or if it failed temporarily before any of the recipients was accepted (RFC 5321 5.1).
+// If any of the mail exchangers failed temporarily, the delivery is reported as temporarily failed,
+// as it could succeed once that mail exchanger recovers.
+func (m *MXProvider) deliverDomain(ctx context.Context, msg *mailprovider2.Message, st mxSettings, g domainRecipients) (mailprovider2.DomainResult, []mailprovider2.RecipientResult) {
+	log := m.log.WithFields(logrus.Fields{
+		"msg_id": msg.ID,
+		"domain": g.domain,
+	})
+	dr := mailprovider2.DomainResult{Domain: g.domain}
+
+	hosts, err := m.lookupMX(ctx, g.domain)
+	if err != nil {
+		log.WithError(err).Debug("failed to lookup mail exchangers")
+		dr.Err = err
+		return dr, failedRecipients(g.rcpts, err)
+	}
+
+	// last is the result of the last failed transaction, holding the replies to each of the recipients.
+	// The temporary failure is kept over the permanent failure of the mail exchanger tried after it.
+	var last *mailprovider2.SendResult
+	for _, host := range hosts {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err, last = mailprovider2.ErrTemporary(ctxErr), nil
+			break
+		}
+
+		pc, connErr := m.connect(ctx, st, host)
+		if connErr != nil {
+			log.WithFields(logrus.Fields{
+				"host":          host,
+				logrus.ErrorKey: connErr,
+			}).Debug("failed to connect to mail exchanger")
+			if err == nil || isTemporary(connErr) || !isTemporary(err) {
+				err, last = connErr, nil
+			}
+			continue
+		}
+
+		dr.Host = host
+		res, sendErr := m.deliverHost(ctx, pc, msg, st, g.rcpts, log.WithField("host", host))
+		if sendErr != nil && isTemporary(sendErr) && (res == nil || len(res.Accepted()) == 0) {
+			log.WithFields(logrus.Fields{
+				"host":          host,
+				logrus.ErrorKey: sendErr,
+			}).Debug("mail exchanger failed temporarily, trying the next one")
+			err, last = sendErr, res
+			continue
+		}
+
+		dr.Err = sendErr
+		if res != nil {
+			return dr, res.Recipients
+		}
+		return dr, failedRecipients(g.rcpts, sendErr)
+	}
+
+	dr.Err = err
+	if last != nil {
+		return dr, last.Recipients
+	}
+	return dr, failedRecipients(g.rcpts, err)
+}
+
+// deliverHost sends the message over the session established with the mail exchanger, and ends the session.
+func (m *MXProvider) deliverHost(ctx context.Context, pc *pooledConn, msg *mailprovider2.Message, st mxSettings, rcpts []*mail.Address, log *logrus.Entry) (*mailprovider2.SendResult, error) {
+	stop := pc.watch(ctx)
+	mw := mailproviderwriter.Writer{Domain: m.pc.Domain, Signer: st.dkim}
+	res, healthy, err := sendTransaction(ctx, pc, mw, msg, rcpts, log)
+	stop()
+
+	if healthy {
+		pc.quit()
+	} else {
+		pc.c.Close()
+	}
+	return res, err
+}
+
+// lookupMX returns the mail exchangers of the domain in the priority order.
+// If the domain has no MX records, the domain itself is the implicit mail exchanger (RFC 5321 5.1).
+func (m *MXProvider) lookupMX(ctx context.Context, domain string) ([]string, error) {
+	if domain == "" {
+		return nil, mailprovider2.ErrPermanent(errors.New("recipient address has no domain"))
+	}
+
+	mxs, err := m.pc.resolver().LookupMX(ctx, domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return nil, mailprovider2.ErrTemporary(fmt.Errorf("failed to lookup mx records of %s: %w", domain, err))
+		}
+		mxs = nil
+	}
+
+	if len(mxs) == 0 {
+		return []string{domain}, nil
+	}
+
+	// The null MX means that the domain does not accept any mail (RFC 7505).
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		return nil, &mailprovider2.Error{
+			Err:          fmt.Errorf("domain %s does not accept mail", domain),
+			EnhancedCode: mailprovider2.EnhancedStatusCode{Class: 5, Subject: 1, Detail: 10},
+			Category:     mailprovider2.CategoryMailboxUnknown,
+		}
+	}
+
+	// The resolver might not order the records, the ones with the same preference keep their order.
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+
+	hosts := make([]string, 0, len(mxs))
+	for _, mx := range mxs {
+		hosts = append(hosts, strings.TrimSuffix(mx.Host, "."))
+	}
+	return hosts, nil
+}
+
+// connect establishes the session with the mail exchanger, trying each of its addresses.
+func (m *MXProvider) connect(ctx context.Context, st mxSettings, host string) (*pooledConn, error) {
+	addrs, err := m.pc.resolver().LookupHost(ctx, host)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			// The mail exchanger that could not be resolved is a routing failure (RFC 3463 X.4.4),
+			// it says nothing about the recipient mailboxes.
+			return nil, &mailprovider2.Error{
+				Err:          fmt.Errorf("mail exchanger %s has no address: %w", host, err),
+				EnhancedCode: mailprovider2.EnhancedStatusCode{Class: 5, Subject: 4, Detail: 4},
+			}
+		}
+		return nil, mailprovider2.ErrTemporary(fmt.Errorf("failed to lookup address of %s: %w", host, err))
+	}
+
+	for _, addr := range addrs {
+		var pc *pooledConn
+		if pc, err = m.dial(ctx, st, host, addr); err == nil {
+			return pc, nil
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("mail exchanger %s has no address", host)
+	}
+	return nil, handleErr(err)
+}
+
+// dial dials the mail exchanger address and starts the session, without the authentication.
+// In the opportunistic TLS mode, the session is established again without TLS if STARTTLS fails,
+// as many mail exchangers present certificates that could not be verified (RFC 7435).
+func (m *MXProvider) dial(ctx context.Context, st mxSettings, host, addr string) (*pooledConn, error) {
+	pc, err := m.dialSession(ctx, st, host, addr, st.tlsMode)
+	var tlsErr *startTLSError
+	if err == nil || !errors.As(err, &tlsErr) {
+		return pc, err
+	}
+
+	if st.tlsMode == mailingpb.SMTP_TLS_STARTTLS_OPPORTUNISTIC {
+		m.log.WithFields(logrus.Fields{
+			"host":          host,
+			logrus.ErrorKey: err,
+		}).Debug("failed to start tls with mail exchanger, retrying without tls")
+		return m.dialSession(ctx, st, host, addr, mailingpb.SMTP_TLS_NONE)
+	}
+	// The mail exchanger might fix its certificate, or the policy could be changed.
+	return nil, mailprovider2.AsError(tlsErr.err, true)
+}
+
+// startTLSError is the failure to start TLS with the mail exchanger.
+type startTLSError struct {
+	err error
+}
+
+func (e *startTLSError) Error() string { return e.err.Error() }
+func (e *startTLSError) Unwrap() error { return e.err }
+
+// dialSession dials the mail exchanger address and starts the session with the given TLS mode.
+func (m *MXProvider) dialSession(ctx context.Context, st mxSettings, host, addr string, mode mailingpb.SMTPTLSMode) (*pooledConn, error) {
+	d := net.Dialer{Timeout: st.timeouts.connect}
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(addr, st.port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial mail exchanger: %w", err)
+	}
+	pc := &pooledConn{conn: conn, timeouts: st.timeouts}
+
+	stop := pc.watch(ctx)
+	defer stop()
+
+	pc.setDeadline(st.timeouts.greeting)
+	if pc.c, err = smtp.NewClient(conn, host); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read mail exchanger greeting: %w", err)
+	}
+
+	pc.setDeadline(st.timeouts.command)
+	if err = pc.c.Hello(m.pc.Domain); err != nil {
+		pc.c.Close()
+		return nil, fmt.Errorf("failed to say hello to mail exchanger: %w", err)
+	}
+
+	tc := st.tc.Clone()
+	tc.ServerName = host
+	pc.setDeadline(st.timeouts.command)
+	if err = startTLS(pc.c, mode, tc); err != nil {
+		pc.c.Close()
+		return nil, &startTLSError{err: err}
+	}
+	return pc, nil
+}
+
+// isTemporary checks if the delivery could be retried after the error.
+// The failure of unknown kind is treated as temporary, as the delivery outcome is unknown.
+func isTemporary(err error) bool {
+	var e *mailprovider2.Error
+	if errors.As(err, &e) {
+		return e.Temporary
+	}
+	return true
+}
+
+// failedRecipients returns the results of the recipients that could not be delivered because of the error.
+func failedRecipients(rcpts []*mail.Address, err error) []mailprovider2.RecipientResult {
+	// The failure of unknown kind is treated as temporary, as the delivery outcome is unknown.
+	tmpl := mailprovider2.RecipientResult{
+		Status:  mailprovider2.RecipientTemporaryRejected,
+		Message: err.Error(),
+	}
+
+	var e *mailprovider2.Error
+	if errors.As(err, &e) {
+		tmpl.Code = e.Code
+		tmpl.EnhancedCode = e.EnhancedCode
+		tmpl.Category = e.Category
+		if e.Message != "" {
+			tmpl.Message = e.Message
+		}
+		if !e.Temporary {
+			tmpl.Status = mailprovider2.RecipientPermanentRejected
+		}
+	}
+
+	results := make([]mailprovider2.RecipientResult, 0, len(rcpts))
+	for _, rcpt := range rcpts {
+		rr := tmpl
+		rr.Address = rcpt.Address
+		results = append(results, rr)
+	}
+	return results
+}
@@ -0,0 +1,532 @@
+package smtpmailprovider_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/mail"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
+	mailprovider2 "github.com/blockysource/mailing/logic/mailprovider"
+	smtpmailprovider "github.com/blockysource/mailing/logic/mailprovider/smtp"
+	"github.com/blockysource/mailing/logic/mailprovider/smtp/smtptest"
+)
+
+// fakeResolver is a Resolver with the static records, the missing names are not found.
+type fakeResolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string][]string
+}
+
+func (r *fakeResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	mxs, ok := r.mx[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	// The records are copied, as the provider sorts them in place.
+	return append([]*net.MX(nil), mxs...), nil
+}
+
+func (r *fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	addrs, ok := r.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func (r *fakeResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// newMXServers starts two servers sharing the port on the different loopback hosts,
+// as the mail exchangers are all dialed at the same port.
+func newMXServers(t *testing.T) (primary, secondary *smtptest.Server) {
+	t.Helper()
+
+	primary, err := smtptest.NewServer(smtptest.Config{Hostname: "mx1.example.com", EnhancedStatusCodes: true})
+	if err != nil {
+		t.Fatalf("failed to start primary server: %v", err)
+	}
+	t.Cleanup(func() { primary.Close() })
+
+	port := strconv.FormatUint(uint64(primary.Port()), 10)
+	secondary, err = smtptest.NewServer(smtptest.Config{
+		Hostname:            "mx2.example.com",
+		Addr:                net.JoinHostPort("127.0.0.2", port),
+		EnhancedStatusCodes: true,
+	})
+	if err != nil {
+		t.Skipf("failed to start secondary server on another loopback host: %v", err)
+	}
+	t.Cleanup(func() { secondary.Close() })
+	return primary, secondary
+}
+
+func newMXProvider(t *testing.T, port uint32, r smtpmailprovider.Resolver, fn func(cfg *mailingpb.MXConfig)) *smtpmailprovider.MXProvider {
+	t.Helper()
+
+	cfg := &mailingpb.MXConfig{
+		Port:    port,
+		TLSMode: mailingpb.SMTP_TLS_STARTTLS_OPPORTUNISTIC,
+		Timeouts: &mailingpb.SMTPTimeouts{
+			ConnectTimeout:  time.Second,
+			GreetingTimeout: time.Second,
+			CommandTimeout:  time.Second,
+			DataTimeout:     time.Second,
+		},
+	}
+	if fn != nil {
+		fn(cfg)
+	}
+	def := mailprovider2.MailingProviderDefinition{
+		UID:    "mx",
+		Config: &mailingpb.MailingProviderConfig{Config: &mailingpb.MailingProviderConfig_MxConfig{MxConfig: cfg}},
+	}
+
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	p, err := smtpmailprovider.NewMX(&smtpmailprovider.SMTPProvidersConfig{Domain: "mta.example.org", Resolver: r}, def, logrus.NewEntry(log))
+	if err != nil {
+		t.Fatalf("failed to create mx provider: %v", err)
+	}
+	return p
+}
+
+func mxMessage(to ...string) *mailprovider2.Message {
+	msg := &mailprovider2.Message{
+		ID:          "mx-message",
+		From:        &mail.Address{Address: "sender@example.org"},
+		Subject:     "Hello",
+		Body:        "Hello there",
+		ContentType: "text/plain; charset=utf-8",
+	}
+	for _, addr := range to {
+		msg.To = append(msg.To, &mail.Address{Address: addr})
+	}
+	return msg
+}
+
+func TestMXProvider_Send_PriorityOrder(t *testing.T) {
+	primary, secondary := newMXServers(t)
+
+	r := &fakeResolver{
+		mx: map[string][]*net.MX{
+			// The records are not ordered by the resolver.
+			"example.com": {{Host: "mx2.example.com.", Pref: 20}, {Host: "mx1.example.com.", Pref: 10}},
+		},
+		hosts: map[string][]string{
+			"mx1.example.com": {"127.0.0.1"},
+			"mx2.example.com": {"127.0.0.2"},
+		},
+	}
+	p := newMXProvider(t, primary.Port(), r, nil)
+
+	res, err := p.Send(context.Background(), mxMessage("alice@example.com"))
+	if err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+
+	if len(res.Domains) != 1 || res.Domains[0].Host != "mx1.example.com" || res.Domains[0].Err != nil {
+		t.Fatalf("unexpected domain results: %+v", res.Domains)
+	}
+	if got := len(primary.Messages()); got != 1 {
+		t.Fatalf("primary received %d messages, want 1", got)
+	}
+	if got := len(secondary.Sessions()); got != 0 {
+		t.Fatalf("secondary had %d sessions, want 0", got)
+	}
+}
+
+func TestMXProvider_Send_Failover(t *testing.T) {
+	tests := []struct {
+		name string
+		// script sets up the failure of the primary mail exchanger.
+		script func(srv *smtptest.Server)
+		// primaryAddr is the address of the primary mail exchanger.
+		primaryAddr string
+	}{
+		{
+			name:        "connect failure",
+			primaryAddr: "127.0.0.3",
+		},
+		{
+			name: "temporary greeting",
+			script: func(srv *smtptest.Server) {
+				srv.Script(smtptest.StageGreeting, smtptest.Reply{Code: 421, EnhancedCode: "4.3.2", Text: "Service not available", Disconnect: true})
+			},
+		},
+		{
+			name: "temporary mail",
+			script: func(srv *smtptest.Server) {
+				srv.Script(smtptest.StageMail, smtptest.Reply{Code: 451, EnhancedCode: "4.3.0", Text: "Try again later"})
+			},
+		},
+		{
+			name: "temporary recipients",
+			script: func(srv *smtptest.Server) {
+				srv.RejectRecipient("alice@example.com", smtptest.Reply{Code: 450, EnhancedCode: "4.2.1", Text: "Greylisted"})
+			},
+		},
+		{
+			name: "temporary data",
+			script: func(srv *smtptest.Server) {
+				srv.Script(smtptest.StageMessage, smtptest.Reply{Code: 452, EnhancedCode: "4.3.1", Text: "Insufficient storage"})
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			primary, secondary := newMXServers(t)
+			if tc.script != nil {
+				tc.script(primary)
+			}
+
+			primaryAddr := tc.primaryAddr
+			if primaryAddr == "" {
+				primaryAddr = "127.0.0.1"
+			}
+			r := &fakeResolver{
+				mx: map[string][]*net.MX{
+					"example.com": {{Host: "mx1.example.com.", Pref: 10}, {Host: "mx2.example.com.", Pref: 20}},
+				},
+				hosts: map[string][]string{
+					"mx1.example.com": {primaryAddr},
+					"mx2.example.com": {"127.0.0.2"},
+				},
+			}
+			p := newMXProvider(t, primary.Port(), r, nil)
+
+			res, err := p.Send(context.Background(), mxMessage("alice@example.com"))
+			if err != nil {
+				t.Fatalf("send failed: %v", err)
+			}
+			if len(res.Domains) != 1 || res.Domains[0].Host != "mx2.example.com" || res.Domains[0].Err != nil {
+				t.Fatalf("unexpected domain results: %+v", res.Domains)
+			}
+			if len(res.Recipients) != 1 || res.Recipients[0].Status != mailprovider2.RecipientAccepted {
+				t.Fatalf("unexpected recipient results: %+v", res.Recipients)
+			}
+			if got := len(primary.Messages()); got != 0 {
+				t.Fatalf("primary received %d messages, want 0", got)
+			}
+			if got := len(secondary.Messages()); got != 1 {
+				t.Fatalf("secondary received %d messages, want 1", got)
+			}
+		})
+	}
+}
+
+func TestMXProvider_Send_NoFailover(t *testing.T) {
+	t.Run("permanent error", func(t *testing.T) {
+		primary, secondary := newMXServers(t)
+		primary.Script(smtptest.StageMail, smtptest.Reply{Code: 550, EnhancedCode: "5.7.1", Text: "Sender rejected"})
+
+		r := &fakeResolver{
+			mx: map[string][]*net.MX{
+				"example.com": {{Host: "mx1.example.com.", Pref: 10}, {Host: "mx2.example.com.", Pref: 20}},
+			},
+			hosts: map[string][]string{
+				"mx1.example.com": {"127.0.0.1"},
+				"mx2.example.com": {"127.0.0.2"},
+			},
+		}
+		p := newMXProvider(t, primary.Port(), r, nil)
+
+		res, err := p.Send(context.Background(), mxMessage("alice@example.com"))
+		if err == nil {
+			t.Fatal("send succeeded, want error")
+		}
+		if len(res.Recipients) != 1 || res.Recipients[0].Status != mailprovider2.RecipientPermanentRejected {
+			t.Fatalf("unexpected recipient results: %+v", res.Recipients)
+		}
+		if res.Domains[0].Host != "mx1.example.com" {
+			t.Fatalf("domain delivered by %s, want mx1.example.com", res.Domains[0].Host)
+		}
+		if got := len(secondary.Sessions()); got != 0 {
+			t.Fatalf("secondary had %d sessions, want 0", got)
+		}
+	})
+
+	t.Run("partially accepted", func(t *testing.T) {
+		primary, secondary := newMXServers(t)
+		primary.RejectRecipient("bob@example.com", smtptest.Reply{Code: 450, EnhancedCode: "4.2.1", Text: "Greylisted"})
+
+		r := &fakeResolver{
+			mx: map[string][]*net.MX{
+				"example.com": {{Host: "mx1.example.com.", Pref: 10}, {Host: "mx2.example.com.", Pref: 20}},
+			},
+			hosts: map[string][]string{
+				"mx1.example.com": {"127.0.0.1"},
+				"mx2.example.com": {"127.0.0.2"},
+			},
+		}
+		p := newMXProvider(t, primary.Port(), r, nil)
+
+		res, err := p.Send(context.Background(), mxMessage("alice@example.com", "bob@example.com"))
+		if err != nil {
+			t.Fatalf("send failed: %v", err)
+		}
+		if len(res.Accepted()) != 1 || len(res.Rejected()) != 1 || res.Rejected()[0].Status != mailprovider2.RecipientTemporaryRejected {
+			t.Fatalf("unexpected recipient results: %+v", res.Recipients)
+		}
+		if got := len(secondary.Sessions()); got != 0 {
+			t.Fatalf("secondary had %d sessions, want 0", got)
+		}
+	})
+
+	t.Run("all mail exchangers failed", func(t *testing.T) {
+		primary, secondary := newMXServers(t)
+		primary.RejectRecipient("alice@example.com", smtptest.Reply{Code: 450, EnhancedCode: "4.2.1", Text: "Greylisted"})
+		secondary.RejectRecipient("alice@example.com", smtptest.Reply{Code: 452, EnhancedCode: "4.2.2", Text: "Mailbox full"})
+
+		r := &fakeResolver{
+			mx: map[string][]*net.MX{
+				"example.com": {{Host: "mx1.example.com.", Pref: 10}, {Host: "mx2.example.com.", Pref: 20}},
+			},
+			hosts: map[string][]string{
+				"mx1.example.com": {"127.0.0.1"},
+				"mx2.example.com": {"127.0.0.2"},
+			},
+		}
+		p := newMXProvider(t, primary.Port(), r, nil)
+
+		res, err := p.Send(context.Background(), mxMessage("alice@example.com"))
+		if err == nil {
+			t.Fatal("send succeeded, want error")
+		}
+		// The reply of the last mail exchanger is reported.
+		if len(res.Recipients) != 1 || res.Recipients[0].Code != 452 || res.Recipients[0].Status != mailprovider2.RecipientTemporaryRejected {
+			t.Fatalf("unexpected recipient results: %+v", res.Recipients)
+		}
+		if res.Domains[0].Host != "mx2.example.com" || res.Domains[0].Err == nil {
+			t.Fatalf("unexpected domain results: %+v", res.Domains)
+		}
+	})
+}
+
+func TestMXProvider_Send_ImplicitMX(t *testing.T) {
+	tests := []struct {
+		name string
+		mx   map[string][]*net.MX
+	}{
+		{name: "not found"},
+		{name: "no records", mx: map[string][]*net.MX{"example.com": {}}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			primary, _ := newMXServers(t)
+
+			r := &fakeResolver{
+				mx:    tc.mx,
+				hosts: map[string][]string{"example.com": {"127.0.0.1"}},
+			}
+			p := newMXProvider(t, primary.Port(), r, nil)
+
+			res, err := p.Send(context.Background(), mxMessage("alice@example.com"))
+			if err != nil {
+				t.Fatalf("send failed: %v", err)
+			}
+			if res.Domains[0].Host != "example.com" {
+				t.Fatalf("domain delivered by %s, want example.com", res.Domains[0].Host)
+			}
+			if got := len(primary.Messages()); got != 1 {
+				t.Fatalf("server received %d messages, want 1", got)
+			}
+		})
+	}
+}
+
+func TestMXProvider_Send_NullMX(t *testing.T) {
+	primary, _ := newMXServers(t)
+
+	r := &fakeResolver{
+		mx:    map[string][]*net.MX{"example.com": {{Host: ".", Pref: 0}}},
+		hosts: map[string][]string{"example.com": {"127.0.0.1"}},
+	}
+	p := newMXProvider(t, primary.Port(), r, nil)
+
+	res, err := p.Send(context.Background(), mxMessage("alice@example.com"))
+	if err == nil {
+		t.Fatal("send succeeded, want error")
+	}
+
+	rr := res.Recipients[0]
+	if rr.Status != mailprovider2.RecipientPermanentRejected || rr.Category != mailprovider2.CategoryMailboxUnknown || rr.EnhancedCode.String() != "5.1.10" {
+		t.Fatalf("unexpected recipient result: %+v", rr)
+	}
+	if got := len(primary.Sessions()); got != 0 {
+		t.Fatalf("server had %d sessions, want 0", got)
+	}
+}
+
+func TestMXProvider_Send_UnresolvedMX(t *testing.T) {
+	tests := []struct {
+		name   string
+		hosts  map[string][]string
+		status mailprovider2.RecipientStatus
+		code   string
+	}{
+		{
+			name:   "all unresolved",
+			status: mailprovider2.RecipientPermanentRejected,
+			code:   "5.4.4",
+		},
+		{
+			// The unreachable mail exchanger might recover, the delivery is retried.
+			name:   "unreachable before unresolved",
+			hosts:  map[string][]string{"mx1.example.com": {"127.0.0.3"}},
+			status: mailprovider2.RecipientTemporaryRejected,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			primary, _ := newMXServers(t)
+
+			r := &fakeResolver{
+				mx: map[string][]*net.MX{
+					"example.com": {{Host: "mx1.example.com.", Pref: 10}, {Host: "mx2.example.com.", Pref: 20}},
+				},
+				hosts: tc.hosts,
+			}
+			p := newMXProvider(t, primary.Port(), r, nil)
+
+			res, err := p.Send(context.Background(), mxMessage("alice@example.com"))
+			if err == nil {
+				t.Fatal("send succeeded, want error")
+			}
+
+			rr := res.Recipients[0]
+			if rr.Status != tc.status || rr.EnhancedCode.String() != tc.code {
+				t.Fatalf("unexpected recipient result: %+v", rr)
+			}
+			// The mail exchanger without an address says nothing about the recipient mailbox.
+			if rr.Category == mailprovider2.CategoryMailboxUnknown {
+				t.Fatalf("got category %s, want the recipient not suppressed", rr.Category)
+			}
+		})
+	}
+}
+
+func TestMXProvider_Send_StartTLSFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    mailingpb.SMTPTLSMode
+		success bool
+	}{
+		// The mail exchanger certificate is not trusted, the message is sent without TLS.
+		{name: "opportunistic", mode: mailingpb.SMTP_TLS_STARTTLS_OPPORTUNISTIC, success: true},
+		{name: "required", mode: mailingpb.SMTP_TLS_STARTTLS_REQUIRED},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newServer(t, smtptest.Config{Hostname: "mx1.example.com", StartTLS: true})
+
+			r := &fakeResolver{
+				mx:    map[string][]*net.MX{"example.com": {{Host: "mx1.example.com.", Pref: 10}}},
+				hosts: map[string][]string{"mx1.example.com": {"127.0.0.1"}},
+			}
+			p := newMXProvider(t, srv.Port(), r, func(cfg *mailingpb.MXConfig) {
+				cfg.TLSMode = tc.mode
+			})
+
+			res, err := p.Send(context.Background(), mxMessage("alice@example.com"))
+			if tc.success {
+				if err != nil {
+					t.Fatalf("send failed: %v", err)
+				}
+				if got := len(srv.Messages()); got != 1 {
+					t.Fatalf("server received %d messages, want 1", got)
+				}
+				if got := len(srv.Sessions()); got != 2 {
+					t.Fatalf("got %d sessions, want the failed tls one and the plain one", got)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatal("send succeeded, want error")
+			}
+			if rr := res.Recipients[0]; rr.Status != mailprovider2.RecipientTemporaryRejected {
+				t.Fatalf("unexpected recipient result: %+v", rr)
+			}
+			if got := len(srv.Messages()); got != 0 {
+				t.Fatalf("server received %d messages, want 0", got)
+			}
+		})
+	}
+}
+
+func TestMXProvider_Send_DomainResults(t *testing.T) {
+	primary, secondary := newMXServers(t)
+
+	r := &fakeResolver{
+		mx: map[string][]*net.MX{
+			"example.com":  {{Host: "mx1.example.com.", Pref: 10}},
+			"null.example": {{Host: ".", Pref: 0}},
+		},
+		hosts: map[string][]string{
+			"mx1.example.com": {"127.0.0.1"},
+			"example.net":     {"127.0.0.2"},
+		},
+	}
+	p := newMXProvider(t, primary.Port(), r, nil)
+
+	msg := mxMessage("alice@example.com", "bob@example.net", "carol@null.example", "dave@Example.com")
+	res, err := p.Send(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+
+	wantDomains := []struct {
+		domain, host string
+		err          bool
+	}{
+		{domain: "example.com", host: "mx1.example.com"},
+		{domain: "example.net", host: "example.net"},
+		{domain: "null.example", err: true},
+	}
+	if len(res.Domains) != len(wantDomains) {
+		t.Fatalf("got %d domain results, want %d: %+v", len(res.Domains), len(wantDomains), res.Domains)
+	}
+	for i, want := range wantDomains {
+		got := res.Domains[i]
+		if got.Domain != want.domain || got.Host != want.host || (got.Err != nil) != want.err {
+			t.Errorf("domain result %d: got %+v, want %+v", i, got, want)
+		}
+	}
+
+	wantStatus := map[string]mailprovider2.RecipientStatus{
+		"alice@example.com":  mailprovider2.RecipientAccepted,
+		"dave@Example.com":   mailprovider2.RecipientAccepted,
+		"bob@example.net":    mailprovider2.RecipientAccepted,
+		"carol@null.example": mailprovider2.RecipientPermanentRejected,
+	}
+	if len(res.Recipients) != len(wantStatus) {
+		t.Fatalf("got %d recipient results, want %d", len(res.Recipients), len(wantStatus))
+	}
+	for _, rr := range res.Recipients {
+		if rr.Status != wantStatus[rr.Address] {
+			t.Errorf("recipient %s: got status %s, want %s", rr.Address, rr.Status, wantStatus[rr.Address])
+		}
+	}
+
+	// The recipients of the same domain are delivered in a single transaction.
+	pm := primary.Messages()
+	if len(pm) != 1 || len(pm[0].Recipients) != 2 {
+		t.Fatalf("unexpected messages of example.com: %+v", pm)
+	}
+	sm := secondary.Messages()
+	if len(sm) != 1 || len(sm[0].To()) != 1 || sm[0].To()[0] != "bob@example.net" {
+		t.Fatalf("unexpected messages of example.net: %+v", sm)
+	}
+}
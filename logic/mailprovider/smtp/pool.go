@@ -0,0 +1,257 @@
+package smtpmailprovider
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/smtp"
+	"sync"
+	"time"
+)
+
+var errPoolClosed = errors.New("smtp connection pool is closed")
+
+// pooledConn is an authenticated smtp client session kept by the connPool.
+type pooledConn struct {
+	c        *smtp.Client
+	conn     net.Conn
+	timeouts smtpTimeouts
+	gen      uint64
+	lastUsed time.Time
+	messages int
+}
+
+// setDeadline sets the deadline of the next session phase, the zero timeout disables the deadline.
+func (pc *pooledConn) setDeadline(timeout time.Duration) {
+	var t time.Time
+	if timeout > 0 {
+		t = time.Now().Add(timeout)
+	}
+	_ = pc.conn.SetDeadline(t)
+}
+
+// quit gracefully ends the session and closes its connection.
+func (pc *pooledConn) quit() {
+	pc.setDeadline(pc.timeouts.command)
+	pc.c.Quit()
+	pc.c.Close()
+}
+
+// watch aborts the blocked session I/O once the context is done, until the returned function is called.
+// The session phases set their own deadlines, so that the session aborted after it finished could still be reused.
+func (pc *pooledConn) watch(ctx context.Context) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			_ = pc.conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// connPool is a bounded pool of authenticated smtp client sessions.
+// The number of open sessions is limited by the size of the semaphore, idle sessions are reused
+// after resetting them with the RSET command, and are closed once they exceed the idle time
+// or the number of messages sent over a single connection.
+type connPool struct {
+	l      sync.Mutex
+	idle   []*pooledConn
+	gen    uint64
+	closed bool
+
+	sem         chan struct{}
+	dial        func(ctx context.Context) (*pooledConn, error)
+	maxIdleTime time.Duration
+	maxMessages int
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newConnPool(cfg *SMTPProvidersConfig, dial func(ctx context.Context) (*pooledConn, error)) *connPool {
+	maxConns := cfg.MaxConnections
+	if maxConns <= 0 {
+		maxConns = DefaultMaxConnections
+	}
+
+	p := &connPool{
+		sem:         make(chan struct{}, maxConns),
+		dial:        dial,
+		maxIdleTime: cfg.MaxIdleTime,
+		maxMessages: cfg.MaxMessagesPerConn,
+		done:        make(chan struct{}),
+	}
+
+	if p.maxIdleTime > 0 {
+		p.wg.Add(1)
+		go p.reapIdle()
+	}
+	return p
+}
+
+// get returns a ready to use session, either the idle one or a newly dialed.
+// The returned session needs to be returned to the pool by calling put.
+func (p *connPool) get(ctx context.Context) (*pooledConn, error) {
+	// Acquire the connection slot.
+	select {
+	case p.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	for {
+		pc, err := p.popIdle()
+		if err != nil {
+			<-p.sem
+			return nil, err
+		}
+		if pc == nil {
+			break
+		}
+
+		// Reset the session state left by the previous message, this also checks whether the connection is still alive.
+		pc.setDeadline(pc.timeouts.command)
+		if err = pc.c.Reset(); err != nil {
+			pc.c.Close()
+			continue
+		}
+		return pc, nil
+	}
+
+	p.l.Lock()
+	gen := p.gen
+	p.l.Unlock()
+
+	pc, err := p.dial(ctx)
+	if err != nil {
+		<-p.sem
+		return nil, err
+	}
+	pc.gen = gen
+	return pc, nil
+}
+
+// put returns the session to the pool. If the session is not healthy, or it reached its message limit,
+// the session is closed instead.
+func (p *connPool) put(pc *pooledConn, healthy bool) {
+	defer func() { <-p.sem }()
+
+	if healthy && (p.maxMessages <= 0 || pc.messages < p.maxMessages) {
+		p.l.Lock()
+		if !p.closed && pc.gen == p.gen {
+			pc.lastUsed = time.Now()
+			p.idle = append(p.idle, pc)
+			p.l.Unlock()
+			return
+		}
+		p.l.Unlock()
+	}
+
+	// Gracefully end the session if it is still in a valid state.
+	if healthy {
+		pc.quit()
+		return
+	}
+	pc.c.Close()
+}
+
+// drain closes all idle sessions, the sessions that are in use are closed when they are returned.
+func (p *connPool) drain() {
+	p.l.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.gen++
+	p.l.Unlock()
+
+	for _, pc := range idle {
+		pc.quit()
+	}
+}
+
+// close closes the pool and all of its idle sessions.
+func (p *connPool) close() {
+	p.l.Lock()
+	if p.closed {
+		p.l.Unlock()
+		return
+	}
+	p.closed = true
+	p.l.Unlock()
+
+	close(p.done)
+	p.wg.Wait()
+	p.drain()
+}
+
+func (p *connPool) popIdle() (*pooledConn, error) {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	if p.closed {
+		return nil, errPoolClosed
+	}
+
+	for len(p.idle) > 0 {
+		// Take the most recently used session first, so that the least used ones could expire.
+		pc := p.idle[len(p.idle)-1]
+		p.idle[len(p.idle)-1] = nil
+		p.idle = p.idle[:len(p.idle)-1]
+
+		if p.isExpired(pc, time.Now()) {
+			pc.c.Close()
+			continue
+		}
+		return pc, nil
+	}
+	return nil, nil
+}
+
+func (p *connPool) isExpired(pc *pooledConn, now time.Time) bool {
+	return p.maxIdleTime > 0 && now.Sub(pc.lastUsed) > p.maxIdleTime
+}
+
+// reapIdle periodically closes the sessions that exceeded the idle time.
+func (p *connPool) reapIdle() {
+	defer p.wg.Done()
+
+	t := time.NewTicker(p.maxIdleTime / 2)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case now := <-t.C:
+			var expired []*pooledConn
+			p.l.Lock()
+			active := p.idle[:0]
+			for _, pc := range p.idle {
+				if p.isExpired(pc, now) {
+					expired = append(expired, pc)
+					continue
+				}
+				active = append(active, pc)
+			}
+			for i := len(active); i < len(p.idle); i++ {
+				p.idle[i] = nil
+			}
+			p.idle = active
+			p.l.Unlock()
+
+			for _, pc := range expired {
+				pc.quit()
+			}
+		}
+	}
+}
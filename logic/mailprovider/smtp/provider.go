@@ -1,46 +1,24 @@
 package smtpmailprovider
 
 import (
-	"bufio"
 	"context"
 	"crypto/tls"
-	"encoding/base64"
 	"errors"
 	"fmt"
-	"io"
-	"mime"
 	"net"
 	"net/mail"
 	"net/smtp"
 	"net/textproto"
-	"strings"
+	"strconv"
 	"sync"
-	"time"
 
 	"github.com/sirupsen/logrus"
 
-	"github.com/blockysource/blocky/open-source/libs/blocky-cloud/email/message"
-
 	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
 	mailprovider2 "github.com/blockysource/mailing/logic/mailprovider"
+	mailproviderwriter "github.com/blockysource/mailing/logic/mailprovider/writer"
 )
 
-var _bufioWriterPool = sync.Pool{}
-
-func newBufioWriter(w io.Writer) *bufio.Writer {
-	if v := _bufioWriterPool.Get(); v != nil {
-		bw := v.(*bufio.Writer)
-		bw.Reset(w)
-		return bw
-	}
-	return bufio.NewWriter(w)
-}
-
-func putBufioWriter(bw *bufio.Writer) {
-	bw.Reset(nil)
-	_bufioWriterPool.Put(bw)
-}
-
 // Compile-time check to verify implements interface.
 var _ mailprovider2.Provider = (*SMTPProvider)(nil)
 
@@ -54,6 +32,10 @@ type SMTPProvider struct {
 	cfg         mailingpb.SMTPConfig
 	log         *logrus.Entry
 	isVerified  bool
+	pool        *connPool
+	ts          *oauth2TokenSource
+	dkim        *mailproviderwriter.DKIMSigner
+	tc          *tls.Config
 }
 
 // New creates a new SMTP provider.
@@ -64,19 +46,36 @@ func New(mc *SMTPProvidersConfig, p mailprovider2.MailingProviderDefinition, log
 		return nil, fmt.Errorf("invalid config: %w", err)
 	}
 
-	return &SMTPProvider{
-		pc:  mc,
-		p:   p,
-		cfg: *cfg,
+	dkim, err := mailproviderwriter.NewDKIMSigner(cfg.DKIMKeys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	tc, err := newTLSConfig(cfg.Host.UnsafeString(), cfg.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	s := &SMTPProvider{
+		pc:   mc,
+		p:    p,
+		cfg:  *cfg,
+		ts:   newOAuth2TokenSource(cfg.OAuth2),
+		dkim: dkim,
+		tc:   tc,
 		log: log.WithFields(logrus.Fields{
 			"provider_id": p.UID,
 			"provider":    mailingpb.SMTP,
 		}),
-	}, nil
+	}
+	s.pool = newConnPool(mc, s.session)
+	return s, nil
 }
 
-// Close closes the provider.
-func (s *SMTPProvider) Close() {}
+// Close closes the provider and all of its pooled smtp sessions.
+func (s *SMTPProvider) Close() {
+	s.pool.close()
+}
 
 // GetID returns the ID of the provider.
 func (s *SMTPProvider) GetID() string {
@@ -111,10 +110,25 @@ func (s *SMTPProvider) UpdateConfig(config *mailingpb.MailingProviderConfig) err
 		return err
 	}
 
+	dkim, err := mailproviderwriter.NewDKIMSigner(cfg.DKIMKeys)
+	if err != nil {
+		return err
+	}
+
+	tc, err := newTLSConfig(cfg.Host.UnsafeString(), cfg.TLS)
+	if err != nil {
+		return err
+	}
+
 	s.l.Lock()
 	s.cfg = *cfg
+	s.ts = newOAuth2TokenSource(cfg.OAuth2)
+	s.dkim = dkim
+	s.tc = tc
 	s.l.Unlock()
 
+	// The pooled sessions were established with the previous configuration.
+	s.pool.drain()
 	return nil
 }
 
@@ -139,73 +153,54 @@ func (s *SMTPProvider) GetDefaultFromAddress() *mail.Address {
 }
 
 // Send lets the provider send the input message.
-func (s *SMTPProvider) Send(ctx context.Context, msg *message.Message) error {
+func (s *SMTPProvider) Send(ctx context.Context, msg *mailprovider2.Message) (*mailprovider2.SendResult, error) {
 	// Send the message via SMTP.
-	if err := s.sendMessage(ctx, msg); err != nil {
-		return err
+	res, err := s.sendMessage(ctx, msg)
+	if err != nil {
+		return res, err
 	}
 
 	s.log.WithFields(logrus.Fields{
 		"msg_id":      msg.ID,
 		"provider":    mailingpb.SMTP,
 		"provider_id": s.p.UID,
+		"rejected":    len(res.Rejected()),
 	}).Debug("email message sent successfully")
-	return nil
+	return res, nil
 }
 
 // Verify verifies the provider configuration.
 func (s *SMTPProvider) Verify(ctx context.Context) error {
-	s.l.Lock()
-	defer s.l.Unlock()
-
-	c, err := s.smtpClient(ctx)
+	pc, err := s.session(ctx)
 	if err != nil {
-		return err
+		return handleErr(err)
 	}
-	defer c.Close()
+	defer pc.c.Close()
 
-	// Do the hello.
-	if err = c.Hello(s.pc.Domain); err != nil {
-		s.log.WithFields(logrus.Fields{
-			"provider":    mailingpb.SMTP,
-			"provider_id": s.p.UID,
-		}).Debug("failed to say hello to smtp client")
-		return fmt.Errorf("failed to say hello to smtp client: %w", err)
+	stop := pc.watch(ctx)
+	pc.setDeadline(pc.timeouts.command)
+	err = pc.c.Quit()
+	stop()
+	if err != nil {
+		return handleErr(fmt.Errorf("failed to quit smtp client: %w", err))
 	}
 
-	// Check the TLS.
-	if ok, _ := c.Extension("STARTTLS"); ok {
-		if err = c.StartTLS(&tls.Config{
-			ServerName: s.cfg.Host.UnsafeString(),
-		}); err != nil {
-			s.log.WithFields(logrus.Fields{
-				"provider":      mailingpb.SMTP,
-				"provider_id":   s.p.UID,
-				logrus.ErrorKey: err,
-			}).Debug("failed to start tls on smtp client")
-			return fmt.Errorf("failed to start tls: %w", err)
+	// Check if the DKIM keys are published by the signing domains.
+	if dkim := s.dkimSigner(); dkim != nil {
+		if err = dkim.Verify(ctx, s.pc.resolver()); err != nil {
+			s.log.WithError(err).Debug("failed to verify dkim keys")
+			return err
 		}
 	}
 
-	// Check the authentication of the smtp server.
-	if err = c.Auth(s.auth()); err != nil {
-		s.log.WithFields(logrus.Fields{
-			"provider":    mailingpb.SMTP,
-			"provider_id": s.p.UID,
-		}).Debug("failed to authenticate smtp client")
-		return fmt.Errorf("failed to authenticate smtp client: %w", err)
-	}
-
-	if err = c.Quit(); err != nil {
-		return fmt.Errorf("failed to quit smtp client: %w", err)
-	}
-
+	s.l.Lock()
 	s.isVerified = true
+	s.l.Unlock()
 	return nil
 }
 
-func (s *SMTPProvider) smtpClient(ctx context.Context) (*smtp.Client, error) {
-	d := net.Dialer{Timeout: 10 * time.Second}
+func (s *SMTPProvider) smtpClient(ctx context.Context, timeouts smtpTimeouts) (*pooledConn, error) {
+	d := net.Dialer{Timeout: timeouts.connect}
 
 	addr := s.addr()
 
@@ -214,198 +209,184 @@ func (s *SMTPProvider) smtpClient(ctx context.Context) (*smtp.Client, error) {
 		return nil, fmt.Errorf("failed to split host and port: %w", err)
 	}
 
-	conn, err := d.DialContext(ctx, "tcp", addr)
+	conn, err := s.dialConn(ctx, &d, addr)
 	if err != nil {
 		return nil, fmt.Errorf("failed to dial smtp server: %w", err)
 	}
+	pc := &pooledConn{conn: conn, timeouts: timeouts}
 
-	c, err := smtp.NewClient(conn, host)
+	// The client reads the server greeting.
+	stop := pc.watch(ctx)
+	defer stop()
+
+	pc.setDeadline(timeouts.greeting)
+	pc.c, err = smtp.NewClient(conn, host)
 	if err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("failed to dial smtp server: %w", err)
+		return nil, fmt.Errorf("failed to read smtp server greeting: %w", err)
 	}
-	return c, nil
+	return pc, nil
 }
 
-func (s *SMTPProvider) sendMessage(ctx context.Context, msg *message.Message) error {
-	c, err := s.smtpClient(ctx)
+// session dials the smtp server and returns the client session that is ready to send messages.
+func (s *SMTPProvider) session(ctx context.Context) (*pooledConn, error) {
+	pc, err := s.smtpClient(ctx, s.timeouts())
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer c.Close()
 
-	// Call Hello to the smtp server.
-	if err = c.Hello(s.pc.Domain); err != nil {
-		s.log.WithError(err).Debug("failed to say hello")
-		return errors.New("failed to say hello")
+	stop := pc.watch(ctx)
+	err = s.startSession(ctx, pc)
+	stop()
+	if err != nil {
+		pc.c.Close()
+		return nil, err
 	}
+	return pc, nil
+}
 
-	if ok, _ := c.Extension("STARTTLS"); ok {
-		config := tls.Config{ServerName: string(s.cfg.Host)}
-		if err = c.StartTLS(&config); err != nil {
-			s.log.
-				WithFields(logrus.Fields{
-					"provider_id": s.p.UID,
-				}).WithError(err).Debug("failed to start tls for smtp client")
-			return err
-		}
+func (s *SMTPProvider) startSession(ctx context.Context, pc *pooledConn) error {
+	// Call Hello to the smtp server.
+	pc.setDeadline(pc.timeouts.command)
+	if err := pc.c.Hello(s.pc.Domain); err != nil {
+		s.log.WithError(err).Debug("failed to say hello to smtp client")
+		return fmt.Errorf("failed to say hello to smtp client: %w", err)
 	}
 
-	if ok, _ := c.Extension("AUTH"); !ok {
-		s.log.WithFields(logrus.Fields{
-			"provider_id": s.p.UID,
-			"host":        s.cfg.Host,
-		}).Debug("smtp server does not support authentication")
-		return mailprovider2.ErrAuth(errors.New("smtp server does not support authentication"))
+	pc.setDeadline(pc.timeouts.command)
+	if err := s.startTLS(pc.c); err != nil {
+		return err
 	}
 
-	// Authenticate the smtp client.
-	if err = c.Auth(s.auth()); err != nil {
-		s.log.WithError(err).Debug("failed to authenticate smtp client")
-		return mailprovider2.ErrAuth(err)
+	pc.setDeadline(pc.timeouts.command)
+	return s.authenticate(ctx, pc.c)
+}
+
+func (s *SMTPProvider) sendMessage(ctx context.Context, msg *mailprovider2.Message) (*mailprovider2.SendResult, error) {
+	pc, err := s.pool.get(ctx)
+	if err != nil {
+		return nil, handleErr(err)
 	}
 
-	// Set the sender.
-	if err = c.Mail(msg.From.String()); err != nil {
-		s.log.WithFields(logrus.Fields{
-			"provider_id":   s.p.UID,
-			"msg_id":        msg.ID,
-			"from":          msg.From.String(),
-			logrus.ErrorKey: err,
-		}).Debug("failed to set sender")
+	// The session is returned to the pool unless the error left it in an unknown state.
+	healthy := true
+	defer func() {
+		s.pool.put(pc, healthy)
+	}()
 
-		return s.handleErr(err)
+	// The context cancellation aborts the session in progress.
+	stop := pc.watch(ctx)
+	defer stop()
+
+	mw := mailproviderwriter.Writer{Domain: s.pc.Domain, Signer: s.dkimSigner()}
+	res, healthy, err := sendTransaction(ctx, pc, mw, msg, msg.Recipients(), s.log.WithField("msg_id", msg.ID))
+	if err != nil {
+		return res, err
 	}
+	pc.messages++
+	return res, nil
+}
 
-	for _, to := range msg.To {
-		// Set the recipients.
-		if err = c.Rcpt(to.String()); err != nil {
-			s.log.
-				WithFields(logrus.Fields{
-					"provider_id":   s.p.UID,
-					"msg_id":        msg.ID,
-					"to":            to.String(),
-					logrus.ErrorKey: err,
-				}).Debug("failed to set recipient")
-			return s.handleErr(err)
-		}
+// rejectedRecipient returns the result of the recipient rejected with the smtp server reply.
+func rejectedRecipient(addr string, err error) mailprovider2.RecipientResult {
+	// The failure without the server reply is treated as temporary, as the delivery outcome is unknown.
+	rr := mailprovider2.RecipientResult{
+		Address: addr,
+		Status:  mailprovider2.RecipientTemporaryRejected,
+		Message: err.Error(),
 	}
 
-	w, err := c.Data()
-	if err != nil {
-		s.log.
-			WithFields(logrus.Fields{
-				"provider_id":   s.p.UID,
-				"msg_id":        msg.ID,
-				logrus.ErrorKey: err,
-			}).Debug("failed to get data writer")
-		return s.handleErr(err)
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		e := mailprovider2.ErrReply(protoErr.Code, protoErr.Msg, err)
+		rr.Code = e.Code
+		rr.EnhancedCode = e.EnhancedCode
+		rr.Category = e.Category
+		rr.Message = e.Message
+		// The 552 reply to RCPT is treated as temporary, as it is used for too many recipients (RFC 5321 4.5.3.1.10).
+		if !e.Temporary && protoErr.Code != 552 {
+			rr.Status = mailprovider2.RecipientPermanentRejected
+		}
 	}
+	return rr
+}
 
-	bw := newBufioWriter(w)
-	defer putBufioWriter(bw)
+// rejectedDelivery returns the result of the recipient, that rejected the message data.
+// Contrary to the RCPT reply, the 552 reply to the data is a permanent failure.
+func rejectedDelivery(addr string, err error) mailprovider2.RecipientResult {
+	rr := rejectedRecipient(addr, err)
 
-	if err = s.writeMessage(msg, bw); err != nil {
-		s.log.WithFields(logrus.Fields{
-			"provider_id":   s.p.UID,
-			"msg_id":        msg.ID,
-			logrus.ErrorKey: err,
-		}).Debug("failed to write message")
-		return errors.New("failed to write message")
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) && protoErr.Code == 552 {
+		rr.Status = mailprovider2.RecipientPermanentRejected
 	}
+	return rr
+}
 
-	if err = bw.Flush(); err != nil {
-		s.log.WithFields(logrus.Fields{
-			"provider_id":   s.p.UID,
-			"msg_id":        msg.ID,
-			logrus.ErrorKey: err,
-		}).Debug("failed to flush buffered writer")
-		return s.handleErr(err)
+// rejectAccepted marks the accepted recipients as rejected, when the server refused the message data.
+func rejectAccepted(res *mailprovider2.SendResult, err error) *mailprovider2.SendResult {
+	for i, rr := range res.Recipients {
+		if rr.Status == mailprovider2.RecipientAccepted {
+			res.Recipients[i] = rejectedDelivery(rr.Address, err)
+		}
 	}
+	return res
+}
 
-	if err = w.Close(); err != nil {
-		s.log.WithFields(logrus.Fields{
-			"provider_id":   s.p.UID,
-			"msg_id":        msg.ID,
-			logrus.ErrorKey: err,
-		}).Debug("failed to close data writer")
-		return s.handleErr(err)
-	}
+// isReplyErr checks if the error is a smtp server reply, after which the session is still usable.
+func isReplyErr(err error) bool {
+	var protoErr *textproto.Error
+	return errors.As(err, &protoErr)
+}
 
-	if err = c.Quit(); err != nil {
-		s.log.WithFields(logrus.Fields{
-			"provider_id":   s.p.UID,
-			"msg_id":        msg.ID,
-			logrus.ErrorKey: err,
-		}).Debug("failed to quit smtp client connection")
-		return s.handleErr(err)
+// handleErr converts the smtp session error into the mailprovider error.
+func handleErr(err error) error {
+	// The timed out or aborted session is reported as temporary, as the delivery could succeed on retry.
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return mailprovider2.ErrTemporary(fmt.Errorf("smtp session timed out: %w", err))
 	}
-	return nil
-}
 
-func (s *SMTPProvider) handleErr(err error) error {
 	var protoErr *textproto.Error
 	if errors.As(err, &protoErr) {
 		switch {
 		case protoErr.Code == 535:
 			// The 535 means Authentication credentials invalid.
 			return mailprovider2.ErrAuth(err)
-		case protoErr.Code >= 400 && protoErr.Code < 500:
-			// The code between 400 and 500 is a temporary error.
-			return mailprovider2.ErrTemporary(err)
-		case protoErr.Code >= 500 && protoErr.Code < 600:
-			// The code between 500 and 600 is a permanent error.
-			return mailprovider2.ErrPermanent(err)
+		case protoErr.Code >= 400 && protoErr.Code < 600:
+			// The code between 400 and 500 is a temporary error, and between 500 and 600 is a permanent one.
+			// The enhanced status code in the reply text refines the error category.
+			return mailprovider2.ErrReply(protoErr.Code, protoErr.Msg, err)
 		}
 	}
 	return err
 }
 
-// writeMessage writes the message to the buffer.
-func (s *SMTPProvider) writeMessage(msg *message.Message, buf *bufio.Writer) error {
-	// Write the content type.
-	s.writeLine(buf, "MIME-version: 1.0")
-	s.writeHeaderLine(buf, "Content-Type", msg.ContentType)
-	s.writeHeaderLine(buf, "From", msg.From.String())
-	var sb strings.Builder
-	for _, to := range msg.To {
-		sb.WriteString(to.String())
-		sb.WriteString(";")
-	}
-	s.writeHeaderLine(buf, "To", sb.String())
-	s.writeHeaderLine(buf, "Subject", mime.QEncoding.Encode("UTF-8", msg.Subject))
-	s.writeHeaderLine(buf, "Content-Transfer-Encoding", "base64")
-	buf.WriteString("\r\n")
-
-	temp := make([]byte, base64.StdEncoding.EncodedLen(len(msg.Body)))
-	base64.StdEncoding.Encode(temp, []byte(msg.Body))
-	buf.Write(temp)
+func (s *SMTPProvider) addr() string {
+	s.l.RLock()
+	defer s.l.RUnlock()
 
-	return nil
+	return net.JoinHostPort(s.cfg.Host.UnsafeString(), strconv.FormatUint(uint64(s.cfg.Port), 10))
 }
 
-func (s *SMTPProvider) writeLine(buf *bufio.Writer, line string) {
-	buf.WriteString(line)
-	buf.WriteString("\r\n")
-}
+// timeouts returns the configured timeouts of the smtp session phases.
+func (s *SMTPProvider) timeouts() smtpTimeouts {
+	s.l.RLock()
+	defer s.l.RUnlock()
 
-func (s *SMTPProvider) writeHeaderLine(buf *bufio.Writer, header, content string) {
-	buf.WriteString(header)
-	buf.WriteString(": ")
-	buf.WriteString(content)
-	buf.WriteString("\r\n")
+	return newSMTPTimeouts(s.cfg.Timeouts)
 }
 
-func (s *SMTPProvider) addr() string {
+func (s *SMTPProvider) dkimSigner() *mailproviderwriter.DKIMSigner {
 	s.l.RLock()
 	defer s.l.RUnlock()
 
-	return fmt.Sprintf("%s:%d", s.cfg.Host, s.cfg.Port)
+	return s.dkim
 }
 
-func (s *SMTPProvider) auth() smtp.Auth {
+func (s *SMTPProvider) host() string {
 	s.l.RLock()
 	defer s.l.RUnlock()
 
-	return smtp.PlainAuth("", s.cfg.Username.UnsafeString(), s.cfg.Password.UnsafeString(), s.cfg.Host.UnsafeString())
+	return s.cfg.Host.UnsafeString()
 }
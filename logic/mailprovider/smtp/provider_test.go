@@ -0,0 +1,471 @@
+package smtpmailprovider_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
+	mailprovider2 "github.com/blockysource/mailing/logic/mailprovider"
+	smtpmailprovider "github.com/blockysource/mailing/logic/mailprovider/smtp"
+	"github.com/blockysource/mailing/logic/mailprovider/smtp/smtptest"
+)
+
+func newServer(t *testing.T, cfg smtptest.Config) *smtptest.Server {
+	t.Helper()
+
+	srv, err := smtptest.NewServer(cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+// newProvider creates the provider of the server, that trusts the server certificate.
+// By default, the provider authenticates as the user with the secret password, using the negotiated mechanism.
+func newProvider(t *testing.T, srv *smtptest.Server, fn func(cfg *mailingpb.SMTPConfig)) *smtpmailprovider.SMTPProvider {
+	t.Helper()
+
+	cfg := &mailingpb.SMTPConfig{
+		Host:          mailingpb.Secret("localhost"),
+		Port:          srv.Port(),
+		Username:      mailingpb.Secret("user"),
+		Password:      mailingpb.Secret("secret"),
+		TLSMode:       mailingpb.SMTP_TLS_STARTTLS_OPPORTUNISTIC,
+		AuthMechanism: mailingpb.SMTP_AUTH_AUTO,
+		Timeouts: &mailingpb.SMTPTimeouts{
+			ConnectTimeout:  time.Second,
+			GreetingTimeout: time.Second,
+			CommandTimeout:  time.Second,
+			DataTimeout:     time.Second,
+		},
+	}
+	if ca := srv.CACertificatePEM(); ca != "" {
+		cfg.TLS = &mailingpb.SMTPTLSConfig{CACertificates: ca}
+	}
+	if fn != nil {
+		fn(cfg)
+	}
+	def := mailprovider2.MailingProviderDefinition{
+		UID:    "smtp",
+		Config: &mailingpb.MailingProviderConfig{Config: &mailingpb.MailingProviderConfig_SmtpConfig{SmtpConfig: cfg}},
+	}
+
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	p, err := smtpmailprovider.New(&smtpmailprovider.SMTPProvidersConfig{Domain: "mta.example.org", MaxConnections: 1}, def, logrus.NewEntry(log))
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+	t.Cleanup(p.Close)
+	return p
+}
+
+// newTokenServer starts the oauth2 authorization server, that issues the access token for the refresh token grant.
+func newTokenServer(t *testing.T, token string) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "refresh_token" || r.PostForm.Get("refresh_token") != "refresh" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"access_token":"`+token+`","expires_in":3600,"token_type":"Bearer"}`)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func smtpMessage(to ...string) *mailprovider2.Message {
+	msg := &mailprovider2.Message{
+		ID:          "smtp-message",
+		From:        &mail.Address{Address: "sender@example.org"},
+		Subject:     "Hello",
+		Body:        "Hello there\n.dotted line\nBye",
+		ContentType: "text/plain; charset=utf-8",
+	}
+	for _, addr := range to {
+		msg.To = append(msg.To, &mail.Address{Address: addr})
+	}
+	return msg
+}
+
+func TestSMTPProvider_Send_TLS(t *testing.T) {
+	tests := []struct {
+		name    string
+		srv     smtptest.Config
+		mode    mailingpb.SMTPTLSMode
+		noCA    bool
+		wantTLS bool
+		wantErr bool
+	}{
+		{name: "starttls required", srv: smtptest.Config{StartTLS: true}, mode: mailingpb.SMTP_TLS_STARTTLS_REQUIRED, wantTLS: true},
+		{name: "starttls required not supported", mode: mailingpb.SMTP_TLS_STARTTLS_REQUIRED, wantErr: true},
+		{name: "starttls opportunistic", srv: smtptest.Config{StartTLS: true}, mode: mailingpb.SMTP_TLS_STARTTLS_OPPORTUNISTIC, wantTLS: true},
+		{name: "starttls opportunistic not supported", mode: mailingpb.SMTP_TLS_STARTTLS_OPPORTUNISTIC},
+		{name: "starttls untrusted certificate", srv: smtptest.Config{StartTLS: true}, mode: mailingpb.SMTP_TLS_STARTTLS_OPPORTUNISTIC, noCA: true, wantErr: true},
+		{name: "implicit", srv: smtptest.Config{ImplicitTLS: true}, mode: mailingpb.SMTP_TLS_IMPLICIT, wantTLS: true},
+		{name: "implicit untrusted certificate", srv: smtptest.Config{ImplicitTLS: true}, mode: mailingpb.SMTP_TLS_IMPLICIT, noCA: true, wantErr: true},
+		{name: "none", srv: smtptest.Config{StartTLS: true}, mode: mailingpb.SMTP_TLS_NONE},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newServer(t, tc.srv)
+			p := newProvider(t, srv, func(cfg *mailingpb.SMTPConfig) {
+				cfg.TLSMode = tc.mode
+				cfg.AuthMechanism = mailingpb.SMTP_AUTH_NONE
+				if tc.noCA {
+					cfg.TLS = nil
+				}
+			})
+
+			_, err := p.Send(context.Background(), smtpMessage("alice@example.com"))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("send succeeded, want error")
+				}
+				if got := len(srv.Messages()); got != 0 {
+					t.Fatalf("server received %d messages, want none", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("send failed: %v", err)
+			}
+
+			msgs := srv.Messages()
+			if len(msgs) != 1 || msgs[0].TLS != tc.wantTLS {
+				t.Fatalf("got messages %+v, want one with tls %t", msgs, tc.wantTLS)
+			}
+		})
+	}
+}
+
+func TestSMTPProvider_Send_Auth(t *testing.T) {
+	tests := []struct {
+		name     string
+		starttls bool
+		offered  []string
+		mech     mailingpb.SMTPAuthMechanism
+		oauth2   bool
+		token    string
+		wantMech string
+		wantAuth bool
+	}{
+		{name: "plain", starttls: true, mech: mailingpb.SMTP_AUTH_PLAIN, wantMech: "PLAIN"},
+		{name: "login", starttls: true, mech: mailingpb.SMTP_AUTH_LOGIN, wantMech: "LOGIN"},
+		{name: "cram-md5", mech: mailingpb.SMTP_AUTH_CRAM_MD5, wantMech: "CRAM-MD5"},
+		{name: "xoauth2", starttls: true, mech: mailingpb.SMTP_AUTH_XOAUTH2, oauth2: true, wantMech: "XOAUTH2"},
+		{name: "auto over tls", starttls: true, mech: mailingpb.SMTP_AUTH_AUTO, wantMech: "PLAIN"},
+		{name: "auto without tls", mech: mailingpb.SMTP_AUTH_AUTO, wantMech: "CRAM-MD5"},
+		{name: "auto with oauth2", starttls: true, mech: mailingpb.SMTP_AUTH_AUTO, oauth2: true, wantMech: "XOAUTH2"},
+		{name: "auto login only", offered: []string{"LOGIN"}, mech: mailingpb.SMTP_AUTH_AUTO, wantMech: "LOGIN"},
+		{name: "not offered", offered: []string{"LOGIN"}, mech: mailingpb.SMTP_AUTH_CRAM_MD5, wantAuth: true},
+		{name: "xoauth2 without oauth2", starttls: true, mech: mailingpb.SMTP_AUTH_XOAUTH2, wantAuth: true},
+		{name: "xoauth2 invalid token", starttls: true, mech: mailingpb.SMTP_AUTH_XOAUTH2, oauth2: true, token: "revoked", wantAuth: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			offered := tc.offered
+			if offered == nil {
+				offered = []string{"PLAIN", "LOGIN", "CRAM-MD5", "XOAUTH2"}
+			}
+			srv := newServer(t, smtptest.Config{
+				StartTLS:       tc.starttls,
+				AuthMechanisms: offered,
+				AuthRequired:   true,
+				Username:       "user",
+				Password:       "secret",
+				Token:          "token",
+			})
+
+			token := tc.token
+			if token == "" {
+				token = "token"
+			}
+			ts := newTokenServer(t, token)
+
+			p := newProvider(t, srv, func(cfg *mailingpb.SMTPConfig) {
+				cfg.AuthMechanism = tc.mech
+				if tc.oauth2 {
+					cfg.OAuth2 = &mailingpb.SMTPOAuth2Config{TokenURL: ts.URL, ClientID: "client", RefreshToken: mailingpb.Secret("refresh")}
+				}
+			})
+
+			_, err := p.Send(context.Background(), smtpMessage("alice@example.com"))
+			if tc.wantAuth {
+				var authErr *mailprovider2.AuthErr
+				if !errors.As(err, &authErr) {
+					t.Fatalf("got %T %v, want auth error", err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("send failed: %v", err)
+			}
+
+			sessions := srv.Sessions()
+			if len(sessions) != 1 || sessions[0].AuthMechanism != tc.wantMech || sessions[0].AuthUser != "user" {
+				t.Fatalf("got sessions %+v, want one authenticated with %s", sessions, tc.wantMech)
+			}
+		})
+	}
+}
+
+func TestSMTPProvider_Send_InvalidCredentials(t *testing.T) {
+	srv := newServer(t, smtptest.Config{AuthMechanisms: []string{"PLAIN"}, AuthRequired: true, Username: "user", Password: "other"})
+	p := newProvider(t, srv, nil)
+
+	_, err := p.Send(context.Background(), smtpMessage("alice@example.com"))
+	var authErr *mailprovider2.AuthErr
+	if !errors.As(err, &authErr) {
+		t.Fatalf("got %T %v, want auth error", err, err)
+	}
+	if !strings.Contains(srv.Transcript(), "S: 535 ") {
+		t.Fatalf("unexpected transcript:\n%s", srv.Transcript())
+	}
+}
+
+func TestSMTPProvider_Send_Errors(t *testing.T) {
+	tests := []struct {
+		name      string
+		stage     smtptest.Stage
+		reply     smtptest.Reply
+		timeout   time.Duration
+		temporary bool
+		code      int
+		category  mailprovider2.ErrorCategory
+		rcpt      mailprovider2.RecipientStatus
+	}{
+		{name: "greeting 421", stage: smtptest.StageGreeting, reply: smtptest.Reply{Code: 421, Text: "Too busy", Disconnect: true}, temporary: true, code: 421, category: mailprovider2.CategoryRateLimited},
+		{name: "greeting 554", stage: smtptest.StageGreeting, reply: smtptest.Reply{Code: 554, Text: "No service"}, code: 554, category: mailprovider2.CategoryPolicy},
+		{name: "mail 451", stage: smtptest.StageMail, reply: smtptest.Reply{Code: 451, EnhancedCode: "4.3.0", Text: "Try again later"}, temporary: true, code: 451},
+		{name: "mail 550", stage: smtptest.StageMail, reply: smtptest.Reply{Code: 550, EnhancedCode: "5.7.1", Text: "Sender denied"}, code: 550, category: mailprovider2.CategoryPolicy},
+		{name: "rcpt 452", stage: smtptest.StageRcpt, reply: smtptest.Reply{Code: 452, EnhancedCode: "4.2.2", Text: "Mailbox full"}, temporary: true, code: 452, category: mailprovider2.CategoryQuotaExceeded, rcpt: mailprovider2.RecipientTemporaryRejected},
+		{name: "rcpt 550", stage: smtptest.StageRcpt, reply: smtptest.Reply{Code: 550, EnhancedCode: "5.1.1", Text: "No such user"}, code: 550, category: mailprovider2.CategoryMailboxUnknown, rcpt: mailprovider2.RecipientPermanentRejected},
+		{name: "data 451", stage: smtptest.StageData, reply: smtptest.Reply{Code: 451, EnhancedCode: "4.3.0", Text: "Try again later"}, temporary: true, code: 451, rcpt: mailprovider2.RecipientTemporaryRejected},
+		{name: "data 554", stage: smtptest.StageData, reply: smtptest.Reply{Code: 554, EnhancedCode: "5.5.1", Text: "Transaction failed"}, code: 554, category: mailprovider2.CategoryPolicy, rcpt: mailprovider2.RecipientPermanentRejected},
+		{name: "message 452", stage: smtptest.StageMessage, reply: smtptest.Reply{Code: 452, EnhancedCode: "4.3.1", Text: "Insufficient system storage"}, temporary: true, code: 452, category: mailprovider2.CategoryQuotaExceeded, rcpt: mailprovider2.RecipientTemporaryRejected},
+		{name: "message 552", stage: smtptest.StageMessage, reply: smtptest.Reply{Code: 552, EnhancedCode: "5.3.4", Text: "Message too big"}, code: 552, category: mailprovider2.CategoryMessageTooLarge, rcpt: mailprovider2.RecipientPermanentRejected},
+		{name: "message 554", stage: smtptest.StageMessage, reply: smtptest.Reply{Code: 554, EnhancedCode: "5.7.1", Text: "Message rejected as spam"}, code: 554, category: mailprovider2.CategoryPolicy, rcpt: mailprovider2.RecipientPermanentRejected},
+		{name: "mail timeout", stage: smtptest.StageMail, reply: smtptest.Reply{Code: 250, Delay: 500 * time.Millisecond}, timeout: 100 * time.Millisecond, temporary: true},
+		{name: "rcpt disconnect", stage: smtptest.StageRcpt, reply: smtptest.Reply{Disconnect: true}, temporary: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newServer(t, smtptest.Config{EnhancedStatusCodes: true})
+			srv.Script(tc.stage, tc.reply)
+			p := newProvider(t, srv, func(cfg *mailingpb.SMTPConfig) {
+				cfg.AuthMechanism = mailingpb.SMTP_AUTH_NONE
+				if tc.timeout > 0 {
+					cfg.Timeouts.CommandTimeout = tc.timeout
+				}
+			})
+
+			res, err := p.Send(context.Background(), smtpMessage("alice@example.com"))
+			if err == nil {
+				t.Fatal("send succeeded, want error")
+			}
+
+			var e *mailprovider2.Error
+			if !errors.As(err, &e) {
+				if tc.code != 0 || !tc.temporary {
+					t.Fatalf("got %T %v, want mailprovider error", err, err)
+				}
+				return
+			}
+			if e.Temporary != tc.temporary || e.Code != tc.code || e.Category != tc.category {
+				t.Errorf("got temporary %t code %d category %s, want %t %d %s", e.Temporary, e.Code, e.Category, tc.temporary, tc.code, tc.category)
+			}
+
+			// The recipients accepted before the message was refused are reported as rejected.
+			if tc.rcpt != mailprovider2.RecipientAccepted {
+				if res == nil || len(res.Recipients) != 1 || res.Recipients[0].Status != tc.rcpt {
+					t.Fatalf("got result %+v, want recipient %s", res, tc.rcpt)
+				}
+			}
+			if got := len(srv.Messages()); got != 0 {
+				t.Fatalf("server received %d messages, want none", got)
+			}
+		})
+	}
+}
+
+func TestSMTPProvider_Send_Pipelining(t *testing.T) {
+	tests := []struct {
+		name       string
+		pipelining bool
+	}{
+		{name: "pipelining", pipelining: true},
+		{name: "no pipelining"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newServer(t, smtptest.Config{Pipelining: tc.pipelining, EnhancedStatusCodes: true})
+			p := newProvider(t, srv, func(cfg *mailingpb.SMTPConfig) { cfg.AuthMechanism = mailingpb.SMTP_AUTH_NONE })
+
+			// The recipients are sent along with the sender only if the commands are pipelined,
+			// so that they reach the server even though the sender is rejected.
+			srv.Script(smtptest.StageMail, smtptest.Reply{Code: 451, EnhancedCode: "4.3.0", Text: "Try again later"})
+			if _, err := p.Send(context.Background(), smtpMessage("alice@example.com", "bob@example.com")); err == nil {
+				t.Fatal("send succeeded, want error")
+			}
+			want := 0
+			if tc.pipelining {
+				want = 2
+			}
+			if got := strings.Count(srv.Transcript(), "C: RCPT TO:"); got != want {
+				t.Fatalf("got %d recipient commands, want %d:\n%s", got, want, srv.Transcript())
+			}
+
+			// The partially rejected recipients get their own replies.
+			srv.RejectRecipient("bob@example.com", smtptest.Reply{Code: 550, EnhancedCode: "5.1.1", Text: "No such user"})
+			res, err := p.Send(context.Background(), smtpMessage("alice@example.com", "bob@example.com", "carol@example.com"))
+			if err != nil {
+				t.Fatalf("send failed: %v", err)
+			}
+			if rejected := res.Rejected(); len(rejected) != 1 || rejected[0].Address != "bob@example.com" || rejected[0].Status != mailprovider2.RecipientPermanentRejected {
+				t.Fatalf("unexpected recipient results: %+v", res.Recipients)
+			}
+
+			msgs := srv.Messages()
+			if len(msgs) != 1 || strings.Join(msgs[0].To(), ",") != "alice@example.com,carol@example.com" {
+				t.Fatalf("unexpected messages: %+v", msgs)
+			}
+		})
+	}
+}
+
+func TestSMTPProvider_Send_Chunking(t *testing.T) {
+	tests := []struct {
+		name     string
+		chunking bool
+		command  string
+	}{
+		{name: "bdat", chunking: true, command: "C: BDAT "},
+		{name: "data", command: "C: DATA"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newServer(t, smtptest.Config{Chunking: tc.chunking, EightBitMIME: true, Size: 1 << 20})
+			p := newProvider(t, srv, func(cfg *mailingpb.SMTPConfig) { cfg.AuthMechanism = mailingpb.SMTP_AUTH_NONE })
+
+			if _, err := p.Send(context.Background(), smtpMessage("alice@example.com")); err != nil {
+				t.Fatalf("send failed: %v", err)
+			}
+
+			msgs := srv.Messages()
+			if len(msgs) != 1 || msgs[0].Chunked != tc.chunking {
+				t.Fatalf("got messages %+v, want one with chunked %t", msgs, tc.chunking)
+			}
+			// The line starting with the dot is received intact, either unstuffed or sent in the chunk as is.
+			if data := string(msgs[0].Data); !strings.Contains(data, "\r\n.dotted line\r\n") || strings.Contains(data, "..dotted") {
+				t.Fatalf("unexpected message data:\n%s", data)
+			}
+			if msgs[0].Params["SIZE"] == "" || msgs[0].Params["BODY"] != "8BITMIME" {
+				t.Fatalf("unexpected mail params: %v", msgs[0].Params)
+			}
+			if !strings.Contains(srv.Transcript(), tc.command) {
+				t.Fatalf("no %q in transcript:\n%s", tc.command, srv.Transcript())
+			}
+		})
+	}
+}
+
+func TestSMTPProvider_Send_PoolReuse(t *testing.T) {
+	srv := newServer(t, smtptest.Config{StartTLS: true, AuthMechanisms: []string{"PLAIN"}, Username: "user", Password: "secret", EnhancedStatusCodes: true})
+	p := newProvider(t, srv, nil)
+
+	// The rejected transaction leaves the session usable, it is reset before the next message.
+	srv.RejectRecipient("bob@example.com", smtptest.Reply{Code: 550, EnhancedCode: "5.1.1", Text: "No such user"})
+	if _, err := p.Send(context.Background(), smtpMessage("bob@example.com")); err == nil {
+		t.Fatal("send succeeded, want error")
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := p.Send(context.Background(), smtpMessage("alice@example.com")); err != nil {
+			t.Fatalf("send %d failed: %v", i+1, err)
+		}
+	}
+
+	sessions := srv.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("got %d sessions, want the single reused one", len(sessions))
+	}
+	if got := strings.Count(srv.Transcript(), "C: RSET"); got != 2 {
+		t.Fatalf("got %d resets, want 2:\n%s", got, srv.Transcript())
+	}
+	if got := strings.Count(srv.Transcript(), "C: AUTH "); got != 1 {
+		t.Fatalf("got %d authentications, want 1", got)
+	}
+	if got := len(srv.Messages()); got != 2 {
+		t.Fatalf("server received %d messages, want 2", got)
+	}
+
+	// The session that fails the reset is replaced with a new one.
+	srv.Script(smtptest.StageReset, smtptest.Reply{Code: 421, Text: "Closing connection", Disconnect: true})
+	if _, err := p.Send(context.Background(), smtpMessage("alice@example.com")); err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	if got := len(srv.Sessions()); got != 2 {
+		t.Fatalf("got %d sessions, want 2", got)
+	}
+}
+
+func TestSMTPProvider_Send_AttachmentError(t *testing.T) {
+	srv := newServer(t, smtptest.Config{StartTLS: true, AuthMechanisms: []string{"PLAIN"}, Username: "user", Password: "secret"})
+	p := newProvider(t, srv, nil)
+
+	msg := smtpMessage("alice@example.com")
+	msg.Attachments = []mailprovider2.Attachment{{
+		Filename:    "report.pdf",
+		ContentType: "application/pdf",
+		Open: func(context.Context) (io.ReadCloser, error) {
+			return nil, errors.New("store unavailable")
+		},
+	}}
+
+	// The attachment store failure keeps its temporary classification, so that the message is retried.
+	_, err := p.Send(context.Background(), msg)
+	var e *mailprovider2.Error
+	if !errors.As(err, &e) || !e.Temporary {
+		t.Fatalf("got %v, want temporary error", err)
+	}
+	if got := len(srv.Messages()); got != 0 {
+		t.Fatalf("server received %d messages, want none", got)
+	}
+}
+
+func TestSMTPProvider_Verify(t *testing.T) {
+	srv := newServer(t, smtptest.Config{StartTLS: true, AuthMechanisms: []string{"PLAIN"}, Username: "user", Password: "secret"})
+	p := newProvider(t, srv, func(cfg *mailingpb.SMTPConfig) { cfg.TLSMode = mailingpb.SMTP_TLS_STARTTLS_REQUIRED })
+
+	if err := p.Verify(context.Background()); err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+	if !p.IsVerified() {
+		t.Fatal("provider is not verified")
+	}
+
+	sessions := srv.Sessions()
+	if len(sessions) != 1 || !sessions[0].TLS || sessions[0].AuthUser != "user" {
+		t.Fatalf("unexpected sessions: %+v", sessions)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(srv.Transcript()), "S: 221 Bye") {
+		t.Fatalf("session did not quit:\n%s", srv.Transcript())
+	}
+}
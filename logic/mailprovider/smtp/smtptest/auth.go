@@ -0,0 +1,213 @@
+package smtptest
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var (
+	errAuthCanceled       = errors.New("authentication canceled")
+	errInvalidBase64      = errors.New("invalid base64 data")
+	errInvalidCredentials = errors.New("invalid credentials")
+)
+
+// xoauth2Error is the error challenge sent to the client with the invalid XOAUTH2 token.
+const xoauth2Error = `{"status":"401","schemes":"bearer","scope":"https://mail.google.com/"}`
+
+// auth handles the AUTH command with the PLAIN, LOGIN, CRAM-MD5 and XOAUTH2 mechanisms.
+// The scripted reply is sent right away, without the credentials exchange.
+func (ss *session) auth(arg string) bool {
+	mech, initial, _ := strings.Cut(arg, " ")
+	mech = strings.ToUpper(mech)
+
+	var def Reply
+	switch {
+	case !ss.helo:
+		def = ss.reply(503, "5.5.1", "EHLO/HELO first")
+	case ss.authed:
+		def = ss.reply(503, "5.5.1", "Already authenticated")
+	case ss.msg != nil:
+		def = ss.reply(503, "5.5.1", "AUTH not allowed during the mail transaction")
+	case !ss.authAdvertised() || !ss.supportsMechanism(mech):
+		def = ss.reply(504, "5.5.4", "Unrecognized authentication type")
+	}
+
+	if r, ok := ss.s.scripted(StageAuth); ok {
+		if def.Code == 0 && r.positive() {
+			ss.authenticated(mech, "")
+		}
+		return ss.send(r)
+	}
+	if def.Code != 0 {
+		return ss.send(def)
+	}
+
+	user, err := ss.exchange(mech, strings.TrimSpace(initial))
+	switch {
+	case err == nil:
+		ss.authenticated(mech, user)
+		return ss.send(ss.reply(235, "2.7.0", "Authentication successful"))
+	case errors.Is(err, errAuthCanceled):
+		return ss.send(ss.reply(501, "5.7.0", "Authentication canceled"))
+	case errors.Is(err, errInvalidBase64):
+		return ss.send(ss.reply(501, "5.5.2", "Invalid base64 data"))
+	case errors.Is(err, errInvalidCredentials):
+		return ss.send(ss.reply(535, "5.7.8", "Authentication credentials invalid"))
+	default:
+		// The connection failed in the middle of the exchange.
+		return false
+	}
+}
+
+// exchange runs the credentials exchange of the mechanism and returns the authenticated name.
+func (ss *session) exchange(mech, initial string) (string, error) {
+	cfg := ss.s.cfg
+	switch mech {
+	case "PLAIN":
+		resp, err := ss.initialResponse(initial)
+		if err != nil {
+			return "", err
+		}
+		// The response is the authorization identity, the name and the password separated with NUL (RFC 4616 2).
+		parts := strings.Split(string(resp), "\x00")
+		if len(parts) != 3 || !ss.validCredentials(parts[1], parts[2], cfg.Password) {
+			return "", errInvalidCredentials
+		}
+		return parts[1], nil
+	case "LOGIN":
+		// The client might send the name as the initial response, instead of waiting for the challenge.
+		var user []byte
+		var err error
+		if initial != "" {
+			user, err = decodeResponse(initial)
+		} else {
+			user, err = ss.challenge("Username:")
+		}
+		if err != nil {
+			return "", err
+		}
+		pass, err := ss.challenge("Password:")
+		if err != nil {
+			return "", err
+		}
+		if !ss.validCredentials(string(user), string(pass), cfg.Password) {
+			return "", errInvalidCredentials
+		}
+		return string(user), nil
+	case "CRAM-MD5":
+		n, err := rand.Int(rand.Reader, big.NewInt(1<<31))
+		if err != nil {
+			return "", err
+		}
+		challenge := fmt.Sprintf("<%d.%d@%s>", n, time.Now().UnixNano(), cfg.Hostname)
+		resp, err := ss.challenge(challenge)
+		if err != nil {
+			return "", err
+		}
+		// The response is the name and the hex encoded HMAC-MD5 digest of the challenge (RFC 2195 2).
+		user, digest, _ := strings.Cut(string(resp), " ")
+		mac := hmac.New(md5.New, []byte(cfg.Password))
+		mac.Write([]byte(challenge))
+		expected := hex.EncodeToString(mac.Sum(nil))
+		if cfg.Username != "" && (user != cfg.Username || !hmac.Equal([]byte(digest), []byte(expected))) {
+			return "", errInvalidCredentials
+		}
+		return user, nil
+	case "XOAUTH2":
+		resp, err := ss.initialResponse(initial)
+		if err != nil {
+			return "", err
+		}
+		var user, token string
+		for _, field := range strings.Split(string(resp), "\x01") {
+			switch {
+			case strings.HasPrefix(field, "user="):
+				user = strings.TrimPrefix(field, "user=")
+			case strings.HasPrefix(field, "auth=Bearer "):
+				token = strings.TrimPrefix(field, "auth=Bearer ")
+			}
+		}
+		if !ss.validCredentials(user, token, cfg.Token) {
+			// The failure is reported with the error challenge, the client responds with an empty line.
+			_, err = ss.challenge(xoauth2Error)
+			if err != nil && !errors.Is(err, errInvalidBase64) && !errors.Is(err, errAuthCanceled) {
+				return "", err
+			}
+			return "", errInvalidCredentials
+		}
+		return user, nil
+	default:
+		return "", errInvalidCredentials
+	}
+}
+
+// initialResponse decodes the initial response of the AUTH command, or asks for it with an empty challenge.
+func (ss *session) initialResponse(initial string) ([]byte, error) {
+	if initial == "" {
+		return ss.challenge("")
+	}
+	return decodeResponse(initial)
+}
+
+// challenge sends the base64 encoded challenge and returns the decoded client response.
+func (ss *session) challenge(text string) ([]byte, error) {
+	if !ss.send(Reply{Code: 334, Text: base64.StdEncoding.EncodeToString([]byte(text))}) {
+		return nil, errors.New("connection closed")
+	}
+	line, err := ss.readLine()
+	if err != nil {
+		return nil, err
+	}
+	return decodeResponse(line)
+}
+
+// decodeResponse decodes the base64 encoded client response, the "=" is an empty response (RFC 4954 4).
+func decodeResponse(s string) ([]byte, error) {
+	switch s {
+	case "*":
+		return nil, errAuthCanceled
+	case "=":
+		return []byte{}, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidBase64
+	}
+	return b, nil
+}
+
+// validCredentials checks the credentials, any credentials are valid if the username is not configured.
+func (ss *session) validCredentials(user, secret, expected string) bool {
+	if ss.s.cfg.Username == "" {
+		return true
+	}
+	return user == ss.s.cfg.Username && hmac.Equal([]byte(secret), []byte(expected))
+}
+
+// supportsMechanism checks if the mechanism is advertised.
+func (ss *session) supportsMechanism(mech string) bool {
+	for _, m := range ss.s.cfg.AuthMechanisms {
+		if strings.EqualFold(m, mech) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticated marks the session as authenticated.
+func (ss *session) authenticated(mech, user string) {
+	ss.authed = true
+	ss.authUser = user
+	ss.s.update(func() {
+		ss.rec.AuthMechanism = mech
+		ss.rec.AuthUser = user
+	})
+}
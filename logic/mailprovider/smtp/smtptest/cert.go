@@ -0,0 +1,86 @@
+package smtptest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+)
+
+// initTLS sets up the TLS configuration of the server, generating the self-signed certificate if none is configured.
+func (s *Server) initTLS() error {
+	if tc := s.cfg.TLSConfig; tc != nil {
+		if len(tc.Certificates) == 0 {
+			return errors.New("tls config has no certificates")
+		}
+		cert, err := x509.ParseCertificate(tc.Certificates[0].Certificate[0])
+		if err != nil {
+			return fmt.Errorf("invalid server certificate: %w", err)
+		}
+		s.tc = tc.Clone()
+		s.cert = cert
+		return nil
+	}
+
+	cert, err := selfSignedCertificate(s.cfg.Hostname)
+	if err != nil {
+		return fmt.Errorf("failed to generate server certificate: %w", err)
+	}
+	s.tc = &tls.Config{Certificates: []tls.Certificate{cert}}
+	s.cert = cert.Leaf
+	return nil
+}
+
+// selfSignedCertificate generates the certificate valid for the hostname and the loopback addresses.
+// The certificate is its own authority, so that the clients could trust it with the private CA bundle.
+func selfSignedCertificate(hostname string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{hostname},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname != "localhost" {
+		tmpl.DNSNames = append(tmpl.DNSNames, "localhost")
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// encodeCertificate returns the PEM encoding of the certificate.
+func encodeCertificate(cert *x509.Certificate) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+}
@@ -0,0 +1,107 @@
+package smtptest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stage is the stage of the SMTP session, at which the reply could be scripted.
+type Stage int
+
+const (
+	// StageGreeting is the greeting sent once the client connects.
+	StageGreeting Stage = iota
+	// StageHello is the reply to the EHLO and HELO commands.
+	StageHello
+	// StageStartTLS is the reply to the STARTTLS command.
+	StageStartTLS
+	// StageAuth is the final reply to the AUTH command, the scripted reply skips the credentials exchange.
+	StageAuth
+	// StageMail is the reply to the MAIL command.
+	StageMail
+	// StageRcpt is the reply to the RCPT command.
+	StageRcpt
+	// StageData is the reply to the DATA command and to the BDAT commands, except the last one.
+	StageData
+	// StageMessage is the reply to the end of the message content, either after the final dot or the last BDAT chunk.
+	StageMessage
+	// StageReset is the reply to the RSET command.
+	StageReset
+	// StageNoop is the reply to the NOOP command.
+	StageNoop
+	// StageQuit is the reply to the QUIT command.
+	StageQuit
+)
+
+// String returns the string representation of the stage.
+func (s Stage) String() string {
+	switch s {
+	case StageGreeting:
+		return "greeting"
+	case StageHello:
+		return "hello"
+	case StageStartTLS:
+		return "starttls"
+	case StageAuth:
+		return "auth"
+	case StageMail:
+		return "mail"
+	case StageRcpt:
+		return "rcpt"
+	case StageData:
+		return "data"
+	case StageMessage:
+		return "message"
+	case StageReset:
+		return "reset"
+	case StageNoop:
+		return "noop"
+	case StageQuit:
+		return "quit"
+	default:
+		return fmt.Sprintf("Stage(%d)", int(s))
+	}
+}
+
+// Reply is the reply of the server.
+type Reply struct {
+	// Code is the reply code. If it is zero, no reply is sent, i.e. to let the client time out,
+	// or to drop the connection silently along with the Disconnect.
+	Code int
+	// EnhancedCode is the enhanced status code written before the text, i.e. "5.1.1".
+	EnhancedCode string
+	// Text is the reply text, the new lines separate the lines of the multiline reply.
+	Text string
+	// Delay delays the reply, i.e. to exceed the client timeouts.
+	Delay time.Duration
+	// Disconnect closes the connection after the reply is sent.
+	Disconnect bool
+}
+
+// positive checks if the reply lets the command take effect.
+func (r Reply) positive() bool {
+	return r.Code >= 200 && r.Code < 400
+}
+
+// lines returns the reply lines, as written to the connection.
+func (r Reply) lines() []string {
+	// The enhanced status code is written on each line of the multiline reply (RFC 2034 3).
+	prefix := ""
+	if r.EnhancedCode != "" {
+		prefix = r.EnhancedCode + " "
+	}
+
+	parts := strings.Split(r.Text, "\n")
+	out := make([]string, 0, len(parts))
+	code := strconv.Itoa(r.Code)
+	for i, part := range parts {
+		sep := "-"
+		if i == len(parts)-1 {
+			sep = " "
+		}
+		out = append(out, code+sep+prefix+strings.TrimRight(part, "\r"))
+	}
+	return out
+}
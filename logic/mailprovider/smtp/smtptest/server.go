@@ -0,0 +1,392 @@
+// Package smtptest provides an in-process SMTP server for the tests of the SMTP providers.
+// The server advertises the configured extensions, records the session transcripts along with the received messages,
+// and lets the tests script the replies at any stage of the session, so that the provider error classification,
+// TLS and authentication paths could be tested end to end without a network.
+package smtptest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config is the configuration of the test server.
+// The zero value is a plain SMTP server, that advertises no extensions and accepts all the messages.
+type Config struct {
+	// Hostname is the name of the server used in its greeting, "localhost" by default.
+	Hostname string
+	// Addr is the loopback address the server listens on, "127.0.0.1:0" by default.
+	// The servers on the different loopback hosts could share the port, i.e. to act as the mail exchangers of a domain.
+	Addr string
+
+	// ImplicitTLS makes the server start the TLS on connect.
+	ImplicitTLS bool
+	// StartTLS makes the server advertise the STARTTLS extension.
+	StartTLS bool
+	// TLSConfig is the TLS configuration of the server.
+	// If not set, a self-signed certificate for the localhost is generated, see the Server.CACertificatePEM.
+	TLSConfig *tls.Config
+
+	// AuthMechanisms are the advertised authentication mechanisms, i.e. PLAIN, LOGIN, CRAM-MD5 and XOAUTH2.
+	AuthMechanisms []string
+	// AuthRequiresTLS makes the server advertise and accept the authentication only over the TLS.
+	AuthRequiresTLS bool
+	// AuthRequired makes the server reject the transactions of the unauthenticated sessions.
+	AuthRequired bool
+	// Username, Password and Token are the accepted credentials, the Token is the XOAUTH2 bearer token.
+	// If the Username is not set, any credentials are accepted.
+	Username, Password, Token string
+
+	// Size is the advertised and enforced maximum message size, the SIZE extension is not advertised if zero.
+	Size int64
+	// MaxRecipients is the maximum number of the recipients of a transaction, unlimited if zero.
+	MaxRecipients int
+
+	Pipelining          bool
+	EightBitMIME        bool
+	SMTPUTF8            bool
+	Chunking            bool
+	DSN                 bool
+	EnhancedStatusCodes bool
+	// Extensions are the additional EHLO keywords advertised verbatim, along with their parameters.
+	Extensions []string
+}
+
+// Server is an SMTP server listening on the loopback interface.
+type Server struct {
+	cfg      Config
+	tc       *tls.Config
+	cert     *x509.Certificate
+	listener net.Listener
+
+	mu       sync.Mutex
+	sessions []*Session
+	messages []*Message
+	scripts  map[Stage][]Reply
+	rcpts    map[string]Reply
+	conns    map[net.Conn]struct{}
+	closed   bool
+
+	wg   sync.WaitGroup
+	done chan struct{}
+}
+
+// NewServer starts a new server, on a random loopback port unless the address is configured.
+func NewServer(cfg Config) (*Server, error) {
+	if cfg.Hostname == "" {
+		cfg.Hostname = "localhost"
+	}
+	if cfg.Addr == "" {
+		cfg.Addr = "127.0.0.1:0"
+	}
+	if cfg.ImplicitTLS && cfg.StartTLS {
+		return nil, errors.New("implicit tls and starttls are mutually exclusive")
+	}
+
+	s := &Server{
+		cfg:     cfg,
+		scripts: make(map[Stage][]Reply),
+		rcpts:   make(map[string]Reply),
+		conns:   make(map[net.Conn]struct{}),
+		done:    make(chan struct{}),
+	}
+
+	if cfg.ImplicitTLS || cfg.StartTLS {
+		if err := s.initTLS(); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+	if cfg.ImplicitTLS {
+		l = tls.NewListener(l, s.tc)
+	}
+	s.listener = l
+
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the address the server listens on, in the host:port form.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Host returns the host the server listens on.
+func (s *Server) Host() string {
+	host, _, _ := net.SplitHostPort(s.Addr())
+	return host
+}
+
+// Port returns the port the server listens on.
+func (s *Server) Port() uint32 {
+	_, port, _ := net.SplitHostPort(s.Addr())
+	n, _ := strconv.ParseUint(port, 10, 16)
+	return uint32(n)
+}
+
+// Certificate returns the certificate of the server, or nil if the server has no TLS.
+func (s *Server) Certificate() *x509.Certificate {
+	return s.cert
+}
+
+// CACertificatePEM returns the PEM encoded certificate of the server, that could be trusted by the clients
+// as the certificate authority. It is empty if the server has no TLS.
+func (s *Server) CACertificatePEM() string {
+	if s.cert == nil {
+		return ""
+	}
+	return encodeCertificate(s.cert)
+}
+
+// Close stops the server, closes all its connections and waits for the sessions to end.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	err := s.listener.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// Script queues the replies of the next commands at the stage, each command consumes a single reply.
+// The scripted reply replaces the reply of the server, if it is a positive one, the command takes effect as usual.
+func (s *Server) Script(stage Stage, replies ...Reply) {
+	s.mu.Lock()
+	s.scripts[stage] = append(s.scripts[stage], replies...)
+	s.mu.Unlock()
+}
+
+// RejectRecipient makes the server reply to all the RCPT commands of the address with the input reply,
+// until the Reset is called. The scripted RCPT replies take precedence.
+func (s *Server) RejectRecipient(address string, r Reply) {
+	s.mu.Lock()
+	s.rcpts[strings.ToLower(address)] = r
+	s.mu.Unlock()
+}
+
+// Reset removes all the recorded sessions, messages and scripted replies.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	s.sessions = nil
+	s.messages = nil
+	s.scripts = make(map[Stage][]Reply)
+	s.rcpts = make(map[string]Reply)
+	s.mu.Unlock()
+}
+
+// Messages returns the messages accepted by the server, in the order they were received.
+func (s *Server) Messages() []*Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]*Message, 0, len(s.messages))
+	for _, m := range s.messages {
+		out = append(out, m.clone())
+	}
+	return out
+}
+
+// Sessions returns the sessions of the server, in the order they were started.
+func (s *Server) Sessions() []*Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]*Session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		c := *sess
+		c.Transcript = append([]string(nil), sess.Transcript...)
+		out = append(out, &c)
+	}
+	return out
+}
+
+// Transcript returns the transcripts of all the sessions joined with the new lines,
+// the client lines are prefixed with "C: " and the server ones with "S: ".
+func (s *Server) Transcript() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var sb strings.Builder
+	for _, sess := range s.sessions {
+		for _, line := range sess.Transcript {
+			sb.WriteString(line)
+			sb.WriteByte('\n')
+		}
+	}
+	return sb.String()
+}
+
+// serve accepts the connections until the server is closed.
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		sess := &Session{ID: len(s.sessions) + 1, RemoteAddr: conn.RemoteAddr().String(), TLS: s.cfg.ImplicitTLS}
+		s.sessions = append(s.sessions, sess)
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn, sess)
+		}()
+	}
+}
+
+// scripted pops the next scripted reply of the stage.
+func (s *Server) scripted(stage Stage) (Reply, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	replies := s.scripts[stage]
+	if len(replies) == 0 {
+		return Reply{}, false
+	}
+	s.scripts[stage] = replies[1:]
+	return replies[0], true
+}
+
+// rejectedRecipient returns the reply set for the recipient with the RejectRecipient.
+func (s *Server) rejectedRecipient(address string) (Reply, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.rcpts[strings.ToLower(address)]
+	return r, ok
+}
+
+// record appends the line to the session transcript.
+func (s *Server) record(sess *Session, line string) {
+	s.mu.Lock()
+	sess.Transcript = append(sess.Transcript, line)
+	s.mu.Unlock()
+}
+
+// update modifies the session record under the lock.
+func (s *Server) update(fn func()) {
+	s.mu.Lock()
+	fn()
+	s.mu.Unlock()
+}
+
+// accept records the received message.
+func (s *Server) accept(m *Message) {
+	s.mu.Lock()
+	s.messages = append(s.messages, m)
+	s.mu.Unlock()
+}
+
+// removeConn forgets the closed connection.
+func (s *Server) removeConn(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+}
+
+// sleep waits for the duration, it returns early once the server is closed.
+func (s *Server) sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-s.done:
+	}
+}
+
+// Session is the record of a single client connection.
+type Session struct {
+	// ID is the sequence number of the session, starting at 1.
+	ID int
+	// RemoteAddr is the address of the client.
+	RemoteAddr string
+	// Helo is the name the client introduced itself with.
+	Helo string
+	// TLS reports whether the session was upgraded to, or started with the TLS.
+	TLS bool
+	// AuthMechanism and AuthUser are the mechanism and the name the client authenticated with.
+	AuthMechanism, AuthUser string
+	// Transcript are the lines exchanged in the session, the client lines are prefixed with "C: "
+	// and the server ones with "S: ". The message content is not recorded, only its size.
+	Transcript []string
+}
+
+// Recipient is the envelope recipient of the received message.
+type Recipient struct {
+	// Address is the recipient address.
+	Address string
+	// Params are the RCPT command parameters, i.e. NOTIFY and ORCPT, keyed by their upper case names.
+	Params map[string]string
+}
+
+// Message is the message accepted by the server.
+type Message struct {
+	// SessionID is the ID of the session the message was received in.
+	SessionID int
+	// From is the envelope sender address.
+	From string
+	// Params are the MAIL command parameters, i.e. SIZE, BODY and RET, keyed by their upper case names.
+	Params map[string]string
+	// Recipients are the accepted envelope recipients.
+	Recipients []Recipient
+	// Data is the message content, as received after the dot-unstuffing.
+	Data []byte
+	// Chunked reports whether the message was received with the BDAT commands.
+	Chunked bool
+	// TLS reports whether the message was received over the TLS.
+	TLS bool
+	// AuthUser is the name the client authenticated with, if any.
+	AuthUser string
+}
+
+// To returns the addresses of the accepted recipients.
+func (m *Message) To() []string {
+	out := make([]string, 0, len(m.Recipients))
+	for _, r := range m.Recipients {
+		out = append(out, r.Address)
+	}
+	return out
+}
+
+// clone returns the copy of the message, that could not be modified by the session.
+func (m *Message) clone() *Message {
+	c := *m
+	c.Recipients = append([]Recipient(nil), m.Recipients...)
+	c.Data = append([]byte(nil), m.Data...)
+	return &c
+}
@@ -0,0 +1,207 @@
+package smtptest_test
+
+import (
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/blockysource/mailing/logic/mailprovider/smtp/smtptest"
+)
+
+func newServer(t *testing.T, cfg smtptest.Config) *smtptest.Server {
+	t.Helper()
+
+	srv, err := smtptest.NewServer(cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+// dial connects to the server and reads its greeting.
+func dial(t *testing.T, srv *smtptest.Server) *textproto.Conn {
+	t.Helper()
+
+	c, err := textproto.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatalf("failed to dial server: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	if _, _, err = c.ReadResponse(220); err != nil {
+		t.Fatalf("unexpected greeting: %v", err)
+	}
+	return c
+}
+
+// cmd sends the command and expects the reply with the code.
+func cmd(t *testing.T, c *textproto.Conn, code int, format string, args ...any) string {
+	t.Helper()
+
+	id, err := c.Cmd(format, args...)
+	if err != nil {
+		t.Fatalf("failed to send command: %v", err)
+	}
+	c.StartResponse(id)
+	defer c.EndResponse(id)
+
+	_, msg, err := c.ReadResponse(code)
+	if err != nil {
+		t.Fatalf("unexpected reply to %q: %v", format, err)
+	}
+	return msg
+}
+
+func TestServer_DotUnstuffing(t *testing.T) {
+	srv := newServer(t, smtptest.Config{})
+	c := dial(t, srv)
+
+	cmd(t, c, 250, "EHLO client.example.org")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.org>")
+	cmd(t, c, 250, "RCPT TO:<alice@example.com>")
+	cmd(t, c, 354, "DATA")
+
+	// The leading dots are doubled by the client, and the single dot line ends the content.
+	c.W.WriteString("Subject: Hello\r\n\r\n..leading dot\r\n...\r\nend\r\n.\r\n")
+	if err := c.W.Flush(); err != nil {
+		t.Fatalf("failed to write data: %v", err)
+	}
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("message not accepted: %v", err)
+	}
+	cmd(t, c, 221, "QUIT")
+
+	msgs := srv.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("got %d messages, want 1", len(msgs))
+	}
+	if want := "Subject: Hello\r\n\r\n.leading dot\r\n..\r\nend\r\n"; string(msgs[0].Data) != want {
+		t.Fatalf("got data %q, want %q", msgs[0].Data, want)
+	}
+	if msgs[0].From != "sender@example.org" || !reflect.DeepEqual(msgs[0].To(), []string{"alice@example.com"}) || msgs[0].Chunked {
+		t.Fatalf("unexpected message: %+v", msgs[0])
+	}
+}
+
+func TestServer_Chunking(t *testing.T) {
+	srv := newServer(t, smtptest.Config{Chunking: true})
+	c := dial(t, srv)
+
+	cmd(t, c, 250, "EHLO client.example.org")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.org>")
+	cmd(t, c, 250, "RCPT TO:<alice@example.com>")
+
+	// The chunks are received as is, the leading dots are not unstuffed.
+	for _, chunk := range []string{"BDAT 9\r\n..first\r\n", "BDAT 9 LAST\r\n.\r\nlast\r\n"} {
+		c.W.WriteString(chunk)
+		if err := c.W.Flush(); err != nil {
+			t.Fatalf("failed to write chunk: %v", err)
+		}
+		if _, _, err := c.ReadResponse(250); err != nil {
+			t.Fatalf("chunk not accepted: %v", err)
+		}
+	}
+
+	msgs := srv.Messages()
+	if len(msgs) != 1 || !msgs[0].Chunked || string(msgs[0].Data) != "..first\r\n.\r\nlast\r\n" {
+		t.Fatalf("unexpected messages: %+v", msgs)
+	}
+}
+
+func TestServer_Script(t *testing.T) {
+	srv := newServer(t, smtptest.Config{EnhancedStatusCodes: true})
+	srv.Script(smtptest.StageRcpt,
+		smtptest.Reply{Code: 450, EnhancedCode: "4.2.1", Text: "Slow down\nTry again later"},
+		smtptest.Reply{Code: 550, EnhancedCode: "5.1.1", Text: "No such user"},
+	)
+	srv.RejectRecipient("Bob@example.com", smtptest.Reply{Code: 551, EnhancedCode: "5.1.6", Text: "User moved"})
+	c := dial(t, srv)
+
+	cmd(t, c, 250, "EHLO client.example.org")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.org>")
+
+	// Each command consumes a single scripted reply, in the order they were queued.
+	_, msg, err := sendCmd(c, "RCPT TO:<alice@example.com>")
+	if tpErr, ok := err.(*textproto.Error); !ok || tpErr.Code != 450 || msg != "4.2.1 Slow down\n4.2.1 Try again later" {
+		t.Fatalf("got reply %q and error %v, want the multiline 450", msg, err)
+	}
+	_, _, err = sendCmd(c, "RCPT TO:<alice@example.com>")
+	if tpErr, ok := err.(*textproto.Error); !ok || tpErr.Code != 550 {
+		t.Fatalf("got error %v, want 550", err)
+	}
+	cmd(t, c, 250, "RCPT TO:<alice@example.com>")
+
+	// The rejected recipient is matched regardless of the case.
+	_, _, err = sendCmd(c, "RCPT TO:<bob@EXAMPLE.com>")
+	if tpErr, ok := err.(*textproto.Error); !ok || tpErr.Code != 551 {
+		t.Fatalf("got error %v, want 551", err)
+	}
+
+	// The reset removes the scripted replies and the rejected recipients.
+	srv.Script(smtptest.StageRcpt, smtptest.Reply{Code: 452, Text: "Too many recipients"})
+	srv.Reset()
+	cmd(t, c, 250, "RCPT TO:<bob@example.com>")
+}
+
+func TestServer_Script_Greeting(t *testing.T) {
+	srv := newServer(t, smtptest.Config{})
+	srv.Script(smtptest.StageGreeting, smtptest.Reply{Code: 554, Text: "No service"})
+
+	c, err := textproto.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatalf("failed to dial server: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err = c.ReadResponse(220); err == nil {
+		t.Fatal("got positive greeting, want 554")
+	}
+	// The session rejected with the greeting accepts only the QUIT.
+	cmd(t, c, 503, "EHLO client.example.org")
+	cmd(t, c, 221, "QUIT")
+}
+
+func TestServer_Transcript(t *testing.T) {
+	srv := newServer(t, smtptest.Config{Hostname: "mx.example.com", Pipelining: true, Size: 1024})
+	c := dial(t, srv)
+
+	cmd(t, c, 250, "EHLO client.example.org")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.org> SIZE=12")
+	cmd(t, c, 554, "DATA")
+	cmd(t, c, 221, "QUIT")
+
+	want := []string{
+		"S: 220 mx.example.com ESMTP smtptest",
+		"C: EHLO client.example.org",
+		"S: 250-mx.example.com greets client.example.org",
+		"S: 250-PIPELINING",
+		"S: 250 SIZE 1024",
+		"C: MAIL FROM:<sender@example.org> SIZE=12",
+		"S: 250 OK",
+		"C: DATA",
+		"S: 554 No valid recipients",
+		"C: QUIT",
+		"S: 221 Bye",
+	}
+	if got := srv.Transcript(); got != strings.Join(want, "\n")+"\n" {
+		t.Fatalf("unexpected transcript:\n%s", got)
+	}
+
+	sessions := srv.Sessions()
+	if len(sessions) != 1 || sessions[0].ID != 1 || sessions[0].Helo != "client.example.org" || sessions[0].TLS {
+		t.Fatalf("unexpected sessions: %+v", sessions)
+	}
+}
+
+// sendCmd sends the command and returns its reply, the reply other than 250 is returned as the *textproto.Error.
+func sendCmd(c *textproto.Conn, line string) (int, string, error) {
+	id, err := c.Cmd("%s", line)
+	if err != nil {
+		return 0, "", err
+	}
+	c.StartResponse(id)
+	defer c.EndResponse(id)
+	return c.ReadResponse(250)
+}
@@ -0,0 +1,526 @@
+package smtptest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// session is the state of a single client connection.
+type session struct {
+	s    *Server
+	rec  *Session
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+
+	// rejected is set if the greeting was negative, the server then accepts only the QUIT (RFC 5321 3.1).
+	rejected bool
+	helo     bool
+	tls      bool
+	authUser string
+	authed   bool
+
+	// msg is the current transaction, nil if none was started with the MAIL command.
+	msg    *Message
+	chunks []byte
+}
+
+// handle serves the client connection until it is closed by either side.
+func (s *Server) handle(conn net.Conn, rec *Session) {
+	defer s.removeConn(conn)
+	defer conn.Close()
+
+	ss := &session{
+		s:    s,
+		rec:  rec,
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+		tls:  s.cfg.ImplicitTLS,
+	}
+
+	r := ss.pick(StageGreeting, Reply{Code: 220, Text: s.cfg.Hostname + " ESMTP smtptest"})
+	ss.rejected = !r.positive()
+	if !ss.send(r) {
+		return
+	}
+
+	for {
+		line, err := ss.readLine()
+		if err != nil {
+			return
+		}
+		if !ss.command(line) {
+			return
+		}
+	}
+}
+
+// command handles the command line, it returns false once the session is over.
+func (ss *session) command(line string) bool {
+	verb, arg, _ := strings.Cut(line, " ")
+	verb = strings.ToUpper(verb)
+	arg = strings.TrimSpace(arg)
+
+	if ss.rejected && verb != "QUIT" {
+		return ss.send(ss.reply(503, "5.5.1", "Bad sequence of commands"))
+	}
+
+	switch verb {
+	case "EHLO", "HELO":
+		return ss.hello(verb == "EHLO", arg)
+	case "STARTTLS":
+		return ss.startTLS(arg)
+	case "AUTH":
+		return ss.auth(arg)
+	case "MAIL":
+		return ss.mail(arg)
+	case "RCPT":
+		return ss.rcpt(arg)
+	case "DATA":
+		return ss.data(arg)
+	case "BDAT":
+		return ss.bdat(arg)
+	case "RSET":
+		r := ss.pick(StageReset, ss.reply(250, "2.0.0", "OK"))
+		if r.positive() {
+			ss.reset()
+		}
+		return ss.send(r)
+	case "NOOP":
+		return ss.send(ss.pick(StageNoop, ss.reply(250, "2.0.0", "OK")))
+	case "VRFY":
+		return ss.send(ss.reply(252, "2.5.0", "Cannot VRFY user"))
+	case "QUIT":
+		ss.send(ss.pick(StageQuit, ss.reply(221, "2.0.0", "Bye")))
+		return false
+	default:
+		return ss.send(ss.reply(500, "5.5.2", "Syntax error, command unrecognized"))
+	}
+}
+
+// hello handles the EHLO and HELO commands, the EHLO reply lists the configured extensions.
+func (ss *session) hello(extended bool, arg string) bool {
+	cfg := ss.s.cfg
+	if arg == "" {
+		return ss.send(ss.pick(StageHello, ss.reply(501, "5.5.4", "Syntax: EHLO hostname")))
+	}
+
+	lines := []string{cfg.Hostname + " greets " + arg}
+	if extended {
+		if cfg.Pipelining {
+			lines = append(lines, "PIPELINING")
+		}
+		if cfg.Size > 0 {
+			lines = append(lines, "SIZE "+strconv.FormatInt(cfg.Size, 10))
+		}
+		if cfg.EightBitMIME {
+			lines = append(lines, "8BITMIME")
+		}
+		if cfg.SMTPUTF8 {
+			lines = append(lines, "SMTPUTF8")
+		}
+		if cfg.Chunking {
+			lines = append(lines, "CHUNKING")
+		}
+		if cfg.DSN {
+			lines = append(lines, "DSN")
+		}
+		if cfg.EnhancedStatusCodes {
+			lines = append(lines, "ENHANCEDSTATUSCODES")
+		}
+		if cfg.StartTLS && !ss.tls {
+			lines = append(lines, "STARTTLS")
+		}
+		if ss.authAdvertised() {
+			lines = append(lines, "AUTH "+strings.Join(cfg.AuthMechanisms, " "))
+		}
+		lines = append(lines, cfg.Extensions...)
+	}
+
+	r := ss.pick(StageHello, Reply{Code: 250, Text: strings.Join(lines, "\n")})
+	if r.positive() {
+		ss.helo = true
+		ss.reset()
+		ss.s.update(func() { ss.rec.Helo = arg })
+	}
+	return ss.send(r)
+}
+
+// startTLS handles the STARTTLS command, the session is reset to its initial state after the handshake (RFC 3207 4.2).
+func (ss *session) startTLS(arg string) bool {
+	def := ss.reply(220, "2.0.0", "Ready to start TLS")
+	valid := false
+	switch {
+	case !ss.s.cfg.StartTLS:
+		def = ss.reply(502, "5.5.1", "Command not implemented")
+	case ss.tls:
+		def = ss.reply(503, "5.5.1", "TLS already active")
+	case arg != "":
+		def = ss.reply(501, "5.5.4", "Syntax: STARTTLS")
+	default:
+		valid = true
+	}
+
+	r := ss.pick(StageStartTLS, def)
+	if !ss.send(r) {
+		return false
+	}
+	if !valid || !r.positive() {
+		return true
+	}
+
+	tc := tls.Server(ss.conn, ss.s.tc)
+	if err := tc.Handshake(); err != nil {
+		ss.s.record(ss.rec, "S: <tls handshake failed: "+err.Error()+">")
+		return false
+	}
+
+	// The commands pipelined after the STARTTLS are discarded, as they were sent before the TLS.
+	ss.r = bufio.NewReader(tc)
+	ss.w = bufio.NewWriter(tc)
+	ss.tls = true
+	ss.helo = false
+	ss.authed = false
+	ss.authUser = ""
+	ss.reset()
+	ss.s.update(func() { ss.rec.TLS = true })
+	return true
+}
+
+// mail handles the MAIL command, that starts the transaction.
+func (ss *session) mail(arg string) bool {
+	cfg := ss.s.cfg
+	from, params, ok := parsePath(arg, "FROM:")
+
+	var def Reply
+	valid := false
+	switch {
+	case !ss.helo:
+		def = ss.reply(503, "5.5.1", "EHLO/HELO first")
+	case ss.msg != nil:
+		def = ss.reply(503, "5.5.1", "Nested MAIL command")
+	case cfg.AuthRequired && !ss.authed:
+		def = ss.reply(530, "5.7.0", "Authentication required")
+	case !ok:
+		def = ss.reply(501, "5.5.4", "Syntax: MAIL FROM:<address>")
+	default:
+		def = ss.mailParams(params)
+		if def.Code == 0 && !isASCII(from) && !hasParam(params, "SMTPUTF8") {
+			def = ss.reply(553, "5.6.7", "SMTPUTF8 is required for the non-ASCII address")
+		}
+		if def.Code == 0 {
+			def = ss.reply(250, "2.1.0", "OK")
+			valid = true
+		}
+	}
+
+	r := ss.pick(StageMail, def)
+	if valid && r.positive() {
+		ss.msg = &Message{
+			SessionID: ss.rec.ID,
+			From:      from,
+			Params:    params,
+			TLS:       ss.tls,
+			AuthUser:  ss.authUser,
+		}
+		ss.chunks = nil
+	}
+	return ss.send(r)
+}
+
+// mailParams validates the MAIL command parameters, it returns the zero reply if they are valid.
+func (ss *session) mailParams(params map[string]string) Reply {
+	cfg := ss.s.cfg
+	for _, k := range sortedKeys(params) {
+		supported := false
+		switch k {
+		case "SIZE":
+			supported = cfg.Size > 0
+			if !supported {
+				break
+			}
+			n, err := strconv.ParseInt(params[k], 10, 64)
+			if err != nil || n < 0 {
+				return ss.reply(501, "5.5.4", "Invalid SIZE parameter")
+			}
+			if n > cfg.Size {
+				return ss.reply(552, "5.3.4", "Message size exceeds fixed maximum message size")
+			}
+		case "BODY":
+			supported = cfg.EightBitMIME
+		case "SMTPUTF8":
+			supported = cfg.SMTPUTF8
+		case "RET", "ENVID":
+			supported = cfg.DSN
+		}
+		if !supported {
+			return ss.reply(555, "5.5.4", "Unsupported parameter "+k)
+		}
+	}
+	return Reply{}
+}
+
+// rcpt handles the RCPT command, the recipients set with the RejectRecipient are rejected with their reply.
+func (ss *session) rcpt(arg string) bool {
+	cfg := ss.s.cfg
+	to, params, ok := parsePath(arg, "TO:")
+
+	var def Reply
+	valid := false
+	switch {
+	case ss.msg == nil:
+		def = ss.reply(503, "5.5.1", "Need MAIL command")
+	case !ok:
+		def = ss.reply(501, "5.5.4", "Syntax: RCPT TO:<address>")
+	case cfg.MaxRecipients > 0 && len(ss.msg.Recipients) >= cfg.MaxRecipients:
+		def = ss.reply(452, "4.5.3", "Too many recipients")
+	default:
+		def = ss.reply(250, "2.1.5", "OK")
+		for _, k := range sortedKeys(params) {
+			if (k != "NOTIFY" && k != "ORCPT") || !cfg.DSN {
+				def = ss.reply(555, "5.5.4", "Unsupported parameter "+k)
+			}
+		}
+		if def.positive() && !isASCII(to) && !hasParam(ss.msg.Params, "SMTPUTF8") {
+			def = ss.reply(553, "5.6.7", "SMTPUTF8 is required for the non-ASCII address")
+		}
+		if rr, rejected := ss.s.rejectedRecipient(to); rejected && def.positive() {
+			def = rr
+		}
+		valid = def.positive()
+	}
+
+	r := ss.pick(StageRcpt, def)
+	if valid && r.positive() {
+		ss.msg.Recipients = append(ss.msg.Recipients, Recipient{Address: to, Params: params})
+	}
+	return ss.send(r)
+}
+
+// data handles the DATA command and reads the message content terminated with the line with a single dot.
+func (ss *session) data(arg string) bool {
+	var def Reply
+	valid := false
+	switch {
+	case arg != "":
+		def = ss.reply(501, "5.5.4", "Syntax: DATA")
+	case ss.msg == nil:
+		def = ss.reply(503, "5.5.1", "Need MAIL command")
+	case len(ss.msg.Recipients) == 0:
+		def = ss.reply(554, "5.5.1", "No valid recipients")
+	case ss.chunks != nil:
+		def = ss.reply(503, "5.5.1", "DATA not allowed after BDAT")
+	default:
+		valid = true
+		def = Reply{Code: 354, Text: "End data with <CR><LF>.<CR><LF>"}
+	}
+
+	r := ss.pick(StageData, def)
+	if !ss.send(r) {
+		return false
+	}
+	if !valid || r.Code != 354 {
+		return true
+	}
+
+	data, err := ss.readData()
+	if err != nil {
+		return false
+	}
+	ss.s.record(ss.rec, "C: <"+strconv.Itoa(len(data))+" bytes of message data>")
+	return ss.finish(data, false)
+}
+
+// bdat handles the BDAT command, the chunk is always read, so that the session stays in sync (RFC 3030 2).
+func (ss *session) bdat(arg string) bool {
+	fields := strings.Fields(arg)
+	if !ss.s.cfg.Chunking {
+		return ss.send(ss.reply(502, "5.5.1", "Command not implemented"))
+	}
+
+	var size int64 = -1
+	if len(fields) > 0 {
+		size, _ = strconv.ParseInt(fields[0], 10, 64)
+	}
+	last := len(fields) == 2 && strings.EqualFold(fields[1], "LAST")
+	if size < 0 || len(fields) > 2 || (len(fields) == 2 && !last) {
+		// The chunk size is unknown, the session could not be kept in sync.
+		ss.send(ss.reply(501, "5.5.4", "Syntax: BDAT size [LAST]"))
+		return false
+	}
+
+	chunk := make([]byte, size)
+	if _, err := io.ReadFull(ss.r, chunk); err != nil {
+		return false
+	}
+	ss.s.record(ss.rec, "C: <"+strconv.Itoa(len(chunk))+" bytes of message data>")
+
+	switch {
+	case ss.msg == nil:
+		return ss.send(ss.reply(503, "5.5.1", "Need MAIL command"))
+	case len(ss.msg.Recipients) == 0:
+		return ss.send(ss.reply(554, "5.5.1", "No valid recipients"))
+	}
+
+	ss.chunks = append(ss.chunks, chunk...)
+	if last {
+		data := ss.chunks
+		ss.chunks = nil
+		return ss.finish(data, true)
+	}
+
+	r := ss.pick(StageData, ss.reply(250, "2.0.0", strconv.Itoa(len(chunk))+" octets received"))
+	if !r.positive() {
+		ss.reset()
+	}
+	return ss.send(r)
+}
+
+// finish ends the transaction with the received message content, the message is recorded if it is accepted.
+func (ss *session) finish(data []byte, chunked bool) bool {
+	msg := ss.msg
+	ss.reset()
+
+	def := ss.reply(250, "2.0.0", "OK: queued")
+	if size := ss.s.cfg.Size; size > 0 && int64(len(data)) > size {
+		def = ss.reply(552, "5.3.4", "Message size exceeds fixed maximum message size")
+	}
+
+	r := ss.pick(StageMessage, def)
+	if def.positive() && r.positive() {
+		msg.Data = data
+		msg.Chunked = chunked
+		ss.s.accept(msg)
+	}
+	return ss.send(r)
+}
+
+// reset aborts the current transaction.
+func (ss *session) reset() {
+	ss.msg = nil
+	ss.chunks = nil
+}
+
+// pick returns the next scripted reply of the stage, or the default one.
+func (ss *session) pick(stage Stage, def Reply) Reply {
+	if r, ok := ss.s.scripted(stage); ok {
+		return r
+	}
+	return def
+}
+
+// reply returns the reply of the server, with the enhanced status code if the extension is advertised.
+func (ss *session) reply(code int, enhancedCode, text string) Reply {
+	r := Reply{Code: code, Text: text}
+	if ss.s.cfg.EnhancedStatusCodes {
+		r.EnhancedCode = enhancedCode
+	}
+	return r
+}
+
+// send writes the reply to the client, it returns false if the session is over.
+func (ss *session) send(r Reply) bool {
+	ss.s.sleep(r.Delay)
+
+	if r.Code != 0 {
+		for _, line := range r.lines() {
+			ss.s.record(ss.rec, "S: "+line)
+			ss.w.WriteString(line)
+			ss.w.WriteString("\r\n")
+		}
+		if err := ss.w.Flush(); err != nil {
+			return false
+		}
+	}
+
+	if r.Disconnect {
+		ss.s.record(ss.rec, "S: <disconnect>")
+		return false
+	}
+	return true
+}
+
+// readLine reads the client line without its line ending.
+func (ss *session) readLine() (string, error) {
+	line, err := ss.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	ss.s.record(ss.rec, "C: "+line)
+	return line, nil
+}
+
+// readData reads the message content up to the line with a single dot, reverting the dot-stuffing.
+func (ss *session) readData() ([]byte, error) {
+	var buf bytes.Buffer
+	for {
+		line, err := ss.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if line == ".\r\n" || line == ".\n" {
+			return buf.Bytes(), nil
+		}
+		buf.WriteString(strings.TrimPrefix(line, "."))
+	}
+}
+
+// authAdvertised checks if the authentication is available in the current session.
+func (ss *session) authAdvertised() bool {
+	cfg := ss.s.cfg
+	return len(cfg.AuthMechanisms) > 0 && (ss.tls || !cfg.AuthRequiresTLS)
+}
+
+// parsePath parses the MAIL and RCPT command arguments, the address in the angle brackets followed by the parameters.
+func parsePath(arg, prefix string) (string, map[string]string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+
+	rest := strings.TrimLeft(arg[len(prefix):], " ")
+	end := strings.IndexByte(rest, '>')
+	if !strings.HasPrefix(rest, "<") || end < 0 {
+		return "", nil, false
+	}
+
+	params := make(map[string]string)
+	for _, p := range strings.Fields(rest[end+1:]) {
+		k, v, _ := strings.Cut(p, "=")
+		params[strings.ToUpper(k)] = v
+	}
+	return rest[1:end], params, true
+}
+
+// hasParam checks if the command has the parameter.
+func hasParam(params map[string]string, name string) bool {
+	_, ok := params[name]
+	return ok
+}
+
+// sortedKeys returns the parameter names in the order, so that the validation replies are deterministic.
+func sortedKeys(params map[string]string) []string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
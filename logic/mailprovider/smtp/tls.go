@@ -0,0 +1,155 @@
+package smtpmailprovider
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
+	mailprovider2 "github.com/blockysource/mailing/logic/mailprovider"
+)
+
+// tlsConfig returns the TLS configuration used for both the implicit TLS and STARTTLS connections.
+func (s *SMTPProvider) tlsConfig() *tls.Config {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	return s.tc.Clone()
+}
+
+// newTLSConfig creates the TLS configuration of the smtp server connections with the configured policy.
+func newTLSConfig(host string, cfg *mailingpb.SMTPTLSConfig) (*tls.Config, error) {
+	tc := &tls.Config{ServerName: host}
+	if cfg == nil {
+		return tc, nil
+	}
+
+	// The private CA bundle replaces the system roots, so that the internal relays could be verified.
+	if cfg.CACertificates != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(cfg.CACertificates)) {
+			return nil, errors.New("no valid certificates found in the ca bundle")
+		}
+		tc.RootCAs = pool
+	}
+
+	if cfg.ClientCertificate != "" || cfg.ClientKey.UnsafeString() != "" {
+		cert, err := tls.X509KeyPair([]byte(cfg.ClientCertificate), []byte(cfg.ClientKey.UnsafeString()))
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	switch cfg.MinVersion {
+	case mailingpb.SMTP_TLS_VERSION_DEFAULT:
+	case mailingpb.SMTP_TLS_VERSION_1_0:
+		tc.MinVersion = tls.VersionTLS10
+	case mailingpb.SMTP_TLS_VERSION_1_1:
+		tc.MinVersion = tls.VersionTLS11
+	case mailingpb.SMTP_TLS_VERSION_1_2:
+		tc.MinVersion = tls.VersionTLS12
+	case mailingpb.SMTP_TLS_VERSION_1_3:
+		tc.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unsupported tls min version: %s", cfg.MinVersion)
+	}
+
+	if len(cfg.PinnedSPKIHashes) > 0 {
+		pins, err := parseSPKIPins(cfg.PinnedSPKIHashes)
+		if err != nil {
+			return nil, err
+		}
+		tc.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifySPKIPins(cs.PeerCertificates, pins)
+		}
+	}
+	return tc, nil
+}
+
+// parseSPKIPins decodes the base64 encoded SHA-256 hashes of the pinned subject public key info.
+// The hashes may be prefixed with "sha256/", as in the HTTP public key pinning.
+func parseSPKIPins(hashes []string) ([][]byte, error) {
+	pins := make([][]byte, 0, len(hashes))
+	for _, h := range hashes {
+		pin, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(strings.TrimSpace(h), "sha256/"))
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("invalid pinned spki hash: %s", h)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// verifySPKIPins checks if any certificate of the chain presented by the server matches the pinned hashes.
+// The pinning is enforced in addition to the certificate chain verification.
+func verifySPKIPins(certs []*x509.Certificate, pins [][]byte) error {
+	for _, cert := range certs {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(sum[:], pin) {
+				return nil
+			}
+		}
+	}
+	return errors.New("smtp server certificate does not match any pinned public key")
+}
+
+func (s *SMTPProvider) tlsMode() mailingpb.SMTPTLSMode {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	return s.cfg.TLSMode
+}
+
+// dialConn dials the smtp server connection, wrapping it with TLS if the implicit TLS mode is configured.
+func (s *SMTPProvider) dialConn(ctx context.Context, d *net.Dialer, addr string) (net.Conn, error) {
+	if s.tlsMode() != mailingpb.SMTP_TLS_IMPLICIT {
+		return d.DialContext(ctx, "tcp", addr)
+	}
+
+	td := tls.Dialer{NetDialer: d, Config: s.tlsConfig()}
+	return td.DialContext(ctx, "tcp", addr)
+}
+
+// startTLS upgrades the smtp client connection according to the configured TLS mode.
+func (s *SMTPProvider) startTLS(c *smtp.Client) error {
+	if err := startTLS(c, s.tlsMode(), s.tlsConfig()); err != nil {
+		s.log.WithError(err).WithField("host", s.host()).Debug("failed to start tls for smtp client")
+		return err
+	}
+	return nil
+}
+
+// startTLS upgrades the smtp client connection according to the TLS mode.
+// The STARTTLS required mode fails if the server does not support it, so that the credentials
+// are never sent in cleartext.
+func startTLS(c *smtp.Client, mode mailingpb.SMTPTLSMode, tc *tls.Config) error {
+	switch mode {
+	case mailingpb.SMTP_TLS_IMPLICIT, mailingpb.SMTP_TLS_NONE:
+		return nil
+	case mailingpb.SMTP_TLS_STARTTLS_OPPORTUNISTIC, mailingpb.SMTP_TLS_STARTTLS_REQUIRED:
+	default:
+		return fmt.Errorf("unsupported tls mode: %s", mode)
+	}
+
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		if mode == mailingpb.SMTP_TLS_STARTTLS_OPPORTUNISTIC {
+			return nil
+		}
+		return mailprovider2.ErrPermanent(errors.New("smtp server does not support STARTTLS"))
+	}
+
+	if err := c.StartTLS(tc); err != nil {
+		return fmt.Errorf("failed to start tls: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,338 @@
+package smtpmailprovider
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	mailprovider2 "github.com/blockysource/mailing/logic/mailprovider"
+	mailproviderwriter "github.com/blockysource/mailing/logic/mailprovider/writer"
+)
+
+// sendTransaction sends the message to the given recipients over the established session.
+// The returned healthy flag reports whether the session is still usable after the transaction.
+func sendTransaction(ctx context.Context, pc *pooledConn, mw mailproviderwriter.Writer, msg *mailprovider2.Message, rcpts []*mail.Address, log *logrus.Entry) (res *mailprovider2.SendResult, healthy bool, err error) {
+	ext := extensionsOf(pc.c)
+
+	// The internationalized mailboxes cannot be downgraded, the message is rejected if the server does not support them.
+	if needsSMTPUTF8(msg) && !ext.smtpUTF8 {
+		log.Debug("smtp server does not support SMTPUTF8")
+		return nil, true, mailprovider2.ErrPermanent(errors.New("smtp server does not support SMTPUTF8 required by the message addresses"))
+	}
+
+	if msg.DSN != nil && !ext.dsn {
+		log.Debug("smtp server does not support DSN, sending without notification options")
+	}
+
+	// Render the message up front, so that its size is known before the transaction is started.
+	var sp mailproviderwriter.Spool
+	defer sp.Close()
+
+	mw.EightBit = ext.eightBitMIME
+	if err = mw.Render(ctx, msg, &sp); err != nil {
+		log.WithError(err).Debug("failed to write message")
+		return nil, true, mailprovider2.AsError(err, true)
+	}
+
+	if ext.size > 0 && sp.Size() > ext.size {
+		log.WithFields(logrus.Fields{
+			"size":     sp.Size(),
+			"max_size": ext.size,
+		}).Debug("message exceeds the smtp server size limit")
+		return nil, true, &mailprovider2.Error{
+			Err:      fmt.Errorf("message size %d exceeds the smtp server limit of %d bytes", sp.Size(), ext.size),
+			Category: mailprovider2.CategoryMessageTooLarge,
+		}
+	}
+
+	// Set the sender and the recipients, including the blind carbon copy ones that are never written to the headers.
+	cmds := make([]string, 0, len(rcpts)+1)
+	cmds = append(cmds, mailCommand(msg, ext, sp.Size()))
+	for _, to := range rcpts {
+		cmds = append(cmds, rcptCommand(msg, to, ext))
+	}
+
+	replies, err := cmdReply(pc, ext.pipelining, cmds)
+	if err != nil {
+		log.WithError(err).Debug("failed to start mail transaction")
+		return nil, false, handleErr(err)
+	}
+
+	if err = replies[0]; err != nil {
+		log.WithFields(logrus.Fields{
+			"from":          msg.From.String(),
+			logrus.ErrorKey: err,
+		}).Debug("failed to set sender")
+		return nil, true, handleErr(err)
+	}
+
+	// The rejected recipients are reported in the result, and the message is delivered to the accepted ones.
+	res = &mailprovider2.SendResult{}
+	for i, to := range rcpts {
+		if err = replies[i+1]; err != nil {
+			log.WithFields(logrus.Fields{
+				"to":            to.String(),
+				logrus.ErrorKey: err,
+			}).Debug("failed to set recipient")
+			res.Recipients = append(res.Recipients, rejectedRecipient(to.Address, err))
+			continue
+		}
+		res.Recipients = append(res.Recipients, mailprovider2.RecipientResult{
+			Address: to.Address,
+			Status:  mailprovider2.RecipientAccepted,
+		})
+	}
+
+	if err = res.Err(); err != nil {
+		// None of the recipients were accepted, the transaction is reset when the session is reused.
+		return res, true, err
+	}
+
+	if err = writeData(pc, ext, &sp); err != nil {
+		log.WithError(err).Debug("failed to send message data")
+		return rejectAccepted(res, err), isReplyErr(err), handleErr(err)
+	}
+	return res, true, nil
+}
+
+// serverExtensions are the ESMTP extensions advertised by the server, that affect the mail transaction.
+type serverExtensions struct {
+	// size is the maximum message size accepted by the server, zero if there is no limit.
+	size         int64
+	hasSize      bool
+	eightBitMIME bool
+	smtpUTF8     bool
+	pipelining   bool
+	chunking     bool
+	dsn          bool
+}
+
+// extensionsOf returns the extensions advertised by the server in the EHLO reply.
+func extensionsOf(c *smtp.Client) serverExtensions {
+	return parseExtensions(c.Extension)
+}
+
+// parseExtensions returns the extensions reported by the lookup function, that returns whether the extension
+// is advertised along with its parameter.
+func parseExtensions(lookup func(ext string) (bool, string)) serverExtensions {
+	var ext serverExtensions
+	if ok, param := lookup("SIZE"); ok {
+		ext.hasSize = true
+		// The SIZE without the parameter, or with zero, means there is no fixed limit (RFC 1870).
+		if n, err := strconv.ParseInt(strings.TrimSpace(param), 10, 64); err == nil && n > 0 {
+			ext.size = n
+		}
+	}
+	ext.eightBitMIME, _ = lookup("8BITMIME")
+	ext.smtpUTF8, _ = lookup("SMTPUTF8")
+	ext.pipelining, _ = lookup("PIPELINING")
+	ext.chunking, _ = lookup("CHUNKING")
+	ext.dsn, _ = lookup("DSN")
+	return ext
+}
+
+// needsSMTPUTF8 checks if any of the message addresses is an internationalized mailbox,
+// which could only be sent to the server supporting the SMTPUTF8 extension (RFC 6531).
+func needsSMTPUTF8(msg *mailprovider2.Message) bool {
+	if msg.From != nil && !mailproviderwriter.IsASCII(msg.From.Address) {
+		return true
+	}
+	for _, addrs := range [][]*mail.Address{msg.ReplyTo, msg.Recipients()} {
+		for _, addr := range addrs {
+			if !mailproviderwriter.IsASCII(addr.Address) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mailCommand returns the MAIL command of the message with the parameters supported by the server.
+func mailCommand(msg *mailprovider2.Message, ext serverExtensions, size int64) string {
+	var sb strings.Builder
+	sb.WriteString("MAIL FROM:<")
+	sb.WriteString(msg.From.Address)
+	sb.WriteString(">")
+	if ext.hasSize {
+		sb.WriteString(" SIZE=")
+		sb.WriteString(strconv.FormatInt(size, 10))
+	}
+	if ext.eightBitMIME {
+		sb.WriteString(" BODY=8BITMIME")
+	}
+	if ext.smtpUTF8 && needsSMTPUTF8(msg) {
+		sb.WriteString(" SMTPUTF8")
+	}
+	if ext.dsn && msg.DSN != nil {
+		switch msg.DSN.Return {
+		case mailprovider2.DSNReturnHeaders:
+			sb.WriteString(" RET=HDRS")
+		case mailprovider2.DSNReturnFull:
+			sb.WriteString(" RET=FULL")
+		}
+		if msg.DSN.EnvelopeID != "" {
+			sb.WriteString(" ENVID=")
+			sb.WriteString(xtext(msg.DSN.EnvelopeID))
+		}
+	}
+	return sb.String()
+}
+
+// rcptCommand returns the RCPT command of the recipient with the parameters supported by the server.
+func rcptCommand(msg *mailprovider2.Message, to *mail.Address, ext serverExtensions) string {
+	var sb strings.Builder
+	sb.WriteString("RCPT TO:<")
+	sb.WriteString(to.Address)
+	sb.WriteString(">")
+	if !ext.dsn || msg.DSN == nil {
+		return sb.String()
+	}
+
+	if msg.DSN.Notify != 0 {
+		var conds []string
+		if msg.DSN.Notify&mailprovider2.DSNNotifySuccess != 0 {
+			conds = append(conds, "SUCCESS")
+		}
+		if msg.DSN.Notify&mailprovider2.DSNNotifyFailure != 0 {
+			conds = append(conds, "FAILURE")
+		}
+		if msg.DSN.Notify&mailprovider2.DSNNotifyDelay != 0 {
+			conds = append(conds, "DELAY")
+		}
+		sb.WriteString(" NOTIFY=")
+		sb.WriteString(strings.Join(conds, ","))
+	}
+
+	// The internationalized address would require the utf-8 address type (RFC 6533), it is left to the server.
+	if mailproviderwriter.IsASCII(to.Address) {
+		sb.WriteString(" ORCPT=rfc822;")
+		sb.WriteString(xtext(to.Address))
+	}
+	return sb.String()
+}
+
+// xtext encodes the DSN parameter value, the characters outside of the printable ASCII range,
+// the "+" and the "=" are encoded as the hexadecimal "+XX" sequence (RFC 3461 4).
+func xtext(s string) string {
+	const hexDigits = "0123456789ABCDEF"
+
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '!' || c > '~' || c == '+' || c == '=' {
+			sb.WriteByte('+')
+			sb.WriteByte(hexDigits[c>>4])
+			sb.WriteByte(hexDigits[c&0x0f])
+			continue
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
+}
+
+// cmdReply sends the commands and returns their replies. If the server supports PIPELINING, all the commands
+// are sent at once before reading the replies, otherwise the commands are sent one by one, and the commands
+// after the rejected first one are not sent at all.
+// The returned error is set only if the session failed, the server rejections are returned as the replies.
+func cmdReply(pc *pooledConn, pipelining bool, cmds []string) ([]error, error) {
+	t := pc.c.Text
+	replies := make([]error, len(cmds))
+	if !pipelining {
+		for i, cmd := range cmds {
+			pc.setDeadline(pc.timeouts.command)
+			id, err := t.Cmd("%s", cmd)
+			if err != nil {
+				return nil, err
+			}
+			if replies[i] = readReply(t, id, 25); replies[i] != nil {
+				if !isReplyErr(replies[i]) {
+					return nil, replies[i]
+				}
+				if i == 0 {
+					return replies[:1], nil
+				}
+			}
+		}
+		return replies, nil
+	}
+
+	// The commands are sent at once, and then each reply is awaited within the command timeout.
+	pc.setDeadline(pc.timeouts.command)
+	ids := make([]uint, len(cmds))
+	for i, cmd := range cmds {
+		id, err := t.Cmd("%s", cmd)
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = id
+	}
+	for i, id := range ids {
+		pc.setDeadline(pc.timeouts.command)
+		if replies[i] = readReply(t, id, 25); replies[i] != nil && !isReplyErr(replies[i]) {
+			return nil, replies[i]
+		}
+	}
+	return replies, nil
+}
+
+// readReply reads the reply of the command with the given id, expecting the code with the given prefix.
+func readReply(t *textproto.Conn, id uint, expectCode int) error {
+	t.StartResponse(id)
+	defer t.EndResponse(id)
+
+	_, _, err := t.ReadResponse(expectCode)
+	return err
+}
+
+// writeData sends the rendered message content. If the server supports CHUNKING, the content is sent
+// with a single BDAT command, which needs neither the dot-stuffing nor the extra round trip of the DATA command.
+// The whole data phase, including the server reply, is bound by the data timeout.
+func writeData(pc *pooledConn, ext serverExtensions, sp *mailproviderwriter.Spool) error {
+	r, err := sp.Reader()
+	if err != nil {
+		return err
+	}
+
+	c := pc.c
+	pc.setDeadline(pc.timeouts.data)
+
+	if !ext.chunking {
+		w, err := c.Data()
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(w, r); err != nil {
+			return err
+		}
+		return w.Close()
+	}
+
+	id := c.Text.Next()
+	c.Text.StartRequest(id)
+	err = writeChunk(c.Text.W, sp.Size(), r)
+	c.Text.EndRequest(id)
+	if err != nil {
+		return err
+	}
+	return readReply(c.Text, id, 250)
+}
+
+// writeChunk writes the last BDAT chunk with its content.
+func writeChunk(w *bufio.Writer, size int64, r io.Reader) error {
+	if _, err := w.WriteString("BDAT " + strconv.FormatInt(size, 10) + " LAST\r\n"); err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	return w.Flush()
+}
@@ -0,0 +1,304 @@
+package mailproviderwriter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
+)
+
+// dkimSignedHeaders are the header fields signed by the DKIM signature, if they are present in the message.
+var dkimSignedHeaders = []string{
+	"From",
+	"Reply-To",
+	"To",
+	"Cc",
+	"Subject",
+	"Date",
+	"Message-ID",
+	"MIME-Version",
+	"Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+// dkimKey is a parsed DKIM signing key.
+type dkimKey struct {
+	domain    string
+	selector  string
+	algorithm string
+	signer    crypto.Signer
+}
+
+// TXTResolver resolves the DNS TXT records, implemented by the *net.Resolver.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// DKIMSigner signs the messages with the DKIM signature, using the key matching the message sender domain.
+type DKIMSigner struct {
+	keys []*dkimKey
+}
+
+// NewDKIMSigner parses the DKIM keys configuration, returns nil if there are no keys configured.
+func NewDKIMSigner(cfgs []*mailingpb.DKIMKey) (*DKIMSigner, error) {
+	if len(cfgs) == 0 {
+		return nil, nil
+	}
+
+	d := &DKIMSigner{keys: make([]*dkimKey, 0, len(cfgs))}
+	for _, cfg := range cfgs {
+		if cfg.Domain == "" || cfg.Selector == "" {
+			return nil, errors.New("dkim key requires domain and selector")
+		}
+
+		signer, err := parseDKIMPrivateKey([]byte(cfg.PrivateKey.UnsafeString()))
+		if err != nil {
+			return nil, fmt.Errorf("invalid dkim key for domain %s: %w", cfg.Domain, err)
+		}
+
+		k := dkimKey{
+			domain:   strings.ToLower(cfg.Domain),
+			selector: cfg.Selector,
+			signer:   signer,
+		}
+		switch signer.(type) {
+		case *rsa.PrivateKey:
+			k.algorithm = "rsa-sha256"
+		case ed25519.PrivateKey:
+			k.algorithm = "ed25519-sha256"
+		}
+		d.keys = append(d.keys, &k)
+	}
+	return d, nil
+}
+
+// parseDKIMPrivateKey parses the PEM encoded RSA or Ed25519 private key.
+func parseDKIMPrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no pem encoded private key found")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			return k, nil
+		case ed25519.PrivateKey:
+			return k, nil
+		default:
+			return nil, fmt.Errorf("unsupported private key type: %T", key)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported pem block type: %s", block.Type)
+	}
+}
+
+// keyFor returns the key of the sender domain or its parent domain.
+// If there is no such key, the first configured key is used to sign on behalf of the provider.
+func (d *DKIMSigner) keyFor(from *mail.Address) *dkimKey {
+	var domain string
+	if from != nil {
+		domain = strings.ToLower(DomainOf(from.Address))
+	}
+
+	for _, k := range d.keys {
+		if domain == k.domain || strings.HasSuffix(domain, "."+k.domain) {
+			return k
+		}
+	}
+	return d.keys[0]
+}
+
+// sign computes the DKIM-Signature header value of the rendered message, using the relaxed/relaxed canonicalization.
+func (k *dkimKey) sign(r io.Reader) (string, error) {
+	br := bufio.NewReader(r)
+	h, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil {
+		return "", fmt.Errorf("failed to read message header: %w", err)
+	}
+
+	// The rest of the reader is the message body.
+	bh := sha256.New()
+	if err = canonicalizeBodyRelaxed(bh, br); err != nil {
+		return "", err
+	}
+
+	var signed []string
+	hh := sha256.New()
+	for _, name := range dkimSignedHeaders {
+		values := h.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+		signed = append(signed, strings.ToLower(name))
+		io.WriteString(hh, canonicalizeHeaderRelaxed(name, values[len(values)-1]))
+		io.WriteString(hh, "\r\n")
+	}
+
+	tags := fmt.Sprintf("v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		k.algorithm, k.domain, k.selector, time.Now().Unix(), strings.Join(signed, ":"),
+		base64.StdEncoding.EncodeToString(bh.Sum(nil)))
+
+	// The signature header itself is signed with the empty b= tag and without the trailing CRLF.
+	io.WriteString(hh, canonicalizeHeaderRelaxed("DKIM-Signature", tags))
+	hashed := hh.Sum(nil)
+
+	var sig []byte
+	switch key := k.signer.(type) {
+	case ed25519.PrivateKey:
+		// The Ed25519 signs the SHA-256 hash of the canonicalized data (RFC 8463).
+		sig = ed25519.Sign(key, hashed)
+	default:
+		sig, err = k.signer.Sign(rand.Reader, hashed, crypto.SHA256)
+		if err != nil {
+			return "", fmt.Errorf("failed to sign message: %w", err)
+		}
+	}
+	return tags + foldBase64(base64.StdEncoding.EncodeToString(sig)), nil
+}
+
+// canonicalizeHeaderRelaxed returns the header field in the relaxed canonical form, without the trailing CRLF.
+func canonicalizeHeaderRelaxed(name, value string) string {
+	value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.TrimSpace(collapseWSP(value))
+}
+
+// canonicalizeBodyRelaxed writes the body in the relaxed canonical form.
+// The whitespace sequences are reduced to a single space, the trailing whitespace of the lines is removed
+// and the empty lines at the end of the body are ignored.
+func canonicalizeBodyRelaxed(w io.Writer, r *bufio.Reader) error {
+	var emptyLines int
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if line == "" && errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		line = strings.TrimRight(collapseWSP(strings.TrimRight(line, "\r\n")), " ")
+		if line == "" {
+			emptyLines++
+		} else {
+			for ; emptyLines > 0; emptyLines-- {
+				io.WriteString(w, "\r\n")
+			}
+			io.WriteString(w, line)
+			io.WriteString(w, "\r\n")
+		}
+
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+	}
+}
+
+// collapseWSP reduces the whitespace sequences into a single space.
+func collapseWSP(s string) string {
+	var sb strings.Builder
+	sb.Grow(len(s))
+
+	inWSP := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			if !inWSP {
+				sb.WriteByte(' ')
+			}
+			inWSP = true
+			continue
+		}
+		inWSP = false
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// foldBase64 inserts the whitespace into the base64 encoded signature, so that the header could be folded.
+func foldBase64(s string) string {
+	const chunk = 64
+
+	var sb strings.Builder
+	for len(s) > chunk {
+		sb.WriteString(s[:chunk])
+		sb.WriteByte(' ')
+		s = s[chunk:]
+	}
+	sb.WriteString(s)
+	return sb.String()
+}
+
+// Verify checks if the public keys published in the DNS match the configured signing keys.
+func (d *DKIMSigner) Verify(ctx context.Context, resolver TXTResolver) error {
+	for _, k := range d.keys {
+		name := k.selector + "._domainkey." + k.domain
+		records, err := resolver.LookupTXT(ctx, name)
+		if err != nil {
+			return fmt.Errorf("failed to lookup dkim record %s: %w", name, err)
+		}
+
+		published, err := parseDKIMRecordKey(strings.Join(records, ""))
+		if err != nil {
+			return fmt.Errorf("invalid dkim record %s: %w", name, err)
+		}
+
+		expected, err := dkimPublicKey(k.signer)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(published, expected) {
+			return fmt.Errorf("dkim record %s does not match the configured key", name)
+		}
+	}
+	return nil
+}
+
+// parseDKIMRecordKey returns the decoded public key (p= tag) of the DKIM DNS record.
+func parseDKIMRecordKey(record string) ([]byte, error) {
+	for _, tag := range strings.Split(record, ";") {
+		k, v, ok := strings.Cut(strings.TrimSpace(tag), "=")
+		if !ok || strings.TrimSpace(k) != "p" {
+			continue
+		}
+		v = strings.Join(strings.Fields(v), "")
+		if v == "" {
+			return nil, errors.New("dkim key is revoked")
+		}
+		return base64.StdEncoding.DecodeString(v)
+	}
+	return nil, errors.New("no public key in dkim record")
+}
+
+// dkimPublicKey returns the public key of the signer in the DKIM record format.
+func dkimPublicKey(signer crypto.Signer) ([]byte, error) {
+	switch pub := signer.Public().(type) {
+	case ed25519.PublicKey:
+		// The Ed25519 public key is published as the raw key (RFC 8463).
+		return pub, nil
+	default:
+		return x509.MarshalPKIXPublicKey(pub)
+	}
+}
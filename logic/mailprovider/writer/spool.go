@@ -0,0 +1,70 @@
+package mailproviderwriter
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// maxSpoolMemory is the size of the content kept in the memory, before the spool switches to the temporary file.
+const maxSpoolMemory = 1 << 20
+
+// Spool buffers the written content in the memory, switching to the temporary file once it grows large,
+// so that the rendered message could be read more than once without keeping the attachments in the memory.
+type Spool struct {
+	buf bytes.Buffer
+	f   *os.File
+	n   int64
+}
+
+// Write writes the content to the spool.
+func (s *Spool) Write(p []byte) (int, error) {
+	if s.f == nil && s.buf.Len()+len(p) > maxSpoolMemory {
+		f, err := os.CreateTemp("", "mail-spool-*")
+		if err != nil {
+			return 0, err
+		}
+		s.f = f
+		if _, err = s.buf.WriteTo(f); err != nil {
+			return 0, err
+		}
+	}
+	var (
+		n   int
+		err error
+	)
+	if s.f != nil {
+		n, err = s.f.Write(p)
+	} else {
+		n, err = s.buf.Write(p)
+	}
+	s.n += int64(n)
+	return n, err
+}
+
+// Size returns the size of the spooled content.
+func (s *Spool) Size() int64 {
+	return s.n
+}
+
+// Reader returns the reader of the spooled content from the beginning.
+func (s *Spool) Reader() (io.Reader, error) {
+	if s.f == nil {
+		return bytes.NewReader(s.buf.Bytes()), nil
+	}
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return s.f, nil
+}
+
+// Close releases the spooled content.
+func (s *Spool) Close() {
+	s.buf.Reset()
+	if s.f != nil {
+		s.f.Close()
+		os.Remove(s.f.Name())
+		s.f = nil
+	}
+	s.n = 0
+}
@@ -0,0 +1,495 @@
+package mailproviderwriter
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/blockysource/mailing/logic/mailprovider"
+)
+
+var _bufioWriterPool = sync.Pool{}
+
+func newBufioWriter(w io.Writer) *bufio.Writer {
+	if v := _bufioWriterPool.Get(); v != nil {
+		bw := v.(*bufio.Writer)
+		bw.Reset(w)
+		return bw
+	}
+	return bufio.NewWriter(w)
+}
+
+func putBufioWriter(bw *bufio.Writer) {
+	bw.Reset(nil)
+	_bufioWriterPool.Put(bw)
+}
+
+// maxHeaderLineLen is the recommended maximum length of the header line, excluding the CRLF.
+const maxHeaderLineLen = 78
+
+// Writer renders the messages in the RFC 5322 format, shared by the providers that send the raw messages.
+type Writer struct {
+	// Domain is the domain used to qualify the generated Message-ID.
+	Domain string
+	// Signer is an optional DKIM signer of the rendered messages.
+	Signer *DKIMSigner
+	// EightBit allows the 8bit transfer encoding of the textual parts, if the server supports the 8BITMIME.
+	EightBit bool
+	// Bcc writes the Bcc header with the blind carbon copy recipients. It is meant for the submission programs,
+	// that extract the recipients from the headers and strip the header before the message is delivered.
+	Bcc bool
+}
+
+// Render renders the message to the writer.
+// The failure to read the attachment content is returned as the temporary mailprovider.Error.
+func (w *Writer) Render(ctx context.Context, msg *mailprovider.Message, dst io.Writer) error {
+	bw := newBufioWriter(dst)
+	defer putBufioWriter(bw)
+
+	if err := w.writeMessage(ctx, msg, bw); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// writeMessage writes the message to the buffer.
+func (w *Writer) writeMessage(ctx context.Context, msg *mailprovider.Message, buf *bufio.Writer) error {
+	if w.Signer == nil {
+		return w.renderMessage(ctx, msg, buf)
+	}
+	return w.writeSigned(ctx, msg, buf)
+}
+
+// writeSigned renders the whole message to the spool, and writes it prefixed with the DKIM-Signature header.
+func (w *Writer) writeSigned(ctx context.Context, msg *mailprovider.Message, buf *bufio.Writer) error {
+	var sp Spool
+	defer sp.Close()
+
+	sw := newBufioWriter(&sp)
+	defer putBufioWriter(sw)
+
+	if err := w.renderMessage(ctx, msg, sw); err != nil {
+		return err
+	}
+	if err := sw.Flush(); err != nil {
+		return err
+	}
+
+	r, err := sp.Reader()
+	if err != nil {
+		return err
+	}
+	sig, err := w.Signer.keyFor(msg.From).sign(r)
+	if err != nil {
+		return err
+	}
+
+	if r, err = sp.Reader(); err != nil {
+		return err
+	}
+	w.writeHeader(buf, "DKIM-Signature", sig)
+	_, err = io.Copy(buf, r)
+	return err
+}
+
+// renderMessage renders the message in the RFC 5322 format.
+func (w *Writer) renderMessage(ctx context.Context, msg *mailprovider.Message, buf *bufio.Writer) error {
+	w.writeHeader(buf, "MIME-Version", "1.0")
+	w.writeHeader(buf, "Date", time.Now().Format(time.RFC1123Z))
+	w.writeHeader(buf, "Message-ID", w.messageID(msg))
+	w.writeHeader(buf, "From", formatAddress(msg.From))
+	if len(msg.ReplyTo) > 0 {
+		w.writeHeader(buf, "Reply-To", joinAddresses(msg.ReplyTo))
+	}
+	w.writeHeader(buf, "To", joinAddresses(msg.To))
+	if len(msg.Cc) > 0 {
+		w.writeHeader(buf, "Cc", joinAddresses(msg.Cc))
+	}
+	if w.Bcc && len(msg.Bcc) > 0 {
+		w.writeHeader(buf, "Bcc", joinAddresses(msg.Bcc))
+	}
+	w.writeHeader(buf, "Subject", encodeHeaderValue(msg.Subject))
+
+	return w.writeBody(ctx, w.topLevelPart(buf), msg)
+}
+
+// createPartFunc writes the MIME entity header and returns the writer of its body.
+type createPartFunc func(h textproto.MIMEHeader) (io.Writer, error)
+
+// topLevelPart returns the createPartFunc that writes the entity header as a part of the message header.
+func (w *Writer) topLevelPart(buf *bufio.Writer) createPartFunc {
+	return func(h textproto.MIMEHeader) (io.Writer, error) {
+		keys := make([]string, 0, len(h))
+		for k := range h {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			for _, v := range h[k] {
+				w.writeHeader(buf, k, v)
+			}
+		}
+		buf.WriteString("\r\n")
+		return buf, nil
+	}
+}
+
+// writeBody writes the message body, wrapping the content and the attachments into the multipart/mixed entity.
+func (w *Writer) writeBody(ctx context.Context, create createPartFunc, msg *mailprovider.Message) error {
+	if len(msg.Attachments) == 0 {
+		return w.writeContent(ctx, create, msg)
+	}
+
+	mw, err := createMultipart(create, "mixed", msg.ID)
+	if err != nil {
+		return err
+	}
+
+	if err = w.writeContent(ctx, mw.CreatePart, msg); err != nil {
+		return err
+	}
+	for _, a := range msg.Attachments {
+		if err = writeAttachment(ctx, mw, a, "attachment"); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// writeContent writes the message content, either as a single part or as multipart/alternative
+// with the plain text and the preferred Body parts.
+func (w *Writer) writeContent(ctx context.Context, create createPartFunc, msg *mailprovider.Message) error {
+	if msg.TextBody == "" {
+		return w.writeRelated(ctx, create, msg)
+	}
+
+	mw, err := createMultipart(create, "alternative", msg.ID)
+	if err != nil {
+		return err
+	}
+
+	// The parts are ordered by the increasing preference.
+	if err = w.writePart(mw.CreatePart, "text/plain; charset=utf-8", msg.TextBody); err != nil {
+		return err
+	}
+	if err = w.writeRelated(ctx, mw.CreatePart, msg); err != nil {
+		return err
+	}
+	return mw.Close()
+}
+
+// writeRelated writes the Body, wrapping it with its inline assets into the multipart/related entity.
+func (w *Writer) writeRelated(ctx context.Context, create createPartFunc, msg *mailprovider.Message) error {
+	if len(msg.Inline) == 0 {
+		return w.writePart(create, msg.ContentType, msg.Body)
+	}
+
+	mw, err := createMultipart(create, "related", msg.ID)
+	if err != nil {
+		return err
+	}
+
+	// The root part of the multipart/related is the first one.
+	if err = w.writePart(mw.CreatePart, msg.ContentType, msg.Body); err != nil {
+		return err
+	}
+	for _, a := range msg.Inline {
+		if err = writeAttachment(ctx, mw, a, "inline"); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// createMultipart creates the multipart entity of the given subtype, with the boundary stable for the message.
+func createMultipart(create createPartFunc, subtype, msgID string) (*multipart.Writer, error) {
+	b := boundary(msgID, subtype)
+
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": b}))
+	body, err := create(h)
+	if err != nil {
+		return nil, err
+	}
+
+	mw := multipart.NewWriter(body)
+	if err = mw.SetBoundary(b); err != nil {
+		return nil, err
+	}
+	return mw, nil
+}
+
+// writePart writes the encoded body as the next MIME entity.
+func (w *Writer) writePart(create createPartFunc, contentType, body string) error {
+	cte := w.transferEncoding(contentType, body)
+
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Transfer-Encoding", cte)
+	pw, err := create(h)
+	if err != nil {
+		return err
+	}
+	return writeEncoded(pw, cte, body)
+}
+
+// writeAttachment streams the base64 encoded attachment content as the next part of the multipart writer.
+func writeAttachment(ctx context.Context, mw *multipart.Writer, a mailprovider.Attachment, disposition string) error {
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", mediaTypeWithParam(a.ContentType, "name", a.Filename))
+	h.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename}))
+	h.Set("Content-Transfer-Encoding", "base64")
+	if a.ContentID != "" {
+		h.Set("Content-ID", "<"+a.ContentID+">")
+	}
+
+	// The attachment content failures are temporary, as the attachment store might recover.
+	rc, err := a.Open(ctx)
+	if err != nil {
+		return mailprovider.ErrTemporary(fmt.Errorf("failed to open attachment %s: %w", a.Filename, err))
+	}
+	defer rc.Close()
+
+	pw, err := mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+
+	ew := base64.NewEncoder(base64.StdEncoding, &lineWrapper{w: pw, max: maxBase64LineLen})
+	if _, err = io.Copy(ew, rc); err != nil {
+		return mailprovider.ErrTemporary(fmt.Errorf("failed to write attachment %s: %w", a.Filename, err))
+	}
+	return ew.Close()
+}
+
+// mediaTypeWithParam adds the parameter to the media type, falling back to application/octet-stream
+// if the media type is not valid.
+func mediaTypeWithParam(mediaType, key, value string) string {
+	mt, params, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		mt, params = "application/octet-stream", map[string]string{}
+	}
+	params[key] = value
+	return mime.FormatMediaType(mt, params)
+}
+
+// boundary returns the multipart boundary that is stable for the given message and part.
+// The boundary starts with the "=_" sequence which never occurs in the quoted-printable nor base64 encoded content.
+func boundary(msgID, part string) string {
+	sum := sha256.Sum256([]byte(msgID + "/" + part))
+	return "=_" + part + "_" + hex.EncodeToString(sum[:12])
+}
+
+// transferEncoding returns the transfer encoding of the content.
+// The textual content is encoded with the quoted-printable, and any other with the base64.
+// If the 8bit encoding is allowed, the textual content that fits the SMTP line limits is sent as is.
+func (w *Writer) transferEncoding(contentType, content string) string {
+	if !strings.HasPrefix(strings.ToLower(contentType), "text/") {
+		return "base64"
+	}
+	if w.EightBit && is8BitSafe(content) {
+		return "8bit"
+	}
+	return "quoted-printable"
+}
+
+// maxLineLen is the maximum length of the SMTP line, excluding the CRLF (RFC 5321 4.5.3.1.6).
+const maxLineLen = 998
+
+// is8BitSafe checks if the content could be sent with the 8bit transfer encoding,
+// i.e. it is a valid UTF-8 without NUL characters and its lines do not exceed the maximum length.
+func is8BitSafe(content string) bool {
+	if !utf8.ValidString(content) || strings.IndexByte(content, 0) >= 0 {
+		return false
+	}
+	for len(content) > 0 {
+		line, rest, _ := strings.Cut(content, "\n")
+		if len(strings.TrimSuffix(line, "\r")) > maxLineLen {
+			return false
+		}
+		content = rest
+	}
+	return true
+}
+
+// writeEncoded writes the content encoded with the given transfer encoding.
+func writeEncoded(w io.Writer, cte, content string) error {
+	var ew io.WriteCloser
+	switch cte {
+	case "8bit":
+		// The content is written as is, only the line breaks are normalized to CRLF.
+		content = strings.ReplaceAll(strings.ReplaceAll(content, "\r\n", "\n"), "\n", "\r\n")
+		_, err := io.WriteString(w, content)
+		return err
+	case "quoted-printable":
+		ew = quotedprintable.NewWriter(w)
+	default:
+		ew = base64.NewEncoder(base64.StdEncoding, &lineWrapper{w: w, max: maxBase64LineLen})
+	}
+
+	if _, err := io.WriteString(ew, content); err != nil {
+		return err
+	}
+	return ew.Close()
+}
+
+// maxBase64LineLen is the maximum length of the base64 encoded line.
+const maxBase64LineLen = 76
+
+// lineWrapper is a writer that breaks the written content into lines of the maximum length.
+type lineWrapper struct {
+	w   io.Writer
+	max int
+	n   int
+}
+
+// Write writes the content breaking the lines with CRLF.
+func (l *lineWrapper) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		if l.n == l.max {
+			if _, err := io.WriteString(l.w, "\r\n"); err != nil {
+				return written, err
+			}
+			l.n = 0
+		}
+
+		chunk := p
+		if rem := l.max - l.n; len(chunk) > rem {
+			chunk = chunk[:rem]
+		}
+		n, err := l.w.Write(chunk)
+		written += n
+		l.n += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// writeHeader writes the header field, folding the line at the whitespace if it exceeds 78 characters.
+func (w *Writer) writeHeader(buf *bufio.Writer, name, value string) {
+	line := name + ": " + value
+
+	// The line cannot be folded right after the field name.
+	minIdx := len(name) + 2
+	for len(line) > maxHeaderLineLen {
+		idx := strings.LastIndexAny(line[:maxHeaderLineLen+1], " \t")
+		if idx < minIdx {
+			// There is no whitespace within the limit, fold at the first one after it.
+			next := strings.IndexAny(line[maxHeaderLineLen+1:], " \t")
+			if next < 0 {
+				break
+			}
+			idx = maxHeaderLineLen + 1 + next
+		}
+
+		buf.WriteString(line[:idx])
+		buf.WriteString("\r\n")
+
+		// The continuation line starts with the folding whitespace.
+		line = line[idx:]
+		minIdx = 1
+	}
+	buf.WriteString(line)
+	buf.WriteString("\r\n")
+}
+
+// messageID returns the domain qualified Message-ID of the message.
+// The message identifier is used as the left part if it is a valid dot-atom, so that
+// the retries of the same message share the same Message-ID.
+func (w *Writer) messageID(msg *mailprovider.Message) string {
+	left := msg.ID
+	if !IsDotAtom(left) {
+		var b [16]byte
+		_, _ = rand.Read(b[:])
+		left = hex.EncodeToString(b[:])
+	}
+
+	domain := w.Domain
+	if !IsDotAtom(domain) {
+		domain = "localhost"
+	}
+	return "<" + left + "@" + domain + ">"
+}
+
+// formatAddress formats the address for the header, the non-ASCII display names are RFC 2047 encoded.
+func formatAddress(addr *mail.Address) string {
+	if addr.Name == "" || IsASCII(addr.Name) {
+		return addr.String()
+	}
+	return mime.QEncoding.Encode("UTF-8", addr.Name) + " <" + addr.Address + ">"
+}
+
+// joinAddresses joins the addresses into the address list header value.
+func joinAddresses(addrs []*mail.Address) string {
+	var sb strings.Builder
+	for i, addr := range addrs {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(formatAddress(addr))
+	}
+	return sb.String()
+}
+
+// encodeHeaderValue RFC 2047 encodes the unstructured header value if it contains non-ASCII characters.
+func encodeHeaderValue(v string) string {
+	if IsASCII(v) {
+		return v
+	}
+	return mime.QEncoding.Encode("UTF-8", v)
+}
+
+// IsASCII checks if the input contains only the ASCII characters.
+func IsASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// IsDotAtom checks if the input is a valid RFC 5322 dot-atom-text.
+func IsDotAtom(s string) bool {
+	if s == "" || s[0] == '.' || s[len(s)-1] == '.' || strings.Contains(s, "..") {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.IndexByte("!#$%&'*+-/=?^_`{|}~.", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// DomainOf returns the domain part of the email address, or an empty string if the address has no domain.
+func DomainOf(address string) string {
+	if i := strings.LastIndexByte(address, '@'); i >= 0 {
+		return address[i+1:]
+	}
+	return ""
+}
@@ -0,0 +1,107 @@
+package localemailattachment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailing"
+	emailattachment "github.com/blockysource/mailing/logic/messages/attachment"
+)
+
+var _ emailattachment.Store = (*Store)(nil)
+
+// ErrInvalidPath is an error returned when the attachment path points outside the store directory.
+var ErrInvalidPath = errors.New("invalid attachment path")
+
+// Store is an attachment store that keeps the attachment content in the local filesystem.
+type Store struct {
+	dir string
+	log *logrus.Entry
+}
+
+// New creates a new local filesystem attachment Store in the given directory.
+func New(dir string, log *logrus.Entry) (*Store, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create attachment directory: %w", err)
+	}
+	return &Store{dir: dir, log: log}, nil
+}
+
+// newStore creates a new local filesystem attachment Store in the configured directory.
+func newStore(cfg *mailing.AttachmentConfig, log *logrus.Entry) (*Store, error) {
+	return New(cfg.Dir, log)
+}
+
+// Put stores the attachment content and returns its path relative to the store directory.
+func (s *Store) Put(_ context.Context, r io.Reader) (string, error) {
+	name := uuid.New().String()
+	// Spread the files over the subdirectories, so that a single directory doesn't grow too large.
+	rel := filepath.Join(name[:2], name)
+
+	full := filepath.Join(s.dir, rel)
+	if err := os.MkdirAll(filepath.Dir(full), 0o750); err != nil {
+		return "", fmt.Errorf("failed to create attachment directory: %w", err)
+	}
+
+	// Write to the temporary file first, so that the partially written content is never visible.
+	tmp, err := os.CreateTemp(filepath.Dir(full), ".tmp-"+name)
+	if err != nil {
+		return "", fmt.Errorf("failed to create attachment file: %w", err)
+	}
+	if _, err = io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to write attachment file: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to close attachment file: %w", err)
+	}
+	if err = os.Rename(tmp.Name(), full); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to store attachment file: %w", err)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// Open opens the stored attachment content for reading.
+func (s *Store) Open(_ context.Context, path string) (io.ReadCloser, error) {
+	full, err := s.fullPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(full)
+}
+
+// Delete deletes the stored attachment content, deleting a missing attachment is not an error.
+func (s *Store) Delete(_ context.Context, path string) error {
+	full, err := s.fullPath(path)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(full); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// fullPath returns the absolute path of the attachment, making sure it is within the store directory.
+func (s *Store) fullPath(path string) (string, error) {
+	full := filepath.Join(s.dir, filepath.FromSlash(path))
+	if !strings.HasPrefix(full, s.dir+string(filepath.Separator)) {
+		return "", ErrInvalidPath
+	}
+	return full, nil
+}
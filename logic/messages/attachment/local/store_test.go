@@ -0,0 +1,112 @@
+package localemailattachment
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	s, err := New(filepath.Join(t.TempDir(), "attachments"), logrus.NewEntry(log))
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	return s
+}
+
+func TestStore(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+
+	path, err := s.Put(ctx, strings.NewReader("attachment content"))
+	if err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	if filepath.IsAbs(path) || strings.Contains(path, "\\") {
+		t.Fatalf("got path %q, want relative slash separated one", path)
+	}
+
+	rc, err := s.Open(ctx, path)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(data) != "attachment content" {
+		t.Fatalf("got content %q, %v", data, err)
+	}
+
+	// No temporary files are left in the store.
+	entries, err := os.ReadDir(filepath.Join(s.dir, filepath.Dir(filepath.FromSlash(path))))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("got directory entries %v, %v, want the single attachment file", entries, err)
+	}
+
+	if err = s.Delete(ctx, path); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if _, err = s.Open(ctx, path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("got %v, want not exist error", err)
+	}
+	// Deleting the missing attachment is not an error.
+	if err = s.Delete(ctx, path); err != nil {
+		t.Fatalf("delete of missing attachment failed: %v", err)
+	}
+}
+
+func TestStore_fullPath(t *testing.T) {
+	s := newTestStore(t)
+
+	tests := []struct {
+		name string
+		path string
+		want string
+		err  error
+	}{
+		{name: "nested", path: "ab/abcdef", want: filepath.Join(s.dir, "ab", "abcdef")},
+		{name: "cleaned", path: "ab/../cd/file", want: filepath.Join(s.dir, "cd", "file")},
+		{name: "absolute", path: "/etc/passwd", want: filepath.Join(s.dir, "etc", "passwd")},
+		{name: "parent", path: "../outside", err: ErrInvalidPath},
+		{name: "nested parent", path: "ab/../../outside", err: ErrInvalidPath},
+		{name: "sibling prefix", path: "../attachments-other/file", err: ErrInvalidPath},
+		{name: "store directory", path: ".", err: ErrInvalidPath},
+		{name: "empty", path: "", err: ErrInvalidPath},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := s.fullPath(tc.path)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("got error %v, want %v", err, tc.err)
+			}
+			if got != tc.want {
+				t.Fatalf("got path %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	// The store operations refuse the paths outside the store directory.
+	outside := filepath.Join(filepath.Dir(s.dir), "outside")
+	if err := os.WriteFile(outside, []byte("secret"), 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if _, err := s.Open(context.Background(), "../outside"); !errors.Is(err, ErrInvalidPath) {
+		t.Fatalf("got open error %v, want %v", err, ErrInvalidPath)
+	}
+	if err := s.Delete(context.Background(), "../outside"); !errors.Is(err, ErrInvalidPath) {
+		t.Fatalf("got delete error %v, want %v", err, ErrInvalidPath)
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Fatalf("file outside of the store was deleted: %v", err)
+	}
+}
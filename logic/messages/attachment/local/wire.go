@@ -0,0 +1,32 @@
+//go:build wireinject
+
+//go:generate go run github.com/google/wire/cmd/wire
+
+package localemailattachment
+
+import (
+	"github.com/google/wire"
+	"github.com/sirupsen/logrus"
+
+	"github.com/blockysource/blocky/pkg/go/providers"
+	"github.com/blockysource/blocky/services/mailing/internal/deps"
+	"github.com/blockysource/blocky/services/mailing/public/mailing"
+)
+
+// NewStore creates a new local filesystem attachment Store in the configured directory.
+func NewStore(*mailing.Dependencies) (*Store, error) {
+	wire.Build(
+		// Logger.
+		deps.GetLogrusLogger,
+		wire.Value(deps.ModuleName),
+		wire.Value(logrus.Fields{
+			"part": "localemailattachment",
+		}),
+		providers.FieldsLogrusEntry,
+
+		deps.GetConfig,
+		deps.GetAttachmentConfig,
+		newStore,
+	)
+	return nil, nil
+}
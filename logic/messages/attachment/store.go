@@ -0,0 +1,16 @@
+package emailattachment
+
+import (
+	"context"
+	"io"
+)
+
+// Store is the interface that stores the content of the message attachments.
+type Store interface {
+	// Put stores the attachment content and returns its path in the store.
+	Put(ctx context.Context, r io.Reader) (string, error)
+	// Open opens the stored attachment content for reading.
+	Open(ctx context.Context, path string) (io.ReadCloser, error)
+	// Delete deletes the stored attachment content.
+	Delete(ctx context.Context, path string) error
+}
@@ -0,0 +1,128 @@
+package emailattachment
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/blockysource/mailing/persistence"
+)
+
+const (
+	// DefaultSweepInterval is the default interval between the sweeps of the expired attachments.
+	DefaultSweepInterval = 10 * time.Minute
+	// sweepBatchSize is the maximum number of attachments deleted in a single batch.
+	sweepBatchSize = 100
+)
+
+// Sweeper periodically deletes the attachments which time to live has expired.
+type Sweeper struct {
+	s        Store
+	p        persistence.MessageAttachmentStorage
+	log      *logrus.Entry
+	interval time.Duration
+
+	closeFn   context.CancelFunc
+	isStarted atomic.Bool
+}
+
+// NewSweeper creates a new attachment Sweeper.
+func NewSweeper(s Store, p persistence.MessageAttachmentStorage, interval time.Duration, log *logrus.Entry) *Sweeper {
+	if interval <= 0 {
+		interval = DefaultSweepInterval
+	}
+	return &Sweeper{
+		s:        s,
+		p:        p,
+		log:      log,
+		interval: interval,
+	}
+}
+
+// Start starts sweeping the expired attachments in the background.
+func (s *Sweeper) Start(ctx context.Context) error {
+	if !s.isStarted.CompareAndSwap(false, true) {
+		s.log.Warn("sweeper already started")
+		return nil
+	}
+	ctx, s.closeFn = context.WithCancel(ctx)
+
+	go func() {
+		t := time.NewTicker(s.interval)
+		defer t.Stop()
+
+		for {
+			s.sweep(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops sweeping the expired attachments.
+func (s *Sweeper) Stop() error {
+	if !s.isStarted.CompareAndSwap(true, false) {
+		s.log.Warn("sweeper already stopped")
+		return nil
+	}
+	s.closeFn()
+	return nil
+}
+
+// sweep deletes the expired attachments in batches, until there are none left.
+// The attachments which content failed to be deleted are skipped, and retried in the next sweep.
+func (s *Sweeper) sweep(ctx context.Context) {
+	now := time.Now()
+
+	var afterID int64
+	for ctx.Err() == nil {
+		expired, err := s.p.ListExpiredAttachments(ctx, &persistence.ListExpiredAttachmentsArgs{
+			Now:     now,
+			AfterID: afterID,
+			Limit:   sweepBatchSize,
+		})
+		if err != nil {
+			s.log.WithError(err).Error("failed to list expired attachments")
+			return
+		}
+		if len(expired) == 0 {
+			return
+		}
+		afterID = expired[len(expired)-1].ID
+
+		ids := make([]int64, 0, len(expired))
+		for _, a := range expired {
+			// The content that is already gone is treated as deleted.
+			if err = s.s.Delete(ctx, a.Filepath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				s.log.WithFields(logrus.Fields{
+					"msg_uid":       a.MessageUID,
+					"filepath":      a.Filepath,
+					logrus.ErrorKey: err,
+				}).Error("failed to delete expired attachment content")
+				continue
+			}
+			ids = append(ids, a.ID)
+		}
+
+		if len(ids) > 0 {
+			if err = s.p.DeleteAttachments(ctx, &persistence.DeleteAttachmentsArgs{IDs: ids}); err != nil {
+				s.log.WithError(err).Error("failed to delete expired attachments")
+				return
+			}
+			s.log.WithField("count", len(ids)).Debug("expired attachments deleted")
+		}
+
+		if len(expired) < sweepBatchSize {
+			return
+		}
+	}
+}
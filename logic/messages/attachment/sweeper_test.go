@@ -0,0 +1,123 @@
+package emailattachment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/blockysource/mailing/persistence"
+)
+
+// testStore is the attachment store which content deletion fails for the chosen paths.
+type testStore struct {
+	files   map[string]bool
+	failing map[string]bool
+}
+
+func (s *testStore) Put(context.Context, io.Reader) (string, error) {
+	return "", errors.New("not implemented")
+}
+
+func (s *testStore) Open(context.Context, string) (io.ReadCloser, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (s *testStore) Delete(_ context.Context, path string) error {
+	if s.failing[path] {
+		return errors.New("permission denied")
+	}
+	if !s.files[path] {
+		return fs.ErrNotExist
+	}
+	delete(s.files, path)
+	return nil
+}
+
+// testStorage is the attachment storage which attachments are all expired.
+type testStorage struct {
+	attachments map[int64]persistence.MessageAttachment
+	lists       int
+}
+
+func (s *testStorage) CreateAttachments(context.Context, *persistence.CreateAttachmentsArgs) error {
+	return errors.New("not implemented")
+}
+
+func (s *testStorage) ListExpiredAttachments(_ context.Context, in *persistence.ListExpiredAttachmentsArgs) ([]persistence.MessageAttachment, error) {
+	s.lists++
+
+	var out []persistence.MessageAttachment
+	for id, a := range s.attachments {
+		if id > in.AfterID {
+			out = append(out, a)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	if len(out) > in.Limit {
+		out = out[:in.Limit]
+	}
+	return out, nil
+}
+
+func (s *testStorage) DeleteAttachments(_ context.Context, in *persistence.DeleteAttachmentsArgs) error {
+	for _, id := range in.IDs {
+		delete(s.attachments, id)
+	}
+	return nil
+}
+
+func TestSweeper_sweep(t *testing.T) {
+	st := &testStore{files: map[string]bool{}, failing: map[string]bool{}}
+	p := &testStorage{attachments: map[int64]persistence.MessageAttachment{}}
+
+	// The first full batch fails to be deleted, and must not stall the expiry of the attachments after it.
+	for id := int64(1); id <= sweepBatchSize+50; id++ {
+		path := fmt.Sprintf("%02d/attachment-%d", id%100, id)
+		switch {
+		case id <= sweepBatchSize:
+			st.failing[path] = true
+		case id%10 == 0:
+			// The content is already gone.
+		default:
+			st.files[path] = true
+		}
+		p.attachments[id] = persistence.MessageAttachment{ID: id, MessageUID: "msg", Filepath: path}
+	}
+
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	s := NewSweeper(st, p, 0, logrus.NewEntry(log))
+	s.sweep(context.Background())
+
+	if len(st.files) != 0 {
+		t.Errorf("got %d attachment files left, want none", len(st.files))
+	}
+	if len(p.attachments) != sweepBatchSize {
+		t.Fatalf("got %d attachments left, want the %d failing ones", len(p.attachments), sweepBatchSize)
+	}
+	for id := range p.attachments {
+		if id > sweepBatchSize {
+			t.Fatalf("attachment %d left, want it deleted", id)
+		}
+	}
+	if p.lists != 2 {
+		t.Errorf("got %d listings, want 2", p.lists)
+	}
+
+	// The failing attachments are retried in the next sweep.
+	for path := range st.failing {
+		st.files[path] = true
+	}
+	st.failing = nil
+	s.sweep(context.Background())
+
+	if len(p.attachments) != 0 || len(st.files) != 0 {
+		t.Fatalf("got %d attachments and %d files left, want none", len(p.attachments), len(st.files))
+	}
+}
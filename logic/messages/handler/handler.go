@@ -1,10 +1,96 @@
 package emailhandler
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailing"
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
 	mailprovidermanager "github.com/blockysource/mailing/logic/mailprovider/manager"
+	emailattachment "github.com/blockysource/mailing/logic/messages/attachment"
+	"github.com/blockysource/mailing/persistence"
 )
 
 // Handler is a handler that handles emails.
 type Handler struct {
-	m *mailprovidermanager.Manager
+	m   *mailprovidermanager.Manager
+	as  emailattachment.Store
+	p   persistence.MessageAttachmentStorage
+	sw  *emailattachment.Sweeper
+	log *logrus.Entry
+}
+
+// Start starts the background work of the handler, sweeping the expired attachments.
+func (h *Handler) Start(ctx context.Context) error {
+	return h.sw.Start(ctx)
+}
+
+// Stop stops the background work of the handler.
+func (h *Handler) Stop() error {
+	return h.sw.Stop()
+}
+
+// AcceptAttachments stores the content of the enqueued message attachments in the attachment store,
+// and records the attachments with the message, so that the content is swept once its time to live expires.
+// The content is replaced by the path in the store, so that it is not kept in the message queue.
+// It needs to be called once the enqueued message is stored, before it is queued for sending.
+func (h *Handler) AcceptAttachments(ctx context.Context, in *mailingpb.EnqueuedEmailMessage) error {
+	if len(in.Attachments) == 0 {
+		return nil
+	}
+
+	var stored []string
+	// Clean up the attachments stored so far.
+	cleanup := func() {
+		for _, path := range stored {
+			if err := h.as.Delete(ctx, path); err != nil {
+				h.log.WithFields(logrus.Fields{
+					"msg_id":        in.UID,
+					"filepath":      path,
+					logrus.ErrorKey: err,
+				}).Warn("failed to delete attachment content")
+			}
+		}
+	}
+
+	args := persistence.CreateAttachmentsArgs{
+		MessageUID:  in.UID,
+		Attachments: make([]persistence.MessageAttachment, 0, len(in.Attachments)),
+	}
+	for i := range in.Attachments {
+		a := &in.Attachments[i]
+		if a.Filepath == "" {
+			path, err := h.as.Put(ctx, bytes.NewReader(a.Content))
+			if err != nil {
+				cleanup()
+				return fmt.Errorf("failed to store attachment %s: %w", a.Filename, err)
+			}
+			stored = append(stored, path)
+			a.Filepath = path
+			a.Content = nil
+		}
+
+		args.Attachments = append(args.Attachments, persistence.MessageAttachment{
+			MessageUID:  in.UID,
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Filepath:    a.Filepath,
+			TTL:         time.Duration(a.TTL) * time.Second,
+		})
+	}
+
+	if err := h.p.CreateAttachments(ctx, &args); err != nil {
+		cleanup()
+		return fmt.Errorf("failed to create attachments: %w", err)
+	}
+	return nil
+}
+
+// newSweeper creates the Sweeper of the expired attachments with the configured interval.
+func newSweeper(as emailattachment.Store, p persistence.MessageAttachmentStorage, cfg *mailing.AttachmentConfig, log *logrus.Entry) *emailattachment.Sweeper {
+	return emailattachment.NewSweeper(as, p, cfg.SweepInterval, log.WithField("type", "sweeper"))
 }
@@ -0,0 +1,176 @@
+package emailhandler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
+	"github.com/blockysource/mailing/persistence"
+)
+
+// testStore is the in-memory attachment store, which fails to put the content after the given number of puts.
+type testStore struct {
+	files   map[string]string
+	puts    int
+	failAt  int
+	deleted []string
+}
+
+func (s *testStore) Put(_ context.Context, r io.Reader) (string, error) {
+	s.puts++
+	if s.puts == s.failAt {
+		return "", errors.New("disk full")
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	path := "stored/" + strconv.Itoa(s.puts)
+	s.files[path] = string(data)
+	return path, nil
+}
+
+func (s *testStore) Open(context.Context, string) (io.ReadCloser, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (s *testStore) Delete(_ context.Context, path string) error {
+	s.deleted = append(s.deleted, path)
+	delete(s.files, path)
+	return nil
+}
+
+// testStorage records the created attachments.
+type testStorage struct {
+	created []*persistence.CreateAttachmentsArgs
+	err     error
+}
+
+func (s *testStorage) CreateAttachments(_ context.Context, in *persistence.CreateAttachmentsArgs) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.created = append(s.created, in)
+	return nil
+}
+
+func (s *testStorage) ListExpiredAttachments(context.Context, *persistence.ListExpiredAttachmentsArgs) ([]persistence.MessageAttachment, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (s *testStorage) DeleteAttachments(context.Context, *persistence.DeleteAttachmentsArgs) error {
+	return errors.New("not implemented")
+}
+
+func newTestHandler(st *testStore, p *testStorage) *Handler {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	return &Handler{as: st, p: p, log: logrus.NewEntry(log)}
+}
+
+func testEnqueuedMessage() *mailingpb.EnqueuedEmailMessage {
+	return &mailingpb.EnqueuedEmailMessage{
+		UID: "msg-1",
+		Attachments: []mailingpb.EmailAttachment{
+			{Filename: "report.pdf", ContentType: "application/pdf", Content: []byte("report"), TTL: 3600},
+			{Filename: "stored.txt", ContentType: "text/plain", Filepath: "existing/path"},
+			{Filename: "logo.png", ContentType: "image/png", Content: []byte("logo"), TTL: 60},
+		},
+	}
+}
+
+func TestHandler_AcceptAttachments(t *testing.T) {
+	st := &testStore{files: map[string]string{}}
+	p := &testStorage{}
+	h := newTestHandler(st, p)
+
+	msg := testEnqueuedMessage()
+	if err := h.AcceptAttachments(context.Background(), msg); err != nil {
+		t.Fatalf("accept failed: %v", err)
+	}
+
+	// The content is moved to the store, while the already stored attachment is kept as is.
+	wantPaths := []string{"stored/1", "existing/path", "stored/2"}
+	for i, a := range msg.Attachments {
+		if a.Filepath != wantPaths[i] || a.Content != nil {
+			t.Errorf("attachment %d: got path %q and content %q, want path %q without content", i, a.Filepath, a.Content, wantPaths[i])
+		}
+	}
+	if st.files["stored/1"] != "report" || st.files["stored/2"] != "logo" {
+		t.Errorf("unexpected stored files: %v", st.files)
+	}
+
+	if len(p.created) != 1 {
+		t.Fatalf("got %d create calls, want 1", len(p.created))
+	}
+	created := p.created[0]
+	if created.MessageUID != "msg-1" || len(created.Attachments) != 3 {
+		t.Fatalf("unexpected created attachments: %+v", created)
+	}
+	want := []persistence.MessageAttachment{
+		{MessageUID: "msg-1", Filename: "report.pdf", ContentType: "application/pdf", Filepath: "stored/1", TTL: time.Hour},
+		{MessageUID: "msg-1", Filename: "stored.txt", ContentType: "text/plain", Filepath: "existing/path"},
+		{MessageUID: "msg-1", Filename: "logo.png", ContentType: "image/png", Filepath: "stored/2", TTL: time.Minute},
+	}
+	for i, a := range created.Attachments {
+		if a != want[i] {
+			t.Errorf("attachment %d: got %+v, want %+v", i, a, want[i])
+		}
+	}
+}
+
+func TestHandler_AcceptAttachments_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		failAt  int
+		err     error
+		deleted []string
+	}{
+		{name: "put", failAt: 2, deleted: []string{"stored/1"}},
+		{name: "create", err: persistence.ErrNotFound, deleted: []string{"stored/1", "stored/2"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			st := &testStore{files: map[string]string{}, failAt: tc.failAt}
+			h := newTestHandler(st, &testStorage{err: tc.err})
+
+			if err := h.AcceptAttachments(context.Background(), testEnqueuedMessage()); err == nil {
+				t.Fatal("accept succeeded, want error")
+			} else if tc.err != nil && !errors.Is(err, tc.err) {
+				t.Fatalf("got error %v, want %v", err, tc.err)
+			}
+
+			// The content stored so far is cleaned up, the attachment stored before is kept.
+			if len(st.deleted) != len(tc.deleted) {
+				t.Fatalf("got deleted %v, want %v", st.deleted, tc.deleted)
+			}
+			for i := range tc.deleted {
+				if st.deleted[i] != tc.deleted[i] {
+					t.Fatalf("got deleted %v, want %v", st.deleted, tc.deleted)
+				}
+			}
+			if len(st.files) != 0 {
+				t.Fatalf("got stored files %v, want none", st.files)
+			}
+		})
+	}
+}
+
+func TestHandler_AcceptAttachments_NoAttachments(t *testing.T) {
+	p := &testStorage{}
+	h := newTestHandler(&testStore{files: map[string]string{}}, p)
+
+	if err := h.AcceptAttachments(context.Background(), &mailingpb.EnqueuedEmailMessage{UID: "msg-1"}); err != nil {
+		t.Fatalf("accept failed: %v", err)
+	}
+	if len(p.created) != 0 {
+		t.Fatalf("got %d create calls, want none", len(p.created))
+	}
+}
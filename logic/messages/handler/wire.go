@@ -0,0 +1,36 @@
+//go:build wireinject
+
+//go:generate go run github.com/google/wire/cmd/wire
+
+package emailhandler
+
+import (
+	"github.com/google/wire"
+	"github.com/sirupsen/logrus"
+
+	"github.com/blockysource/blocky/pkg/go/providers"
+	"github.com/blockysource/blocky/services/mailing/internal/deps"
+	"github.com/blockysource/blocky/services/mailing/public/mailing"
+	mailprovidermanager "github.com/blockysource/mailing/logic/mailprovider/manager"
+	emailattachment "github.com/blockysource/mailing/logic/messages/attachment"
+	"github.com/blockysource/mailing/persistence"
+)
+
+// NewHandler creates a new Handler.
+func NewHandler(*mailing.Dependencies, *mailprovidermanager.Manager, emailattachment.Store, persistence.MessageAttachmentStorage) (*Handler, error) {
+	wire.Build(
+		// Logger.
+		deps.GetLogrusLogger,
+		wire.Value(deps.ModuleName),
+		wire.Value(logrus.Fields{
+			"part": "emailhandler",
+		}),
+		providers.FieldsLogrusEntry,
+
+		deps.GetConfig,
+		deps.GetAttachmentConfig,
+		newSweeper,
+		wire.Struct(new(Handler), "*"),
+	)
+	return nil, nil
+}
@@ -1,6 +1,7 @@
 package emailtemplate
 
 import (
+	"errors"
 	"fmt"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
@@ -8,6 +9,9 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+// ErrNoAttachmentStore is an error returned when the message has attachments, but no attachment store is configured.
+var ErrNoAttachmentStore = errors.New("no attachment store configured")
+
 // InvalidTemplateError is an error that occurs when a template is invalid.
 type InvalidTemplateError struct {
 	Err   error
@@ -0,0 +1,82 @@
+package emailtemplate
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"text/template"
+
+	"github.com/blockysource/mailing/logic/mailprovider"
+)
+
+// InlineAsset is an asset embedded in the HTML template body, i.e. a logo image.
+// The asset is referenced in the body with the cid template function: <img src="cid:{{ cid "logo" }}">.
+type InlineAsset struct {
+	Name        string
+	ContentType string
+	Content     []byte
+}
+
+// inlineContentID returns the Content-ID of the template inline asset, which is stable for the template and asset name.
+func inlineContentID(templateUID, name string) string {
+	sum := sha256.Sum256([]byte(templateUID + "/" + name))
+	return hex.EncodeToString(sum[:16]) + "@inline"
+}
+
+// inlineFuncs returns the template functions that resolve the inline asset names to their Content-ID.
+func inlineFuncs(t *TemplateDefinition) template.FuncMap {
+	return template.FuncMap{
+		"cid": func(name string) (string, error) {
+			for _, a := range t.InlineAssets {
+				if a.Name == name {
+					return inlineContentID(t.UID, name), nil
+				}
+			}
+			return "", fmt.Errorf("inline asset %s not found", name)
+		},
+	}
+}
+
+// validateInlineAssets checks if the inline assets are named uniquely and have the content.
+func validateInlineAssets(assets []InlineAsset) error {
+	names := make(map[string]struct{}, len(assets))
+	for _, a := range assets {
+		if a.Name == "" {
+			return errors.New("inline asset name is empty")
+		}
+		if _, ok := names[a.Name]; ok {
+			return fmt.Errorf("inline asset %s is defined more than once", a.Name)
+		}
+		names[a.Name] = struct{}{}
+
+		if len(a.Content) == 0 {
+			return fmt.Errorf("inline asset %s has no content", a.Name)
+		}
+	}
+	return nil
+}
+
+// inlineAttachments returns the inline assets of the template as the message inline attachments.
+func (t *TemplateParser) inlineAttachments() []mailprovider.Attachment {
+	if len(t.base.InlineAssets) == 0 {
+		return nil
+	}
+
+	inline := make([]mailprovider.Attachment, 0, len(t.base.InlineAssets))
+	for _, a := range t.base.InlineAssets {
+		content := a.Content
+		inline = append(inline, mailprovider.Attachment{
+			Filename:    a.Name,
+			ContentType: a.ContentType,
+			ContentID:   inlineContentID(t.base.UID, a.Name),
+			Open: func(context.Context) (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(content)), nil
+			},
+		})
+	}
+	return inline
+}
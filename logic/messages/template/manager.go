@@ -12,12 +12,14 @@ import (
 
 	"github.com/blockysource/blocky/services/mailing/public/mailing"
 	mailprovidermanager "github.com/blockysource/mailing/logic/mailprovider/manager"
+	emailattachment "github.com/blockysource/mailing/logic/messages/attachment"
 )
 
 // Manager is the interface that manages email templates.
 type Manager struct {
 	templates *templateBTree
 	pm        *mailprovidermanager.Manager
+	as        emailattachment.Store
 	log       *logrus.Entry
 	cfg       *mailing.TemplateConfig
 }
@@ -82,8 +84,13 @@ func (m *Manager) prepareTemplateParser(t *TemplateDefinition, tp *TemplateParse
 		return newInvalidTemplateError("subject", m.parseTemplateExecErr(err))
 	}
 
+	if err = validateInlineAssets(t.InlineAssets); err != nil {
+		return newInvalidTemplateError("inline_assets", err)
+	}
+
 	bodyTemp, err := template.New("").
 		Option("missingkey=error").
+		Funcs(inlineFuncs(t)).
 		Parse(t.Body)
 	if err != nil {
 		return newInvalidTemplateError("body", err)
@@ -92,6 +99,19 @@ func (m *Manager) prepareTemplateParser(t *TemplateDefinition, tp *TemplateParse
 		return newInvalidTemplateError("body", m.parseTemplateExecErr(err))
 	}
 
+	var textBodyTemp *template.Template
+	if t.TextBody != "" {
+		textBodyTemp, err = template.New("").
+			Option("missingkey=error").
+			Parse(t.TextBody)
+		if err != nil {
+			return newInvalidTemplateError("text_body", err)
+		}
+		if err = textBodyTemp.Execute(io.Discard, params); err != nil {
+			return newInvalidTemplateError("text_body", m.parseTemplateExecErr(err))
+		}
+	}
+
 	if tp == nil {
 		return nil
 	}
@@ -109,6 +129,8 @@ func (m *Manager) prepareTemplateParser(t *TemplateDefinition, tp *TemplateParse
 		fat:                 fromAddrTemp,
 		st:                  subTemp,
 		bt:                  bodyTemp,
+		tbt:                 textBodyTemp,
+		as:                  m.as,
 		log:                 m.log.WithField("template_uid", t.UID),
 		parameters:          parameters,
 	}
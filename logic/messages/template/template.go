@@ -2,6 +2,8 @@ package emailtemplate
 
 import (
 	"bytes"
+	"context"
+	"io"
 	"net/http"
 	"net/mail"
 	"sync"
@@ -9,10 +11,9 @@ import (
 
 	"github.com/sirupsen/logrus"
 
-	mailprovider2 "github.com/blockysource/blocky/open-source/libs/blocky-cloud/email/message"
-
 	"github.com/blockysource/blocky/services/mailing/public/mailingpb"
 	"github.com/blockysource/mailing/logic/mailprovider"
+	emailattachment "github.com/blockysource/mailing/logic/messages/attachment"
 )
 
 // TemplateDefinition is an email template definition.
@@ -22,7 +23,11 @@ type TemplateDefinition struct {
 	FromAddress string
 	Subject     string
 	Body        string
-	Parameters  []Parameter
+	// TextBody is an optional plain text alternative of the HTML Body.
+	TextBody string
+	// InlineAssets are the assets embedded in the HTML Body.
+	InlineAssets []InlineAsset
+	Parameters   []Parameter
 }
 
 // TemplateParser is an email template.
@@ -33,6 +38,8 @@ type TemplateParser struct {
 	fat                 *template.Template
 	st                  *template.Template
 	bt                  *template.Template
+	tbt                 *template.Template
+	as                  emailattachment.Store
 	log                 *logrus.Entry
 	parameters          []Parameter
 }
@@ -69,7 +76,7 @@ func putBuffer(buf *bytes.Buffer) {
 }
 
 // Parse parses the email template and returns an email message.
-func (t *TemplateParser) Parse(in *mailingpb.EnqueuedEmailMessage) (mailprovider2.Message, error) {
+func (t *TemplateParser) Parse(in *mailingpb.EnqueuedEmailMessage) (mailprovider.Message, error) {
 	// Try to parse all the parts of the template, starting with the FromAddress.
 	buf := getBuffer()
 	defer putBuffer(buf)
@@ -90,11 +97,12 @@ func (t *TemplateParser) Parse(in *mailingpb.EnqueuedEmailMessage) (mailprovider
 				"msg_id":        in.UID,
 				logrus.ErrorKey: err,
 			}).Error("failed to parse FromAddress")
-			return mailprovider2.Message{}, err
+			return mailprovider.Message{}, err
 		}
 
 		// Get the from address.
 		fromAddressStr := buf.String()
+		buf.Reset()
 
 		var err error
 		fromAddr, err = mail.ParseAddress(fromAddressStr)
@@ -103,7 +111,7 @@ func (t *TemplateParser) Parse(in *mailingpb.EnqueuedEmailMessage) (mailprovider
 				"msg_id":        in.UID,
 				logrus.ErrorKey: err,
 			}).Error("failed parsing template parsed FromAddress")
-			return mailprovider2.Message{}, err
+			return mailprovider.Message{}, err
 		}
 	}
 
@@ -113,10 +121,11 @@ func (t *TemplateParser) Parse(in *mailingpb.EnqueuedEmailMessage) (mailprovider
 			"msg_id":        in.UID,
 			logrus.ErrorKey: err,
 		}).Error("failed to parse template Subject")
-		return mailprovider2.Message{}, err
+		return mailprovider.Message{}, err
 	}
 
 	subject := buf.String()
+	buf.Reset()
 
 	// Parse the body.
 	if err := t.bt.Execute(buf, params); err != nil {
@@ -124,35 +133,130 @@ func (t *TemplateParser) Parse(in *mailingpb.EnqueuedEmailMessage) (mailprovider
 			"msg_id":        in.UID,
 			logrus.ErrorKey: err,
 		}).Error("failed to parse template Body")
-		return mailprovider2.Message{}, err
+		return mailprovider.Message{}, err
 	}
 
 	body := buf.String()
-
 	buf.Reset()
 
-	toAddresses := make([]*mail.Address, 0, len(in.ToAddress))
-	for _, toAddr := range in.ToAddress {
-		parsed, err := mail.ParseAddress(toAddr)
-		if err != nil {
+	// Parse the plain text alternative of the body.
+	var textBody string
+	if t.tbt != nil {
+		if err := t.tbt.Execute(buf, params); err != nil {
 			t.log.WithFields(logrus.Fields{
-				"msg_id":  in.UID,
-				"to_addr": toAddr,
-			}).Error("failed to parse ToAddress")
-			return mailprovider2.Message{}, newInvalidAddressError("to_address", toAddr, err)
+				"msg_id":        in.UID,
+				logrus.ErrorKey: err,
+			}).Error("failed to parse template TextBody")
+			return mailprovider.Message{}, err
 		}
-		toAddresses = append(toAddresses, parsed)
+		textBody = buf.String()
+		buf.Reset()
+	}
+
+	toAddresses, err := t.parseAddresses(in.UID, "to_address", in.ToAddress)
+	if err != nil {
+		return mailprovider.Message{}, err
+	}
+
+	ccAddresses, err := t.parseAddresses(in.UID, "cc_address", in.CcAddress)
+	if err != nil {
+		return mailprovider.Message{}, err
+	}
+
+	bccAddresses, err := t.parseAddresses(in.UID, "bcc_address", in.BccAddress)
+	if err != nil {
+		return mailprovider.Message{}, err
+	}
+
+	replyToAddresses, err := t.parseAddresses(in.UID, "reply_to_address", in.ReplyToAddress)
+	if err != nil {
+		return mailprovider.Message{}, err
 	}
 
 	ct := http.DetectContentType([]byte(body))
 
-	msg := mailprovider2.Message{
+	if len(in.Attachments) > 0 && t.as == nil {
+		t.log.WithField("msg_id", in.UID).Error("message has attachments, but no attachment store is configured")
+		return mailprovider.Message{}, ErrNoAttachmentStore
+	}
+
+	// The attachment content is streamed from the store when the message is written, within the send context.
+	as := t.as
+	attachments := make([]mailprovider.Attachment, 0, len(in.Attachments))
+	for _, a := range in.Attachments {
+		path := a.Filepath
+		attachments = append(attachments, mailprovider.Attachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Open: func(ctx context.Context) (io.ReadCloser, error) {
+				return as.Open(ctx, path)
+			},
+		})
+	}
+
+	msg := mailprovider.Message{
 		ID:          in.UID,
 		From:        fromAddr,
+		ReplyTo:     replyToAddresses,
 		To:          toAddresses,
+		Cc:          ccAddresses,
+		Bcc:         bccAddresses,
 		Subject:     subject,
 		Body:        body,
+		TextBody:    textBody,
 		ContentType: ct,
+		Attachments: attachments,
+		Inline:      t.inlineAttachments(),
+		DSN:         dsnOptions(in),
 	}
 	return msg, nil
 }
+
+// dsnOptions returns the delivery status notification options of the enqueued message.
+// The envelope identifier is the message UID, so that the notifications could be correlated with the message.
+func dsnOptions(in *mailingpb.EnqueuedEmailMessage) *mailprovider.DSN {
+	if in.DSN == nil {
+		return nil
+	}
+
+	dsn := mailprovider.DSN{EnvelopeID: in.UID}
+	for _, n := range in.DSN.Notify {
+		switch n {
+		case mailingpb.DSN_NOTIFY_SUCCESS:
+			dsn.Notify |= mailprovider.DSNNotifySuccess
+		case mailingpb.DSN_NOTIFY_FAILURE:
+			dsn.Notify |= mailprovider.DSNNotifyFailure
+		case mailingpb.DSN_NOTIFY_DELAY:
+			dsn.Notify |= mailprovider.DSNNotifyDelay
+		}
+	}
+	switch in.DSN.Return {
+	case mailingpb.DSN_RETURN_HEADERS:
+		dsn.Return = mailprovider.DSNReturnHeaders
+	case mailingpb.DSN_RETURN_FULL:
+		dsn.Return = mailprovider.DSNReturnFull
+	}
+	return &dsn
+}
+
+// parseAddresses parses the input addresses of the given field.
+func (t *TemplateParser) parseAddresses(msgID, field string, in []string) ([]*mail.Address, error) {
+	if len(in) == 0 {
+		return nil, nil
+	}
+
+	addresses := make([]*mail.Address, 0, len(in))
+	for _, addr := range in {
+		parsed, err := mail.ParseAddress(addr)
+		if err != nil {
+			t.log.WithFields(logrus.Fields{
+				"msg_id": msgID,
+				"field":  field,
+				"addr":   addr,
+			}).Error("failed to parse address")
+			return nil, newInvalidAddressError(field, addr, err)
+		}
+		addresses = append(addresses, parsed)
+	}
+	return addresses, nil
+}
@@ -12,10 +12,11 @@ import (
 	"github.com/blockysource/blocky/services/mailing/internal/deps"
 	"github.com/blockysource/blocky/services/mailing/public/mailing"
 	mailprovidermanager "github.com/blockysource/mailing/logic/mailprovider/manager"
+	emailattachment "github.com/blockysource/mailing/logic/messages/attachment"
 )
 
 // NewManager creates a new Manager.
-func NewManager(d *mailing.Dependencies, pm *mailprovidermanager.Manager) (*Manager, error) {
+func NewManager(d *mailing.Dependencies, pm *mailprovidermanager.Manager, as emailattachment.Store) (*Manager, error) {
 	wire.Build(
 		newTemplateBTree,
 		deps.GetLogrusLogger,
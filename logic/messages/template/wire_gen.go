@@ -13,12 +13,13 @@ import (
 	"github.com/blockysource/blocky/services/mailing/internal/deps"
 	"github.com/blockysource/blocky/services/mailing/public/mailing"
 	mailprovidermanager "github.com/blockysource/mailing/logic/mailprovider/manager"
+	emailattachment "github.com/blockysource/mailing/logic/messages/attachment"
 )
 
 // Injectors from wire.go:
 
 // NewManager creates a new Manager.
-func NewManager(d *mailing.Dependencies, pm *mailprovidermanager.Manager) (*Manager, error) {
+func NewManager(d *mailing.Dependencies, pm *mailprovidermanager.Manager, as emailattachment.Store) (*Manager, error) {
 	emailtemplateTemplateBTree := newTemplateBTree()
 	moduleName := _wireModuleNameValue
 	logger, err := deps.GetLogrusLogger(d)
@@ -41,6 +42,7 @@ func NewManager(d *mailing.Dependencies, pm *mailprovidermanager.Manager) (*Mana
 	manager := &Manager{
 		templates: emailtemplateTemplateBTree,
 		pm:        pm,
+		as:        as,
 		log:       entry,
 		cfg:       templateConfig,
 	}
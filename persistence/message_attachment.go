@@ -0,0 +1,54 @@
+package persistence
+
+import (
+	"context"
+	"time"
+)
+
+// MessageAttachmentStorage is an interface that represents a message attachment storage.
+type MessageAttachmentStorage interface {
+	CreateAttachments(ctx context.Context, in *CreateAttachmentsArgs) error
+	ListExpiredAttachments(ctx context.Context, in *ListExpiredAttachmentsArgs) ([]MessageAttachment, error)
+	DeleteAttachments(ctx context.Context, in *DeleteAttachmentsArgs) error
+}
+
+// MessageAttachment is a stored attachment of the email message.
+type MessageAttachment struct {
+	// ID is the identifier of the attachment.
+	ID int64
+	// MessageUID is the unique identifier of the message the attachment belongs to.
+	MessageUID string
+	// Filename is the name of the attached file.
+	Filename string
+	// ContentType is the content type of the attached file.
+	ContentType string
+	// Filepath is the path of the attachment content in the attachment store.
+	Filepath string
+	// TTL is the time to live of the attachment content, counted from the message creation.
+	TTL time.Duration
+}
+
+// CreateAttachmentsArgs creates the attachments of the stored message.
+type CreateAttachmentsArgs struct {
+	// MessageUID is the unique identifier of the message the attachments belong to.
+	MessageUID string
+	// Attachments are the attachments to create, in the order of the message attachments.
+	Attachments []MessageAttachment
+}
+
+// ListExpiredAttachmentsArgs lists the attachments which time to live has expired.
+type ListExpiredAttachmentsArgs struct {
+	// Now is the time against which the attachment expiration is checked.
+	Now time.Time
+	// AfterID lists only the attachments with the identifier greater than the given one,
+	// so that the listing could advance past the attachments that failed to be deleted.
+	AfterID int64
+	// Limit is the maximum number of the listed attachments.
+	Limit int
+}
+
+// DeleteAttachmentsArgs deletes the attachments.
+type DeleteAttachmentsArgs struct {
+	// IDs are the identifiers of the attachments to delete.
+	IDs []int64
+}
@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE mailing_template
+    DROP COLUMN text_body;
+
+COMMIT;
@@ -0,0 +1,7 @@
+BEGIN;
+
+-- text_body is an optional plain text alternative of the template HTML body.
+ALTER TABLE mailing_template
+    ADD COLUMN text_body TEXT;
+
+COMMIT;
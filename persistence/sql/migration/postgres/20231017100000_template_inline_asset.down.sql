@@ -0,0 +1,5 @@
+BEGIN;
+
+DROP TABLE mailing_template_inline_asset;
+
+COMMIT;
@@ -0,0 +1,15 @@
+BEGIN;
+
+-- mailing_template_inline_asset is a table that stores the assets embedded in the email template HTML body.
+CREATE TABLE mailing_template_inline_asset
+(
+    id           SERIAL PRIMARY KEY,
+    template_id  INTEGER NOT NULL REFERENCES mailing_template (id) ON DELETE CASCADE,
+    name         TEXT    NOT NULL,
+    content_type TEXT    NOT NULL,
+    content      BYTEA   NOT NULL,
+    CONSTRAINT mailing_template_inline_asset_template_id_name_key
+        UNIQUE (template_id, name)
+);
+
+COMMIT;
@@ -0,0 +1,117 @@
+package postgrespersistence
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blockysource/mailing/persistence"
+)
+
+var _ persistence.MessageAttachmentStorage = (*MessageAttachmentStorage)(nil)
+
+// MessageAttachmentStorage is the message attachment storage in the PostgreSQL database.
+type MessageAttachmentStorage struct {
+	db *sql.DB
+}
+
+// NewMessageAttachmentStorage creates a new MessageAttachmentStorage.
+func NewMessageAttachmentStorage(db *sql.DB) *MessageAttachmentStorage {
+	return &MessageAttachmentStorage{db: db}
+}
+
+// CreateAttachments creates the attachments of the stored message.
+// It returns persistence.ErrNotFound if the message is not stored.
+func (s *MessageAttachmentStorage) CreateAttachments(ctx context.Context, in *persistence.CreateAttachmentsArgs) error {
+	if len(in.Attachments) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var msgID int64
+	err = tx.QueryRowContext(ctx, `SELECT id FROM mailing_message WHERE uid = $1`, in.MessageUID).Scan(&msgID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return persistence.ErrNotFound
+		}
+		return err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO mailing_message_attachment (message_id, seq_num, filename, content_type, filepath, ttl)
+		VALUES ($1, $2, $3, $4, $5, $6)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for i, a := range in.Attachments {
+		// The attachment without the time to live is never expired.
+		var ttl sql.NullInt64
+		if a.TTL > 0 {
+			ttl = sql.NullInt64{Int64: int64(a.TTL / time.Second), Valid: true}
+		}
+		if _, err = stmt.ExecContext(ctx, msgID, i, a.Filename, a.ContentType, a.Filepath, ttl); err != nil {
+			return fmt.Errorf("failed to create attachment %s: %w", a.Filename, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// ListExpiredAttachments lists the attachments which time to live, counted from the message creation, has expired.
+// The attachments are listed in the order of their identifiers.
+func (s *MessageAttachmentStorage) ListExpiredAttachments(ctx context.Context, in *persistence.ListExpiredAttachmentsArgs) ([]persistence.MessageAttachment, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT a.id, m.uid, a.filename, a.content_type, a.filepath, a.ttl
+		FROM mailing_message_attachment a
+			JOIN mailing_message m ON m.id = a.message_id
+		WHERE a.ttl IS NOT NULL
+			AND m.created_at + a.ttl * INTERVAL '1 second' <= $1
+			AND a.id > $2
+		ORDER BY a.id
+		LIMIT $3`, in.Now, in.AfterID, in.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []persistence.MessageAttachment
+	for rows.Next() {
+		var (
+			a   persistence.MessageAttachment
+			ttl int64
+		)
+		if err = rows.Scan(&a.ID, &a.MessageUID, &a.Filename, &a.ContentType, &a.Filepath, &ttl); err != nil {
+			return nil, err
+		}
+		a.TTL = time.Duration(ttl) * time.Second
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// DeleteAttachments deletes the attachments.
+func (s *MessageAttachmentStorage) DeleteAttachments(ctx context.Context, in *persistence.DeleteAttachmentsArgs) error {
+	if len(in.IDs) == 0 {
+		return nil
+	}
+
+	// The identifiers are passed as separate parameters, so that no driver specific array type is needed.
+	params := make([]string, len(in.IDs))
+	args := make([]any, len(in.IDs))
+	for i, id := range in.IDs {
+		params[i] = "$" + strconv.Itoa(i+1)
+		args[i] = id
+	}
+	_, err := s.db.ExecContext(ctx, `DELETE FROM mailing_message_attachment WHERE id IN (`+strings.Join(params, ", ")+`)`, args...)
+	return err
+}
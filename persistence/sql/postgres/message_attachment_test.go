@@ -0,0 +1,282 @@
+package postgrespersistence
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blockysource/mailing/persistence"
+)
+
+// testDriverName is the name of the database/sql driver, which connections are served by the registered testDB.
+const testDriverName = "postgrespersistence-test"
+
+var (
+	testDBsMu sync.Mutex
+	testDBs   = map[string]*testDB{}
+)
+
+func init() {
+	sql.Register(testDriverName, testDriver{})
+}
+
+// testQuery is the statement executed by the storage.
+type testQuery struct {
+	query string
+	args  []driver.Value
+}
+
+// testDB records the executed statements and answers the queries with the respond function.
+type testDB struct {
+	respond func(query string, args []driver.Value) ([]string, [][]driver.Value, error)
+
+	mu        sync.Mutex
+	queries   []testQuery
+	commits   int
+	rollbacks int
+}
+
+func (db *testDB) record(query string, args []driver.Value) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.queries = append(db.queries, testQuery{query: strings.Join(strings.Fields(query), " "), args: args})
+}
+
+// newTestDB opens the database served by the respond function.
+func newTestDB(t *testing.T, respond func(query string, args []driver.Value) ([]string, [][]driver.Value, error)) (*sql.DB, *testDB) {
+	t.Helper()
+
+	tdb := &testDB{respond: respond}
+	testDBsMu.Lock()
+	testDBs[t.Name()] = tdb
+	testDBsMu.Unlock()
+
+	db, err := sql.Open(testDriverName, t.Name())
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		testDBsMu.Lock()
+		delete(testDBs, t.Name())
+		testDBsMu.Unlock()
+	})
+	return db, tdb
+}
+
+type testDriver struct{}
+
+func (testDriver) Open(name string) (driver.Conn, error) {
+	testDBsMu.Lock()
+	defer testDBsMu.Unlock()
+	db, ok := testDBs[name]
+	if !ok {
+		return nil, errors.New("unknown test database: " + name)
+	}
+	return &testConn{db: db}, nil
+}
+
+type testConn struct {
+	db *testDB
+}
+
+func (c *testConn) Prepare(query string) (driver.Stmt, error) {
+	return &testStmt{db: c.db, query: query}, nil
+}
+
+func (c *testConn) Close() error { return nil }
+
+func (c *testConn) Begin() (driver.Tx, error) {
+	return &testTx{db: c.db}, nil
+}
+
+type testTx struct {
+	db *testDB
+}
+
+func (tx *testTx) Commit() error {
+	tx.db.mu.Lock()
+	tx.db.commits++
+	tx.db.mu.Unlock()
+	return nil
+}
+
+func (tx *testTx) Rollback() error {
+	tx.db.mu.Lock()
+	tx.db.rollbacks++
+	tx.db.mu.Unlock()
+	return nil
+}
+
+type testStmt struct {
+	db    *testDB
+	query string
+}
+
+func (s *testStmt) Close() error  { return nil }
+func (s *testStmt) NumInput() int { return -1 }
+
+func (s *testStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.record(s.query, args)
+	if _, _, err := s.db.respond(s.query, args); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *testStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.record(s.query, args)
+	columns, values, err := s.db.respond(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &testRows{columns: columns, values: values}, nil
+}
+
+type testRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *testRows) Columns() []string { return r.columns }
+func (r *testRows) Close() error      { return nil }
+
+func (r *testRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func TestMessageAttachmentStorage_CreateAttachments(t *testing.T) {
+	db, tdb := newTestDB(t, func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		if strings.Contains(query, "FROM mailing_message WHERE uid") {
+			return []string{"id"}, [][]driver.Value{{int64(7)}}, nil
+		}
+		return nil, nil, nil
+	})
+
+	s := NewMessageAttachmentStorage(db)
+	err := s.CreateAttachments(context.Background(), &persistence.CreateAttachmentsArgs{
+		MessageUID: "msg-1",
+		Attachments: []persistence.MessageAttachment{
+			{Filename: "report.pdf", ContentType: "application/pdf", Filepath: "ab/report", TTL: time.Hour},
+			{Filename: "logo.png", ContentType: "image/png", Filepath: "cd/logo"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+
+	if len(tdb.queries) != 3 {
+		t.Fatalf("got %d queries, want 3: %v", len(tdb.queries), tdb.queries)
+	}
+	if got := tdb.queries[0].args; !reflect.DeepEqual(got, []driver.Value{"msg-1"}) {
+		t.Errorf("got message query args %v", got)
+	}
+	// The attachments keep the order of the message attachments, the one without the time to live never expires.
+	want := [][]driver.Value{
+		{int64(7), int64(0), "report.pdf", "application/pdf", "ab/report", int64(3600)},
+		{int64(7), int64(1), "logo.png", "image/png", "cd/logo", nil},
+	}
+	for i, q := range tdb.queries[1:] {
+		if !strings.HasPrefix(q.query, "INSERT INTO mailing_message_attachment") {
+			t.Errorf("got query %q, want insert", q.query)
+		}
+		if !reflect.DeepEqual(q.args, want[i]) {
+			t.Errorf("got insert args %v, want %v", q.args, want[i])
+		}
+	}
+	if tdb.commits != 1 {
+		t.Errorf("got %d commits, want 1", tdb.commits)
+	}
+}
+
+func TestMessageAttachmentStorage_CreateAttachments_NotFound(t *testing.T) {
+	db, tdb := newTestDB(t, func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		return []string{"id"}, nil, nil
+	})
+
+	s := NewMessageAttachmentStorage(db)
+	err := s.CreateAttachments(context.Background(), &persistence.CreateAttachmentsArgs{
+		MessageUID:  "missing",
+		Attachments: []persistence.MessageAttachment{{Filename: "report.pdf", Filepath: "ab/report"}},
+	})
+	if !errors.Is(err, persistence.ErrNotFound) {
+		t.Fatalf("got error %v, want %v", err, persistence.ErrNotFound)
+	}
+	if len(tdb.queries) != 1 || tdb.commits != 0 || tdb.rollbacks != 1 {
+		t.Fatalf("got %d queries, %d commits and %d rollbacks, want the rolled back lookup only", len(tdb.queries), tdb.commits, tdb.rollbacks)
+	}
+}
+
+func TestMessageAttachmentStorage_ListExpiredAttachments(t *testing.T) {
+	db, tdb := newTestDB(t, func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		return []string{"id", "uid", "filename", "content_type", "filepath", "ttl"}, [][]driver.Value{
+			{int64(11), "msg-1", "report.pdf", "application/pdf", "ab/report", int64(3600)},
+			{int64(12), "msg-2", "logo.png", "image/png", "cd/logo", int64(60)},
+		}, nil
+	})
+
+	now := time.Date(2023, 10, 17, 12, 0, 0, 0, time.UTC)
+	s := NewMessageAttachmentStorage(db)
+	got, err := s.ListExpiredAttachments(context.Background(), &persistence.ListExpiredAttachmentsArgs{
+		Now:     now,
+		AfterID: 10,
+		Limit:   100,
+	})
+	if err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+
+	want := []persistence.MessageAttachment{
+		{ID: 11, MessageUID: "msg-1", Filename: "report.pdf", ContentType: "application/pdf", Filepath: "ab/report", TTL: time.Hour},
+		{ID: 12, MessageUID: "msg-2", Filename: "logo.png", ContentType: "image/png", Filepath: "cd/logo", TTL: time.Minute},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	q := tdb.queries[0]
+	if !reflect.DeepEqual(q.args, []driver.Value{now, int64(10), int64(100)}) {
+		t.Errorf("got query args %v", q.args)
+	}
+	// The listing advances past the given identifier in the order of the identifiers.
+	if !strings.Contains(q.query, "a.id > $2 ORDER BY a.id LIMIT $3") {
+		t.Errorf("unexpected query: %s", q.query)
+	}
+}
+
+func TestMessageAttachmentStorage_DeleteAttachments(t *testing.T) {
+	db, tdb := newTestDB(t, func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		return nil, nil, nil
+	})
+
+	s := NewMessageAttachmentStorage(db)
+	if err := s.DeleteAttachments(context.Background(), &persistence.DeleteAttachmentsArgs{}); err != nil {
+		t.Fatalf("delete of no attachments failed: %v", err)
+	}
+	if len(tdb.queries) != 0 {
+		t.Fatalf("got %d queries, want none", len(tdb.queries))
+	}
+
+	if err := s.DeleteAttachments(context.Background(), &persistence.DeleteAttachmentsArgs{IDs: []int64{3, 5, 8}}); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	q := tdb.queries[0]
+	if q.query != "DELETE FROM mailing_message_attachment WHERE id IN ($1, $2, $3)" {
+		t.Errorf("unexpected query: %s", q.query)
+	}
+	if !reflect.DeepEqual(q.args, []driver.Value{int64(3), int64(5), int64(8)}) {
+		t.Errorf("got query args %v", q.args)
+	}
+}